@@ -0,0 +1,332 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+const (
+	// alertTimeout is how long an alert command or request may take.
+	alertTimeout = time.Minute
+
+	// alertRetries is how many times a failed alert request is
+	// retried.
+	alertRetries = 3
+)
+
+var (
+	alertActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sds011_alert_active",
+		Help: "Whether a particulate level of any sensor is above its alert threshold (1) or not (0).",
+	})
+	alertFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_alert_failures_total",
+		Help: "Alert commands that failed, and failed attempts to POST alerts.",
+	})
+	alertDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_alerts_dropped_total",
+		Help: "Alerts dropped because too many were waiting to be sent.",
+	})
+)
+
+// alertConfig says when to alert, and how.
+type alertConfig struct {
+	// pm25 and pm10 are the thresholds, 0 if there's none.
+	pm25, pm10 float64
+	// hysteresis is how far below the thresholds the levels have to
+	// fall to clear the alert.
+	hysteresis float64
+	// consecutive is how many measurements in a row have to be above
+	// a threshold to alert, or below to clear.
+	consecutive int
+
+	cmd, clearCmd string // shell commands
+	url           string
+
+	// device is the ID of the device to alert on, as four lowercase
+	// hex digits or sds011.CombinedDeviceID, or empty for every one
+	// but the combined.
+	device string
+
+	// values returns what to compare with the thresholds for a
+	// measurement, like its averages, and false if there's nothing to
+	// compare, or is nil for its own values.
+	values func(sds011.Point) (sds011.Point, bool)
+
+	// countOnly lets the alerts go without commands and a URL, only
+	// counted in alertsFired, for -replay.
+	countOnly bool
+
+	// syslog lets the alerts go without commands and a URL too, as
+	// they're sent to -syslog-addr.
+	syslog bool
+}
+
+// An alertEvent is an alert starting or clearing.
+type alertEvent struct {
+	active     bool
+	point      sds011.Point // the measurement that made it happen
+	pm25, pm10 float64      // the thresholds then
+}
+
+// An alertObserver is told of the alerts starting and clearing.
+type alertObserver interface {
+	ObserveAlert(alertEvent)
+}
+
+// An alerter alerts when a particulate level goes above its threshold,
+// and clears the alert when all fall back below theirs minus the
+// hysteresis, by running commands and POSTing to a URL. Every device
+// has an alert of its own, unless cfg.device picks one. It is an
+// observer.
+type alerter struct {
+	cfg    alertConfig
+	states map[uint16]*alertState // by device ID
+	client *http.Client
+	out    *outbox[alertEvent]
+
+	// observers are told of the events too.
+	observers []alertObserver
+}
+
+// alertState is the alert of a device.
+type alertState struct {
+	active bool
+	streak int // how many measurements in a row would change active
+}
+
+// startAlerts starts watching measurements for alerts.
+func startAlerts(cfg alertConfig) (*alerter, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	a := &alerter{
+		cfg:    cfg,
+		states: make(map[uint16]*alertState),
+		client: &http.Client{Timeout: alertTimeout},
+		out:    newOutbox[alertEvent](16, alertDropped, "alert"),
+	}
+	registry.MustRegister(alertActive, alertFailures, alertDropped)
+	a.out.start(a.send)
+	return a, nil
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg alertConfig) check() error {
+	if err := cfg.checkThresholds(); err != nil {
+		return err
+	}
+	if cfg.cmd == "" && cfg.clearCmd == "" && cfg.url == "" && !cfg.countOnly && !cfg.syslog {
+		return errors.New("alert thresholds need -alert-cmd, -alert-clear-cmd, -alert-url or -syslog-addr")
+	}
+	if u, err := url.Parse(cfg.url); cfg.url != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("-alert-url %q isn't an http or https URL", cfg.url)
+	}
+	if cfg.device != "" && cfg.device != sds011.CombinedDeviceID {
+		if _, err := strconv.ParseUint(cfg.device, 16, 16); err != nil || len(cfg.device) != 4 {
+			return fmt.Errorf("-alert-device %q isn't four hex digits or combined", cfg.device)
+		}
+	}
+	return nil
+}
+
+// checkThresholds returns an error if the thresholds, hysteresis or
+// consecutive are out of range.
+func (cfg alertConfig) checkThresholds() error {
+	if cfg.pm25 < 0 || cfg.pm10 < 0 || cfg.hysteresis < 0 {
+		return errors.New("alert thresholds and -alert-hysteresis can't be negative")
+	}
+	if cfg.consecutive < 1 {
+		return fmt.Errorf("-alert-consecutive must be at least 1, not %d", cfg.consecutive)
+	}
+	return nil
+}
+
+// reload takes the thresholds, hysteresis and consecutive from the
+// flags, unless they are out of range. The alert stays as it is until
+// the next measurements.
+func (a *alerter) reload() {
+	cfg := a.cfg
+	cfg.pm25, cfg.pm10, cfg.hysteresis, cfg.consecutive = *alertPM25, *alertPM10, *alertHysteresis, *alertConsecutive
+	if err := cfg.checkThresholds(); err != nil {
+		slog.Error("keeping the alert thresholds", "error", err)
+		return
+	}
+	a.cfg = cfg
+	for _, s := range a.states {
+		s.streak = 0
+	}
+}
+
+func (a *alerter) Observe(point sds011.Point) {
+	if a.cfg.device == "" && point.Combined > 0 || a.cfg.device != "" && deviceName(point) != a.cfg.device {
+		return
+	}
+	if a.cfg.values != nil {
+		var ok bool
+		if point, ok = a.cfg.values(point); !ok {
+			return
+		}
+	}
+	s := a.states[point.DeviceID]
+	if s == nil {
+		s = new(alertState)
+		a.states[point.DeviceID] = s
+	}
+	var changes bool
+	if s.active {
+		changes = a.below(point)
+	} else {
+		changes = a.above(point)
+	}
+	if !changes {
+		s.streak = 0
+		return
+	}
+	if s.streak++; s.streak < a.cfg.consecutive {
+		return
+	}
+	s.active, s.streak = !s.active, 0
+	id := deviceName(point)
+	if s.active {
+		alertsFired.Add(1)
+		slog.Warn("particulate levels above the alert thresholds", "event", "alert", "device_id", id, "pm2_5", point.PM25, "pm10", point.PM10)
+	} else {
+		slog.Info("particulate levels back below the alert thresholds", "event", "alert", "device_id", id, "pm2_5", point.PM25, "pm10", point.PM10)
+	}
+	alertActive.Set(0)
+	for _, s := range a.states {
+		if s.active {
+			alertActive.Set(1)
+		}
+	}
+	e := alertEvent{s.active, point, a.cfg.pm25, a.cfg.pm10}
+	a.out.put(e)
+	for _, o := range a.observers {
+		o.ObserveAlert(e)
+	}
+}
+
+func (a *alerter) ObserveError(error) {}
+
+// above returns true if a level of point is above its threshold.
+func (a *alerter) above(point sds011.Point) bool {
+	return a.cfg.pm25 > 0 && point.PM25 > a.cfg.pm25 || a.cfg.pm10 > 0 && point.PM10 > a.cfg.pm10
+}
+
+// below returns true if all levels of point are below their
+// thresholds minus the hysteresis.
+func (a *alerter) below(point sds011.Point) bool {
+	return (a.cfg.pm25 == 0 || point.PM25 < a.cfg.pm25-a.cfg.hysteresis) &&
+		(a.cfg.pm10 == 0 || point.PM10 < a.cfg.pm10-a.cfg.hysteresis)
+}
+
+// send runs the commands and POSTs to the URL for every event, in
+// order, until the queue is closed.
+func (a *alerter) send(events <-chan alertEvent) {
+	for e := range events {
+		cmd := a.cfg.clearCmd
+		if e.active {
+			cmd = a.cfg.cmd
+		}
+		if cmd != "" {
+			if err := runAlert(cmd, e.point); err != nil {
+				alertFailures.Inc()
+				slog.Error("alert command failed", "command", cmd, "error", err)
+			}
+		}
+		if a.cfg.url != "" {
+			a.post(e)
+		}
+	}
+}
+
+// runAlert runs cmd with the shell, passing it point in the
+// environment variables SDS011_PM25, SDS011_PM10 and SDS011_TS (in RFC
+// 3339 format). Its output goes to stderr, so that it isn't mixed up
+// with the measurements.
+func runAlert(cmd string, point sds011.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	c := shellCommand(ctx, cmd)
+	c.Env = append(os.Environ(), pointEnv(point)...)
+	c.Stdout, c.Stderr = os.Stderr, os.Stderr
+	return c.Run()
+}
+
+// shellCommand returns the command running cmd with the shell, killed
+// once ctx is done.
+func shellCommand(ctx context.Context, cmd string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", cmd)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", "-c", cmd)
+}
+
+// pointEnv returns the environment variables passing point to a
+// command: SDS011_PM25, SDS011_PM10, SDS011_TS and SDS011_DEVICE_ID.
+func pointEnv(point sds011.Point) []string {
+	return []string{
+		fmt.Sprintf("SDS011_PM25=%.1f", point.PM25),
+		fmt.Sprintf("SDS011_PM10=%.1f", point.PM10),
+		"SDS011_TS=" + point.Timestamp.Format(time.RFC3339),
+		"SDS011_DEVICE_ID=" + deviceName(point),
+	}
+}
+
+// alertJSON is what is POSTed to -alert-url.
+type alertJSON struct {
+	State string       `json:"state"` // "alert" or "clear"
+	Point sds011.Point `json:"measurement"`
+	PM25  float64      `json:"pm2_5_threshold,omitempty"`
+	PM10  float64      `json:"pm10_threshold,omitempty"`
+}
+
+func (a *alerter) post(e alertEvent) {
+	msg := alertJSON{State: "clear", Point: e.point, PM25: e.pm25, PM10: e.pm10}
+	if e.active {
+		msg.State = "alert"
+	}
+	body, err := json.Marshal(msg)
+	if err == nil {
+		header := http.Header{"Content-Type": {"application/json"}}
+		err = deliver(a.out, alertRetries, alertFailures, "POSTing an alert", func() error {
+			return post(a.client, a.cfg.url, header, body, a.out.stop)
+		})
+	}
+	if err != nil {
+		slog.Error("POSTing an alert failed", "url", redactURL(a.cfg.url), "error", err)
+	}
+}
+
+// Close sends what's left, giving up on it after shutdownTimeout.
+func (a *alerter) Close() {
+	a.out.close()
+}
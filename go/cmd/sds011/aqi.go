@@ -0,0 +1,119 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/aqi"
+	"github.com/ryszard/sds011/go/sds011/caqi"
+)
+
+// aqiScales are the values of -aqi.
+var aqiScales = []string{"off", "us", "eu"}
+
+// airQuality computes the air quality index of measurements, on the
+// US EPA scale or the European CAQI, for the output, the metrics and
+// /latest. With nowcast, the US index of a measurement is that of the
+// EPA NowCast of the measurements up to it of the same device, once
+// there are enough of them. It is an observer, which has to see
+// measurements before anything asks for their index.
+type airQuality struct {
+	scale   string // "us" or "eu"
+	nowcast bool
+
+	mu      sync.Mutex
+	devices map[uint16]*deviceAir
+}
+
+// deviceAir is what airQuality keeps for a device.
+type deviceAir struct {
+	pm25, pm10 aqi.NowCast
+	last       sds011.Point // the latest measurement
+	index      int          // of last
+	category   string
+}
+
+// airQ is the index -aqi asks for, or nil.
+var airQ *airQuality
+
+// newAirQuality returns the index -aqi and -aqi-nowcast ask for, or
+// nil if it's off.
+func newAirQuality() (*airQuality, error) {
+	if !slices.Contains(aqiScales, *aqiScale) {
+		return nil, fmt.Errorf("unknown -aqi %q, want one of %v", *aqiScale, strings.Join(aqiScales, ", "))
+	}
+	if *aqiNowcast && *aqiScale != "us" {
+		return nil, errors.New("-aqi-nowcast needs -aqi=us")
+	}
+	if *aqiScale == "off" {
+		return nil, nil
+	}
+	return &airQuality{scale: *aqiScale, nowcast: *aqiNowcast, devices: make(map[uint16]*deviceAir)}, nil
+}
+
+func (q *airQuality) Observe(point sds011.Point) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	d := q.devices[point.DeviceID]
+	if d == nil {
+		d = new(deviceAir)
+		q.devices[point.DeviceID] = d
+	}
+	of := point
+	if q.nowcast {
+		d.pm25.Add(point.Timestamp, point.PM25)
+		d.pm10.Add(point.Timestamp, point.PM10)
+		// Both have values for the same hours, so they're ready
+		// together.
+		if pm25, err := d.pm25.Read(); err == nil {
+			of.PM25 = pm25
+		}
+		if pm10, err := d.pm10.Read(); err == nil {
+			of.PM10 = pm10
+		}
+	}
+	d.last = point
+	d.index, d.category = q.compute(of)
+}
+
+func (q *airQuality) ObserveError(error) {}
+
+// of returns the index of point and its category. For the latest
+// measurement of a device, that's what Observe computed; for others,
+// it's the index of their own concentrations.
+func (q *airQuality) of(point sds011.Point) (index int, category string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if d := q.devices[point.DeviceID]; d != nil && point.Timestamp.Equal(d.last.Timestamp) {
+		return d.index, d.category
+	}
+	return q.compute(point)
+}
+
+// compute returns the index of the concentrations of point.
+func (q *airQuality) compute(point sds011.Point) (int, string) {
+	if q.scale == "eu" {
+		result := caqi.FromPoint(point)
+		return result.Index, result.Category.String()
+	}
+	result := aqi.FromPoint(point)
+	return result.Index, result.Category.String()
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+	"github.com/ryszard/sds011/go/sds011/promexporter"
+)
+
+// aqiBoundaries are measurements on either side of the boundaries
+// between the categories of the US AQI, with their index and category.
+var aqiBoundaries = []struct {
+	pm25, pm10 float64
+	index      int
+	category   string
+}{
+	{9.0, 0, 50, "Good"},
+	{9.1, 0, 51, "Moderate"},
+	{35.4, 0, 100, "Moderate"},
+	{35.49, 0, 100, "Moderate"},
+	{35.5, 0, 101, "Unhealthy for Sensitive Groups"},
+	{55.4, 0, 150, "Unhealthy for Sensitive Groups"},
+	{55.5, 0, 151, "Unhealthy"},
+	{125.4, 0, 200, "Unhealthy"},
+	{125.5, 0, 201, "Very Unhealthy"},
+	{225.4, 0, 300, "Very Unhealthy"},
+	{225.5, 0, 301, "Hazardous"},
+	{325.4, 0, 500, "Hazardous"},
+	{325.5, 0, 500, "Beyond the AQI"},
+	{0, 154, 100, "Moderate"},
+	{0, 155, 101, "Unhealthy for Sensitive Groups"},
+	{0, 604, 500, "Hazardous"},
+	{0, 605, 500, "Beyond the AQI"},
+}
+
+// useAQI sets -aqi to scale for the test, and returns the index it
+// asks for.
+func useAQI(t *testing.T, scale string) *airQuality {
+	t.Helper()
+	oldScale, oldQ := *aqiScale, airQ
+	t.Cleanup(func() { *aqiScale, airQ = oldScale, oldQ })
+	*aqiScale = scale
+	q, err := newAirQuality()
+	if err != nil {
+		t.Fatalf("newAirQuality: %v", err)
+	}
+	airQ = q
+	return q
+}
+
+func TestAQIColumn(t *testing.T) {
+	q := useAQI(t, "us")
+	opts, err := outputOptions()
+	if err != nil {
+		t.Fatalf("outputOptions: %v", err)
+	}
+	var b bytes.Buffer
+	w := pointio.NewCSVWriter(&b, append(opts, pointio.WithHeader())...)
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	for i, tc := range aqiBoundaries {
+		point := sds011.Point{PM25: tc.pm25, PM10: tc.pm10, Timestamp: start.Add(time.Duration(i) * time.Minute)}
+		q.Observe(point)
+		if err := w.Write(point); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatalf("reading the output: %v", err)
+	}
+	if len(rows) != len(aqiBoundaries)+1 {
+		t.Fatalf("got %d rows, want a header and %d measurements", len(rows), len(aqiBoundaries))
+	}
+	column := make(map[string]int)
+	for i, name := range rows[0] {
+		column[name] = i
+	}
+	ai, ok := column["aqi"]
+	ci, ok2 := column["aqi_category"]
+	if !ok || !ok2 {
+		t.Fatalf("header %v has no aqi and aqi_category columns", rows[0])
+	}
+	for i, tc := range aqiBoundaries {
+		row := rows[i+1]
+		if want := strconv.Itoa(tc.index); row[ai] != want || row[ci] != tc.category {
+			t.Errorf("PM2.5 %v, PM10 %v: got AQI %s %q, want %s %q", tc.pm25, tc.pm10, row[ai], row[ci], want, tc.category)
+		}
+	}
+}
+
+func TestAQIJSON(t *testing.T) {
+	q := useAQI(t, "us")
+	opts, err := outputOptions()
+	if err != nil {
+		t.Fatalf("outputOptions: %v", err)
+	}
+	for _, tc := range aqiBoundaries {
+		var b bytes.Buffer
+		w := pointio.NewJSONWriter(&b, opts...)
+		point := sds011.Point{PM25: tc.pm25, PM10: tc.pm10, Timestamp: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)}
+		q.Observe(point)
+		if err := w.Write(point); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		var got struct {
+			AQI      int    `json:"aqi"`
+			Category string `json:"aqi_category"`
+		}
+		if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+			t.Fatalf("decoding %q: %v", b.String(), err)
+		}
+		if got.AQI != tc.index || got.Category != tc.category {
+			t.Errorf("PM2.5 %v, PM10 %v: got AQI %d %q, want %d %q", tc.pm25, tc.pm10, got.AQI, got.Category, tc.index, tc.category)
+		}
+	}
+}
+
+func TestAQIMetrics(t *testing.T) {
+	q := useAQI(t, "us")
+	for _, tc := range aqiBoundaries {
+		c := promexporter.NewCollector(nil, "", promexporter.WithAQI(q.of))
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(c)
+		point := sds011.Point{PM25: tc.pm25, PM10: tc.pm10, Timestamp: time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)}
+		q.Observe(point)
+		c.Observe(point)
+
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("Gather: %v", err)
+		}
+		index, categories := -1.0, map[string]float64{}
+		for _, f := range families {
+			for _, m := range f.GetMetric() {
+				switch f.GetName() {
+				case "sds011_aqi":
+					index = m.GetGauge().GetValue()
+				case "sds011_aqi_category":
+					for _, l := range m.GetLabel() {
+						if l.GetName() == "category" {
+							categories[l.GetValue()] = m.GetGauge().GetValue()
+						}
+					}
+				}
+			}
+		}
+		if index != float64(tc.index) {
+			t.Errorf("PM2.5 %v, PM10 %v: sds011_aqi is %v, want %d", tc.pm25, tc.pm10, index, tc.index)
+		}
+		if len(categories) != 1 || categories[tc.category] != 1 {
+			t.Errorf("PM2.5 %v, PM10 %v: sds011_aqi_category is %v, want 1 with category %q", tc.pm25, tc.pm10, categories, tc.category)
+		}
+	}
+}
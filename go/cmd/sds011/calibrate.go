@@ -0,0 +1,421 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// calibrateJoins are what -join of calibrate takes.
+var calibrateJoins = []string{"nearest", "mean"}
+
+// theilSenPoints is how many pairs the slope of a Theil–Sen fit is
+// taken from at most, as it compares every two of them. More are
+// thinned out evenly.
+const theilSenPoints = 2000
+
+// referenceTimeLayouts are the layouts of the reference times tried
+// without -reference-time-format, in the time zone of -utc or
+// -timezone if they don't have one.
+var referenceTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// A referenceRow is a row of the reference data: its time, and its
+// values, NaN where it has none.
+type referenceRow struct {
+	t          time.Time
+	pm25, pm10 float64
+}
+
+// A calibrationFit is the fit of the values of a particulate to the
+// reference, reference = scale * measured + offset.
+type calibrationFit struct {
+	name          string // like the flags have it, pm25 or pm10
+	pairs         int
+	scale, offset float64
+	r2            float64
+	residual      float64 // the standard deviation of the residuals
+	err           error   // why there's no fit
+}
+
+// calibrate reads the measurements in -input and the reference data
+// in -reference, joins them in time, fits the scale and offset of
+// every particulate, and prints the fits, and the flags or the -config
+// snippet of the calibration.
+func calibrate(w io.Writer) error {
+	cf := calibrateFlags
+	switch {
+	case *cf.reference == "":
+		return withExit(exitUsage, errors.New("-reference is required"))
+	case !slices.Contains(calibrateJoins, *cf.join):
+		return withExit(exitUsage, fmt.Errorf("unknown -join %q, want one of %v", *cf.join, strings.Join(calibrateJoins, ", ")))
+	case *cf.joinWindow <= 0:
+		return withExit(exitUsage, fmt.Errorf("-join-window must be positive, not %v", *cf.joinWindow))
+	case *cf.minSamples < 3:
+		return withExit(exitUsage, fmt.Errorf("-min-samples must be at least 3, not %d", *cf.minSamples))
+	case *cf.print != "flags" && *cf.print != "config":
+		return withExit(exitUsage, fmt.Errorf("unknown -print %q, want flags or config", *cf.print))
+	}
+	loc, err := timestampLocation()
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+
+	points, id, err := calibrationPoints(*cf.input, *cf.device)
+	if err != nil {
+		return err
+	}
+	rows, err := readReference(*cf.reference, loc)
+	if err != nil {
+		return err
+	}
+	var xs25, ys25, xs10, ys10 []float64
+	joined := 0
+	for _, row := range rows {
+		point, ok := joinPoint(points, row.t, *cf.joinWindow, *cf.join == "mean")
+		if !ok {
+			continue
+		}
+		joined++
+		if !math.IsNaN(row.pm25) {
+			xs25, ys25 = append(xs25, point.PM25), append(ys25, row.pm25)
+		}
+		if !math.IsNaN(row.pm10) {
+			xs10, ys10 = append(xs10, point.PM10), append(ys10, row.pm10)
+		}
+	}
+	fits := []calibrationFit{
+		fitCalibration("pm25", xs25, ys25, *cf.minSamples, *cf.robust),
+		fitCalibration("pm10", xs10, ys10, *cf.minSamples, *cf.robust),
+	}
+
+	how := "the nearest measurement"
+	if *cf.join == "mean" {
+		how = "the mean of the measurements"
+	}
+	fmt.Fprintf(w, "joined %d of %d reference rows with %s of device %04x within %v, of %d measurements\n",
+		joined, len(rows), how, id, *cf.joinWindow, len(points))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tpairs\tscale\toffset\tr2\tresidual_stddev\t")
+	var fitted []calibrationFit
+	for _, f := range fits {
+		if f.err != nil {
+			fmt.Fprintf(tw, "%s\t%d\t-\t-\t-\t-\t%v\n", f.name, f.pairs, f.err)
+			continue
+		}
+		fitted = append(fitted, f)
+		fmt.Fprintf(tw, "%s\t%d\t%.4f\t%.2f\t%.3f\t%.2f\t\n", f.name, f.pairs, f.scale, f.offset, f.r2, f.residual)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(fitted) == 0 {
+		return withExit(exitFailed, errors.New("no particulate has a fit"))
+	}
+
+	fmt.Fprintln(w)
+	var settings []string
+	for _, f := range fitted {
+		if *cf.print == "config" {
+			settings = append(settings, fmt.Sprintf("%s-scale: %.4f", f.name, f.scale), fmt.Sprintf("%s-offset: %.2f", f.name, f.offset))
+		} else {
+			settings = append(settings, fmt.Sprintf("-%s-scale=%.4f", f.name, f.scale), fmt.Sprintf("-%s-offset=%.2f", f.name, f.offset))
+		}
+	}
+	if *cf.print == "config" {
+		_, err = fmt.Fprintf(w, "calibration:\n  %04x: {%s}\n", id, strings.Join(settings, ", "))
+	} else {
+		_, err = fmt.Fprintln(w, strings.Join(settings, " "))
+	}
+	return err
+}
+
+// calibrationPoints returns the measurements with values in the file
+// at path, or stdin for "-", by time, of the device with the ID device,
+// or, if it's empty, of the only one there is, and its ID.
+func calibrationPoints(path, device string) ([]sds011.Point, uint16, error) {
+	var want uint16
+	if device != "" {
+		var err error
+		if want, err = parseHexID(device); err != nil {
+			return nil, 0, withExit(exitUsage, fmt.Errorf("-device %q isn't a device ID in hex", device))
+		}
+	}
+	var points []sds011.Point
+	devices := map[uint16]bool{}
+	err := readPoints(path, func(point sds011.Point) {
+		if point.Missing != "" || point.Combined > 0 || device != "" && point.DeviceID != want {
+			return
+		}
+		devices[point.DeviceID] = true
+		points = append(points, point)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(devices) > 1 {
+		var ids []string
+		for id := range devices {
+			ids = append(ids, fmt.Sprintf("%04x", id))
+		}
+		slices.Sort(ids)
+		return nil, 0, withExit(exitUsage, fmt.Errorf("-input has the measurements of devices %v, pick one with -device", strings.Join(ids, ", ")))
+	}
+	if len(points) == 0 {
+		return nil, 0, withExit(exitFailed, errors.New("no measurements in -input"))
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp.Before(points[j].Timestamp) })
+	return points, points[0].DeviceID, nil
+}
+
+// readReference reads the reference data in the CSV file at path,
+// separated by commas, semicolons or tabs, whichever the header has
+// most of, with the columns named by -reference-time,
+// -reference-pm25 and -reference-pm10. Values that aren't numbers, or
+// are negative, as stations mark those they don't have, are left out,
+// and so are the rows whose time doesn't parse, with a warning.
+func readReference(path string, loc *time.Location) ([]referenceRow, error) {
+	cf := calibrateFlags
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	header, _, _ := bytes.Cut(data, []byte("\n"))
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = ','
+	for _, c := range []rune{';', '\t'} {
+		if bytes.Count(header, []byte(string(c))) > bytes.Count(header, []byte(string(r.Comma))) {
+			r.Comma = c
+		}
+	}
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading -reference: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("-reference is empty")
+	}
+	column := func(name string) int {
+		return slices.IndexFunc(records[0], func(c string) bool { return strings.EqualFold(strings.TrimSpace(c), name) })
+	}
+	ti, pm25i, pm10i := column(*cf.refTime), column(*cf.refPM25), column(*cf.refPM10)
+	switch {
+	case ti < 0:
+		return nil, fmt.Errorf("-reference has no %q column for -reference-time, only %q", *cf.refTime, records[0])
+	case pm25i < 0 && pm10i < 0:
+		return nil, fmt.Errorf("-reference has neither a %q column for -reference-pm25 nor a %q one for -reference-pm10, only %q", *cf.refPM25, *cf.refPM10, records[0])
+	case pm25i < 0:
+		slog.Warn("-reference has no column for -reference-pm25, so PM2.5 has no fit", "column", *cf.refPM25)
+	case pm10i < 0:
+		slog.Warn("-reference has no column for -reference-pm10, so PM10 has no fit", "column", *cf.refPM10)
+	}
+	value := func(record []string, i int) float64 {
+		if i < 0 || i >= len(record) {
+			return math.NaN()
+		}
+		s := strings.TrimSpace(record[i])
+		if r.Comma != ',' {
+			// A decimal comma.
+			s = strings.Replace(s, ",", ".", 1)
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) {
+			return math.NaN()
+		}
+		return v
+	}
+	var rows []referenceRow
+	var bad int
+	for _, record := range records[1:] {
+		if ti >= len(record) {
+			bad++
+			continue
+		}
+		t, err := parseReferenceTime(strings.TrimSpace(record[ti]), *cf.refTimeFormat, loc)
+		if err != nil {
+			bad++
+			continue
+		}
+		rows = append(rows, referenceRow{t, value(record, pm25i), value(record, pm10i)})
+	}
+	if bad > 0 {
+		slog.Warn("left out the rows of -reference whose time doesn't parse", "rows", bad, "column", *cf.refTime)
+	}
+	if len(rows) == 0 {
+		return nil, withExit(exitFailed, errors.New("no rows in -reference with a time"))
+	}
+	return rows, nil
+}
+
+// parseReferenceTime parses s with layout, or if it's empty with one
+// of referenceTimeLayouts or as seconds since the epoch, in loc unless
+// it says its time zone.
+func parseReferenceTime(s, layout string, loc *time.Location) (time.Time, error) {
+	if layout != "" {
+		return time.ParseInLocation(layout, s, loc)
+	}
+	for _, l := range referenceTimeLayouts {
+		if t, err := time.ParseInLocation(l, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("can't tell the time %q", s)
+}
+
+// joinPoint returns the measurement of points, which are by time,
+// nearest to t, or with mean the mean of those, within window of t, and
+// false if there's none.
+func joinPoint(points []sds011.Point, t time.Time, window time.Duration, mean bool) (sds011.Point, bool) {
+	lo := sort.Search(len(points), func(i int) bool { return !points[i].Timestamp.Before(t.Add(-window)) })
+	hi := sort.Search(len(points), func(i int) bool { return points[i].Timestamp.After(t.Add(window)) })
+	if lo >= hi {
+		return sds011.Point{}, false
+	}
+	if mean {
+		var agg sds011.Aggregator
+		for _, p := range points[lo:hi] {
+			agg.Add(p)
+		}
+		s := agg.Summary()
+		return sds011.Point{Timestamp: t, PM25: s.PM25.Mean, PM10: s.PM10.Mean}, true
+	}
+	nearest := points[lo]
+	for _, p := range points[lo+1 : hi] {
+		if p.Timestamp.Sub(t).Abs() < nearest.Timestamp.Sub(t).Abs() {
+			nearest = p
+		}
+	}
+	return nearest, true
+}
+
+// fitCalibration fits ys = scale * xs + offset by least squares, or
+// with robust by Theil–Sen, the median of the slopes between every two
+// pairs and of the offsets they leave, unless there are fewer than
+// minPairs pairs, the measurements don't vary, or the scale isn't
+// positive, as the calibration can't have it.
+func fitCalibration(name string, xs, ys []float64, minPairs int, robust bool) calibrationFit {
+	f := calibrationFit{name: name, pairs: len(xs)}
+	if len(xs) < minPairs {
+		f.err = fmt.Errorf("too few pairs, -min-samples is %d", minPairs)
+		return f
+	}
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= float64(len(xs))
+	my /= float64(len(ys))
+	var sxx, sxy, syy float64
+	for i := range xs {
+		dx, dy := xs[i]-mx, ys[i]-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		f.err = errors.New("the measurements don't vary")
+		return f
+	}
+	if robust {
+		var err error
+		if f.scale, f.offset, err = theilSen(xs, ys); err != nil {
+			f.err = err
+			return f
+		}
+	} else {
+		f.scale = sxy / sxx
+		f.offset = my - f.scale*mx
+	}
+	if f.scale <= 0 {
+		f.err = fmt.Errorf("the scale is %.4f, not positive, so the measurements don't follow the reference", f.scale)
+		return f
+	}
+	var ssr float64
+	for i := range xs {
+		r := ys[i] - f.scale*xs[i] - f.offset
+		ssr += r * r
+	}
+	f.r2 = math.NaN()
+	if syy > 0 {
+		f.r2 = 1 - ssr/syy
+	}
+	f.residual = math.Sqrt(ssr / float64(len(xs)-2))
+	return f
+}
+
+// theilSen returns the Theil–Sen slope and intercept of the pairs,
+// from theilSenPoints of them at most, or an error if the
+// measurements of those don't vary.
+func theilSen(xs, ys []float64) (slope, intercept float64, err error) {
+	sx, sy := xs, ys
+	if n := len(xs); n > theilSenPoints {
+		sx, sy = make([]float64, theilSenPoints), make([]float64, theilSenPoints)
+		for i := range sx {
+			j := i * n / theilSenPoints
+			sx[i], sy[i] = xs[j], ys[j]
+		}
+	}
+	var slopes []float64
+	for i := range sx {
+		for j := i + 1; j < len(sx); j++ {
+			if sx[i] != sx[j] {
+				slopes = append(slopes, (sy[j]-sy[i])/(sx[j]-sx[i]))
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return 0, 0, errors.New("the measurements the robust fit is taken from don't vary")
+	}
+	slope = medianOf(slopes)
+	offsets := make([]float64, len(xs))
+	for i := range xs {
+		offsets[i] = ys[i] - slope*xs[i]
+	}
+	return slope, medianOf(offsets), nil
+}
+
+// medianOf returns the median of xs, which it sorts.
+func medianOf(xs []float64) float64 {
+	slices.Sort(xs)
+	n := len(xs)
+	if n%2 == 1 {
+		return xs[n/2]
+	}
+	return (xs[n/2-1] + xs[n/2]) / 2
+}
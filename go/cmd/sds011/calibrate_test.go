@@ -0,0 +1,141 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// linear returns n pairs with ys = scale * xs + offset.
+func linear(n int, scale, offset float64) (xs, ys []float64) {
+	for i := range n {
+		x := 1 + float64(i)*0.7
+		xs, ys = append(xs, x), append(ys, scale*x+offset)
+	}
+	return xs, ys
+}
+
+func TestFitCalibration(t *testing.T) {
+	for _, robust := range []bool{false, true} {
+		xs, ys := linear(50, 1.5, -2)
+		f := fitCalibration("pm25", xs, ys, 24, robust)
+		if f.err != nil {
+			t.Fatalf("fitCalibration(robust=%v): %v", robust, f.err)
+		}
+		if math.Abs(f.scale-1.5) > 1e-9 || math.Abs(f.offset+2) > 1e-9 {
+			t.Errorf("fitCalibration(robust=%v) = scale %v, offset %v, want 1.5 and -2", robust, f.scale, f.offset)
+		}
+		if f.pairs != 50 || math.Abs(f.r2-1) > 1e-9 || f.residual > 1e-9 {
+			t.Errorf("fitCalibration(robust=%v) = %d pairs, r2 %v, residual %v, want 50, 1 and 0", robust, f.pairs, f.r2, f.residual)
+		}
+	}
+}
+
+func TestFitCalibrationOutliers(t *testing.T) {
+	xs, ys := linear(50, 0.8, 3)
+	for _, i := range []int{5, 20, 40} {
+		ys[i] += 100
+	}
+	robust := fitCalibration("pm10", xs, ys, 24, true)
+	if robust.err != nil {
+		t.Fatalf("fitCalibration(robust): %v", robust.err)
+	}
+	if math.Abs(robust.scale-0.8) > 1e-9 || math.Abs(robust.offset-3) > 1e-9 {
+		t.Errorf("fitCalibration(robust) = scale %v, offset %v, want 0.8 and 3 despite the outliers", robust.scale, robust.offset)
+	}
+	squares := fitCalibration("pm10", xs, ys, 24, false)
+	if squares.err != nil {
+		t.Fatalf("fitCalibration: %v", squares.err)
+	}
+	if math.Abs(squares.offset-3) < 1 {
+		t.Errorf("fitCalibration = offset %v, want the outliers to pull it away from 3", squares.offset)
+	}
+	if squares.r2 >= 1 || squares.residual <= 0 {
+		t.Errorf("fitCalibration = r2 %v, residual %v, want the outliers to show", squares.r2, squares.residual)
+	}
+}
+
+func TestFitCalibrationFails(t *testing.T) {
+	xs, ys := linear(50, 1.5, -2)
+	same := make([]float64, 50)
+	for i := range same {
+		same[i] = 7
+	}
+	_, down := linear(50, -1, 100)
+	for _, tc := range []struct {
+		name     string
+		xs, ys   []float64
+		minPairs int
+	}{
+		{"too few", xs[:10], ys[:10], 24},
+		{"constant", same, ys, 24},
+		{"negative scale", xs, down, 24},
+	} {
+		for _, robust := range []bool{false, true} {
+			if f := fitCalibration("pm25", tc.xs, tc.ys, tc.minPairs, robust); f.err == nil {
+				t.Errorf("%s: fitCalibration(robust=%v) = scale %v, offset %v, want an error", tc.name, robust, f.scale, f.offset)
+			}
+		}
+	}
+}
+
+func TestTheilSenSampledDontVary(t *testing.T) {
+	// The pairs sampled are those with even indices, whose
+	// measurements are all the same, though the others' aren't.
+	n := 2 * theilSenPoints
+	xs, ys := make([]float64, n), make([]float64, n)
+	for i := range xs {
+		xs[i], ys[i] = 5, 5
+		if i%2 == 1 {
+			xs[i], ys[i] = float64(i), float64(i)
+		}
+	}
+	if _, _, err := theilSen(xs, ys); err == nil {
+		t.Error("theilSen succeeded without slopes")
+	}
+	if f := fitCalibration("pm25", xs, ys, 24, true); f.err == nil {
+		t.Errorf("fitCalibration(robust) = scale %v, offset %v, want an error", f.scale, f.offset)
+	}
+	if _, _, err := theilSen([]float64{1}, []float64{2}); err == nil {
+		t.Error("theilSen succeeded with a single pair")
+	}
+}
+
+func TestTheilSenThinned(t *testing.T) {
+	xs, ys := linear(3*theilSenPoints, 1.25, 0.5)
+	slope, intercept, err := theilSen(xs, ys)
+	if err != nil {
+		t.Fatalf("theilSen: %v", err)
+	}
+	if math.Abs(slope-1.25) > 1e-9 || math.Abs(intercept-0.5) > 1e-9 {
+		t.Errorf("theilSen = %v, %v, want 1.25 and 0.5", slope, intercept)
+	}
+}
+
+func TestMedianOf(t *testing.T) {
+	for _, tc := range []struct {
+		xs   []float64
+		want float64
+	}{
+		{[]float64{3}, 3},
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	} {
+		if got := medianOf(append([]float64(nil), tc.xs...)); got != tc.want {
+			t.Errorf("medianOf(%v) = %v, want %v", tc.xs, got, tc.want)
+		}
+	}
+}
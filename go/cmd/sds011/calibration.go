@@ -0,0 +1,150 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"gopkg.in/yaml.v3"
+)
+
+// calibrationKeys are the settings of a device in the calibration
+// section of the -config file, named like the flags.
+var calibrationKeys = []string{"pm25-offset", "pm25-scale", "pm10-offset", "pm10-scale"}
+
+// flagCalibration returns the calibration set by the flags.
+func flagCalibration() sds011.Calibration {
+	return sds011.Calibration{
+		PM25Scale:  *pm25Scale,
+		PM25Offset: *pm25Offset,
+		PM10Scale:  *pm10Scale,
+		PM10Offset: *pm10Offset,
+	}
+}
+
+// calibrationFor returns the calibration of the device with the ID:
+// its own from the -config file, if it has one there, or the one the
+// flags set.
+func calibrationFor(id uint16) sds011.Calibration {
+	if c, ok := loaded.calibrations[id]; ok {
+		return c
+	}
+	return flagCalibration()
+}
+
+// checkCalibration returns an error if a scale of c isn't positive.
+func checkCalibration(c sds011.Calibration) error {
+	if c.PM25Scale <= 0 || c.PM10Scale <= 0 {
+		return fmt.Errorf("calibration scales must be positive, not %v and %v", c.PM25Scale, c.PM10Scale)
+	}
+	return nil
+}
+
+// logCalibration logs the calibrations in use.
+func logCalibration() {
+	c := flagCalibration()
+	slog.Info("calibration", "pm25_scale", c.PM25Scale, "pm25_offset", c.PM25Offset, "pm10_scale", c.PM10Scale, "pm10_offset", c.PM10Offset)
+	var ids []uint16
+	for id := range loaded.calibrations {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		c := loaded.calibrations[id]
+		slog.Info("calibration", "device_id", fmt.Sprintf("%04x", id), "pm25_scale", c.PM25Scale, "pm25_offset", c.PM25Offset, "pm10_scale", c.PM10Scale, "pm10_offset", c.PM10Offset)
+	}
+}
+
+// readCalibrations reads the calibration section of the -config file,
+// which maps device IDs, in hex as the output has them, to their
+// settings, like
+//
+//	calibration:
+//	  a160: {pm25-scale: 0.8, pm25-offset: -1.5}
+//	  0x1f2e: {pm10-scale: 0.9}
+//
+// Those left out are at their defaults, not at the values of the
+// flags.
+func readCalibrations(path string, m *yaml.Node) (map[uint16]sds011.Calibration, error) {
+	if m.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: calibration: want a mapping of device IDs to settings", path, m.Line)
+	}
+	calibrations := make(map[uint16]sds011.Calibration)
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		id, err := parseHexID(key.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: calibration: %q isn't a device ID in hex", path, key.Line, key.Value)
+		}
+		if value.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s:%d: calibration: %s: want a mapping of %v to numbers", path, value.Line, key.Value, strings.Join(calibrationKeys, ", "))
+		}
+		c := sds011.Calibration{PM25Scale: 1, PM10Scale: 1}
+		fields := []*float64{&c.PM25Offset, &c.PM25Scale, &c.PM10Offset, &c.PM10Scale}
+		for j := 0; j+1 < len(value.Content); j += 2 {
+			name, v := value.Content[j], value.Content[j+1]
+			k := slices.Index(calibrationKeys, name.Value)
+			if k < 0 {
+				return nil, fmt.Errorf("%s:%d: calibration: unknown setting %q", path, name.Line, name.Value)
+			}
+			x, err := strconv.ParseFloat(v.Value, 64)
+			if err != nil || v.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("%s:%d: calibration: %s: want a number", path, v.Line, name.Value)
+			}
+			*fields[k] = x
+		}
+		if err := checkCalibration(c); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, value.Line, err)
+		}
+		calibrations[id] = c
+	}
+	return calibrations, nil
+}
+
+// calibratedDevice is a device whose measurements are corrected by the
+// calibration of the device that took them. Negative values come out
+// as zero.
+type calibratedDevice struct {
+	sds011.Device
+}
+
+func (d calibratedDevice) GetContext(ctx context.Context) (*sds011.Point, error) {
+	point, err := d.Device.GetContext(ctx)
+	if err == nil {
+		calibrationFor(point.DeviceID).Apply(point)
+	}
+	return point, err
+}
+
+// rawDevice is a device that adds the raw values of its measurements,
+// in tenths of μg/m³, to an aggregator, as their PM values.
+type rawDevice struct {
+	sds011.Device
+	raw *sds011.Aggregator
+}
+
+func (d rawDevice) GetContext(ctx context.Context) (*sds011.Point, error) {
+	point, err := d.Device.GetContext(ctx)
+	if err == nil {
+		d.raw.Add(sds011.Point{PM25: float64(point.PM25Raw), PM10: float64(point.PM10Raw), Timestamp: point.Timestamp})
+	}
+	return point, err
+}
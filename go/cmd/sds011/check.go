@@ -0,0 +1,398 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// checkTimeout is how long -check waits for a sensor to answer, or
+// for a server of -check-sinks to accept the connection.
+const checkTimeout = 3 * time.Second
+
+// A sinkCheck is how -check checks an output sending measurements
+// elsewhere.
+type sinkCheck struct {
+	flag, value string // the flag asking for it, and its value
+	check       func() error
+	targets     []checkTarget // what it connects to, for -check-sinks
+}
+
+// A checkTarget is an address an output connects to.
+type checkTarget struct {
+	network, addr string
+}
+
+// The default ports of the schemes of the URLs of the outputs.
+var (
+	httpPorts = map[string]string{"http": "80", "https": "443"}
+	mqttPorts = map[string]string{"tcp": "1883", "mqtt": "1883", "ssl": "8883", "tls": "8883", "mqtts": "8883", "ws": "80", "wss": "443"}
+	natsPorts = map[string]string{"nats": "4222", "tls": "4222"}
+)
+
+// runCheck is what watch and get do with -check: it checks the flags,
+// that the ports of the sensors open, and that the files written to
+// can be, and with -check-sensor that the sensors answer, and with
+// -check-sinks that the servers of the outputs can be connected to.
+// It writes what would run to w, and every problem found, and returns
+// an error if there were any. Nothing is measured, and the settings of
+// the sensors aren't changed.
+func runCheck(ctx context.Context, w io.Writer, logger *slog.Logger) error {
+	var problems []error
+	add := func(err error) {
+		if j, ok := err.(interface{ Unwrap() []error }); ok {
+			problems = append(problems, j.Unwrap()...)
+		} else if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	add(checkServeFlags())
+	switch {
+	case *simulate:
+		sensorPaths = []string{simulatedPort}
+	case *replayPath != "":
+		sensorPaths = []string{replayPort}
+		if _, err := isCapture(*replayPath); err != nil {
+			add(withExit(exitSensor, fmt.Errorf("reading -replay: %w", err)))
+		}
+	default:
+		paths, err := sensorPorts()
+		add(withExit(exitSensor, err))
+		sensorPaths = paths
+	}
+	_, err := outputOptions()
+	add(err)
+	_, err = timestampLocation()
+	add(err)
+	if _, err := newPointWriter(*format); err != nil {
+		add(fmt.Errorf("bad -format: %w", err))
+	}
+	if *output != "" {
+		if _, err := newPointWriter(cmp.Or(*outputFormat, *format)); err != nil {
+			add(fmt.Errorf("bad -output-format: %w", err))
+		}
+		if _, err := compressOutput(*output, *compress); err != nil {
+			add(fmt.Errorf("-compress: %w", err))
+		}
+	}
+	for _, f := range []struct{ flag, path string }{{"output", *output}, {"summary-output", *summaryOutput}, {"raw-samples", *rawSamplesPath}, {"sqlite", *sqlitePath}, {"debug-file", *debugFile}} {
+		if f.path != "" && f.path != "-" {
+			add(checkWritable(f.flag, f.path))
+		}
+	}
+	if *tlsCert != "" && *tlsKey != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			add(fmt.Errorf("-tls-cert and -tls-key: %w", err))
+		}
+	}
+	if *basicAuthUser != "" && *basicAuthPassword != "" {
+		_, err := newBasicAuth(http.NotFoundHandler(), *basicAuthUser, *basicAuthPassword)
+		add(err)
+	}
+	alerting := (*alertPM25 > 0 || *alertPM10 > 0) && !*once
+	if alerting {
+		add(alertFlags().check())
+	}
+	var sinks []sinkCheck
+	for _, s := range sinkChecks() {
+		if *once && s.flag != "pushgateway-url" {
+			continue
+		}
+		sinks = append(sinks, s)
+		if s.check != nil {
+			add(s.check())
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "read\t%s\n", strings.Join(sensorPaths, ", "))
+	for _, path := range sensorPaths {
+		if path == simulatedPort || path == replayPort {
+			continue
+		}
+		status, err := checkPort(logger, path)
+		add(err)
+		if err != nil {
+			status = "FAILED: " + err.Error()
+		}
+		fmt.Fprintf(tw, "\t%s: %s\n", path, status)
+	}
+	how := fmt.Sprintf("the %s of %d samples", *aggregate, max(*samples, 1))
+	if *interval > 0 {
+		fmt.Fprintf(tw, "measure\tevery %v, %s\n", *interval, how)
+	} else {
+		fmt.Fprintf(tw, "measure\tcontinuously, %s\n", how)
+	}
+	switch {
+	case *output == "":
+		fmt.Fprintf(tw, "write\t%s to stdout\n", *format)
+	case *tee:
+		fmt.Fprintf(tw, "write\t%s to stdout, and %s to %s\n", *format, cmp.Or(*outputFormat, *format), *output)
+	default:
+		fmt.Fprintf(tw, "write\t%s to %s\n", cmp.Or(*outputFormat, *format), *output)
+	}
+	if *addr != "" && !*once {
+		status := "free"
+		if ln, err := net.Listen("tcp", *addr); err != nil {
+			status = "taken: " + err.Error()
+			if !*listenOptional {
+				add(withExit(exitListen, fmt.Errorf("-listen-address: %w", err)))
+				status = "FAILED: " + err.Error()
+			}
+		} else {
+			ln.Close()
+		}
+		fmt.Fprintf(tw, "serve\t%s, %s\n", *addr, status)
+	}
+	statuses := connectSinks(ctx, sinks)
+	for i, s := range sinks {
+		what := "send"
+		if i > 0 {
+			what = ""
+		}
+		fmt.Fprintf(tw, "%s\t-%s %s\n", what, s.flag, s.value)
+		for j, t := range s.targets {
+			if err := statuses[i][j]; err != nil {
+				add(withExit(exitOutput, fmt.Errorf("-%s: can't connect to %s: %w", s.flag, t.addr, err)))
+				fmt.Fprintf(tw, "\t  %s: FAILED: %v\n", t.addr, err)
+			} else if *checkSinks && t.network != "udp" {
+				fmt.Fprintf(tw, "\t  %s: reachable\n", t.addr)
+			} else if *checkSinks {
+				fmt.Fprintf(tw, "\t  %s: not checked, as UDP doesn't connect\n", t.addr)
+			}
+		}
+	}
+	if alerting {
+		fmt.Fprintf(tw, "alert\tabove PM2.5 %v and PM10 %v µg/m³ (0 for never)\n", *alertPM25, *alertPM10)
+	}
+	tw.Flush()
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "OK")
+		return nil
+	}
+	found := fmt.Sprintf("%d problems", len(problems))
+	if len(problems) == 1 {
+		found = "a problem"
+	}
+	fmt.Fprintf(w, "\n%s:\n", found)
+	for _, p := range problems {
+		fmt.Fprintf(w, "  %v\n", p)
+	}
+	// The flags are checked first, so that they are what's at fault
+	// if they are wrong too.
+	code := exitUsage
+	var e *exitError
+	if errors.As(problems[0], &e) {
+		code = e.code
+	}
+	return withExit(code, fmt.Errorf("-check found %s", found))
+}
+
+// checkPort opens the sensor at path, and with -check-sensor asks it
+// for its firmware version, and returns what it found. A port another
+// sds011 has open isn't a problem, as it's likely the one being
+// checked for.
+func checkPort(logger *slog.Logger, path string) (string, error) {
+	sensor, err := sds011.New(path, sds011.WithLogger(logger.With("port", path)), sds011.WithCommandTimeout(checkTimeout))
+	if errors.Is(err, sds011.ErrPortBusy) {
+		return "opens, but something else has it open, like sds011 running already", nil
+	}
+	if err != nil {
+		return "", withExit(exitSensor, fmt.Errorf("opening sensor at %v: %w", path, err))
+	}
+	defer sensor.Close()
+	if !*checkSensor {
+		return "opens", nil
+	}
+	fw, err := sensor.Firmware()
+	if err != nil {
+		return "", withExit(exitSensor, fmt.Errorf("sensor at %v didn't answer the firmware query, as it doesn't while asleep: %w", path, err))
+	}
+	return "answers, firmware " + fw.String(), nil
+}
+
+// checkWritable returns an error if the file at path, given with the
+// flag, can't be written, or if there's none, created, without
+// changing it.
+func checkWritable(flag, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		return f.Close()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return withExit(exitOutput, fmt.Errorf("-%s: %w", flag, err))
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sds011-check-*")
+	if err != nil {
+		return withExit(exitOutput, fmt.Errorf("-%s: can't create %s: %w", flag, path, err))
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// sinkChecks returns how to check the outputs the flags ask for.
+func sinkChecks() []sinkCheck {
+	var sinks []sinkCheck
+	add := func(flag, value string, check func() error, targets ...checkTarget) {
+		if value != "" {
+			sinks = append(sinks, sinkCheck{flag, value, check, targets})
+		}
+	}
+	add("remote-write-url", *remoteWriteURL, remoteWriteFlags().check, urlTargets(*remoteWriteURL, httpPorts)...)
+	add("pushgateway-url", *pushgatewayURL, pushgatewayFlags().check, urlTargets(*pushgatewayURL, httpPorts)...)
+	add("otlp", *otlp, func() error {
+		if _, _, err := net.SplitHostPort(*otlp); err != nil {
+			return fmt.Errorf("bad -otlp: %w", err)
+		}
+		return nil
+	}, checkTarget{"tcp", *otlp})
+	add("mqtt-broker", *mqttBroker, func() error {
+		_, err := mqttFlags().clientOptions()
+		return err
+	}, urlTargets(*mqttBroker, mqttPorts)...)
+	var kafkaTargets []checkTarget
+	for _, b := range strings.Split(*kafkaBrokers, ",") {
+		kafkaTargets = append(kafkaTargets, checkTarget{"tcp", b})
+	}
+	add("kafka-brokers", *kafkaBrokers, func() error {
+		_, err := kafkaFlags().clientOptions()
+		return err
+	}, kafkaTargets...)
+	add("nats-url", *natsURL, func() error {
+		cfg := natsFlags()
+		if err := cfg.check(); err != nil {
+			return err
+		}
+		_, err := cfg.options()
+		return err
+	}, urlTargets(*natsURL, natsPorts)...)
+	add("redis-addr", *redisAddr, redisFlags().check, checkTarget{"tcp", *redisAddr})
+	add("influx-url", *influxURL, influxFlags().check, urlTargets(*influxURL, httpPorts)...)
+	add("graphite-addr", *graphiteAddr, func() error {
+		return checkGraphite(*graphiteNetwork, *graphiteAddr, *graphiteBuffer)
+	}, checkTarget{*graphiteNetwork, *graphiteAddr})
+	zabbixAddr, _, zabbixErr := zabbixTarget(*zabbixServer, *zabbixHost)
+	add("zabbix-server", *zabbixServer, func() error { return zabbixErr }, checkTarget{"tcp", zabbixAddr})
+	add("statsd-addr", *statsdAddr, func() error {
+		if err := checkStatsdTagsFormat(*statsdTagsFormat); err != nil {
+			return err
+		}
+		if _, err := net.ResolveUDPAddr("udp", *statsdAddr); err != nil {
+			return fmt.Errorf("bad -statsd-addr: %w", err)
+		}
+		return nil
+	}, checkTarget{"udp", *statsdAddr})
+	syslogNetwork, syslogTarget, _ := syslogFlags().target()
+	add("syslog-addr", *syslogAddr, syslogFlags().check, checkTarget{syslogNetwork, syslogTarget})
+	var hookTargets []checkTarget
+	for _, u := range *webhookURLs {
+		hookTargets = append(hookTargets, urlTargets(u, httpPorts)...)
+	}
+	add("webhook-url", strings.Join(*webhookURLs, " "), func() error {
+		return webhookFlags().check(*webhookURLs)
+	}, hookTargets...)
+	if *postgresDSN != "" {
+		cfg, err := postgresFlags().poolConfig()
+		var targets []checkTarget
+		if err == nil {
+			host, port := cfg.ConnConfig.Host, fmt.Sprint(cfg.ConnConfig.Port)
+			if strings.HasPrefix(host, "/") {
+				targets = append(targets, checkTarget{"unix", filepath.Join(host, ".s.PGSQL."+port)})
+			} else {
+				targets = append(targets, checkTarget{"tcp", net.JoinHostPort(host, port)})
+			}
+		}
+		// The DSN can have a password in it.
+		add("postgres-dsn", "(set)", func() error { return err }, targets...)
+	}
+	add("exec", *execCmd, func() error {
+		if err := execFlags().check(); err != nil {
+			return err
+		}
+		if err := shellCommand(context.Background(), "").Err; err != nil {
+			return fmt.Errorf("-exec: no shell to run it with: %w", err)
+		}
+		return nil
+	})
+	if *alertPM25 > 0 || *alertPM10 > 0 {
+		// Checked with the alerts.
+		add("alert-url", *alertURL, nil, urlTargets(*alertURL, httpPorts)...)
+	}
+	return sinks
+}
+
+// urlTargets returns the addresses of the hosts of the URLs in s,
+// separated by commas, with the port in ports of their scheme if they
+// have none. URLs that don't parse are left out.
+func urlTargets(s string, ports map[string]string) []checkTarget {
+	var targets []checkTarget
+	for _, raw := range strings.Split(s, ",") {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		targets = append(targets, checkTarget{"tcp", net.JoinHostPort(u.Hostname(), cmp.Or(u.Port(), ports[u.Scheme]))})
+	}
+	return targets
+}
+
+// connectSinks connects to the targets of sinks, all at once, with
+// -check-sinks, and returns the errors connecting, by sink and target.
+// UDP isn't checked, as it has no connection to make.
+func connectSinks(ctx context.Context, sinks []sinkCheck) [][]error {
+	errs := make([][]error, len(sinks))
+	var wg sync.WaitGroup
+	for i, s := range sinks {
+		errs[i] = make([]error, len(s.targets))
+		if !*checkSinks {
+			continue
+		}
+		for j, t := range s.targets {
+			if t.network == "udp" {
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := (&net.Dialer{Timeout: checkTimeout}).DialContext(ctx, t.network, t.addr)
+				if err == nil {
+					conn.Close()
+				}
+				errs[i][j] = err
+			}()
+		}
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// combines are what -combine takes.
+var combines = []string{"off", "mean", "median"}
+
+// combinedBacklog is how many combined measurements wait to be written
+// before the oldest are dropped.
+const combinedBacklog = 16
+
+// A combiner combines the measurements of the sensors into one, with
+// the mean or the median of their values, and how many sensors it
+// combines in Combined: once every sensor measured, or, if some
+// didn't, because their measurement failed, once a window of -interval
+// passed since the first one did. A sensor measuring again before
+// then starts a new window. The combined measurements are passed to
+// emit in a goroutine of its own, as the combiner observes
+// measurements with the lock of the shared observers held. It is an
+// observer.
+type combiner struct {
+	median  bool
+	sensors int // how many there are
+
+	mu       sync.Mutex
+	points   map[uint16]sds011.Point // of the window, by device ID
+	timer    *time.Timer             // ending the window
+	closed   bool
+	combined chan sds011.Point
+	done     chan struct{}
+}
+
+// newCombiner returns a combiner of the measurements of sensors
+// sensors, with how, "mean" or "median".
+func newCombiner(how string, sensors int) *combiner {
+	return &combiner{
+		median:   how == "median",
+		sensors:  sensors,
+		points:   make(map[uint16]sds011.Point),
+		combined: make(chan sds011.Point, combinedBacklog),
+		done:     make(chan struct{}),
+	}
+}
+
+// start passes the combined measurements to emit until the combiner
+// is closed.
+func (c *combiner) start(emit func(sds011.Point)) {
+	go func() {
+		defer close(c.done)
+		for point := range c.combined {
+			emit(point)
+		}
+	}()
+}
+
+func (c *combiner) Observe(point sds011.Point) {
+	if point.Manual || point.Combined > 0 {
+		// Not measured with the others.
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.points[point.DeviceID]; ok {
+		c.flushLocked()
+	}
+	c.points[point.DeviceID] = point
+	switch {
+	case len(c.points) == c.sensors:
+		c.flushLocked()
+	case c.timer == nil:
+		window := *interval
+		if window <= 0 {
+			window = time.Duration(max(*samples, 1)) * time.Second
+		}
+		c.timer = time.AfterFunc(window, c.flush)
+	}
+}
+
+func (c *combiner) ObserveError(error) {}
+
+// flush combines the measurements of the window.
+func (c *combiner) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+func (c *combiner) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.points) == 0 || c.closed {
+		return
+	}
+	var agg sds011.Aggregator
+	for _, p := range c.points {
+		agg.Add(p)
+	}
+	s := agg.Summary()
+	point := sds011.Point{Timestamp: s.End, Combined: s.Count, PM25: s.PM25.Mean, PM10: s.PM10.Mean}
+	if c.median {
+		point.PM25, point.PM10 = s.PM25.Median, s.PM10.Median
+	}
+	if len(c.points) < c.sensors {
+		slog.Debug("combined the measurements of only some of the sensors", "sensors", len(c.points), "of", c.sensors)
+	}
+	clear(c.points)
+	if sendNewest(c.combined, point) {
+		slog.Warn("writing combined measurements is too slow, dropped the oldest")
+	}
+}
+
+// Close combines what's in the window, and waits for the combined
+// measurements to be passed on.
+func (c *combiner) Close() {
+	c.mu.Lock()
+	c.flushLocked()
+	c.closed = true
+	close(c.combined)
+	c.mu.Unlock()
+	<-c.done
+}
+
+// deviceName returns the device ID of point as four hex digits, or
+// sds011.CombinedDeviceID if it's combined.
+func deviceName(point sds011.Point) string {
+	if point.Combined > 0 {
+		return sds011.CombinedDeviceID
+	}
+	return fmt.Sprintf("%04x", point.DeviceID)
+}
@@ -0,0 +1,506 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A command is one of the things sds011 does, named by its first
+// argument. The flags before the name are the global ones, those
+// after it the command's own.
+type command struct {
+	name  string
+	args  string // the arguments after the flags, for the usage
+	short string // a line for the list of commands
+	long  string // the help text
+	flags *flag.FlagSet
+	run   func(ctx context.Context, stopSignals func(), logger *slog.Logger, args []string) error
+}
+
+// commands are the commands, in the order they are listed.
+var commands []*command
+
+// newCommand adds a command. Its flags include the global flags named
+// shared, so that they can also be given after the command's name.
+func newCommand(name, args, short, long string, shared []string, run func(context.Context, func(), *slog.Logger, []string) error) *command {
+	c := &command{name: name, args: args, short: short, long: long, run: run}
+	c.flags = flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, s := range shared {
+		f := flag.Lookup(s)
+		c.flags.Var(f.Value, f.Name, f.Usage)
+	}
+	c.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [global flags] %s [flags] %s\n\n%s\n", os.Args[0], name, args, long)
+		fmt.Fprint(os.Stderr, "\nFlags:\n")
+		c.flags.PrintDefaults()
+	}
+	commands = append(commands, c)
+	return c
+}
+
+// lookupCommand returns the command with the given name, or nil.
+func lookupCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Flags of the commands.
+var (
+	setIDFlag   *string
+	infoTimeout *time.Duration
+	periodSet   *uint8 // nil if -set wasn't given
+	haCleanupID *string
+	sleepFlags  struct{ timeout *time.Duration }
+	wakeFlags   struct {
+		timeout, warmup *time.Duration
+		verify          *bool
+	}
+	selftestFlags struct {
+		timeout, dataTimeout, duration *time.Duration
+	}
+	statsFlags struct {
+		inputs   *stringsFlag
+		from, to *string
+		groupBy  *string
+		interval *time.Duration
+	}
+	calibrateFlags struct {
+		input, reference, device  *string
+		join                      *string
+		joinWindow                *time.Duration
+		robust                    *bool
+		minSamples                *int
+		refTime, refPM25, refPM10 *string
+		refTimeFormat, print      *string
+	}
+)
+
+// samplingFlags are the global flags about how measurements are
+// taken, and from what, which the commands taking them share.
+var samplingFlags = []string{"debug", "debug-file", "samples", "aggregate", "trim", "spread", "extended-columns", "aqi", "pm25-offset", "pm25-scale", "pm10-offset", "pm10-scale", "raw-columns", "trigger-column", "quiet", "warmup", "discard-first", "simulate", "simulate-pm25", "simulate-pm10", "simulate-diurnal", "simulate-walk", "simulate-spikes", "simulate-seed"}
+
+func init() {
+	newCommand("watch", "", "read measurements continuously (the default)",
+		`watch reads measurements until it's stopped, and writes them to stdout or
+-output, serving them as Prometheus metrics with -listen-address.
+
+SIGHUP re-reads the settings in -config that can change while running,
+and opens the ports of the sensors again, between two measurements.
+
+With -check, it checks the settings instead, and what it would open and
+connect to, prints what it would do and every problem found, and exits.
+
+With -replay, it feeds recorded measurements, or a capture of a sensor,
+through everything instead of reading the sensors, and exits once
+they're over.`,
+		append(samplingFlags, "check", "check-sensor", "check-sinks", "replay", "replay-speed", "interval", "align", "power-save", "power-save-keep", "round", "count", "duration", "emit-missing", "missing-placeholder", "aqi-nowcast", "combine", "smoothing", "smoothing-alpha", "smoothing-reset", "delta", "delta-max-gap", "wait-for-device", "reconnect-max-backoff", "watchdog", "config", "listen-address", "listen-optional", "dashboard", "history-size", "stats-window", "stats-min-points", "max-staleness", "latest-max-age", "tls-cert", "tls-key", "basic-auth-user", "basic-auth-password-file", "metrics-path", "metrics-go-collector", "otlp", "metrics-namespace", "metrics-labels", "metrics-legacy-names", "remote-write-url", "remote-write-token", "remote-write-username", "remote-write-password", "remote-write-queue", "pushgateway-url", "pushgateway-job", "pushgateway-username", "pushgateway-password", "pushgateway-timeout", "pushgateway-delete-on-exit", "mqtt-broker", "mqtt-topic", "mqtt-username", "mqtt-password", "mqtt-qos", "mqtt-retain", "mqtt-ca-file", "ha-discovery", "kafka-brokers", "kafka-topic", "kafka-acks", "kafka-compression", "kafka-sasl", "kafka-username", "kafka-password", "kafka-tls", "kafka-ca-file", "nats-url", "nats-subject", "nats-creds", "nats-nkey", "nats-username", "nats-password", "nats-ca-file", "nats-jetstream", "redis-addr", "redis-username", "redis-password", "redis-db", "redis-ttl", "redis-maxlen", "redis-timeseries", "redis-retention", "influx-url", "influx-token", "influx-org", "influx-bucket", "influx-batch-size", "influx-flush-interval", "graphite-addr", "graphite-prefix", "graphite-network", "graphite-buffer", "zabbix-server", "zabbix-host", "statsd-addr", "statsd-prefix", "statsd-tags-format", "syslog-addr", "syslog-facility", "syslog-app-name", "syslog-pen", "tag", "webhook-url", "webhook-timeout", "webhook-token", "webhook-retries", "webhook-batch", "webhook-aqi", "postgres-dsn", "postgres-migrate", "postgres-batch-size", "postgres-flush-interval", "postgres-buffer", "sqlite", "sqlite-retention", "alert-pm25", "alert-pm10", "alert-hysteresis", "alert-consecutive", "alert-cmd", "alert-clear-cmd", "alert-url", "alert-device", "alert-on", "exec", "exec-mode", "exec-timeout", "exec-concurrency", "output", "output-format", "metadata", "tee", "compress", "compress-flush", "rotate-size", "rotate-interval", "daily-summary", "summary-output", "summary-resume", "raw-samples", "raw-samples-rotate-size", "raw-samples-rotate-interval", "raw-samples-compress"),
+		func(ctx context.Context, stopSignals func(), logger *slog.Logger, _ []string) error {
+			return serve(ctx, stopSignals, logger)
+		})
+	newCommand("get", "", "take a single measurement and print it",
+		`get wakes the sensor up if it's asleep, takes one measurement of -samples
+samples, prints it, and puts the sensor to sleep.`,
+		append(samplingFlags, "check", "check-sensor", "check-sinks", "wait-for-device", "pushgateway-url", "pushgateway-job", "pushgateway-username", "pushgateway-password", "pushgateway-timeout"),
+		func(ctx context.Context, stopSignals func(), logger *slog.Logger, _ []string) error {
+			*once = true
+			return serve(ctx, stopSignals, logger)
+		})
+	sleep := newCommand("sleep", "", "put the sensor to sleep",
+		`sleep puts the sensor to sleep, stopping its fan and laser, and fails if the
+sensor doesn't confirm it in -timeout.`, nil,
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			sensor, err := openSensor(logger, sds011.WithCommandTimeout(*sleepFlags.timeout))
+			if err != nil {
+				return err
+			}
+			defer sensor.Close()
+			return sensor.Sleep()
+		})
+	sleepFlags.timeout = sleep.flags.Duration("timeout", 5*time.Second, "how long to wait for the sensor to confirm")
+	wake := newCommand("wake", "", "wake the sensor up",
+		`wake wakes the sensor up, and fails if the sensor doesn't confirm it in
+-timeout. With -verify, it then waits for -warmup, and for a measurement,
+for up to -timeout more, and fails if none comes.`, nil,
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			sensor, err := openSensor(logger, sds011.WithCommandTimeout(*wakeFlags.timeout))
+			if err != nil {
+				return err
+			}
+			defer sensor.Close()
+			return wakeUp(ctx, sensor)
+		})
+	wakeFlags.timeout = wake.flags.Duration("timeout", 5*time.Second, "how long to wait for the sensor to confirm, and with -verify for a measurement")
+	wakeFlags.warmup = wake.flags.Duration("warmup", 0, "with -verify, how long to wait before waiting for a measurement")
+	wakeFlags.verify = wake.flags.Bool("verify", false, "wait for a measurement before succeeding")
+	info := newCommand("info", "", "print the sensor's ID, firmware and settings",
+		`info prints the sensor's device ID, firmware version, reporting mode and
+working period, and whether it is awake, waking it up for the time it
+takes if it isn't. With -format=json, it prints them as a JSON object.
+If the sensor doesn't answer about something in -timeout, info says so
+and goes on with the rest, but exits with an error.`, nil,
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			sensor, err := openSensor(logger, sds011.WithCommandTimeout(*infoTimeout))
+			if err != nil {
+				return err
+			}
+			defer sensor.Close()
+			return printInfo(os.Stdout, sensor, *format == "json" || *format == "jsonl")
+		})
+	infoTimeout = info.flags.Duration("timeout", time.Second, "how long to wait for each answer from the sensor")
+	setID := newCommand("set-id", "", "change the sensor's device ID",
+		`set-id changes the sensor's device ID to -id, checks that the sensor
+confirmed it, and prints the old and the new one.`, nil,
+		func(ctx context.Context, stopSignals func(), logger *slog.Logger, args []string) error {
+			if *setIDFlag == "" {
+				return errors.New("-id is required")
+			}
+			id, err := parseDeviceID(*setIDFlag)
+			if err != nil {
+				return err
+			}
+			return withSensor(func(ctx context.Context, sensor *sds011.Sensor, _ []string) error {
+				return setDeviceID(sensor, id)
+			})(ctx, stopSignals, logger, args)
+		})
+	setIDFlag = setID.flags.String("id", "", "the new device ID, in hex like 0xA1B2 or in decimal")
+	period := newCommand("period", "", "print or set the working period",
+		`period prints the working period: the sensor measures once every that
+many minutes, sleeping in between, or continuously if it's 0. With
+-set, it changes it first, and prints the value the sensor confirmed.
+A sleeping sensor is woken up for the time it takes.`, nil,
+		withSensor(func(ctx context.Context, sensor *sds011.Sensor, _ []string) error {
+			// A sleeping sensor doesn't answer.
+			if awake, err := sensor.State(); err == nil && !awake {
+				if err := sensor.Awake(); err != nil {
+					return fmt.Errorf("waking the sensor up: %w", err)
+				}
+				defer sensor.Sleep()
+			}
+			if periodSet != nil {
+				if err := sensor.SetWorkingPeriod(*periodSet); err != nil {
+					return err
+				}
+			}
+			period, err := sensor.WorkingPeriod()
+			if err != nil {
+				return err
+			}
+			fmt.Println(period)
+			return nil
+		}))
+	haCleanupCmd := newCommand("ha-cleanup", "", "remove the sensor from Home Assistant",
+		`ha-cleanup removes the retained messages that -ha-discovery announces the
+sensor to Home Assistant with from -mqtt-broker, so that it forgets the
+sensor. The sensor is asked for its device ID, unless it's given with -id.`,
+		[]string{"mqtt-broker", "mqtt-username", "mqtt-password", "mqtt-ca-file"},
+		func(ctx context.Context, stopSignals func(), logger *slog.Logger, args []string) error {
+			if *mqttBroker == "" {
+				return errors.New("-mqtt-broker is required")
+			}
+			if *haCleanupID != "" {
+				id, err := parseDeviceID(*haCleanupID)
+				if err != nil {
+					return err
+				}
+				return haCleanup(mqttFlags(), id)
+			}
+			return withSensor(func(ctx context.Context, sensor *sds011.Sensor, _ []string) error {
+				// A sleeping sensor doesn't answer.
+				if awake, err := sensor.State(); err == nil && !awake {
+					if err := sensor.Awake(); err != nil {
+						return fmt.Errorf("waking the sensor up: %w", err)
+					}
+					defer sensor.Sleep()
+				}
+				id, err := sensor.DeviceID()
+				if err != nil {
+					return fmt.Errorf("asking for the device ID: %w", err)
+				}
+				return haCleanup(mqttFlags(), id)
+			})(ctx, stopSignals, logger, args)
+		})
+	selftestCmd := newCommand("selftest", "", "check the sensor and its cabling",
+		`selftest checks that the sensor at -port_path works, step by step: it opens
+the port, asks for the firmware version, the device ID and the reporting
+mode, puts the sensor to sleep and wakes it up, reads data frames for
+-duration, and checks how many came and were bad, and that their values are
+plausible. It prints what every step found, and PASS or FAIL at the end,
+exiting with an error if a step failed. A step waits for an answer for
+-timeout, or for a data frame for -data-timeout, so that a dead sensor fails
+quickly. With -format=json, it prints the report as a JSON object.`,
+		[]string{"format", "debug", "debug-file"},
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			return selftest(ctx, os.Stdout, logger, *format == "json" || *format == "jsonl")
+		})
+	selftestFlags.timeout = selftestCmd.flags.Duration("timeout", 2*time.Second, "how long to wait for the sensor to answer a command")
+	selftestFlags.dataTimeout = selftestCmd.flags.Duration("data-timeout", 5*time.Second, "how long to wait for a data frame")
+	selftestFlags.duration = selftestCmd.flags.Duration("duration", 30*time.Second, "how long to read data frames for")
+	stats := newCommand("stats", "", "summarize recorded measurements",
+		`stats reads measurements written by watch as CSV, TSV or JSON lines, or
+compressed with gzip, from -input or stdin, and prints the count, mean,
+median, minimum, maximum and 95th percentile of PM2.5 and PM10, for every
+-group-by of them, with how many of the measurements expected every
+-interval there are values for. With -format=json, it prints a JSON object
+for every group. The groups are in the local time zone, or as -utc or
+-timezone says.`, []string{"format", "utc", "timezone"},
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			return printStats(os.Stdout, *statsFlags.inputs, *format == "json" || *format == "jsonl")
+		})
+	statsFlags.inputs = new(stringsFlag)
+	stats.flags.Var(statsFlags.inputs, "input", `read the measurements from this file, or stdin for "-" (the default); can be repeated, like for rotated files`)
+	statsFlags.from = stats.flags.String("from", "", "leave out the measurements before this date (e.g. 2024-03-01), or time (e.g. 2024-03-01T12:00:00)")
+	statsFlags.to = stats.flags.String("to", "", "leave out the measurements from this date or time on")
+	statsFlags.groupBy = stats.flags.String("group-by", "day", "summarize the measurements of every hour, day, week (from Monday), month, or none for all of them together")
+	statsFlags.interval = stats.flags.Duration("interval", 0, "the interval the measurements were taken at, for how many there should be; 0 to take it from them")
+	calibrateCmd := newCommand("calibrate", "", "fit the calibration to reference data",
+		`calibrate reads measurements written by watch as CSV, TSV or JSON lines, or
+compressed with gzip, from -input or stdin, and the data of a reference
+station in the CSV file at -reference, taken side by side, and pairs every
+reference row with the measurement nearest to it in time, or with -join=mean
+with the mean of the measurements, within -join-window of it. It fits the
+scale and offset that make the measurements the reference values, for PM2.5
+and PM10, by least squares, or with -robust by Theil–Sen, which outliers
+sway less, and prints the fits, with how many pairs they're of, their R²
+and the standard deviation of what they leave, and then the -pm25-scale,
+-pm25-offset, -pm10-scale and -pm10-offset flags, or with -print=config the
+calibration section of -config, to paste. A particulate with fewer than
+-min-samples pairs has no fit, and calibrate exits with an error if neither
+has one.
+
+The measurements should be uncalibrated, or the fit corrects what the
+calibration left. The reference CSV can be separated by commas, semicolons
+or tabs, with decimal commas with the others, and the names of its columns
+are set with -reference-time, -reference-pm25 and -reference-pm10. Its
+times are in RFC 3339 format, or like 2024-03-01 12:00, or seconds since
+the epoch, unless -reference-time-format says otherwise, in the local time
+zone if they don't say theirs, or as -utc or -timezone says.`, []string{"utc", "timezone"},
+		func(ctx context.Context, _ func(), logger *slog.Logger, _ []string) error {
+			return calibrate(os.Stdout)
+		})
+	calibrateFlags.input = calibrateCmd.flags.String("input", "-", `read the measurements from this file, or stdin for "-"`)
+	calibrateFlags.reference = calibrateCmd.flags.String("reference", "", "read the reference data from this CSV file")
+	calibrateFlags.device = calibrateCmd.flags.String("device", "", "fit the measurements of the device with this ID (e.g. 1f2e), if -input has those of several")
+	calibrateFlags.join = calibrateCmd.flags.String("join", "nearest", "pair every reference row with the nearest measurement, or with the mean of them: nearest or mean")
+	calibrateFlags.joinWindow = calibrateCmd.flags.Duration("join-window", 10*time.Minute, "how far from a reference row in time the measurements paired with it can be, either way")
+	calibrateFlags.robust = calibrateCmd.flags.Bool("robust", false, "fit by Theil–Sen, the median of the slopes between every two pairs, rather than by least squares")
+	calibrateFlags.minSamples = calibrateCmd.flags.Int("min-samples", 24, "the fewest pairs to fit a particulate with")
+	calibrateFlags.refTime = calibrateCmd.flags.String("reference-time", "timestamp", "the column of -reference with the times, in any case")
+	calibrateFlags.refPM25 = calibrateCmd.flags.String("reference-pm25", "pm2_5", "the column of -reference with PM2.5, in µg/m³")
+	calibrateFlags.refPM10 = calibrateCmd.flags.String("reference-pm10", "pm10", "the column of -reference with PM10, in µg/m³")
+	calibrateFlags.refTimeFormat = calibrateCmd.flags.String("reference-time-format", "", "the layout of the times of -reference, as Go has it, like 02.01.2006 15:04")
+	calibrateFlags.print = calibrateCmd.flags.String("print", "flags", "print the calibration as flags, or as config, the calibration section of -config")
+	haCleanupID = haCleanupCmd.flags.String("id", "", "the device ID of the sensor, in hex like 0xA1B2 or in decimal")
+	period.flags.Func("set", "change the working period to this many minutes, from 0 to 30", func(s string) error {
+		minutes, err := strconv.ParseUint(s, 10, 8)
+		if err != nil || minutes > 30 {
+			return fmt.Errorf("want 0 to 30 minutes")
+		}
+		m := uint8(minutes)
+		periodSet = &m
+		return nil
+	})
+}
+
+// withSensor returns a command's run function opening the sensor,
+// calling fn with it, and closing it.
+func withSensor(fn func(ctx context.Context, sensor *sds011.Sensor, args []string) error) func(context.Context, func(), *slog.Logger, []string) error {
+	return func(ctx context.Context, _ func(), logger *slog.Logger, args []string) error {
+		sensor, err := openSensor(logger)
+		if err != nil {
+			return err
+		}
+		defer sensor.Close()
+		return fn(ctx, sensor, args)
+	}
+}
+
+// openSensor opens the sensor at -port_path, looking for it first if
+// it's "auto".
+func openSensor(logger *slog.Logger, opts ...sds011.Option) (*sds011.Sensor, error) {
+	if *portPath == "auto" {
+		path, err := findSensor()
+		if err != nil {
+			return nil, withExit(exitSensor, fmt.Errorf("looking for a sensor: %w", err))
+		}
+		slog.Info("found sensor", "port", path)
+		*portPath = path
+	}
+	return openSensorAt(logger, *portPath, opts...)
+}
+
+// openSensorAt opens the sensor at path.
+func openSensorAt(logger *slog.Logger, path string, opts ...sds011.Option) (*sds011.Sensor, error) {
+	debugOpts, err := debugOptions(path)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(append([]sds011.Option{sds011.WithLogger(logger.With("port", path))}, debugOpts...), opts...)
+	sensor, err := sds011.New(path, opts...)
+	if err != nil {
+		return nil, withExit(exitSensor, fmt.Errorf("opening sensor at %v: %w", path, err))
+	}
+	return sensor, nil
+}
+
+// wakeUp wakes the sensor up, and with -verify waits for it to send
+// a measurement.
+func wakeUp(ctx context.Context, sensor *sds011.Sensor) error {
+	if err := sensor.Awake(); err != nil {
+		return err
+	}
+	if !*wakeFlags.verify {
+		return nil
+	}
+	if err := warmUp(ctx, sensor, *wakeFlags.warmup); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, *wakeFlags.timeout)
+	defer cancel()
+	for {
+		point, err := sensor.GetContext(ctx)
+		if err == nil {
+			slog.Info("the sensor is measuring", "point", point)
+			return nil
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("no measurement in %v", *wakeFlags.timeout)
+		}
+		if ctx.Err() != nil || !sds011.Recoverable(err) {
+			return fmt.Errorf("waiting for a measurement: %w", err)
+		}
+	}
+}
+
+// parseDeviceID parses a device ID in hex, starting with 0x, or in
+// decimal.
+func parseDeviceID(s string) (uint16, error) {
+	base, digits := 10, s
+	if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		base, digits = 16, s[2:]
+	}
+	id, err := strconv.ParseUint(digits, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad device ID %q: want 0x0000 to 0xFFFE, or 0 to 65534", s)
+	}
+	if uint16(id) == sds011.Broadcast {
+		return 0, errors.New("device ID 0xFFFF is reserved for addressing all sensors")
+	}
+	return uint16(id), nil
+}
+
+// setDeviceID changes the sensor's device ID.
+func setDeviceID(sensor *sds011.Sensor, id uint16) error {
+	old, err := sensor.DeviceID()
+	if err != nil {
+		return fmt.Errorf("reading the device ID: %w", err)
+	}
+	fmt.Printf("current ID: %04X\n", old)
+	if err := sensor.SetDeviceID(id); err != nil {
+		return err
+	}
+	fmt.Printf("%04X -> %04X\n", old, id)
+	return nil
+}
+
+// An infoField is one of the things info reports.
+type infoField struct {
+	name, label string // in JSON and in text
+	value       any
+	err         error
+}
+
+// printInfo prints what the info command reports to w, as aligned text
+// or as JSON. It returns an error if the sensor didn't answer about
+// any of it.
+func printInfo(w io.Writer, sensor *sds011.Sensor, asJSON bool) error {
+	awake, err := sensor.State()
+	state := infoField{"awake", "awake", awake, err}
+	if err == nil && !awake {
+		// A sleeping sensor doesn't answer the other questions.
+		if err := sensor.Awake(); err != nil {
+			state.err = fmt.Errorf("waking it up: %w", err)
+		} else {
+			defer sensor.Sleep()
+		}
+	}
+
+	id, err := sensor.DeviceID()
+	fields := []infoField{{"device_id", "device ID", fmt.Sprintf("%04X", id), err}}
+	fw, err := sensor.Firmware()
+	fields = append(fields, infoField{"firmware", "firmware", fw.String(), err})
+	active, err := sensor.ReportMode()
+	mode := "query"
+	if active {
+		mode = "active"
+	}
+	fields = append(fields, infoField{"reporting_mode", "reporting mode", mode, err})
+	period, err := sensor.WorkingPeriod()
+	fields = append(fields, infoField{"working_period", "working period", period, err})
+	fields = append(fields, state)
+
+	failed := 0
+	if asJSON {
+		report := map[string]any{}
+		errs := map[string]string{}
+		for _, f := range fields {
+			if f.err != nil {
+				errs[f.name] = f.err.Error()
+				failed++
+				continue
+			}
+			report[f.name] = f.value
+		}
+		if len(errs) > 0 {
+			report["errors"] = errs
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+		for _, f := range fields {
+			value := f.value
+			if f.err != nil {
+				value = "no answer: " + f.err.Error()
+				failed++
+			}
+			fmt.Fprintf(tw, "%v:\t%v\n", f.label, value)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("the sensor didn't answer %d of %d questions", failed, len(fields))
+	}
+	return nil
+}
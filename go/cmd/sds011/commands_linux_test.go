@@ -0,0 +1,284 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// runOnPTY runs sds011 with args against a fake sensor behind a
+// pseudo-terminal, as if -port_path was its path, and returns what it
+// printed to stdout, dropping what it printed to stderr. The flags it
+// sets are reset when the test ends.
+func runOnPTY(t *testing.T, pty *sds011test.PTY, args ...string) (string, error) {
+	t.Helper()
+	stdout, _, err := runOnPTYStderr(t, pty, args...)
+	return stdout, err
+}
+
+// runOnPTYStderr is like runOnPTY, but returns what sds011 printed to
+// stderr too. Only errors are logged, unless args say otherwise.
+func runOnPTYStderr(t *testing.T, pty *sds011test.PTY, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	t.Cleanup(func() { resetFlags(args) })
+	args = append([]string{"-port_path", pty.Path, "-log-level", "error"}, args...)
+
+	capture := func() (w *os.File, out <-chan string) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(r)
+			r.Close()
+			c <- string(b)
+		}()
+		return w, c
+	}
+	outw, out := capture()
+	errw, errs := capture()
+	oldStdout, oldStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = outw, errw
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err = runCommand(ctx, func() {}, args)
+	os.Stdout, os.Stderr = oldStdout, oldStderr
+	outw.Close()
+	errw.Close()
+	return <-out, <-errs, err
+}
+
+// resetFlags sets the global flags, and those of the commands, that
+// args gave back to their defaults.
+func resetFlags(args []string) {
+	sets := []*flag.FlagSet{flag.CommandLine}
+	for _, c := range commands {
+		sets = append(sets, c.flags)
+	}
+	for _, arg := range args {
+		name, ok := strings.CutPrefix(arg, "-")
+		if !ok {
+			continue
+		}
+		name, _, _ = strings.Cut(name, "=")
+		for _, set := range sets {
+			if f := set.Lookup(name); f != nil {
+				f.Value.Set(f.DefValue)
+			}
+		}
+	}
+	*portPath, *once, periodSet = "/dev/ttyUSB0", false, nil
+}
+
+// newPTY returns a fake sensor behind a pseudo-terminal, closed when
+// the test ends.
+func newPTY(t *testing.T) *sds011test.PTY {
+	t.Helper()
+	pty, err := sds011test.NewPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() { pty.Close() })
+	return pty
+}
+
+func TestGetCommand(t *testing.T) {
+	pty := newPTY(t)
+	pty.Fake.SetInterval(10 * time.Millisecond)
+	pty.Fake.SetSource(func(time.Time) (float64, float64) { return 12.3, 20.1 })
+	out, err := runOnPTY(t, pty, "-warmup", "0", "get")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	fields := strings.Split(strings.TrimSpace(out), ",")
+	if len(fields) < 3 || fields[1] != "12.30" || fields[2] != "20.10" {
+		t.Errorf("get printed %q, want a line with PM2.5 12.3 and PM10 20.1", out)
+	}
+	if pty.Fake.Awake() {
+		t.Error("get left the sensor awake")
+	}
+}
+
+func TestWatchCommand(t *testing.T) {
+	newRegistry(t)
+	pty := newPTY(t)
+	pty.Fake.SetInterval(10 * time.Millisecond)
+	pty.Fake.SetSource(func(time.Time) (float64, float64) { return 12.3, 20.1 })
+	out, stderr, err := runOnPTYStderr(t, pty, "-log-level", "warn", "-warmup", "0", "watch", "-count", "2")
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("watch -count 2 printed %q, want 2 lines", out)
+	}
+	for _, line := range lines {
+		if fields := strings.Split(line, ","); len(fields) < 3 || fields[1] != "12.30" || fields[2] != "20.10" {
+			t.Errorf("watch printed %q, want a line with PM2.5 12.3 and PM10 20.1", line)
+		}
+	}
+	if strings.Contains(stderr, "deprecated") {
+		t.Errorf("watch logged %q, want no deprecation warning", stderr)
+	}
+}
+
+func TestNoCommand(t *testing.T) {
+	newRegistry(t)
+	pty := newPTY(t)
+	pty.Fake.SetInterval(10 * time.Millisecond)
+	pty.Fake.SetSource(func(time.Time) (float64, float64) { return 12.3, 20.1 })
+	out, stderr, err := runOnPTYStderr(t, pty, "-log-level", "warn", "-warmup", "0", "-count", "2")
+	if err != nil {
+		t.Fatalf("sds011 without a command: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || !strings.Contains(lines[0], ",12.30,20.10") {
+		t.Errorf("sds011 -count 2 printed %q, want 2 measurements", out)
+	}
+	if !strings.Contains(stderr, `running sds011 without a command is deprecated, use \"sds011 watch\"`) {
+		t.Errorf("sds011 without a command logged %q, want a deprecation warning", stderr)
+	}
+}
+
+func TestSleepAndWakeCommands(t *testing.T) {
+	pty := newPTY(t)
+	if _, err := runOnPTY(t, pty, "sleep"); err != nil {
+		t.Fatalf("sleep: %v", err)
+	}
+	if pty.Fake.Awake() {
+		t.Error("the sensor is awake after sleep")
+	}
+	if _, err := runOnPTY(t, pty, "wake", "-verify"); err != nil {
+		t.Fatalf("wake: %v", err)
+	}
+	if !pty.Fake.Awake() {
+		t.Error("the sensor is asleep after wake")
+	}
+}
+
+func TestWakeCommandVerifyTimeout(t *testing.T) {
+	pty := newPTY(t)
+	pty.Fake.SetInterval(time.Hour)
+	if _, err := runOnPTY(t, pty, "wake", "-verify", "-timeout", "100ms"); err == nil {
+		t.Error("wake -verify succeeded without a measurement")
+	}
+}
+
+func TestInfoCommand(t *testing.T) {
+	pty := newPTY(t)
+	pty.Fake.SetDeviceID(0xA1B2)
+	pty.Fake.SetAwake(false)
+	out, err := runOnPTY(t, pty, "-format", "json", "info")
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+	var info map[string]any
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatalf("info printed %q: %v", out, err)
+	}
+	want := map[string]any{"device_id": "A1B2", "reporting_mode": "active", "working_period": 0.0, "awake": false}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("info: %s is %v, want %v", k, info[k], v)
+		}
+	}
+	if _, ok := info["firmware"]; !ok {
+		t.Error("info: no firmware")
+	}
+	if pty.Fake.Awake() {
+		t.Error("info left a sleeping sensor awake")
+	}
+}
+
+func TestInfoCommandText(t *testing.T) {
+	pty := newPTY(t)
+	out, err := runOnPTY(t, pty, "info")
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+	for _, line := range []string{"device ID:      A160", "reporting mode: active", "awake:          true"} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("info printed\n%s\nwithout %q", out, line)
+		}
+	}
+}
+
+func TestSetIDCommand(t *testing.T) {
+	pty := newPTY(t)
+	out, err := runOnPTY(t, pty, "set-id", "-id", "0xA1B2")
+	if err != nil {
+		t.Fatalf("set-id: %v", err)
+	}
+	if got := pty.Fake.DeviceID(); got != 0xA1B2 {
+		t.Errorf("set-id: the device ID is %04X, want A1B2", got)
+	}
+	if want := "current ID: A160\nA160 -> A1B2\n"; out != want {
+		t.Errorf("set-id printed %q, want %q", out, want)
+	}
+
+	for _, id := range []string{"", "0xFFFF", "zz"} {
+		if _, err := runOnPTY(t, pty, "set-id", "-id", id); err == nil {
+			t.Errorf("set-id -id %q succeeded", id)
+		}
+	}
+	if got := pty.Fake.DeviceID(); got != 0xA1B2 {
+		t.Errorf("a failed set-id changed the device ID to %04X", got)
+	}
+}
+
+func TestPeriodCommand(t *testing.T) {
+	pty := newPTY(t)
+	out, err := runOnPTY(t, pty, "period", "-set", "5")
+	if err != nil {
+		t.Fatalf("period -set: %v", err)
+	}
+	if out != "5\n" || pty.Fake.WorkingPeriod() != 5 {
+		t.Errorf("period -set 5 printed %q, and the working period is %v", out, pty.Fake.WorkingPeriod())
+	}
+
+	pty.Fake.SetAwake(false)
+	out, err = runOnPTY(t, pty, "period")
+	if err != nil {
+		t.Fatalf("period: %v", err)
+	}
+	if out != "5\n" {
+		t.Errorf("period printed %q, want 5", out)
+	}
+	if pty.Fake.Awake() {
+		t.Error("period left a sleeping sensor awake")
+	}
+
+	if _, err := runOnPTY(t, pty, "period", "-set", "31"); err == nil {
+		t.Error("period -set 31 succeeded")
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	pty := newPTY(t)
+	if _, err := runOnPTY(t, pty, "nonsense"); exitCode(err) != exitUsage {
+		t.Errorf("an unknown command failed with %v, want exit code %v", err, exitUsage)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestParseDeviceID(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want uint16
+		ok   bool
+	}{
+		{"0xA1B2", 0xA1B2, true},
+		{"0Xa1b2", 0xA1B2, true},
+		{"41394", 0xA1B2, true},
+		{"0", 0, true},
+		{"0xFFFE", 0xFFFE, true},
+		{"0xFFFF", 0, false},
+		{"65535", 0, false},
+		{"65536", 0, false},
+		{"0x", 0, false},
+		{"A1B2", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+	} {
+		got, err := parseDeviceID(tc.in)
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("parseDeviceID(%q) = %04X, %v, want %04X", tc.in, got, err, tc.want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("parseDeviceID(%q) = %04X, want an error", tc.in, got)
+		}
+	}
+}
+
+func TestLookupCommand(t *testing.T) {
+	for _, c := range commands {
+		if got := lookupCommand(c.name); got != c {
+			t.Errorf("lookupCommand(%q) = %v, want the command", c.name, got)
+		}
+	}
+	if c := lookupCommand("nonsense"); c != nil {
+		t.Errorf("lookupCommand(%q) = %v, want nil", "nonsense", c)
+	}
+}
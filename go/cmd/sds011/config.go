@@ -0,0 +1,319 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the names of the environment variables setting the
+// global flags, like SDS011_PORT_PATH for -port_path.
+const envPrefix = "SDS011_"
+
+// reloadable are the global flags that re-reading the -config file on
+// SIGHUP changes. The others need a restart.
+var reloadable = []string{"interval", "samples", "alert-pm25", "alert-pm10", "alert-hysteresis", "alert-consecutive", "tag", "log-level"}
+
+// settings records where the global flags that aren't left at their
+// defaults were set.
+type settings struct {
+	path    string
+	sources map[string]string // flag name to "flag", "env SDS011_X" or "file"
+	// values are those in the -config file, when it was loaded.
+	values map[string][]string
+	// calibrations are those of the devices in the -config file.
+	calibrations map[uint16]sds011.Calibration
+	// tags are the -tag tags set on the command line or by an
+	// environment variable, which replace those with the same keys in
+	// the -config file.
+	tags tagsFlag
+}
+
+// loaded are the settings, once main loaded them.
+var loaded *settings
+
+// loadSettings sets the global flags that weren't given on the
+// command line from the environment variables, and those that are in
+// neither from the -config file, but for -tag, whose tags in the file
+// are merged with the others. cmd is the command being run, whose
+// flags include some of the global ones.
+func loadSettings(cmd *command) (*settings, error) {
+	s := &settings{path: *configPath, sources: make(map[string]string)}
+	flag.Visit(func(f *flag.Flag) { s.sources[f.Name] = "flag" })
+	cmd.flags.Visit(func(f *flag.Flag) {
+		if flag.Lookup(f.Name) != nil {
+			s.sources[f.Name] = "flag"
+		}
+	})
+	var errs []error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		v, ok := os.LookupEnv(name)
+		if !ok || s.sources[f.Name] != "" || f.Name == "config" {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			errs = append(errs, fmt.Errorf("$%s: %w", name, err))
+			return
+		}
+		s.sources[f.Name] = "env " + name
+	})
+	if s.path == "" {
+		return s, errors.Join(errs...)
+	}
+	values, calibrations, err := readConfig(s.path)
+	if err != nil {
+		return s, errors.Join(append(errs, err)...)
+	}
+	s.calibrations, s.values = calibrations, values
+	s.tags = slices.Clone(*tags)
+	for name, vs := range values {
+		if name == "tag" && s.sources[name] != "" {
+			merged, err := mergeTags(vs, s.tags)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: tag: %w", s.path, err))
+				continue
+			}
+			*tags = merged
+			s.sources[name] += " and file"
+			continue
+		}
+		if s.sources[name] != "" {
+			continue
+		}
+		f := flag.Lookup(name)
+		for _, v := range vs {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", s.path, name, err))
+			}
+		}
+		s.sources[name] = "file"
+	}
+	return s, errors.Join(errs...)
+}
+
+// envName returns the name of the environment variable setting the
+// named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfig reads a YAML file mapping the names of global flags to
+// their values, or to lists of them for the flags that can be given
+// many times, like
+//
+//	port_path: /dev/ttyUSB1
+//	interval: 5m
+//	tag: [room=kitchen, floor=1]
+//
+// and the calibrations of devices (see readCalibrations).
+func readConfig(path string) (map[string][]string, map[uint16]sds011.Calibration, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading -config: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string][]string)
+	var calibrations map[uint16]sds011.Calibration
+	if len(doc.Content) == 0 {
+		return values, nil, nil // an empty file
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("%s: want a mapping of flag names to values", path)
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		if key.Value == "calibration" {
+			if calibrations, err = readCalibrations(path, value); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		f := flag.Lookup(key.Value)
+		if f == nil || key.Value == "config" {
+			return nil, nil, fmt.Errorf("%s:%d: unknown setting %q", path, key.Line, key.Value)
+		}
+		switch {
+		case value.Kind == yaml.ScalarNode && value.Tag != "!!null":
+			values[key.Value] = []string{value.Value}
+		case value.Kind == yaml.SequenceNode && repeatable(f):
+			var vs []string
+			for _, v := range value.Content {
+				if v.Kind != yaml.ScalarNode {
+					return nil, nil, fmt.Errorf("%s:%d: %s: want a list of values", path, v.Line, key.Value)
+				}
+				vs = append(vs, v.Value)
+			}
+			values[key.Value] = vs
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: %s: want a single value", path, value.Line, key.Value)
+		}
+	}
+	return values, calibrations, nil
+}
+
+// repeatable returns true if f can be given many times.
+func repeatable(f *flag.Flag) bool {
+	switch f.Value.(type) {
+	case *tagsFlag, *stringsFlag:
+		return true
+	}
+	return false
+}
+
+// log logs where the flags not left at their defaults were set.
+func (s *settings) log() {
+	var names []string
+	for name := range s.sources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var attrs []any
+	for _, name := range names {
+		attrs = append(attrs, name, s.sources[name])
+	}
+	slog.Info("settings", attrs...)
+}
+
+// watch reads the -config file again on every SIGHUP, and sends what's
+// in it to the returned channel, until stop is called. It sends nil if
+// there's no -config file, or reading it failed, for the rest of what
+// SIGHUP does to be done anyway.
+func (s *settings) watch() (reloads <-chan map[string][]string, stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ch := make(chan map[string][]string, 1)
+	go func() {
+		for range hup {
+			if s.path == "" {
+				slog.Info("SIGHUP, reopening the ports")
+				sendNewest(ch, nil)
+				continue
+			}
+			slog.Info("SIGHUP, re-reading -config and reopening the ports", "path", s.path)
+			values, calibrations, err := readConfig(s.path)
+			if err != nil {
+				slog.Error("re-reading -config failed, keeping the settings", "error", err)
+			} else if !maps.Equal(calibrations, s.calibrations) {
+				slog.Warn("calibrations changed in -config, restart to apply them")
+			}
+			sendNewest(ch, values)
+		}
+	}()
+	return ch, func() {
+		signal.Stop(hup)
+		close(hup)
+	}
+}
+
+// reload sets the reloadable flags that weren't set on the command
+// line or by environment variables to their values in values, or to
+// their defaults if they aren't there, merging the -tag tags with
+// those set elsewhere, and returns the names of those that changed.
+// It logs what did, and what couldn't, and warns about the other
+// settings that changed in the file, which need a restart.
+func (s *settings) reload(values map[string][]string) (changed []string) {
+	s.warnRestart(values)
+	for _, name := range reloadable {
+		if source := s.sources[name]; source != "" && source != "file" && name != "tag" {
+			continue
+		}
+		f := flag.Lookup(name)
+		old := f.Value.String()
+		vs, ok := values[name]
+		if !ok {
+			vs = []string{f.DefValue}
+		}
+		var err error
+		if t, ok := f.Value.(*tagsFlag); ok {
+			var fresh tagsFlag
+			fresh, err = mergeTags(vs, s.tags)
+			if err == nil && !sameKeys(fresh, *t) {
+				err = errors.New("the keys of the tags can't change without a restart, only their values")
+			}
+			if err == nil {
+				err = checkTags(fresh)
+			}
+			if err == nil {
+				*t = fresh
+			}
+		} else {
+			err = f.Value.Set(vs[0])
+		}
+		if err != nil {
+			slog.Error("bad setting in -config, keeping the old one", "name", name, "error", err)
+			continue
+		}
+		switch {
+		case name == "tag" && len(s.tags) > 0:
+			s.sources[name] = strings.TrimSuffix(s.sources[name], " and file")
+			if ok {
+				s.sources[name] += " and file"
+			}
+		case ok:
+			s.sources[name] = "file"
+		default:
+			delete(s.sources, name)
+		}
+		if now := f.Value.String(); now != old {
+			slog.Info("setting changed", "name", name, "old", old, "new", now)
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// warnRestart warns about the settings that aren't reloadable, and
+// weren't set elsewhere, whose values in the -config file aren't those
+// it was loaded with anymore.
+func (s *settings) warnRestart(values map[string][]string) {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	for name := range s.values {
+		if _, ok := values[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if slices.Contains(reloadable, name) {
+			continue
+		}
+		if source := s.sources[name]; source != "" && source != "file" {
+			continue
+		}
+		if old, now := s.values[name], values[name]; !slices.Equal(old, now) {
+			slog.Warn("setting changed in -config, restart to apply it", "name", name, "old", strings.Join(old, ","), "new", strings.Join(now, ","))
+		}
+	}
+}
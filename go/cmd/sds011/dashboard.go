@@ -0,0 +1,38 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboards are what -dashboard takes.
+var dashboards = []string{"on", "off"}
+
+// dashboardHTML is the page of the dashboard. It has its script and
+// styles inline, and loads nothing from elsewhere, so that it works
+// without the internet.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// serveDashboard answers with the dashboard, which shows /latest and
+// charts /history, and keeps them up to date with /events.
+func serveDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(dashboardHTML)
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A frameDump writes the frames sent to and received from the sensors
+// for -debug, a line each, in the format of captures (see
+// sds011.WithCapture), so that they can be replayed:
+//
+//	2024-05-01T10:00:00.123456789Z received aa c0 7b 00 c8 01 a1 60 45 ab
+//
+// The frames the sensors threw away are also written, as "rejected",
+// with why after a #, and with several sensors every line says which
+// port it's from that way too.
+type frameDump struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openFrameDump returns the dump the flags ask for, opening
+// -debug-file when first called, or nil without -debug.
+var openFrameDump = sync.OnceValues(func() (*frameDump, error) {
+	switch {
+	case *debugFile != "":
+		f, err := os.OpenFile(*debugFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("opening -debug-file: %w", err)
+		}
+		return &frameDump{w: f}, nil
+	case *debug:
+		return &frameDump{w: os.Stderr}, nil
+	}
+	return nil, nil
+})
+
+// debugOptions are the options making the sensor at port write to
+// the -debug dump, if there is one.
+func debugOptions(port string) ([]sds011.Option, error) {
+	d, err := openFrameDump()
+	if d == nil || err != nil {
+		return nil, err
+	}
+	if len(sensorPaths) <= 1 {
+		port = ""
+	}
+	return []sds011.Option{
+		sds011.WithTrace(func(dir sds011.Direction, frame []byte) {
+			d.write(dir.String(), frame, port, nil)
+		}),
+		sds011.WithOnReject(func(b []byte, reason error) {
+			d.write("rejected", b, port, reason)
+		}),
+	}, nil
+}
+
+// write writes a line for b, ignoring errors like captures do.
+func (d *frameDump) write(what string, b []byte, port string, reason error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	line := fmt.Sprintf("%s %s % x", time.Now().Format(time.RFC3339Nano), what, b)
+	switch {
+	case port != "" && reason != nil:
+		line += " # " + port + ": " + reason.Error()
+	case port != "":
+		line += " # " + port
+	case reason != nil:
+		line += " # " + reason.Error()
+	}
+	fmt.Fprintln(d.w, line)
+}
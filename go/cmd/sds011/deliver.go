@@ -0,0 +1,117 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minBackoff and maxBackoff bound how long deliver waits before
+// trying again. The wait doubles after every attempt.
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// deliver calls send until it succeeds, it fails with an error that
+// isn't a retryableError, or it was retried retries times, and returns
+// its last error. It waits with exponential backoff between attempts,
+// and gives up when out is stopped. Every failed attempt is counted in
+// failures, and what says what send does, for the logs.
+func deliver[T any](out *outbox[T], retries int, failures prometheus.Counter, what string, send func() error) error {
+	backoff := minBackoff
+	for attempt := 0; ; attempt++ {
+		if out.stopped() {
+			return errors.New("shutting down")
+		}
+		err := send()
+		if err == nil {
+			return nil
+		}
+		failures.Inc()
+		var retry *retryableError
+		if !errors.As(err, &retry) || attempt == retries {
+			return err
+		}
+		wait := backoff
+		if retry.after > 0 {
+			wait = min(retry.after, maxBackoff)
+		}
+		slog.Warn(what+" failed, retrying", "error", err, "backoff", wait)
+		if !out.sleep(wait) {
+			return err
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// A retryableError is an error sending that may go away.
+type retryableError struct {
+	err   error
+	after time.Duration // how long the server asked to wait, if it did
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+
+func (e *retryableError) Unwrap() error { return e.err }
+
+// post POSTs body to url with the given header, giving up when stop is
+// closed. Connection failures, timeouts, and the server failing or
+// asking to wait are retryableErrors.
+func post(client *http.Client, url string, header http.Header, body []byte, stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		after, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return &retryableError{err: err, after: time.Duration(after) * time.Second}
+	}
+	return err
+}
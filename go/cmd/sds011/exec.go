@@ -0,0 +1,364 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// execModes are what -exec-mode takes.
+var execModes = []string{"each", "stream"}
+
+const (
+	// execQueue is how many measurements wait for the command, while
+	// as many runs of it as -exec-concurrency allows are running, or
+	// writing to it takes long. When it's full, the oldest is dropped.
+	execQueue = 16
+
+	// execMaxLine is the longest line of the command's stderr that is
+	// logged as one.
+	execMaxLine = 1024
+
+	// execRestartWait is the least time between two starts of the
+	// command with -exec-mode=stream, for one that exits right away
+	// not to be started over and over.
+	execRestartWait = 5 * time.Second
+
+	// execWaitDelay is how long a killed command may keep its output
+	// open, say through a child of its own, before it's closed.
+	execWaitDelay = time.Second
+)
+
+var (
+	execPassed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_exec_measurements_total",
+		Help: "Measurements passed to the -exec command.",
+	})
+	execFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_exec_failures_total",
+		Help: "Runs of the -exec command that failed or were killed, and failed writes to it with -exec-mode=stream.",
+	})
+	execDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_exec_dropped_total",
+		Help: "Measurements not passed to the -exec command, because too many were waiting, or it couldn't be started.",
+	})
+)
+
+// execConfig says what command is run for the measurements, and how.
+type execConfig struct {
+	cmd         string
+	mode        string // one of execModes
+	timeout     time.Duration
+	concurrency int // runs at a time, with mode "each"
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg execConfig) check() error {
+	if !slices.Contains(execModes, cfg.mode) {
+		return fmt.Errorf("unknown -exec-mode %q, want one of %v", cfg.mode, strings.Join(execModes, ", "))
+	}
+	if cfg.timeout <= 0 {
+		return fmt.Errorf("-exec-timeout must be positive, not %v", cfg.timeout)
+	}
+	if cfg.concurrency < 1 {
+		return fmt.Errorf("-exec-concurrency must be at least 1, not %d", cfg.concurrency)
+	}
+	return nil
+}
+
+// An execOutput passes measurements to a command run with the shell,
+// as their records, the JSON webhooks get. With mode "each", it runs
+// the command for every measurement, with the record on its stdin, and
+// the measurement in the environment variables of pointEnv, and
+// SDS011_PORT, and SDS011_MISSING for missing ones, killing it if it
+// takes longer than the timeout, and running at most concurrency at a
+// time. With mode "stream", it runs the command once, and writes a
+// line with the record to its stdin for every measurement, killing it
+// if that takes longer than the timeout, and starting it again if it
+// exits. What it writes to stderr is logged, and so is how it exits if
+// it fails. It is an observer.
+type execOutput struct {
+	cfg execConfig
+	out *outbox[sds011.Point]
+
+	// running are the runs of the command with mode "each".
+	running sync.WaitGroup
+
+	// child is the command running with mode "stream", nil until it's
+	// first started, and started when it last was.
+	child   *execChild
+	started time.Time
+}
+
+// An execChild is the command running with mode "stream".
+type execChild struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr *lineLogger
+	done   chan struct{} // closed once it exited
+	err    error         // how it exited, once done is closed
+}
+
+// startExec starts passing measurements to cfg.cmd.
+func startExec(cfg execConfig) (*execOutput, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	e := &execOutput{
+		cfg: cfg,
+		out: newOutbox[sds011.Point](execQueue, execDropped, "-exec"),
+	}
+	registry.MustRegister(execPassed, execFailures, execDropped)
+	if cfg.mode == "stream" {
+		e.out.start(e.stream)
+	} else {
+		e.out.start(e.each)
+	}
+	return e, nil
+}
+
+func (e *execOutput) Observe(point sds011.Point) {
+	e.out.put(point)
+}
+
+func (e *execOutput) ObserveError(error) {}
+
+// encode returns the record of point, as a line.
+func (e *execOutput) encode(point sds011.Point) ([]byte, error) {
+	b, err := json.Marshal(newRecord(point, devicePorts.of(point)))
+	return append(b, '\n'), err
+}
+
+// each runs the command for the queued measurements, at most
+// cfg.concurrency at a time, until the queue is closed, and waits for
+// the runs to end.
+func (e *execOutput) each(points <-chan sds011.Point) {
+	defer e.running.Wait()
+	slots := make(chan struct{}, e.cfg.concurrency)
+	for point := range points {
+		select {
+		case slots <- struct{}{}:
+		case <-e.out.stop:
+			return
+		}
+		e.running.Add(1)
+		go func() {
+			defer e.running.Done()
+			defer func() { <-slots }()
+			e.run(point)
+		}()
+	}
+}
+
+// run runs the command for point, and logs how it went.
+func (e *execOutput) run(point sds011.Point) {
+	record, err := e.encode(point)
+	if err != nil {
+		slog.Error("encoding the record for -exec", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.timeout)
+	defer cancel()
+	c := shellCommand(ctx, e.cfg.cmd)
+	c.Env = append(os.Environ(), pointEnv(point)...)
+	c.Env = append(c.Env, "SDS011_PORT="+devicePorts.of(point))
+	if point.Missing != "" {
+		c.Env = append(c.Env, "SDS011_MISSING="+point.Missing)
+	}
+	stderr := &lineLogger{}
+	c.Stdin, c.Stdout, c.Stderr = bytes.NewReader(record), os.Stderr, stderr
+	c.WaitDelay = execWaitDelay
+	start := time.Now()
+	err = c.Run()
+	stderr.flush()
+	execPassed.Inc()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		execFailures.Inc()
+		slog.Error("-exec took longer than -exec-timeout, killed it", "timeout", e.cfg.timeout, "device_id", deviceName(point))
+	case err != nil:
+		execFailures.Inc()
+		slog.Error("-exec failed", "error", err, "device_id", deviceName(point))
+	default:
+		slog.Debug("-exec done", "took", time.Since(start), "device_id", deviceName(point))
+	}
+}
+
+// stream writes the queued measurements to the command, starting it
+// when it isn't running, until the queue is closed, and then stops it.
+func (e *execOutput) stream(points <-chan sds011.Point) {
+	defer e.stopChild()
+	for point := range points {
+		record, err := e.encode(point)
+		if err != nil {
+			slog.Error("encoding the record for -exec", "error", err)
+			continue
+		}
+		if e.child != nil && e.child.exited() {
+			execFailures.Inc()
+			slog.Error("-exec exited, starting it again", "error", childExit(e.child.err))
+			e.child = nil
+		}
+		if e.child == nil && !e.startChild() {
+			execDropped.Inc()
+			continue
+		}
+		if err := e.child.write(record, e.cfg.timeout); err != nil {
+			execFailures.Inc()
+			slog.Error("writing to -exec failed, dropped the measurement", "error", err)
+			continue
+		}
+		execPassed.Inc()
+	}
+}
+
+// startChild starts the command, unless it was started less than
+// execRestartWait ago, and returns true if it's running.
+func (e *execOutput) startChild() bool {
+	if time.Since(e.started) < execRestartWait {
+		slog.Debug("-exec was started too recently to start it again, dropped the measurement")
+		return false
+	}
+	e.started = time.Now()
+	c := shellCommand(context.Background(), e.cfg.cmd)
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		slog.Error("starting -exec", "error", err)
+		return false
+	}
+	child := &execChild{cmd: c, stdin: stdin, stderr: &lineLogger{}, done: make(chan struct{})}
+	c.Stdout, c.Stderr = os.Stderr, child.stderr
+	c.WaitDelay = execWaitDelay
+	if err := c.Start(); err != nil {
+		slog.Error("starting -exec", "error", err)
+		return false
+	}
+	go func() {
+		child.err = c.Wait()
+		child.stderr.flush()
+		close(child.done)
+	}()
+	e.child = child
+	slog.Info("started -exec", "pid", c.Process.Pid)
+	return true
+}
+
+// stopChild closes the stdin of the command, for it to exit, and
+// kills it if it doesn't within the timeout.
+func (e *execOutput) stopChild() {
+	if e.child == nil {
+		return
+	}
+	e.child.stdin.Close()
+	select {
+	case <-e.child.done:
+	case <-time.After(e.cfg.timeout):
+		slog.Warn("-exec didn't exit within -exec-timeout once its stdin was closed, killed it")
+		e.child.cmd.Process.Kill()
+		<-e.child.done
+	}
+	if e.child.err != nil {
+		slog.Error("-exec failed", "error", e.child.err)
+	}
+}
+
+// exited returns true if the command exited.
+func (child *execChild) exited() bool {
+	select {
+	case <-child.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// write writes record to the stdin of the command, killing it if that
+// takes longer than timeout.
+func (child *execChild) write(record []byte, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() { child.cmd.Process.Kill() })
+	_, err := child.stdin.Write(record)
+	if !timer.Stop() {
+		return fmt.Errorf("took longer than -exec-timeout %v, killed it", timeout)
+	}
+	return err
+}
+
+// childExit returns err, or an error saying that the command exited
+// on its own without failing if it's nil.
+func childExit(err error) error {
+	if err == nil {
+		return errors.New("exited with status 0")
+	}
+	return err
+}
+
+// A lineLogger logs the lines written to it, as those the -exec
+// command wrote to stderr, cutting them at execMaxLine.
+type lineLogger struct {
+	buf []byte
+}
+
+func (l *lineLogger) Write(b []byte) (int, error) {
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(l.buf[:i])
+		l.buf = append(l.buf[:0], l.buf[i+1:]...)
+	}
+	if len(l.buf) > execMaxLine {
+		l.flush()
+	}
+	return len(b), nil
+}
+
+// flush logs what's left of the last line.
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		l.log(l.buf)
+		l.buf = l.buf[:0]
+	}
+}
+
+func (l *lineLogger) log(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > execMaxLine {
+		line = line[:execMaxLine]
+	}
+	slog.Warn("-exec wrote to stderr", "line", string(line))
+}
+
+// Close passes on what's left, giving up on it after shutdownTimeout,
+// and stops the command with -exec-mode=stream.
+func (e *execOutput) Close() {
+	e.out.close()
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// Exit codes, as the usage lists them.
+const (
+	exitOK     = 0
+	exitUsage  = 1 // an unknown command, or bad flags or settings
+	exitSensor = 2 // the sensor couldn't be opened, or didn't answer or measure
+	exitOutput = 3 // an output couldn't be opened or written
+	exitListen = 4 // -listen-address couldn't be listened on
+	exitFailed = 5 // anything else
+)
+
+// An exitError is an error that makes the program exit with code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExit returns err, making the program exit with code if it's the
+// first one found wrapped in what the command returns.
+func withExit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code, err}
+}
+
+// sensorErrors are the errors of the sensor, which it's at fault for
+// if a command fails with one without saying otherwise.
+var sensorErrors = []error{
+	sds011.ErrTimeout, sds011.ErrClosed, sds011.ErrDisconnected, sds011.ErrDeviceGone,
+	sds011.ErrChecksum, sds011.ErrBadHeader, sds011.ErrNotAcknowledged, sds011.ErrOutOfRange,
+	sds011.ErrPortBusy, sds011.ErrUnsupported,
+}
+
+// exitCode returns the code to exit with after a command returned err.
+func exitCode(err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	for _, target := range sensorErrors {
+		if errors.Is(err, target) {
+			return exitSensor
+		}
+	}
+	return exitFailed
+}
@@ -0,0 +1,199 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// graphiteTimeout is how long connecting to Graphite and sending it a
+// measurement may take.
+const graphiteTimeout = 5 * time.Second
+
+var (
+	graphiteSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_graphite_sent_total",
+		Help: "Measurements sent to Graphite.",
+	})
+	graphiteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_graphite_failures_total",
+		Help: "Failed attempts to send a measurement to Graphite.",
+	})
+	graphiteDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_graphite_dropped_total",
+		Help: "Measurements dropped because too many were waiting to be sent to Graphite, or sending them over UDP failed.",
+	})
+)
+
+// graphiteWriter sends measurements to Graphite in its plaintext
+// protocol, as
+//
+//	<prefix>.<device ID>.pm25 12.30 1500000000
+//	<prefix>.<device ID>.pm10 20.10 1500000000
+//
+// Over TCP, it reconnects when sending fails, and sends again. Over
+// UDP, measurements that fail to be sent are dropped. It is an
+// observer.
+type graphiteWriter struct {
+	network, addr string
+	prefix        string
+	out           *outbox[sds011.Point]
+	conn          net.Conn
+}
+
+// startGraphite starts sending measurements to the Graphite server at
+// addr, over network, "tcp" or "udp". Up to buffer of them wait while
+// it's unreachable. In prefix, "{host}" stands for the host name.
+func startGraphite(network, addr, prefix string, buffer int) (*graphiteWriter, error) {
+	if err := checkGraphite(network, addr, buffer); err != nil {
+		return nil, err
+	}
+	gw := &graphiteWriter{
+		network: network,
+		addr:    addr,
+		prefix:  graphitePrefix(prefix),
+		out:     newOutbox[sds011.Point](buffer, graphiteDropped, "Graphite"),
+	}
+	registry.MustRegister(graphiteSent, graphiteFailures, graphiteDropped)
+	gw.out.start(gw.send)
+	return gw, nil
+}
+
+// checkGraphite returns an error if the network, address or buffer
+// size of startGraphite don't make sense.
+func checkGraphite(network, addr string, buffer int) error {
+	if network != "tcp" && network != "udp" {
+		return fmt.Errorf("-graphite-network must be tcp or udp, not %q", network)
+	}
+	if buffer < 1 {
+		return fmt.Errorf("-graphite-buffer must be at least 1, not %d", buffer)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("bad -graphite-addr: %w", err)
+	}
+	return nil
+}
+
+// graphitePrefix returns prefix with "{host}" replaced by the host
+// name, and every component made safe for a metric path.
+func graphitePrefix(prefix string) string {
+	host, _ := os.Hostname()
+	// The domain isn't wanted, and its dots would nest the rest.
+	host, _, _ = strings.Cut(host, ".")
+	var parts []string
+	for _, part := range strings.Split(prefix, ".") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(part, "{host}", host)
+		parts = append(parts, graphiteComponent(part))
+	}
+	return strings.Join(parts, ".")
+}
+
+// graphiteComponent returns s with everything but letters, digits,
+// '-' and '_' replaced by '_', so that it's one component of a metric
+// path.
+func graphiteComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func (gw *graphiteWriter) Observe(point sds011.Point) {
+	gw.out.put(point)
+}
+
+func (gw *graphiteWriter) ObserveError(error) {}
+
+// send sends the queued measurements until the queue is closed.
+func (gw *graphiteWriter) send(points <-chan sds011.Point) {
+	defer func() {
+		if gw.conn != nil {
+			gw.conn.Close()
+		}
+	}()
+	backoff := time.Second
+	for point := range points {
+		for {
+			if gw.out.stopped() {
+				graphiteDropped.Inc()
+				break
+			}
+			err := gw.write(point)
+			if err == nil {
+				graphiteSent.Inc()
+				backoff = time.Second
+				break
+			}
+			graphiteFailures.Inc()
+			if gw.network == "udp" {
+				graphiteDropped.Inc()
+				slog.Debug("sending to Graphite failed, dropped the measurement", "error", err)
+				break
+			}
+			slog.Warn("sending to Graphite failed, reconnecting", "error", err, "backoff", backoff)
+			if !gw.out.sleep(backoff) {
+				graphiteDropped.Inc()
+				break
+			}
+			backoff = min(2*backoff, time.Minute)
+		}
+	}
+}
+
+// write sends the lines of point, connecting first if needed. If
+// sending fails, the connection is closed.
+func (gw *graphiteWriter) write(point sds011.Point) error {
+	if gw.conn == nil {
+		conn, err := net.DialTimeout(gw.network, gw.addr, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		gw.conn = conn
+	}
+	ts := strconv.FormatInt(point.Timestamp.Unix(), 10)
+	path := fmt.Sprintf("%v.%04x", gw.prefix, point.DeviceID)
+	if gw.prefix == "" {
+		path = fmt.Sprintf("%04x", point.DeviceID)
+	}
+	b := fmt.Appendf(nil, "%v.pm25 %.2f %v\n%v.pm10 %.2f %v\n", path, point.PM25, ts, path, point.PM10, ts)
+	gw.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	_, err := gw.conn.Write(b)
+	if err != nil {
+		gw.conn.Close()
+		gw.conn = nil
+	}
+	return err
+}
+
+// Close sends what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects.
+func (gw *graphiteWriter) Close() {
+	gw.out.close()
+}
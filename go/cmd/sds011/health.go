@@ -0,0 +1,189 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// health tracks whether the serial ports are open and keeps the
+// latest measurement read from each, for the /healthz and /readyz
+// probes and /latest. forPort returns the observers telling it about
+// them.
+type health struct {
+	maxStaleness time.Duration
+	// latestMaxAge is how old /latest may be, unless asked otherwise.
+	latestMaxAge time.Duration
+	// aqi returns the index of a measurement and its category for
+	// /latest, or is nil.
+	aqi func(sds011.Point) (index int, category string)
+	// extended adds the Extended columns to /latest.
+	extended bool
+	// combining makes /latest answer with the combined measurement
+	// of -combine.
+	combining bool
+
+	mu       sync.Mutex
+	open     map[string]bool         // by port
+	latest   map[string]sds011.Point // by port, once there is one
+	combined sds011.Point            // the latest, with -combine
+}
+
+func newHealth(maxStaleness time.Duration) *health {
+	return &health{maxStaleness: maxStaleness, open: make(map[string]bool), latest: make(map[string]sds011.Point)}
+}
+
+// setOpen records whether the serial port is open.
+func (h *health) setOpen(port string, open bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.open[port] = open
+}
+
+// forPort returns an observer of the measurements read from port.
+func (h *health) forPort(port string) observer {
+	return portHealth{h, port}
+}
+
+type portHealth struct {
+	h    *health
+	port string
+}
+
+func (p portHealth) Observe(point sds011.Point) {
+	p.h.mu.Lock()
+	defer p.h.mu.Unlock()
+	p.h.open[p.port] = true
+	p.h.latest[p.port] = point
+}
+
+// ObserveError notes that the port is closed while the sensor is
+// disconnected, and open again when it answers with anything else.
+func (p portHealth) ObserveError(err error) {
+	p.h.mu.Lock()
+	defer p.h.mu.Unlock()
+	p.h.open[p.port] = !errors.Is(err, sds011.ErrDisconnected)
+}
+
+// forCombined returns an observer of the combined measurements of
+// -combine.
+func (h *health) forCombined() observer {
+	return combinedHealth{h}
+}
+
+type combinedHealth struct{ h *health }
+
+func (c combinedHealth) Observe(point sds011.Point) {
+	c.h.mu.Lock()
+	defer c.h.mu.Unlock()
+	c.h.combined = point
+}
+
+func (c combinedHealth) ObserveError(error) {}
+
+// healthJSON is the body of the answers to the probes.
+type healthJSON struct {
+	Status          string   `json:"status"`
+	LastMeasurement string   `json:"last_measurement,omitempty"`
+	AgeSeconds      *float64 `json:"age_seconds,omitempty"`
+	MaxStaleness    float64  `json:"max_staleness_seconds,omitempty"`
+	// ClosedPorts are listed when there are several.
+	ClosedPorts []string `json:"closed_ports,omitempty"`
+}
+
+// serveHealthz answers 200 while a serial port is open, and 503
+// otherwise, so that one sensor being unplugged doesn't get the
+// others restarted.
+func (h *health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	var closed []string
+	for port, open := range h.open {
+		if !open {
+			closed = append(closed, port)
+		}
+	}
+	all := len(closed) == len(h.open)
+	several := len(h.open) > 1
+	h.mu.Unlock()
+	body := healthJSON{Status: "ok"}
+	if several {
+		slices.Sort(closed)
+		body.ClosedPorts = closed
+	}
+	if all {
+		body.Status = "serial port closed"
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// serveReadyz answers 200 if a measurement was taken in the last
+// maxStaleness, and 503 saying how stale the latest one is otherwise.
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	last := h.latestPoint().Timestamp
+	body := healthJSON{Status: "ok", MaxStaleness: h.maxStaleness.Seconds()}
+	if last.IsZero() {
+		body.Status = "no measurement yet"
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+	age := time.Since(last).Seconds()
+	body.LastMeasurement = last.Format(time.RFC3339)
+	body.AgeSeconds = &age
+	if age > h.maxStaleness.Seconds() {
+		body.Status = "stale"
+		writeJSON(w, http.StatusServiceUnavailable, body)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// latestPoint returns the latest measurement read from any port, or a
+// zero point if there was none yet.
+func (h *health) latestPoint() sds011.Point {
+	point, _ := h.latestWhere(func(string, sds011.Point) bool { return true })
+	return point
+}
+
+// latestWhere returns the latest of the measurements read last from
+// each port for which keep returns true, and its port, or a zero point
+// if there is none.
+func (h *health) latestWhere(keep func(port string, point sds011.Point) bool) (sds011.Point, string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var latest sds011.Point
+	var from string
+	for port, point := range h.latest {
+		if keep(port, point) && point.Timestamp.After(latest.Timestamp) {
+			latest, from = point, port
+		}
+	}
+	return latest, from
+}
+
+// writeJSON answers with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// history keeps the latest measurements, as many as it has room for,
+// for /history. It is an observer, and a missing observer.
+type history struct {
+	mu     sync.RWMutex
+	points []sds011.Point // a ring, with the oldest at next once full
+	next   int
+	full   bool
+}
+
+// newHistory returns a history with room for size measurements.
+func newHistory(size int) *history {
+	return &history{points: make([]sds011.Point, size)}
+}
+
+func (hist *history) Observe(point sds011.Point) {
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	hist.points[hist.next] = point
+	hist.next++
+	if hist.next == len(hist.points) {
+		hist.next, hist.full = 0, true
+	}
+}
+
+func (hist *history) ObserveError(error) {}
+
+// ObserveMissing keeps missing points too, for gaps to show.
+func (hist *history) ObserveMissing(point sds011.Point) {
+	hist.Observe(point)
+}
+
+// since returns the measurements taken at or after t for which keep
+// returns true, oldest first, but at most the limit newest of them if
+// limit is positive.
+func (hist *history) since(t time.Time, keep func(sds011.Point) bool, limit int) []sds011.Point {
+	hist.mu.RLock()
+	defer hist.mu.RUnlock()
+	var points []sds011.Point
+	if hist.full {
+		points = append(points, hist.points[hist.next:]...)
+	}
+	points = append(points, hist.points[:hist.next]...)
+	i := slices.IndexFunc(points, func(point sds011.Point) bool { return !point.Timestamp.Before(t) })
+	if i < 0 {
+		return nil
+	}
+	points = slices.DeleteFunc(points[i:], func(point sds011.Point) bool { return !keep(point) })
+	if limit > 0 && len(points) > limit {
+		points = points[len(points)-limit:]
+	}
+	return points
+}
+
+// serveHistory answers with the measurements in the history, oldest
+// first, as a JSON array of what sds011.Point.MarshalJSON returns, or
+// as CSV with a header if the format query parameter is csv. When
+// several ports are read, they come with the port of their sensor.
+// The since query parameter, in RFC 3339 format, leaves out the older
+// ones, limit keeps only that many of the newest, and port and
+// device_id only those of that sensor.
+func (hist *history) serveHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	keep := func(sds011.Point) bool { return true }
+	if s := query.Get("device_id"); s != "" {
+		id, err := parseHexID(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad device_id %q, want four hex digits", s), http.StatusBadRequest)
+			return
+		}
+		keep = func(point sds011.Point) bool { return point.DeviceID == id }
+	}
+	if port := query.Get("port"); port != "" {
+		byID := keep
+		keep = func(point sds011.Point) bool { return byID(point) && devicePorts.of(point) == port }
+	}
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, fmt.Sprintf("bad since %q, want an RFC 3339 timestamp", s), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("bad limit %q, want a number of measurements", s), http.StatusBadRequest)
+			return
+		}
+	}
+	points := hist.since(since, keep, limit)
+	switch query.Get("format") {
+	case "", "json":
+		if points == nil {
+			points = []sds011.Point{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(sensorPaths) <= 1 {
+			json.NewEncoder(w).Encode(points)
+			return
+		}
+		withPorts := make([]json.RawMessage, len(points))
+		for i, point := range points {
+			b, err := json.Marshal(point)
+			if err != nil || len(b) < 2 || b[len(b)-1] != '}' {
+				http.Error(w, "encoding the measurements failed", http.StatusInternalServerError)
+				return
+			}
+			port, _ := json.Marshal(devicePorts.of(point))
+			withPorts[i] = fmt.Appendf(b[:len(b)-1], `,"port":%s}`, port)
+		}
+		json.NewEncoder(w).Encode(withPorts)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		opts := []pointio.Option{pointio.WithHeader(), pointio.WithColumns(pointio.DeviceID, pointio.Spread)}
+		if *emitMissing {
+			opts = append(opts, pointio.WithColumns(pointio.Error), pointio.WithMissing(*missingPlaceholder))
+		}
+		if len(sensorPaths) > 1 {
+			opts = append(opts, pointio.WithColumnFunc("port", devicePorts.of))
+		}
+		out := pointio.NewCSVWriter(w, opts...)
+		for _, point := range points {
+			if err := out.Write(point); err != nil {
+				return
+			}
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q, want json or csv", query.Get("format")), http.StatusBadRequest)
+	}
+}
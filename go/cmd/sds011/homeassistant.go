@@ -0,0 +1,209 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// Home Assistant finds MQTT sensors by the retained messages
+// describing them under haPrefix, and says it's online on
+// haStatusTopic when it starts, having maybe forgotten them.
+// See https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery.
+const (
+	haPrefix      = "homeassistant"
+	haStatusTopic = haPrefix + "/status"
+)
+
+// A haEntity is one of the Home Assistant sensors a SDS011 shows up
+// as.
+type haEntity struct {
+	key         string // for topics and IDs
+	name        string
+	deviceClass string
+	value       func(sds011.Point) float64
+}
+
+var haEntities = []haEntity{
+	{"pm25", "PM2.5", "pm25", func(p sds011.Point) float64 { return p.PM25 }},
+	{"pm10", "PM10", "pm10", func(p sds011.Point) float64 { return p.PM10 }},
+}
+
+// haConfig is the discovery message of an entity.
+type haConfig struct {
+	Name                string   `json:"name"`
+	UniqueID            string   `json:"unique_id"`
+	ObjectID            string   `json:"object_id"`
+	DeviceClass         string   `json:"device_class"`
+	StateClass          string   `json:"state_class"`
+	Unit                string   `json:"unit_of_measurement"`
+	StateTopic          string   `json:"state_topic"`
+	AvailabilityTopic   string   `json:"availability_topic"`
+	PayloadAvailable    string   `json:"payload_available"`
+	PayloadNotAvailable string   `json:"payload_not_available"`
+	Device              haDevice `json:"device"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// haObjectID returns the ID of the sensor with the device ID id, or of
+// its entity e if key isn't empty, like "sds011_a160_pm25".
+func haObjectID(id uint16, key string) string {
+	if key == "" {
+		return fmt.Sprintf("sds011_%04x", id)
+	}
+	return fmt.Sprintf("sds011_%04x_%v", id, key)
+}
+
+func haConfigTopic(id uint16, e haEntity) string {
+	return fmt.Sprintf("%v/sensor/%v/config", haPrefix, haObjectID(id, e.key))
+}
+
+func (cfg mqttConfig) haStateTopic(id uint16, e haEntity) string {
+	return fmt.Sprintf("%v/%04x/%v", cfg.topic, id, e.key)
+}
+
+// haConfigs returns the retained discovery messages of the sensor
+// with the device ID id.
+func (cfg mqttConfig) haConfigs(id uint16) ([]mqttMessage, error) {
+	device := haDevice{
+		Identifiers:  []string{haObjectID(id, "")},
+		Name:         fmt.Sprintf("SDS011 %04x", id),
+		Manufacturer: "Nova Fitness",
+		Model:        "SDS011",
+	}
+	var msgs []mqttMessage
+	for _, e := range haEntities {
+		payload, err := json.Marshal(haConfig{
+			Name:                e.name,
+			UniqueID:            haObjectID(id, e.key),
+			ObjectID:            haObjectID(id, e.key),
+			DeviceClass:         e.deviceClass,
+			StateClass:          "measurement",
+			Unit:                "µg/m³",
+			StateTopic:          cfg.haStateTopic(id, e),
+			AvailabilityTopic:   cfg.statusTopic(),
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+			Device:              device,
+		})
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, mqttMessage{haConfigTopic(id, e), true, payload})
+	}
+	return msgs, nil
+}
+
+// haStates returns the messages with the values of point for the
+// entities' state topics.
+func (p *mqttPublisher) haStates(point sds011.Point) []mqttMessage {
+	var msgs []mqttMessage
+	for _, e := range haEntities {
+		value := strconv.FormatFloat(e.value(point), 'f', 1, 64)
+		msgs = append(msgs, mqttMessage{p.cfg.haStateTopic(point.DeviceID, e), p.cfg.retain, []byte(value)})
+	}
+	return msgs
+}
+
+// announce queues the discovery messages of the sensor with the
+// device ID id, unless it was already announced with it.
+func (p *mqttPublisher) announce(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.announceLocked(id)
+}
+
+// announceLocked is announce, called with mu held.
+func (p *mqttPublisher) announceLocked(id uint16) {
+	if p.announced && p.announcedID == id {
+		return
+	}
+	msgs, err := p.cfg.haConfigs(id)
+	if err != nil {
+		slog.Error("encoding the Home Assistant discovery messages", "error", err)
+		return
+	}
+	p.out.put(msgs...)
+	p.announcedID, p.announced = id, true
+}
+
+// rediscover makes the sensor be announced again: now, since the
+// broker may have lost the retained messages while disconnected, and
+// every time Home Assistant starts. It is called every time the
+// client connects.
+func (p *mqttPublisher) rediscover(c mqtt.Client) {
+	c.Subscribe(haStatusTopic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) == "online" {
+			p.reannounce()
+		}
+	})
+	p.reannounce()
+}
+
+func (p *mqttPublisher) reannounce() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.announced {
+		// The first measurement will do it.
+		return
+	}
+	p.announced = false
+	p.announceLocked(p.announcedID)
+}
+
+// haCleanup connects to the broker and removes the retained discovery
+// messages of the sensor with the device ID id, so that Home Assistant
+// forgets it.
+func haCleanup(cfg mqttConfig, id uint16) error {
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return err
+	}
+	client := mqtt.NewClient(opts.SetConnectTimeout(mqttPublishTimeout))
+	if err := wait(client.Connect()); err != nil {
+		return fmt.Errorf("connecting to %v: %w", cfg.broker, err)
+	}
+	defer client.Disconnect(250)
+	for _, e := range haEntities {
+		// An empty retained message removes the retained one.
+		if err := wait(client.Publish(haConfigTopic(id, e), 1, true, []byte{})); err != nil {
+			return fmt.Errorf("removing %v: %w", haConfigTopic(id, e), err)
+		}
+		fmt.Printf("removed %v\n", haConfigTopic(id, e))
+	}
+	return nil
+}
+
+// wait waits for token for up to mqttPublishTimeout, and returns its
+// error.
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return errors.New("timed out")
+	}
+	return token.Error()
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var httpAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sds011_http_auth_failures_total",
+	Help: "HTTP requests refused for lacking the right user name and password.",
+})
+
+// certReloader holds a TLS certificate, and loads it again from its
+// files on SIGHUP, so that renewing it doesn't need a restart.
+type certReloader struct {
+	certFile, keyFile string
+	hup               chan os.Signal
+
+	mu   sync.Mutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate and key in the given PEM
+// files, and starts reloading them on SIGHUP.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, hup: make(chan os.Signal, 1)}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	signal.Notify(cr.hup, syscall.SIGHUP)
+	go func() {
+		for range cr.hup {
+			if err := cr.load(); err != nil {
+				slog.Error("reloading the TLS certificate failed, still using the old one", "error", err)
+				continue
+			}
+			slog.Info("reloaded the TLS certificate", "path", cr.certFile)
+		}
+	}()
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// stop stops reloading the certificate.
+func (cr *certReloader) stop() {
+	signal.Stop(cr.hup)
+	close(cr.hup)
+}
+
+// basicAuth is a handler that lets requests with the right user name
+// and password through to the next one, and those for /healthz, so
+// that probes don't need them.
+type basicAuth struct {
+	next http.Handler
+	// The hashes of the user name and password, which, unlike
+	// them, are of the same length as those of any request, so
+	// that comparing them takes the same time.
+	user, password [sha256.Size]byte
+}
+
+// newBasicAuth returns a handler asking for user and the password in
+// passwordFile before letting requests through to next. The file's
+// trailing newline isn't part of the password.
+func newBasicAuth(next http.Handler, user, passwordFile string) (*basicAuth, error) {
+	b, err := os.ReadFile(passwordFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading the basic auth password: %w", err)
+	}
+	password := strings.TrimRight(string(b), "\r\n")
+	if password == "" {
+		return nil, fmt.Errorf("the basic auth password in %s is empty", passwordFile)
+	}
+	registry.MustRegister(httpAuthFailures)
+	return &basicAuth{next: next, user: sha256.Sum256([]byte(user)), password: sha256.Sum256([]byte(password))}, nil
+}
+
+func (ba *basicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		ba.next.ServeHTTP(w, r)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	userHash, passwordHash := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(password))
+	if !ok || subtle.ConstantTimeCompare(userHash[:], ba.user[:])&subtle.ConstantTimeCompare(passwordHash[:], ba.password[:]) != 1 {
+		httpAuthFailures.Inc()
+		w.Header().Set("WWW-Authenticate", `Basic realm="sds011", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ba.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+const (
+	// influxRetries is how many times writing a batch is retried
+	// before it's dropped.
+	influxRetries = 5
+
+	// influxRequestTimeout is how long a write may take.
+	influxRequestTimeout = 10 * time.Second
+)
+
+var (
+	influxWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_influxdb_written_total",
+		Help: "Measurements written to InfluxDB.",
+	})
+	influxFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_influxdb_write_failures_total",
+		Help: "Failed attempts to write a batch of measurements to InfluxDB.",
+	})
+	influxDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_influxdb_dropped_total",
+		Help: "Measurements dropped because writing them to InfluxDB kept failing, or too many were waiting.",
+	})
+)
+
+// influxConfig says where and how measurements are written to
+// InfluxDB.
+type influxConfig struct {
+	url           string
+	token         string
+	org, bucket   string
+	batchSize     int
+	flushInterval time.Duration
+	tags          []pointio.Tag
+}
+
+// influxWriter writes measurements to InfluxDB 2, in batches. It is
+// an observer.
+type influxWriter struct {
+	cfg      influxConfig
+	endpoint string
+	client   *http.Client
+	out      *outbox[sds011.Point]
+
+	mu   sync.Mutex
+	tags []pointio.Tag // the first is the device ID
+}
+
+// startInflux starts writing measurements to the InfluxDB server at
+// cfg.url.
+func startInflux(cfg influxConfig) (*influxWriter, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(cfg.url)
+	u = u.JoinPath("api/v2/write")
+	u.RawQuery = url.Values{"org": {cfg.org}, "bucket": {cfg.bucket}, "precision": {"ns"}}.Encode()
+
+	host, _ := os.Hostname()
+	tags := []pointio.Tag{{Key: "device_id"}, {Key: "host", Value: host}}
+	iw := &influxWriter{
+		cfg:      cfg,
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: influxRequestTimeout},
+		tags:     append(tags, cfg.tags...),
+		// Room for the batches that pile up while retrying.
+		out: newOutbox[sds011.Point](4*cfg.batchSize, influxDropped, "InfluxDB"),
+	}
+	registry.MustRegister(influxWritten, influxFailures, influxDropped)
+	iw.out.start(iw.loop)
+	return iw, nil
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg influxConfig) check() error {
+	u, err := url.Parse(cfg.url)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("-influx-url %q isn't an http or https URL", cfg.url)
+	}
+	if cfg.org == "" || cfg.bucket == "" {
+		return errors.New("-influx-url needs -influx-org and -influx-bucket")
+	}
+	if cfg.batchSize < 1 {
+		return fmt.Errorf("-influx-batch-size must be at least 1, not %d", cfg.batchSize)
+	}
+	if cfg.flushInterval <= 0 {
+		return fmt.Errorf("-influx-flush-interval must be positive, not %v", cfg.flushInterval)
+	}
+	return nil
+}
+
+func (iw *influxWriter) Observe(point sds011.Point) {
+	iw.out.put(point)
+}
+
+func (iw *influxWriter) ObserveError(error) {}
+
+// reload takes the -tag tags anew, for the measurements to come.
+func (iw *influxWriter) reload() {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	iw.tags = append(iw.tags[:2:2], *tags...)
+}
+
+// loop writes the queued measurements every flushInterval, or as soon
+// as there are batchSize of them, until the queue is closed.
+func (iw *influxWriter) loop(points <-chan sds011.Point) {
+	ticker := time.NewTicker(iw.cfg.flushInterval)
+	defer ticker.Stop()
+	var batch []byte
+	n := 0
+	flush := func() {
+		if n > 0 {
+			iw.writeBatch(batch, n)
+		}
+		batch, n = batch[:0], 0
+	}
+	for {
+		select {
+		case point, ok := <-points:
+			if !ok {
+				flush()
+				return
+			}
+			iw.mu.Lock()
+			iw.tags[0].Value = fmt.Sprintf("%04x", point.DeviceID)
+			batch = pointio.AppendLine(batch, point, iw.tags)
+			iw.mu.Unlock()
+			if n++; n >= iw.cfg.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// writeBatch writes the n measurements in batch, retrying with
+// backoff if the server fails or doesn't answer, and drops them if it
+// keeps doing so or refuses them.
+func (iw *influxWriter) writeBatch(batch []byte, n int) {
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if iw.cfg.token != "" {
+		header.Set("Authorization", "Token "+iw.cfg.token)
+	}
+	err := deliver(iw.out, influxRetries, influxFailures, "writing to InfluxDB", func() error {
+		return post(iw.client, iw.endpoint, header, batch, iw.out.stop)
+	})
+	if err != nil {
+		influxDropped.Add(float64(n))
+		slog.Error("writing to InfluxDB failed, dropped the measurements", "count", n, "error", err)
+		return
+	}
+	influxWritten.Add(float64(n))
+}
+
+// Close writes what's left in the queue, giving up on it after
+// shutdownTimeout.
+func (iw *influxWriter) Close() {
+	iw.out.close()
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// A writeRequest is a request received by a fake InfluxDB.
+type writeRequest struct {
+	path, query, auth, contentType string
+	body                           string
+}
+
+// fakeInflux starts a server answering writes with the statuses
+// given, then with 204, and sending what it received to the channel
+// returned.
+func fakeInflux(t *testing.T, statuses ...int) (*httptest.Server, <-chan writeRequest) {
+	t.Helper()
+	requests := make(chan writeRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- writeRequest{r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), r.Header.Get("Content-Type"), string(body)}
+		status := http.StatusNoContent
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func receiveWrite(t *testing.T, requests <-chan writeRequest) writeRequest {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was written to InfluxDB")
+		return writeRequest{}
+	}
+}
+
+func influxPoint(pm25, pm10 float64, id uint16, ns int64) sds011.Point {
+	return sds011.Point{PM25: pm25, PM10: pm10, DeviceID: id, Timestamp: time.Unix(0, ns)}
+}
+
+func TestInfluxLineProtocol(t *testing.T) {
+	newRegistry(t)
+	server, requests := fakeInflux(t)
+	iw, err := startInflux(influxConfig{
+		url:           server.URL + "/influx",
+		token:         "s3cret",
+		org:           "home org",
+		bucket:        "air",
+		batchSize:     3,
+		flushInterval: time.Hour,
+		tags:          []pointio.Tag{{Key: "room", Value: "living room"}},
+	})
+	if err != nil {
+		t.Fatalf("startInflux: %v", err)
+	}
+	written := counterValue(influxWritten)
+	iw.Observe(influxPoint(12.3, 20.1, 0xa1b2, 1500000000000000000))
+	iw.Observe(influxPoint(0, 999.9, 0x0001, 1500000001000000001))
+	iw.Observe(sds011.Point{DeviceID: 0xa1b2, Timestamp: time.Unix(0, 1500000002000000000), Missing: "timeout"})
+
+	r := receiveWrite(t, requests)
+	host, _ := os.Hostname()
+	want := "particulate,device_id=a1b2,host=" + host + ",room=living\\ room pm25=12.30,pm10=20.10 1500000000000000000\n" +
+		"particulate,device_id=0001,host=" + host + ",room=living\\ room pm25=0.00,pm10=999.90 1500000001000000001\n" +
+		"particulate,device_id=a1b2,host=" + host + ",room=living\\ room missing=\"timeout\" 1500000002000000000\n"
+	if r.body != want {
+		t.Errorf("wrote\n%s\nwant\n%s", r.body, want)
+	}
+	if r.path != "/influx/api/v2/write" {
+		t.Errorf("wrote to %v, want /influx/api/v2/write", r.path)
+	}
+	if want := "bucket=air&org=home+org&precision=ns"; r.query != want {
+		t.Errorf("wrote with query %q, want %q", r.query, want)
+	}
+	if r.auth != "Token s3cret" {
+		t.Errorf("wrote with Authorization %q, want %q", r.auth, "Token s3cret")
+	}
+	if r.contentType != "text/plain; charset=utf-8" {
+		t.Errorf("wrote with Content-Type %q", r.contentType)
+	}
+
+	iw.Close()
+	if got := counterValue(influxWritten) - written; got != 3 {
+		t.Errorf("counted %v measurements written, want 3", got)
+	}
+}
+
+func TestInfluxFlushInterval(t *testing.T) {
+	newRegistry(t)
+	server, requests := fakeInflux(t)
+	iw, err := startInflux(influxConfig{url: server.URL, org: "o", bucket: "b", batchSize: 100, flushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("startInflux: %v", err)
+	}
+	defer iw.Close()
+	iw.Observe(influxPoint(1, 2, 0xa1b2, 1))
+	r := receiveWrite(t, requests)
+	host, _ := os.Hostname()
+	if want := "particulate,device_id=a1b2,host=" + host + " pm25=1.00,pm10=2.00 1\n"; r.body != want {
+		t.Errorf("wrote %q, want %q", r.body, want)
+	}
+	if r.auth != "" {
+		t.Errorf("wrote with Authorization %q without a token", r.auth)
+	}
+}
+
+func TestInfluxRetries(t *testing.T) {
+	newRegistry(t)
+	server, requests := fakeInflux(t, http.StatusServiceUnavailable)
+	iw, err := startInflux(influxConfig{url: server.URL, org: "o", bucket: "b", batchSize: 1, flushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("startInflux: %v", err)
+	}
+	failures, written := counterValue(influxFailures), counterValue(influxWritten)
+	iw.Observe(influxPoint(1, 2, 0xa1b2, 1))
+	first, again := receiveWrite(t, requests), receiveWrite(t, requests)
+	if first != again {
+		t.Errorf("wrote %+v after failing to write %+v", again, first)
+	}
+	iw.Close()
+	if got := counterValue(influxFailures) - failures; got != 1 {
+		t.Errorf("counted %v failures, want 1", got)
+	}
+	if got := counterValue(influxWritten) - written; got != 1 {
+		t.Errorf("counted %v measurements written, want 1", got)
+	}
+}
+
+func TestInfluxDropsRefused(t *testing.T) {
+	newRegistry(t)
+	server, requests := fakeInflux(t, http.StatusBadRequest)
+	iw, err := startInflux(influxConfig{url: server.URL, org: "o", bucket: "b", batchSize: 2, flushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("startInflux: %v", err)
+	}
+	dropped := counterValue(influxDropped)
+	iw.Observe(influxPoint(1, 2, 0xa1b2, 1))
+	iw.Observe(influxPoint(3, 4, 0xa1b2, 2))
+	receiveWrite(t, requests)
+	iw.Close()
+	select {
+	case r := <-requests:
+		t.Errorf("wrote %+v again after it was refused", r)
+	default:
+	}
+	if got := counterValue(influxDropped) - dropped; got != 2 {
+		t.Errorf("counted %v measurements dropped, want 2", got)
+	}
+}
+
+func TestInfluxConfigCheck(t *testing.T) {
+	good := influxConfig{url: "http://localhost:8086", org: "o", bucket: "b", batchSize: 1, flushInterval: time.Second}
+	if err := good.check(); err != nil {
+		t.Errorf("check(%+v): %v", good, err)
+	}
+	for _, bad := range []func(*influxConfig){
+		func(c *influxConfig) { c.url = "localhost:8086" },
+		func(c *influxConfig) { c.url = "udp://localhost:8086" },
+		func(c *influxConfig) { c.org = "" },
+		func(c *influxConfig) { c.bucket = "" },
+		func(c *influxConfig) { c.batchSize = 0 },
+		func(c *influxConfig) { c.flushInterval = 0 },
+	} {
+		cfg := good
+		bad(&cfg)
+		if err := cfg.check(); err == nil {
+			t.Errorf("check(%+v) succeeded", cfg)
+		}
+	}
+}
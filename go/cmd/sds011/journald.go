@@ -0,0 +1,187 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// journalSocket is where journald takes log records in its native
+// protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalFields are the names of the journal fields of attributes
+// that aren't their keys in upper case.
+var journalFields = map[string]string{"pm2_5": "PM25"}
+
+// A journaldHandler sends log records to journald in its native
+// protocol, as a datagram each, with the message in MESSAGE, the level
+// in PRIORITY, and every attribute in a field of its own, its key in
+// upper case after SDS011_, and the groups', like SDS011_DEVICE_ID, so
+// that journalctl can filter by them. Records it fails to send go to
+// fallback.
+type journaldHandler struct {
+	conn     net.Conn
+	level    slog.Leveler
+	fallback slog.Handler
+	prefix   string // of the keys, from the groups
+	fields   []byte // of the attributes of WithAttrs
+}
+
+// newJournaldLogger returns a logger sending to journald, or, if it
+// can't connect to it, writing text to stderr.
+func newJournaldLogger(opts *slog.HandlerOptions) *slog.Logger {
+	fallback := slog.NewTextHandler(os.Stderr, opts)
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		logger := slog.New(fallback)
+		logger.Warn("can't log to the journal, logging to stderr", "error", err)
+		return logger
+	}
+	return slog.New(&journaldHandler{conn: conn, level: opts.Level, fallback: fallback})
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	b := appendJournalField(nil, "MESSAGE", r.Message)
+	b = appendJournalField(b, "PRIORITY", journalPriority(r.Level))
+	b = appendJournalField(b, "SYSLOG_IDENTIFIER", "sds011")
+	b = append(b, h.fields...)
+	r.Attrs(func(a slog.Attr) bool {
+		b = appendJournalAttr(b, h.prefix, a)
+		return true
+	})
+	if _, err := h.conn.Write(b); err != nil {
+		return h.fallback.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.fallback = h.fallback.WithAttrs(attrs)
+	h2.fields = append([]byte(nil), h.fields...)
+	for _, a := range attrs {
+		h2.fields = appendJournalAttr(h2.fields, h.prefix, a)
+	}
+	return &h2
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.fallback = h.fallback.WithGroup(name)
+	h2.prefix = h.prefix + journalName(name) + "_"
+	return &h2
+}
+
+// journalPriority returns the syslog priority of level, which PRIORITY
+// has.
+func journalPriority(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "7"
+	case level < slog.LevelWarn:
+		return "6"
+	case level < slog.LevelError:
+		return "4"
+	}
+	return "3"
+}
+
+// journalName returns key in upper case, with everything but letters
+// and digits replaced by '_', or as journalFields has it.
+func journalName(key string) string {
+	if name, ok := journalFields[key]; ok {
+		return name
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z':
+			return r - 'a' + 'A'
+		case 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// appendJournalAttr appends a to b as a field, or the attributes of a
+// group as fields of their own, after prefix.
+func appendJournalAttr(b []byte, prefix string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return b
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += journalName(a.Key) + "_"
+		}
+		for _, ga := range a.Value.Group() {
+			b = appendJournalAttr(b, prefix, ga)
+		}
+		return b
+	}
+	value := a.Value.String()
+	if a.Value.Kind() == slog.KindTime {
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	}
+	// Journal field names are at most 64 characters.
+	name := "SDS011_" + prefix + journalName(a.Key)
+	return appendJournalField(b, name[:min(len(name), 64)], value)
+}
+
+// appendJournalField appends the field name with value to b: as
+// name=value and a newline, or, if value has newlines, as name and a
+// newline, the length of value as 8 bytes, little-endian, value and a
+// newline.
+func appendJournalField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	if !strings.Contains(value, "\n") {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// measurementLogger logs every measurement at the info level, as the
+// event measurement, for the journal to have their values in fields
+// of their own. It is an observer.
+type measurementLogger struct{}
+
+func (measurementLogger) Observe(point sds011.Point) {
+	slog.Info("measured", "event", "measurement", "device_id", deviceName(point),
+		"pm2_5", fmt.Sprintf("%.1f", point.PM25), "pm10", fmt.Sprintf("%.1f", point.PM10))
+}
+
+func (measurementLogger) ObserveError(error) {}
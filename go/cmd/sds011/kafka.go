@@ -0,0 +1,230 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	// kafkaQueueSize is how many measurements wait to be produced
+	// while the brokers are unreachable, both in the outbox and in
+	// the client's buffer. When the outbox is full, the oldest one is
+	// dropped.
+	kafkaQueueSize = 64
+
+	// kafkaRetries is how many times producing a measurement is
+	// retried before it's dropped.
+	kafkaRetries = 5
+
+	// kafkaSchemaVersion is the version of the JSON of the messages,
+	// in their schema_version header, which changes when fields do
+	// other than by being added.
+	kafkaSchemaVersion = "1"
+)
+
+var (
+	kafkaProduced = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_kafka_produced_total",
+		Help: "Measurements produced to Kafka.",
+	})
+	kafkaDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_kafka_dropped_total",
+		Help: "Measurements dropped because producing them to Kafka kept failing, or too many were waiting.",
+	})
+)
+
+// kafkaAcks are the values of -kafka-acks, and what they ask for.
+var kafkaAcks = map[string]kgo.Acks{
+	"all":    kgo.AllISRAcks(),
+	"leader": kgo.LeaderAck(),
+	"none":   kgo.NoAck(),
+}
+
+// kafkaCodecs are the values of -kafka-compression, and the codecs
+// they stand for.
+var kafkaCodecs = map[string]kgo.CompressionCodec{
+	"none":   kgo.NoCompression(),
+	"gzip":   kgo.GzipCompression(),
+	"snappy": kgo.SnappyCompression(),
+	"lz4":    kgo.Lz4Compression(),
+	"zstd":   kgo.ZstdCompression(),
+}
+
+// kafkaConfig says where and how measurements are produced.
+type kafkaConfig struct {
+	brokers            []string
+	topic              string
+	acks               string // a key of kafkaAcks
+	compression        string // a key of kafkaCodecs
+	sasl               string // "", plain, scram-sha-256 or scram-sha-512
+	username, password string
+	tls                bool
+	caFile             string
+}
+
+// kafkaProducer produces measurements to a Kafka topic, as JSON keyed
+// by the device ID, so that the measurements of a sensor stay in
+// order in the same partition. It is an observer.
+type kafkaProducer struct {
+	client *kgo.Client
+	out    *outbox[*kgo.Record]
+	// pending counts the records handed to the client whose
+	// callbacks haven't run yet.
+	pending sync.WaitGroup
+}
+
+// startKafka starts producing measurements to the topic of cfg. The
+// client connects to the brokers when it first has something to
+// produce, and again whenever they're unreachable.
+func startKafka(cfg kafkaConfig) (*kafkaProducer, error) {
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	p := &kafkaProducer{
+		client: client,
+		out:    newOutbox[*kgo.Record](kafkaQueueSize, kafkaDropped, "Kafka"),
+	}
+	registry.MustRegister(kafkaProduced, kafkaDropped)
+	p.out.start(p.produce)
+	return p, nil
+}
+
+// clientOptions returns the options of a client producing as cfg
+// says.
+func (cfg kafkaConfig) clientOptions() ([]kgo.Opt, error) {
+	if len(cfg.brokers) == 0 {
+		return nil, errors.New("-kafka-brokers is empty")
+	}
+	if cfg.topic == "" {
+		return nil, errors.New("-kafka-topic is empty")
+	}
+	acks, ok := kafkaAcks[cfg.acks]
+	if !ok {
+		return nil, fmt.Errorf("unknown -kafka-acks %q, want all, leader or none", cfg.acks)
+	}
+	codec, ok := kafkaCodecs[cfg.compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown -kafka-compression %q, want none, gzip, snappy, lz4 or zstd", cfg.compression)
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.brokers...),
+		kgo.DefaultProduceTopic(cfg.topic),
+		kgo.RequiredAcks(acks),
+		kgo.ProducerBatchCompression(codec),
+		kgo.RecordRetries(kafkaRetries),
+		kgo.MaxBufferedRecords(kafkaQueueSize),
+	}
+	if cfg.acks != "all" {
+		// Idempotent producing needs all the replicas to acknowledge.
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	switch cfg.sasl {
+	case "":
+	case "plain":
+		opts = append(opts, kgo.SASL(plain.Auth{User: cfg.username, Pass: cfg.password}.AsMechanism()))
+	case "scram-sha-256":
+		opts = append(opts, kgo.SASL(scram.Auth{User: cfg.username, Pass: cfg.password}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		opts = append(opts, kgo.SASL(scram.Auth{User: cfg.username, Pass: cfg.password}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("unknown -kafka-sasl %q, want plain, scram-sha-256 or scram-sha-512", cfg.sasl)
+	}
+	if cfg.sasl != "" && cfg.username == "" {
+		return nil, errors.New("-kafka-sasl needs -kafka-username")
+	}
+	if cfg.tls || cfg.caFile != "" {
+		tlsConfig, err := brokerTLSConfig("-kafka-ca-file", cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	} else if cfg.sasl == "plain" {
+		slog.Warn("-kafka-sasl=plain without -kafka-tls sends the password in the clear")
+	}
+	return opts, nil
+}
+
+func (p *kafkaProducer) Observe(point sds011.Point) {
+	payload, err := json.Marshal(point)
+	if err != nil {
+		slog.Error("encoding the Kafka message", "error", err)
+		return
+	}
+	p.out.put(&kgo.Record{
+		Key:     fmt.Appendf(nil, "%04x", point.DeviceID),
+		Value:   payload,
+		Headers: []kgo.RecordHeader{{Key: "schema_version", Value: []byte(kafkaSchemaVersion)}},
+	})
+}
+
+func (p *kafkaProducer) ObserveError(error) {}
+
+// produce hands the queued measurements to the client until the queue
+// is closed, which produces them in the background, and drops those
+// it fails to produce. Handing one over waits while the client's
+// buffer is full, as when the brokers are unreachable.
+func (p *kafkaProducer) produce(records <-chan *kgo.Record) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.out.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for r := range records {
+		p.pending.Add(1)
+		p.client.Produce(ctx, r, func(r *kgo.Record, err error) {
+			defer p.pending.Done()
+			if err != nil {
+				kafkaDropped.Inc()
+				slog.Warn("producing to Kafka failed, dropped the measurement", "topic", r.Topic, "key", string(r.Key), "error", err)
+				return
+			}
+			kafkaProduced.Inc()
+		})
+	}
+	if err := p.client.Flush(ctx); err != nil {
+		slog.Warn("producing the last measurements to Kafka", "error", err)
+	}
+}
+
+// Close produces what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects. The records given up on are
+// counted as dropped by the time it returns.
+func (p *kafkaProducer) Close() {
+	p.out.close()
+	// Closing the client fails the records it still buffers.
+	p.client.Close()
+	p.pending.Wait()
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// fakeKafka starts a fake Kafka cluster with the topic, closed when
+// the test ends.
+func fakeKafka(t *testing.T, topic string) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+// consumeKafka returns the first n records of topic in cluster.
+func consumeKafka(t *testing.T, cluster *kfake.Cluster, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("got %d of %d records from Kafka: %v", len(records), n, err)
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			t.Errorf("fetching %s/%d: %v", topic, partition, err)
+		})
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaRecords(t *testing.T) {
+	newRegistry(t)
+	cluster := fakeKafka(t, "air")
+	p, err := startKafka(kafkaConfig{brokers: cluster.ListenAddrs(), topic: "air", acks: "all", compression: "none"})
+	if err != nil {
+		t.Fatalf("startKafka: %v", err)
+	}
+	produced := counterValue(kafkaProduced)
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	points := []sds011.Point{
+		{PM25: 12.3, PM10: 20.1, DeviceID: 0xa1b2, Timestamp: ts, Seq: 1},
+		{PM25: 4.5, PM10: 6.7, DeviceID: 0x0001, Timestamp: ts.Add(time.Second), Seq: 7},
+		{PM25: 12.4, PM10: 20.2, DeviceID: 0xa1b2, Timestamp: ts.Add(time.Minute), Seq: 2},
+	}
+	for _, point := range points {
+		p.Observe(point)
+	}
+	p.Close()
+	if got := counterValue(kafkaProduced) - produced; got != 3 {
+		t.Errorf("counted %v measurements produced, want 3", got)
+	}
+
+	records := consumeKafka(t, cluster, "air", len(points))
+	last := map[string]*kgo.Record{} // by key
+	seen := 0
+	for _, r := range records {
+		var got sds011.Point
+		if err := json.Unmarshal(r.Value, &got); err != nil {
+			t.Errorf("record %q isn't a point: %v", r.Value, err)
+			continue
+		}
+		var want *sds011.Point
+		for i := range points {
+			if points[i].Seq == got.Seq && points[i].DeviceID == got.DeviceID {
+				want = &points[i]
+			}
+		}
+		if want == nil {
+			t.Errorf("unexpected record %q", r.Value)
+			continue
+		}
+		seen++
+		wantValue, _ := json.Marshal(*want)
+		if string(r.Value) != string(wantValue) {
+			t.Errorf("record value is %s, want %s", r.Value, wantValue)
+		}
+		if wantKey := fmt.Sprintf("%04x", want.DeviceID); string(r.Key) != wantKey {
+			t.Errorf("record key is %q, want %q", r.Key, wantKey)
+		}
+		if len(r.Headers) != 1 || r.Headers[0].Key != "schema_version" || string(r.Headers[0].Value) != kafkaSchemaVersion {
+			t.Errorf("record headers are %v, want schema_version %v", r.Headers, kafkaSchemaVersion)
+		}
+		// The measurements of a sensor stay in order.
+		if last, ok := last[string(r.Key)]; ok && (last.Partition != r.Partition || last.Offset > r.Offset) {
+			t.Errorf("record %q at %d/%d came after %q at %d/%d", r.Value, r.Partition, r.Offset, last.Value, last.Partition, last.Offset)
+		}
+		last[string(r.Key)] = r
+	}
+	if seen != len(points) {
+		t.Errorf("got %d of the %d measurements from Kafka", seen, len(points))
+	}
+}
+
+func TestKafkaDropsUnproduced(t *testing.T) {
+	newRegistry(t)
+	cluster := fakeKafka(t, "air")
+	brokers := cluster.ListenAddrs()
+	cluster.Close()
+	p, err := startKafka(kafkaConfig{brokers: brokers, topic: "air", acks: "leader", compression: "gzip"})
+	if err != nil {
+		t.Fatalf("startKafka: %v", err)
+	}
+	dropped := counterValue(kafkaDropped)
+	p.Observe(sds011.Point{PM25: 1, PM10: 2, DeviceID: 0xa1b2})
+	// Closing gives up on the measurement after shutdownTimeout.
+	p.Close()
+	if got := counterValue(kafkaDropped) - dropped; got != 1 {
+		t.Errorf("counted %v measurements dropped, want 1", got)
+	}
+}
+
+func TestKafkaConfigCheck(t *testing.T) {
+	good := kafkaConfig{brokers: []string{"localhost:9092"}, topic: "air", acks: "all", compression: "none"}
+	if _, err := good.clientOptions(); err != nil {
+		t.Errorf("clientOptions(%+v): %v", good, err)
+	}
+	for _, bad := range []func(*kafkaConfig){
+		func(c *kafkaConfig) { c.brokers = nil },
+		func(c *kafkaConfig) { c.topic = "" },
+		func(c *kafkaConfig) { c.acks = "some" },
+		func(c *kafkaConfig) { c.compression = "brotli" },
+		func(c *kafkaConfig) { c.sasl = "kerberos" },
+		func(c *kafkaConfig) { c.sasl = "plain" },
+	} {
+		cfg := good
+		bad(&cfg)
+		if _, err := cfg.clientOptions(); err == nil {
+			t.Errorf("clientOptions(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// serveLatest answers with the record of the latest measurement, with
+// how many seconds old it is as "age_seconds", its AQI as "aqi" and
+// "aqi_category" with -aqi, the columns of -extended-columns, and its
+// port as "port" when several are read. The port and device_id query
+// parameters pick the sensor, and otherwise the latest of all is the
+// one, or with -combine, the combined one, with the latest of every
+// device in "devices", by device ID. Its age is in the X-Data-Age
+// header too. It answers 503 if there was no measurement yet, or if
+// it's older than the max_age query parameter, in seconds, or
+// -latest-max-age without it, and 404 if there's none from the sensor
+// picked.
+func (h *health) serveLatest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	port, device := query.Get("port"), query.Get("device_id")
+	// Combined measurements are the default with -combine, listing
+	// those of the devices too.
+	combined := device == sds011.CombinedDeviceID || h.combining && port == "" && device == ""
+	var id uint16
+	if s := device; s != "" && !combined {
+		var err error
+		if id, err = parseHexID(s); err != nil {
+			http.Error(w, fmt.Sprintf("bad device_id %q, want four hex digits", s), http.StatusBadRequest)
+			return
+		}
+	}
+	maxAge := h.latestMaxAge.Seconds()
+	if s := query.Get("max_age"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 {
+			http.Error(w, fmt.Sprintf("bad max_age %q, want a number of seconds", s), http.StatusBadRequest)
+			return
+		}
+		maxAge = v
+	}
+	var point sds011.Point
+	var from string
+	if combined {
+		h.mu.Lock()
+		point = h.combined
+		h.mu.Unlock()
+	} else {
+		point, from = h.latestWhere(func(p string, point sds011.Point) bool {
+			return (port == "" || p == port) && (device == "" || point.DeviceID == id)
+		})
+	}
+	if point.Timestamp.IsZero() {
+		if (port != "" || device != "") && !(combined && h.combining) {
+			writeJSON(w, http.StatusNotFound, healthJSON{Status: "no measurement from that sensor"})
+			return
+		}
+		writeJSON(w, http.StatusServiceUnavailable, healthJSON{Status: "no measurement yet"})
+		return
+	}
+	age := time.Since(point.Timestamp).Seconds()
+	if age > maxAge {
+		writeJSON(w, http.StatusServiceUnavailable, healthJSON{
+			Status:          "stale",
+			LastMeasurement: point.Timestamp.Format(time.RFC3339),
+			AgeSeconds:      &age,
+			MaxStaleness:    maxAge,
+		})
+		return
+	}
+	rec := h.latestRecord(point, from)
+	if combined && device == "" {
+		rec.Devices = make(map[string]record)
+		h.mu.Lock()
+		for p, point := range h.latest {
+			rec.Devices[deviceName(point)] = h.latestRecord(point, p)
+		}
+		h.mu.Unlock()
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		http.Error(w, "encoding the measurement failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Data-Age", strconv.FormatInt(*rec.AgeSeconds, 10))
+	w.Write(append(b, '\n'))
+}
+
+// latestRecord returns the record of point, read from port, for
+// /latest.
+func (h *health) latestRecord(point sds011.Point, port string) record {
+	rec := newRecord(point, port)
+	rec.extended = h.extended
+	age := int64(math.Round(time.Since(point.Timestamp).Seconds()))
+	rec.AgeSeconds = &age
+	if h.aqi != nil {
+		rec = rec.withAQI(h.aqi)
+	}
+	if len(sensorPaths) > 1 {
+		rec.Port = port
+	}
+	return rec
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// logFormats are the values of -log-format.
+var logFormats = []string{"auto", "text", "json", "journald"}
+
+// logLevelVar is the level the logger logs at, which reloadLogLevel
+// changes.
+var logLevelVar slog.LevelVar
+
+// logToJournal is true if the logger sends to journald.
+var logToJournal bool
+
+// newLogger returns the logger writing to stderr, or sending to
+// journald, that -log-level, -log-format and -v ask for. Without
+// -log-level, it logs warnings and errors, and more with -v, or to
+// journald, informational messages too.
+func newLogger() (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: &logLevelVar}
+	var logger *slog.Logger
+	switch *logFormat {
+	case "auto":
+		if stderrIsJournal() {
+			logger = newJournaldLogger(opts)
+		} else {
+			logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+		}
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	case "journald":
+		logger = newJournaldLogger(opts)
+	default:
+		return nil, fmt.Errorf("unknown -log-format %q, want one of %v", *logFormat, strings.Join(logFormats, ", "))
+	}
+	_, logToJournal = logger.Handler().(*journaldHandler)
+	level, err := flagLogLevel()
+	if err != nil {
+		return nil, err
+	}
+	logLevelVar.Set(level)
+	return logger, nil
+}
+
+// flagLogLevel returns the level -log-level and -v ask for.
+func flagLogLevel() (slog.Level, error) {
+	level := verbosity.level()
+	if logToJournal {
+		level = min(level, slog.LevelInfo)
+	}
+	if *logLevel != "" {
+		if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+			return level, fmt.Errorf("unknown -log-level %q, want debug, info, warn or error", *logLevel)
+		}
+	}
+	return level, nil
+}
+
+// reloadLogLevel logs at the reloaded -log-level from now on, unless
+// it's unknown.
+func reloadLogLevel() {
+	level, err := flagLogLevel()
+	if err != nil {
+		slog.Error("keeping the log level", "level", logLevelVar.Level(), "error", err)
+		return
+	}
+	logLevelVar.Set(level)
+}
+
+// errorKind returns what kind of error reading a sensor err is, for
+// the logs to be filtered by.
+func errorKind(err error) string {
+	switch {
+	case errors.Is(err, sds011.ErrDeviceGone):
+		return "device_gone"
+	case errors.Is(err, sds011.ErrDisconnected):
+		return "disconnected"
+	case errors.Is(err, sds011.ErrClosed):
+		return "closed"
+	case errors.Is(err, sds011.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, sds011.ErrChecksum):
+		return "checksum"
+	case errors.Is(err, sds011.ErrBadHeader):
+		return "bad_header"
+	case errors.Is(err, sds011.ErrOutOfRange):
+		return "out_of_range"
+	}
+	return "other"
+}
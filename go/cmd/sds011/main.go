@@ -13,117 +13,1901 @@
 // limitations under the License.
 
 // sds011 is a simple reader for the SDS011 Air Quality Sensor. It
-// outputs data in TSV to standard output (timestamp formatted
-// according to RFC3339, PM2.5 levels, PM10 levels).
+// outputs data to standard output, by default as CSV (timestamp
+// formatted according to RFC3339, PM2.5 levels, PM10 levels).
 package main
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/ryszard/sds011/go/sds011"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+	"github.com/ryszard/sds011/go/sds011/promexporter"
 )
 
-var interval time.Duration
-
 var (
-	interval = flag.Duration("interval", 0, "measurement interval (e.g. 30s, 15m, 1h20m)")
-	portPath = flag.String("port_path", "/dev/ttyUSB0", "serial port path")
-	samples = flag.Int("samples", 1, "number of samples per measurement")
-	unix = flag.Bool("unix", false, "print timestamps as number of seconds since 1970-01-01 00:00:00 UTC")
-	addr = flag.String("listen-address", "", "The address to listen on for HTTP requests.")
+	configPath          = flag.String("config", "", "read the global flags given neither on the command line nor as $SDS011_<FLAG> environment variables from this YAML file; SIGHUP re-reads -interval, -samples, the -alert thresholds, -tag and -log-level from it, and warns about the rest needing a restart")
+	interval            = flag.Duration("interval", 0, "measurement interval (e.g. 30s, 15m, 1h20m)")
+	warmup              = flag.Duration("warmup", 30*time.Second, "how long to read and discard measurements after waking the sensor up; it sleeps between measurements only if the interval is longer")
+	discardFirst        = flag.Int("discard-first", 0, "after waking the sensor up, and -warmup, also discard this many of the measurements it sends, which can be left over from before it slept, without counting them towards -samples")
+	portPath            = flag.String("port_path", "/dev/ttyUSB0", `serial port path, or "auto" to use the first sensor found; watch and get also take a comma-separated list of paths or patterns like /dev/ttyUSB*, and read all of the sensors at once`)
+	waitForDevice       = flag.Duration("wait-for-device", 0, "keep looking for the sensors at -port_path for this long when starting, instead of failing at once if they aren't there yet (e.g. 2m)")
+	reconnectMaxBackoff = flag.Duration("reconnect-max-backoff", time.Minute, "when a sensor stops working, open its port again after 1s, then twice as long every time, up to this")
+	watchdogSilence     = flag.Duration("watchdog", time.Minute, "when an awake sensor sends nothing for this long, wake it up, and if that doesn't help, open its port again; 0 to not watch")
+	simulate            = flag.Bool("simulate", false, "read a simulated sensor instead of the one at -port_path, making up plausible measurements, to try things out without the hardware")
+	simulatePM25        = flag.Float64("simulate-pm25", 12, "the PM2.5 level, in µg/m³, the -simulate measurements keep around")
+	simulatePM10        = flag.Float64("simulate-pm10", 20, "the PM10 level, in µg/m³, the -simulate measurements keep around")
+	simulateDiurnal     = flag.Float64("simulate-diurnal", 0.3, "how much the -simulate levels rise in the evening and fall in the morning, as a fraction of them")
+	simulateWalk        = flag.Float64("simulate-walk", 0.2, "how far the -simulate levels wander off randomly in an hour, as a fraction of them")
+	simulateSpikes      = flag.Float64("simulate-spikes", 0.5, "how many times an hour the -simulate levels spike, on average")
+	simulateSeed        = flag.Uint64("simulate-seed", 0, "seed the random numbers of -simulate with this, to get the same measurements every time; 0 for a random seed")
+	replayPath          = flag.String("replay", "", "instead of reading the sensors, feed the measurements in this file, written by watch as CSV, TSV or JSON lines, maybe gzipped, or the frames of a -debug dump, -samples at a time, to the output and everything else, with their own timestamps, and exit with a summary of them, and of the alerts that fired, once it's over; the metrics of the sensors aren't exported, and alert thresholds need no -alert-cmd or -alert-url, to just count the alerts")
+	replaySpeed         = flag.Float64("replay-speed", 0, "with -replay, feed the measurements at the pace they were recorded at, this many times faster; 0 for as fast as they can")
+	logLevel            = flag.String("log-level", "", "log messages at this level and above: debug, info, warn or error; without it, warn, info with -v, and debug with -vv")
+	logFormat           = flag.String("log-format", "auto", "log to stderr as text, or json, an object per line, or to journald, with the measurements, alerts and reconnections as events with their values in fields of their own, like SDS011_PM25; auto logs to journald when stderr goes to the journal, as $JOURNAL_STREAM has it, and as text otherwise")
+	debug               = flag.Bool("debug", false, "dump every frame sent to and received from the sensors to stderr, with the time, in the format of captures, and the frames thrown away with why")
+	debugFile           = flag.String("debug-file", "", "write the -debug dump to this file instead of stderr, implying -debug")
+	samples             = flag.Int("samples", 1, "number of samples per measurement")
+	aggregate           = flag.String("aggregate", "mean", "how to combine the samples of a measurement: mean, median, or trimmed (the mean without the -trim highest and lowest)")
+	trim                = flag.Float64("trim", 10, "percentage of the samples left out at each end by -aggregate=trimmed")
+	spread              = flag.Bool("spread", false, "add the number of samples and their standard deviations to CSV and TSV output")
+	pm25Offset          = flag.Float64("pm25-offset", 0, "add this to every PM2.5 reading, after -pm25-scale, and before anything else sees it")
+	pm25Scale           = flag.Float64("pm25-scale", 1, "multiply every PM2.5 reading by this")
+	pm10Offset          = flag.Float64("pm10-offset", 0, "add this to every PM10 reading, after -pm10-scale, and before anything else sees it")
+	pm10Scale           = flag.Float64("pm10-scale", 1, "multiply every PM10 reading by this")
+	triggerColumn       = flag.Bool("trigger-column", false, "add a trigger column to CSV and TSV output, saying if a measurement was taken on schedule, or manually on SIGUSR1 or POST /trigger; the other outputs mark manual ones anyway")
+	emitMissing         = flag.Bool("emit-missing", false, "write a row for every measurement that failed or was skipped, at the time it was due, with an error column saying why and no values, which -missing-placeholder stands for in CSV and TSV, and are null in JSON; /history keeps them too")
+	missingPlaceholder  = flag.String("missing-placeholder", "", "with -emit-missing, write this, like NaN, for the values of failed measurements in CSV and TSV output, instead of nothing")
+	rawColumns          = flag.Bool("raw-columns", false, "add the readings before calibration, in tenths of µg/m³, to CSV and TSV output")
+	extendedColumns     = flag.Bool("extended-columns", false, "add the number of samples of every measurement, and their lowest, highest and standard deviations, as sample_count, pm2_5_min, pm2_5_max, pm2_5_stddev, pm10_min, pm10_max and pm10_stddev, to CSV, TSV and JSON output, and to /latest")
+	aqiScale            = flag.String("aqi", "off", "add the air quality index of measurements and its category to the output, the Prometheus metrics and /latest: us for the US EPA AQI, eu for the European CAQI, or off")
+	aqiNowcast          = flag.Bool("aqi-nowcast", false, "with -aqi=us, compute the index from the EPA NowCast of the measurements, once there are some for 2 of the last 3 hours")
+	smoothing           = flag.String("smoothing", "off", "add the exponential moving average of the measurements of every device to the output, as the pm2_5_smoothed and pm10_smoothed columns, and to the Prometheus metrics, as _smoothed gauges: ema, or off")
+	smoothingAlpha      = flag.Float64("smoothing-alpha", 0.3, "with -smoothing, how far each measurement moves the average towards its values, above 0 and at most 1; the lower, the smoother")
+	smoothingReset      = flag.Duration("smoothing-reset", 15*time.Minute, "with -smoothing, start the average over when a measurement comes this long after the previous one; 0 for never")
+	delta               = flag.Bool("delta", false, "add how fast the concentrations of every device change, in μg/m³ per minute since the measurement before, to the output, as the pm2_5_rate and pm10_rate columns, empty for the first measurement and after a gap, and to the Prometheus metrics, as _rate_ugm3_per_min gauges")
+	deltaMaxGap         = flag.Duration("delta-max-gap", 0, "with -delta, leave out the rates of a measurement coming more than this long after the previous one; 0 for three times -interval")
+	combine             = flag.String("combine", "off", "with several ports, also write and export a measurement with the device ID combined, of the mean or the median of the devices' measurements taken together, leaving out those that failed, and how many made it in a sensors column; /latest answers with it, and those of the devices under devices: mean, median, or off")
+	count               = flag.Int("count", 0, "take this many measurements and exit, failing if all of them failed; 0 for no limit")
+	check               = flag.Bool("check", false, "check the flags and -config, that the ports of the sensors open and the files to write can be, print what would run, and exit, failing with every problem found, without measuring or changing the sensors' settings")
+	checkSensor         = flag.Bool("check-sensor", false, "with -check, also ask the sensors for their firmware version, which they don't answer while asleep")
+	checkSinks          = flag.Bool("check-sinks", false, "with -check, also connect to the servers of the outputs, like -mqtt-broker, waiting up to 3s for each")
+	once                = flag.Bool("once", false, "take a single measurement, print it and exit, without serving HTTP or pushing metrics, other than to -pushgateway-url")
+	duration            = flag.Duration("duration", 0, "run for this long and exit, failing if no measurement succeeded; 0 for no limit")
+	utc                 = flag.Bool("utc", false, "write timestamps in UTC")
+	timezone            = flag.String("timezone", "", "write timestamps in this IANA time zone (e.g. Europe/Warsaw), instead of the local one")
+	unix                = flag.Bool("unix", false, "print timestamps as number of seconds since 1970-01-01 00:00:00 UTC")
+	timestampFormat     = flag.String("timestamp-format", "rfc3339", `format of the timestamps written: rfc3339, rfc3339nano, unix, unixmilli, or a Go layout like "2006-01-02 15:04:05"`)
+	metadataMode        = flag.String("metadata", "off", "add what the measurements were read with, the host name, port, device ID and firmware of the sensor, the version of sds011, -interval, -samples and -tag, to JSON output as a metadata field: in every record, in a header record for every sensor that output starts with, or off; /latest and webhooks have it unless it's off, and JSON always has the version of its fields as schema")
+	addr                = flag.String("listen-address", "", "The address to listen on for HTTP requests.")
+	dashboard           = flag.String("dashboard", "on", "serve a dashboard of the latest measurement, its AQI category and a chart of /history at / with -listen-address, which works on a phone and without the internet: on, or off for just the metrics and the JSON")
+	listenOptional      = flag.Bool("listen-optional", false, "if -listen-address can't be listened on, log it and go on measuring without serving HTTP, instead of exiting")
+	historySize         = flag.Int("history-size", 2880, "how many of the latest measurements to keep for /history; 0 to not serve it")
+	statsWindow         = flag.Duration("stats-window", 0, "also export the median, 95th percentile and maximum of the concentrations over the measurements in this trailing window (e.g. 1h), of those kept for -history-size, as metrics")
+	statsMinPoints      = flag.Int("stats-min-points", 10, "export the -stats-window metrics once there are this many measurements in the window")
+	maxStaleness        = flag.Duration("max-staleness", 0, "make /readyz fail when the latest measurement is older than this; 0 for -latest-max-age, or 5 times -interval, or 5s per sample without it")
+	latestMaxAge        = flag.Duration("latest-max-age", 0, "make /latest answer 503 when the measurement is older than this, unless its max_age query parameter says otherwise; 0 for the same as -max-staleness, so that /latest and /readyz agree")
+	tlsCert             = flag.String("tls-cert", "", "serve HTTPS with the certificate in this PEM file, reloaded on SIGHUP; needs -tls-key")
+	tlsKey              = flag.String("tls-key", "", "the PEM file with the private key of -tls-cert")
+	basicAuthUser       = flag.String("basic-auth-user", "", "ask HTTP clients for this user name, and the password in -basic-auth-password-file, except for /healthz")
+	basicAuthPassword   = flag.String("basic-auth-password-file", "", "the file holding the password of -basic-auth-user")
+	metricsPath         = flag.String("metrics-path", "/metrics", "the path to serve Prometheus metrics at")
+	metricsGoCollector  = flag.Bool("metrics-go-collector", false, "also export the go_* and process_* metrics of the Go runtime and the process")
+	metricsNamespace    = flag.String("metrics-namespace", "sds011", "start the names of the Prometheus metrics with this and an underscore")
+	metricsLabels       = varFlag(labelsFlag{}, "metrics-labels", "add these key=value,... labels to all the Prometheus metrics (e.g. location=bedroom)")
+	metricsLegacyNames  = flag.Bool("metrics-legacy-names", false, "also export PM2.5 and PM10 under their old names, like sds011_pm2_5, which are going away")
+	otlp                = flag.String("otlp", "", "push metrics to the OTLP/gRPC collector at this address (e.g. localhost:4317)")
+	mqttBroker          = flag.String("mqtt-broker", "", "also publish measurements as JSON to the MQTT broker at this URL (e.g. tcp://localhost:1883, or ssl://host:8883 for TLS)")
+	mqttTopic           = flag.String("mqtt-topic", "air/sds011", "MQTT topic to publish measurements to, in which <key> stands for the value of the -tag key")
+	mqttUsername        = flag.String("mqtt-username", "", "MQTT user name")
+	mqttPassword        = flag.String("mqtt-password", "", "MQTT password")
+	mqttQoS             = flag.Int("mqtt-qos", 0, "MQTT quality of service: 0, 1 or 2")
+	mqttRetain          = flag.Bool("mqtt-retain", false, "make the broker keep the last measurement for new subscribers")
+	mqttCAFile          = flag.String("mqtt-ca-file", "", "with an ssl:// broker, trust the certificates in this PEM file instead of the system's")
+	haDiscovery         = flag.Bool("ha-discovery", false, "with -mqtt-broker, announce the sensor to Home Assistant, and publish its state for it; \"sds011 ha-cleanup\" removes it")
+	kafkaBrokers        = flag.String("kafka-brokers", "", "also produce measurements as JSON to Kafka, keyed by device ID, through these comma-separated brokers (e.g. host1:9092,host2:9092)")
+	kafkaTopic          = flag.String("kafka-topic", "sds011", "Kafka topic to produce measurements to")
+	kafkaAcksFlag       = flag.String("kafka-acks", "all", "which replicas must acknowledge a measurement produced to Kafka: all, leader or none")
+	kafkaCompression    = flag.String("kafka-compression", "none", "compress the measurements produced to Kafka with none, gzip, snappy, lz4 or zstd")
+	kafkaSASL           = flag.String("kafka-sasl", "", "authenticate to Kafka with the SASL mechanism plain, scram-sha-256 or scram-sha-512, as -kafka-username")
+	kafkaUsername       = flag.String("kafka-username", "", "Kafka SASL user name")
+	kafkaPassword       = flag.String("kafka-password", "", "Kafka SASL password; defaults to $KAFKA_PASSWORD")
+	kafkaTLS            = flag.Bool("kafka-tls", false, "connect to the Kafka brokers with TLS")
+	kafkaCAFile         = flag.String("kafka-ca-file", "", "connect to the Kafka brokers with TLS, trusting the certificates in this PEM file instead of the system's")
+	natsURL             = flag.String("nats-url", "", "also publish measurements as JSON to the NATS server at this URL (e.g. nats://localhost:4222, or tls://host:4222 for TLS)")
+	natsSubject         = flag.String("nats-subject", "air.sds011.<device_id>", "NATS subject to publish measurements on, in which <device_id> stands for the device ID, <hostname> for the host name, and <key> for the value of -tag key")
+	natsCreds           = flag.String("nats-creds", "", "authenticate to NATS with the user credentials in this file")
+	natsNkey            = flag.String("nats-nkey", "", "authenticate to NATS with the nkey seed in this file")
+	natsUsername        = flag.String("nats-username", "", "NATS user name")
+	natsPassword        = flag.String("nats-password", "", "NATS password; defaults to $NATS_PASSWORD")
+	natsCAFile          = flag.String("nats-ca-file", "", "connect to NATS with TLS, trusting the certificates in this PEM file instead of the system's")
+	natsJetStream       = flag.Bool("nats-jetstream", false, "publish to NATS with JetStream, waiting for the server to acknowledge every measurement and retrying if it doesn't, so that they're stored; a stream must take -nats-subject")
+	redisAddr           = flag.String("redis-addr", "", "also write measurements to the Redis server at this host:port: the latest as JSON to sds011:<device_id>:latest, and the history to the capped stream sds011:<device_id>:history")
+	redisUsername       = flag.String("redis-username", "", "Redis ACL user name")
+	redisPassword       = flag.String("redis-password", "", "Redis password; defaults to $REDIS_PASSWORD")
+	redisDB             = flag.Int("redis-db", 0, "Redis database number to write to")
+	redisTTL            = flag.Duration("redis-ttl", 15*time.Minute, "how long the latest measurement in Redis lasts, 0 for as long as there's no newer one")
+	redisMaxLen         = flag.Int64("redis-maxlen", 10000, "about how many measurements every device's Redis stream keeps")
+	redisTimeSeries     = flag.Bool("redis-timeseries", false, "keep the history in Redis with RedisTimeSeries, in sds011:<device_id>:pm2_5 and sds011:<device_id>:pm10, instead of a stream")
+	redisRetention      = flag.Duration("redis-retention", 7*24*time.Hour, "how long the RedisTimeSeries of -redis-timeseries keep measurements, 0 for forever")
+	influxURL           = flag.String("influx-url", "", "also write measurements to the InfluxDB 2 server at this URL (e.g. http://localhost:8086)")
+	influxToken         = flag.String("influx-token", "", "InfluxDB API token; defaults to $INFLUX_TOKEN")
+	influxOrg           = flag.String("influx-org", "", "InfluxDB organization to write to")
+	influxBucket        = flag.String("influx-bucket", "", "InfluxDB bucket to write to")
+	influxBatchSize     = flag.Int("influx-batch-size", 100, "write to InfluxDB once this many measurements are waiting")
+	influxFlushInterval = flag.Duration("influx-flush-interval", 10*time.Second, "write the waiting measurements to InfluxDB at least this often")
+	graphiteAddr        = flag.String("graphite-addr", "", "also send measurements to the Graphite server at this address (e.g. localhost:2003)")
+	graphitePrefixFlag  = flag.String("graphite-prefix", "air.sds011", "prefix of the Graphite metric paths, in which {host} stands for the host name")
+	graphiteNetwork     = flag.String("graphite-network", "tcp", "send to Graphite over tcp, or udp to not wait nor retry")
+	graphiteBuffer      = flag.Int("graphite-buffer", 1000, "how many measurements to keep while Graphite is unreachable")
+	zabbixServer        = flag.String("zabbix-server", "", "also send measurements to the Zabbix server or proxy at this host:port, 10051 if it has none, with the sender protocol, as the trapper items sds011.pm25[<device_id>] and sds011.pm10[<device_id>] of -zabbix-host")
+	zabbixHost          = flag.String("zabbix-host", "", "the host in Zabbix that -zabbix-server gets the measurements of; defaults to the host name")
+	statsdAddr          = flag.String("statsd-addr", "", "also send measurements as gauges to the StatsD server at this address (e.g. 127.0.0.1:8125)")
+	statsdPrefix        = flag.String("statsd-prefix", "sds011", "prefix of the StatsD gauge names")
+	statsdTagsFormat    = flag.String("statsd-tags-format", "none", "how to tag StatsD gauges with the device ID, host and -tag values: none, or dogstatsd")
+	syslogAddr          = flag.String("syslog-addr", "", "also send measurements, and alerts starting and clearing, to syslog at this address, udp://host:514, tcp://host:514 or unixgram:///dev/log, as RFC 5424 messages with the values and -tag values as structured data")
+	syslogFacility      = flag.String("syslog-facility", "daemon", "the facility of the -syslog-addr messages: kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp, or local0 to local7")
+	syslogAppName       = flag.String("syslog-app-name", "sds011", "the APP-NAME of the -syslog-addr messages")
+	syslogPEN           = flag.Int("syslog-pen", 32473, "the private enterprise number of the structured data of the -syslog-addr messages, sds011@<pen>; 32473 is the one for documentation")
+	tags                = varFlag(new(tagsFlag), "tag", "add this key=value tag to every measurement: as a column of CSV and a field of JSON, for webhooks and /latest too, as a tag of InfluxDB line protocol, both -format=influx and -influx-url, and of DogStatsD gauges, as a label of the metrics if they're exported, as an OTLP attribute, and in the extra column of -postgres-dsn; <key> stands for value in -mqtt-topic and -nats-subject. Can be repeated; those in -config are merged with these, which replace those with the same key")
+	webhookTimeout      = flag.Duration("webhook-timeout", 10*time.Second, "how long a request to a webhook may take")
+	webhookToken        = flag.String("webhook-token", "", "send this bearer token to webhooks; defaults to $WEBHOOK_TOKEN")
+	webhookRetries      = flag.Int("webhook-retries", 3, "how many times to retry a failed request to a webhook before dropping its measurements")
+	webhookBatch        = flag.Int("webhook-batch", 1, "POST this many measurements at a time, as a JSON array, instead of each as an object")
+	webhookURLs         = varFlag(new(stringsFlag), "webhook-url", "also POST every measurement as JSON to this URL; can be repeated")
+	webhookAQI          = flag.Bool("webhook-aqi", false, "add the US EPA AQI and its category to what webhooks get")
+	remoteWriteURL      = flag.String("remote-write-url", "", "also push the metrics of -metrics-path after every measurement to this Prometheus remote-write endpoint (e.g. https://host/api/v1/write), for when nothing can scrape them")
+	remoteWriteToken    = flag.String("remote-write-token", "", "send this bearer token with remote writes; defaults to $REMOTE_WRITE_TOKEN")
+	remoteWriteUser     = flag.String("remote-write-username", "", "authenticate remote writes with basic auth as this user")
+	remoteWritePassword = flag.String("remote-write-password", "", "basic auth password of -remote-write-username; defaults to $REMOTE_WRITE_PASSWORD")
+	remoteWriteQueue    = flag.Int("remote-write-queue", 100, "how many remote-write requests wait to be sent while the endpoint is unreachable, before the oldest are dropped")
+	pushgatewayURL      = flag.String("pushgateway-url", "", "also push the metrics of -metrics-path to this Prometheus Pushgateway (e.g. http://host:9091), in a group of -pushgateway-job for every sensor, with its device ID as the instance label: after every measurement, or once at the end of a run with -count or -duration, failing it if that push fails")
+	pushgatewayJob      = flag.String("pushgateway-job", "sds011", "the job label of the metrics pushed to -pushgateway-url")
+	pushgatewayUsername = flag.String("pushgateway-username", "", "authenticate to -pushgateway-url with basic auth as this user")
+	pushgatewayPassword = flag.String("pushgateway-password", "", "basic auth password of -pushgateway-username; defaults to $PUSHGATEWAY_PASSWORD")
+	pushgatewayTimeout  = flag.Duration("pushgateway-timeout", 10*time.Second, "how long a push to -pushgateway-url may take")
+	pushgatewayDelete   = flag.Bool("pushgateway-delete-on-exit", false, "delete the groups pushed to -pushgateway-url when exiting, so that the metrics of a sensor no longer read don't linger")
+	postgresDSN         = flag.String("postgres-dsn", "", "also insert measurements into the sds011_readings table of the PostgreSQL or TimescaleDB database at this connection string or URL (e.g. postgres://user@host/db); the password can be in $PGPASSWORD")
+	postgresMigrate     = flag.Bool("postgres-migrate", false, "create the sds011_readings table if it doesn't exist, as a hypertable with TimescaleDB")
+	postgresBatchSize   = flag.Int("postgres-batch-size", 100, "insert into PostgreSQL once this many measurements are waiting")
+	postgresFlush       = flag.Duration("postgres-flush-interval", 10*time.Second, "insert the waiting measurements into PostgreSQL at least this often")
+	postgresBuffer      = flag.Int("postgres-buffer", 1000, "how many measurements wait to be inserted while PostgreSQL is unreachable, before the oldest are dropped")
+	sqlitePath          = flag.String("sqlite", "", "also store measurements in the readings table of the SQLite database at this path, creating it if needed")
+	sqliteRetention     = varFlag(new(daysFlag), "sqlite-retention", "with -sqlite, delete readings older than this (e.g. 90d, or 36h); 0 to keep them all")
+	alertPM25           = flag.Float64("alert-pm25", 0, "alert when PM2.5 goes above this many µg/m³; 0 for never")
+	alertPM10           = flag.Float64("alert-pm10", 0, "alert when PM10 goes above this many µg/m³; 0 for never")
+	alertHysteresis     = flag.Float64("alert-hysteresis", 5, "clear the alert when the levels fall this many µg/m³ below the thresholds")
+	alertConsecutive    = flag.Int("alert-consecutive", 3, "how many measurements in a row must cross a threshold to alert or clear the alert")
+	alertCmd            = flag.String("alert-cmd", "", "run this shell command when alerting, with the measurement in $SDS011_PM25, $SDS011_PM10 and $SDS011_TS")
+	alertClearCmd       = flag.String("alert-clear-cmd", "", "run this shell command when the alert clears, like -alert-cmd")
+	alertURL            = flag.String("alert-url", "", "POST alerts, and their clearing, as JSON to this URL")
+	alertDevice         = flag.String("alert-device", "", "alert only on the measurements of the device with this ID (e.g. 1f2e), or on the combined ones of -combine with combined, rather than on those of every device")
+	alertOn             = flag.String("alert-on", "raw", "compare the alert thresholds with the raw measurements, with their -smoothing averages, or with their -delta rates, in μg/m³ per minute, which the alerts then report: raw, smoothed or rate")
+	execCmd             = flag.String("exec", "", "also pass every measurement to this shell command, as JSON on its stdin, like webhooks get, with SDS011_PM25, SDS011_PM10, SDS011_TS, SDS011_DEVICE_ID, SDS011_PORT and, for missing ones, SDS011_MISSING set; what it writes to stderr, and how it fails, is logged")
+	execMode            = flag.String("exec-mode", "each", "run -exec for each measurement, or once, as a stream, writing a line of JSON to its stdin for every measurement, and starting it again if it exits: "+strings.Join(execModes, ", "))
+	execTimeout         = flag.Duration("exec-timeout", 10*time.Second, "kill -exec if a run of it, or with -exec-mode=stream writing a measurement to it, takes longer than this")
+	execConcurrency     = flag.Int("exec-concurrency", 2, "run at most this many -exec at a time; the measurements that come meanwhile wait, and the oldest are dropped when too many do")
+	format              = flag.String("format", "csv", "output format: "+strings.Join(pointio.Formats, ", "))
+	header              = flag.Bool("header", false, "start CSV and TSV output with a row naming the columns")
+	delimiter           = flag.String("delimiter", "", `separate CSV values with this instead of the format's default: ",", "\t" or ";"`)
+	output              = flag.String("output", "", "append the output to this file instead of writing it to stdout, unless -tee")
+	outputFormat        = flag.String("output-format", "", "the format of -output, if not -format: "+strings.Join(pointio.Formats, ", "))
+	tee                 = flag.Bool("tee", false, "with -output, write to stdout too, as -format says")
+	compress            = flag.String("compress", "auto", "compress -output: gzip, none, or auto for gzip if it ends with .gz")
+	compressFlush       = flag.Duration("compress-flush", 0, "with compressed -output, write out what's compressed when it's been waiting this long; 0 for every measurement, so that at most one is lost on a power failure")
+	quiet               = flag.Bool("quiet", false, "don't write measurements to stdout, only to the other outputs, like -output, -listen-address or -mqtt-broker; with get or -once, only exit with whether measuring succeeded")
+	rotateSize          = flag.Int64("rotate-size", 0, "with -output, rotate the file when it reaches this many bytes, after compressing")
+	rotateInterval      = flag.Duration("rotate-interval", 0, "with -output, rotate the file when it gets this old (e.g. 24h)")
+	dailySummaries      = flag.Bool("daily-summary", false, "when every day ends, in the time zone of -utc or -timezone, also write a summary of it for every device: the mean, lowest and highest PM2.5 and PM10, when they were highest, and how many of the measurements expected at -interval succeeded, as completeness_percent, with the day 23 or 25 hours long when the clocks change; as JSON lines with type daily_summary between the measurements, or to -summary-output, which it needs unless the output is -format=jsonl; MQTT publishes it to -mqtt-topic/summary, and webhooks get it too")
+	summaryOutput       = flag.String("summary-output", "", "with -daily-summary, append the summaries to this file instead of the output: as JSON lines if the output is -format=jsonl, or else as CSV")
+	summaryResume       = flag.Bool("summary-resume", false, "with -daily-summary, read today's measurements back from -output when starting, so that restarting doesn't leave them out of the summary")
+	rawSamplesPath      = flag.String("raw-samples", "", `also write every sample of the measurements, with which of its measurement's it is, to this file, or stderr for "-", in -format; the warmup measurements and frames with bad checksums it leaves out are logged when it stops, with -v`)
+	rawRotateSize       = flag.Int64("raw-samples-rotate-size", 0, "rotate -raw-samples like -rotate-size does -output")
+	rawRotateInterval   = flag.Duration("raw-samples-rotate-interval", 0, "rotate -raw-samples like -rotate-interval does -output")
+	rawCompress         = flag.String("raw-samples-compress", "auto", "compress -raw-samples like -compress does -output")
+	powerSave           = flag.String("power-save", "host", "how the sensor saves power between measurements: host, putting it to sleep and waking it up for every one, or hardware, setting its working period to -interval, so that it sleeps and wakes up on its own, and taking the one measurement it sends every period, with no commands in between; an -interval that isn't 1 to 30 whole minutes, or -align, falls back to host")
+	powerSaveKeep       = flag.Bool("power-save-keep", true, "with -power-save=hardware, leave the working period set on exit, so that the sensor goes on measuring every -interval and sleeping in between, even if the host doesn't run; false sets it back to 0, and puts the sensor to sleep")
+	roundTo             = flag.Duration("round", 0, "round the timestamps of the measurements written, and of the rows of -emit-missing, to the nearest multiple of this, like 1m or 1s, halfway ones up, so that 10:00:30 is 10:01:00 with 1m; a measurement whose rounded timestamp would repeat the previous one's keeps its own, with a warning; 0 for the precise times")
+	align               = varFlag(new(alignFlag), "align", "start measurements on the boundaries of -interval on the clock, like :00, :15, :30 and :45 for 15m, waking the sensor up -warmup before them, and wait for the first; -align=after-first takes one measurement right away before that")
 )
 
-var (
-	pm25mt = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "pm25",
-			Help: "Data from PM2.5 sensor",
-		},
-	)
-	pm10mt = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "pm10",
-			Help: "Data from PM10 sensor",
-		},
-	)
-)
+// verbosity is how much is logged: 0 for warnings and errors, 1 for
+// informational messages too, 2 for everything.
+var verbosity verbosityFlag
+
+// verbosityFlag is a boolean flag that counts how many times it was
+// given, so that -v -v is the same as -vv.
+type verbosityFlag int
+
+func (v *verbosityFlag) String() string { return strconv.Itoa(int(*v)) }
+
+func (v *verbosityFlag) IsBoolFlag() bool { return true }
+
+func (v *verbosityFlag) Set(s string) error {
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	if on {
+		*v++
+	}
+	return nil
+}
+
+// varFlag defines a flag with the given name and usage, set by
+// calling v.Set, and returns v.
+func varFlag[T flag.Value](v T, name, usage string) T {
+	flag.Var(v, name, usage)
+	return v
+}
+
+// daysFlag is a duration flag that also takes a number of days, like
+// 90d.
+type daysFlag time.Duration
+
+func (d *daysFlag) String() string {
+	if *d != 0 && time.Duration(*d)%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", time.Duration(*d)/(24*time.Hour))
+	}
+	return time.Duration(*d).String()
+}
+
+func (d *daysFlag) Set(s string) error {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 16)
+		if err != nil {
+			return fmt.Errorf("bad number of days %q", days)
+		}
+		*d = daysFlag(time.Duration(n) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	*d = daysFlag(v)
+	return err
+}
+
+// alignFlag is a boolean flag that also takes after-first.
+type alignFlag string
+
+const alignAfterFirst = "after-first"
+
+func (a *alignFlag) String() string {
+	if *a == "" {
+		return "false"
+	}
+	return string(*a)
+}
+
+func (a *alignFlag) IsBoolFlag() bool { return true }
+
+func (a *alignFlag) Set(s string) error {
+	if s == alignAfterFirst {
+		*a = alignFlag(s)
+		return nil
+	}
+	on, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("want true, false or %s, not %q", alignAfterFirst, s)
+	}
+	*a = ""
+	if on {
+		*a = "true"
+	}
+	return nil
+}
+
+// on returns true if measurements are aligned.
+func (a *alignFlag) on() bool { return *a != "" }
+
+// tagsFlag is a flag that can be given many times, each with a
+// key=value tag. A key given again replaces the value.
+type tagsFlag []pointio.Tag
+
+func (t *tagsFlag) String() string {
+	var s []string
+	for _, tag := range *t {
+		s = append(s, tag.Key+"="+tag.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+func (t *tagsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" || value == "" {
+		return fmt.Errorf("want key=value, not %q", s)
+	}
+	t.put(pointio.Tag{Key: key, Value: value})
+	return nil
+}
+
+// put adds tag, or replaces the value of the one with its key.
+func (t *tagsFlag) put(tag pointio.Tag) {
+	if i := slices.IndexFunc(*t, func(old pointio.Tag) bool { return old.Key == tag.Key }); i >= 0 {
+		(*t)[i].Value = tag.Value
+		return
+	}
+	*t = append(*t, tag)
+}
+
+// labelsFlag is a flag holding comma-separated key=value Prometheus
+// labels.
+type labelsFlag prometheus.Labels
+
+// labelName matches the label names Prometheus accepts.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func (l labelsFlag) String() string {
+	var s []string
+	for k, v := range l {
+		s = append(s, k+"="+v)
+	}
+	slices.Sort(s)
+	return strings.Join(s, ",")
+}
+
+func (l labelsFlag) Set(s string) error {
+	for _, label := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || value == "" {
+			return fmt.Errorf("want key=value, not %q", label)
+		}
+		if !labelName.MatchString(key) || strings.HasPrefix(key, "__") {
+			return fmt.Errorf("%q isn't a valid label name", key)
+		}
+		switch key {
+		case "device_id", "port", "kind", "category":
+			return fmt.Errorf("label %q is already used by the exporter", key)
+		}
+		l[key] = value
+	}
+	return nil
+}
+
+// stringsFlag is a flag that can be given many times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// level returns the lowest level logged at verbosity v.
+func (v verbosityFlag) level() slog.Level {
+	switch {
+	case v >= 2:
+		return slog.LevelDebug
+	case v == 1:
+		return slog.LevelInfo
+	}
+	return slog.LevelWarn
+}
 
 func init() {
+	// Bad flags are reported by runCommand, with its exit code.
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.Var(&verbosity, "v", "log more; repeat for even more (see -log-level)")
+	flag.BoolFunc("vv", "log everything, including every frame sent and received", func(string) error {
+		verbosity += 2
+		return nil
+	})
+
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr,
-			`sds011 reads data from the SDS011 sensor and sends them to stdout as CSV.
+			`sds011 reads data from the SDS011 sensor and sends them to stdout, or
+controls it.
+
+Usage: sds011 [global flags] command [flags] [arguments]
 
-The columns are: an RFC3339 timestamp, the PM2.5 level, the PM10 level.`)
-		fmt.Fprintf(os.Stderr, "\n\nUsage of %s:\n", os.Args[0])
+The commands are:
+
+`)
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "  %-8s %v\n", c.name, c.short)
+		}
+		fmt.Fprint(os.Stderr, `
+"sds011 command -h" describes a command and its flags.
+
+Measurements are written as CSV by default, with the columns: an RFC3339
+timestamp, the PM2.5 level, the PM10 level. -format=tsv separates them with tabs instead,
+-format=jsonl writes a JSON object per line, and -format=influx writes
+InfluxDB line protocol, for example to pipe to Telegraf.
+
+The exit status is 0 on success, and otherwise tells what failed:
+
+  1  usage: an unknown command, or bad flags or settings
+  2  the sensor: it couldn't be found or opened, or didn't answer, or
+     every measurement of -count failed
+  3  an output: -output, -sqlite, -raw-samples or the connection to a
+     broker or a server couldn't be opened, or writing failed
+  4  -listen-address couldn't be listened on (see -listen-optional)
+  5  anything else`)
+		fmt.Fprint(os.Stderr, "\n\nGlobal flags:\n")
 		flag.PrintDefaults()
 	}
+}
+
+// registry holds the metrics served via HTTP. Unlike the default one,
+// it has only the metrics of the program, unless -metrics-go-collector
+// is set.
+var registry = prometheus.NewRegistry()
+
+// HTTP server timeouts. Scrapes are small and quick, so these only
+// keep slow or stuck clients from holding connections.
+const (
+	httpReadTimeout  = 10 * time.Second
+	httpWriteTimeout = 30 * time.Second
+	httpIdleTimeout  = 2 * time.Minute
+)
+
+// serveHTTP exposes the registered metrics via HTTP at -metrics-path,
+// the liveness and readiness probes h answers at /healthz and /readyz,
+// the latest measurement at /latest, the ones in hist at /history
+// unless it's nil, and the new ones b sends at /stream and /events, in
+// a new goroutine, on ln. POST /trigger fires t, and / is the
+// dashboard, unless -dashboard=off. It serves HTTPS if -tls-cert is
+// set, and asks for -basic-auth-user's password if that is. If serving
+// fails, it logs why, and measuring goes on.
+func serveHTTP(ln net.Listener, h *health, hist *history, b *broadcaster, t *trigger) (*http.Server, error) {
+	if *metricsGoCollector {
+		registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+	mux := http.NewServeMux()
+	mux.Handle(*metricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", h.serveHealthz)
+	mux.HandleFunc("GET /readyz", h.serveReadyz)
+	mux.HandleFunc("GET /latest", h.serveLatest)
+	if hist != nil {
+		mux.HandleFunc("GET /history", hist.serveHistory)
+	}
+	mux.HandleFunc("GET /stream", b.serveStream)
+	mux.HandleFunc("GET /events", b.serveEvents)
+	mux.HandleFunc("POST /trigger", t.serveTrigger)
+	if *dashboard == "on" {
+		mux.HandleFunc("GET /{$}", serveDashboard)
+	}
+	var handler http.Handler = mux
+	if *basicAuthUser != "" {
+		ba, err := newBasicAuth(mux, *basicAuthUser, *basicAuthPassword)
+		if err != nil {
+			return nil, err
+		}
+		if *tlsCert == "" {
+			slog.Warn("-basic-auth-user without -tls-cert sends the password in the clear")
+		}
+		handler = ba
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	srv.RegisterOnShutdown(b.close)
+	listen := func() error { return srv.Serve(ln) }
+	if *tlsCert != "" {
+		cr, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		srv.RegisterOnShutdown(cr.stop)
+		srv.TLSConfig = &tls.Config{GetCertificate: cr.getCertificate, MinVersion: tls.VersionTLS12}
+		listen = func() error { return srv.ServeTLS(ln, "", "") }
+	}
+	go func() {
+		if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serving HTTP stopped", "address", *addr, "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// shutdownTimeout is how long shutting down waits for the sensor to go
+// to sleep and for HTTP requests to finish.
+const shutdownTimeout = 2 * time.Second
 
-	prometheus.MustRegister(pm25mt)
-	prometheus.MustRegister(pm10mt)
+// shutdownHTTP stops the HTTP server, letting the requests in flight
+// finish.
+func shutdownHTTP(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("shutting down HTTP", "error", err)
+	}
 }
 
-func listen_http() {
-	// Expose the registered metrics via HTTP.
-	http.Handle("/metrics", promhttp.Handler())
-	log.Fatal(http.ListenAndServe(*addr, nil))
+// sleepSensor puts the sensor to sleep, so that its fan and laser don't
+// keep running after the program exits, but doesn't wait for it longer
+// than shutdownTimeout.
+func sleepSensor(sensor sds011.Device) {
+	done := make(chan error, 1)
+	go func() { done <- sensor.Sleep() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			slog.Warn("putting the sensor to sleep", "error", err)
+		}
+	case <-time.After(shutdownTimeout):
+		slog.Warn("putting the sensor to sleep timed out")
+	}
+}
+
+// findSensor returns the path of the first port with a sensor.
+func findSensor() (string, error) {
+	found, err := sds011.Scan(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, d := range found {
+		if d.Err != nil {
+			slog.Warn("couldn't check port", "port", d.Path, "error", d.Err)
+			continue
+		}
+		return d.Path, nil
+	}
+	return "", errors.New("no sensor found")
 }
 
 func main() {
-	flag.Parse()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := runCommand(ctx, stop, os.Args[1:])
+	stop()
+	os.Exit(exitCode(err))
+}
 
-	if (len(*addr) > 0) {
-		go listen_http()
+// runCommand runs the command args name, with the global flags before
+// it and its own after it, until it's done or ctx is, and returns why
+// it failed, which it has already logged or printed. stopSignals is
+// what the command calls once it starts shutting down.
+func runCommand(ctx context.Context, stopSignals func(), args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return withExit(exitUsage, err)
+	}
+	name := flag.Arg(0)
+	if name == "" {
+		name = "watch"
+	}
+	cmd := lookupCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		flag.Usage()
+		return withExit(exitUsage, fmt.Errorf("unknown command %q", name))
 	}
+	if flag.NArg() > 0 {
+		if err := cmd.flags.Parse(flag.Args()[1:]); err != nil {
+			return withExit(exitUsage, err)
+		}
+	}
+	var err error
+	loaded, err = loadSettings(cmd)
 
-	sensor, err := sds011.New(*portPath)
+	logger, lerr := newLogger()
+	if lerr != nil {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+		err = cmp.Or(err, lerr)
+	}
+	slog.SetDefault(logger)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("bad settings", "error", err)
+		return withExit(exitUsage, err)
+	}
+	loaded.log()
+	if flag.Arg(0) == "" {
+		slog.Warn(`running sds011 without a command is deprecated, use "sds011 watch"`)
 	}
-	defer sensor.Close()
 
-	for {
-		var pm10, pm25 float64
-		var ts string
-		var t1 time.Time
-		var awake bool
+	if err := cmd.run(ctx, stopSignals, logger, cmd.flags.Args()); err != nil {
+		slog.Error(name+" failed", "error", err, "exit_code", exitCode(err))
+		return err
+	}
+	return nil
+}
 
-		if awake, err = sensor.IsAwake(); !awake {
-			sensor.Awake()
+// checkServeFlags returns an error, joining every problem found, if
+// the flags of watch and get don't make sense, and sets up what they
+// ask for.
+func checkServeFlags() error {
+	var errs []error
+	if !slices.Contains(aggregates, *aggregate) {
+		errs = append(errs, fmt.Errorf("unknown -aggregate %q, want one of %v", *aggregate, strings.Join(aggregates, ", ")))
+	}
+	if *trim < 0 || *trim >= 50 {
+		errs = append(errs, fmt.Errorf("-trim %v out of range [0, 50)", *trim))
+	}
+	if *haDiscovery && *mqttBroker == "" {
+		errs = append(errs, errors.New("-ha-discovery needs -mqtt-broker"))
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		errs = append(errs, errors.New("-tls-cert and -tls-key go together"))
+	}
+	if (*basicAuthUser == "") != (*basicAuthPassword == "") {
+		errs = append(errs, errors.New("-basic-auth-user and -basic-auth-password-file go together"))
+	}
+	if !strings.HasPrefix(*metricsPath, "/") {
+		errs = append(errs, fmt.Errorf("-metrics-path %q doesn't start with /", *metricsPath))
+	}
+	if !labelName.MatchString(*metricsNamespace) {
+		errs = append(errs, fmt.Errorf("-metrics-namespace %q isn't a valid metric name prefix", *metricsNamespace))
+	}
+	if err := checkCalibration(flagCalibration()); err != nil {
+		errs = append(errs, err)
+	}
+	var err error
+	if airQ, err = newAirQuality(); err != nil {
+		errs = append(errs, err)
+	}
+	if smooth, err = newSmoother(); err != nil {
+		errs = append(errs, err)
+	}
+	if rates, err = newRater(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkDailySummary(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkReplay(); err != nil {
+		errs = append(errs, err)
+	}
+	if !slices.Contains(powerSaves, *powerSave) {
+		errs = append(errs, fmt.Errorf("unknown -power-save %q, want one of %v", *powerSave, strings.Join(powerSaves, ", ")))
+	}
+	if *powerSave == "hardware" && *samples > 1 {
+		errs = append(errs, errors.New("-power-save=hardware takes the one measurement the sensor sends every working period, so -samples can't be more than 1"))
+	}
+	if !slices.Contains(metadataModes, *metadataMode) {
+		errs = append(errs, fmt.Errorf("unknown -metadata %q, want one of %v", *metadataMode, strings.Join(metadataModes, ", ")))
+	}
+	if !slices.Contains(combines, *combine) {
+		errs = append(errs, fmt.Errorf("unknown -combine %q, want one of %v", *combine, strings.Join(combines, ", ")))
+	}
+	if *alertDevice == sds011.CombinedDeviceID && *combine == "off" {
+		errs = append(errs, errors.New("-alert-device=combined needs -combine"))
+	}
+	if !slices.Contains(dashboards, *dashboard) {
+		errs = append(errs, fmt.Errorf("unknown -dashboard %q, want one of %v", *dashboard, strings.Join(dashboards, ", ")))
+	}
+	if *roundTo < 0 {
+		errs = append(errs, fmt.Errorf("-round can't be negative, not %v", *roundTo))
+	}
+	if *waitForDevice < 0 || *reconnectMaxBackoff < 0 || *watchdogSilence < 0 {
+		errs = append(errs, errors.New("-wait-for-device, -reconnect-max-backoff and -watchdog can't be negative"))
+	}
+	if err := checkSimulation(); err != nil {
+		errs = append(errs, err)
+	}
+	if (*tee || *outputFormat != "") && *output == "" {
+		errs = append(errs, errors.New("-tee and -output-format need -output"))
+	}
+	if align.on() && (*interval <= 0 || (24*time.Hour)%*interval != 0) {
+		errs = append(errs, fmt.Errorf("-align needs an -interval that a day divides into, not %v", *interval))
+	}
+	if *statsWindow < 0 {
+		errs = append(errs, fmt.Errorf("-stats-window can't be negative, not %v", *statsWindow))
+	}
+	if *statsWindow > 0 && *historySize <= 0 {
+		errs = append(errs, errors.New("-stats-window needs -history-size"))
+	}
+	if *discardFirst < 0 {
+		errs = append(errs, fmt.Errorf("-discard-first can't be negative, not %d", *discardFirst))
+	}
+	if *quiet && !*once && !otherOutputs() {
+		errs = append(errs, errors.New("-quiet needs another output, like -output, -listen-address or -mqtt-broker"))
+	}
+	if err := checkTags(*tags); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// serve reads the sensors and writes the output until ctx is done,
+// which SIGINT and SIGTERM make it, and then shuts everything down:
+// puts the sensors to sleep, flushes the output, and stops the HTTP
+// server. Every sensor is read on its own, so that one failing
+// doesn't hold up the others. It calls stopSignals once it starts
+// shutting down, so that another signal kills the program at once.
+func serve(ctx context.Context, stopSignals func(), logger *slog.Logger) error {
+	if *check {
+		return runCheck(ctx, os.Stdout, logger)
+	}
+	if err := checkServeFlags(); err != nil {
+		return withExit(exitUsage, err)
+	}
+	recordTags.set(*tags)
+	// Listening first, so that a taken -listen-address fails before
+	// the sensors are touched.
+	var ln net.Listener
+	if len(*addr) > 0 && !*once {
+		var err error
+		if ln, err = net.Listen("tcp", *addr); err != nil {
+			if !*listenOptional {
+				return withExit(exitListen, fmt.Errorf("-listen-address: %w", err))
+			}
+			slog.Error("not serving HTTP, going on without it", "error", err)
+		} else {
+			defer ln.Close() // in case serving doesn't start
 		}
+	}
+	wait := newDeviceWait(*waitForDevice)
+	if *simulate {
+		sensorPaths = []string{simulatedPort}
+	} else if *replayPath != "" {
+		sensorPaths = []string{replayPort}
+	} else if err := wait.retry(ctx, "finding the ports", func() (err error) {
+		sensorPaths, err = sensorPorts()
+		return err
+	}); err != nil {
+		return withExit(exitSensor, err)
+	}
+	if _, err := outputOptions(); err != nil {
+		return withExit(exitUsage, err)
+	}
+	loc, err := timestampLocation()
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+	outputLocation = loc
+	newWriter, err := newPointWriter(*format)
+	if err != nil {
+		return withExit(exitUsage, fmt.Errorf("bad -format: %w", err))
+	}
+	stdout := &stdoutWriter{newWriter(os.Stdout, true), newWriter}
+	var out pointio.PointWriter = stdout
+	if *quiet {
+		out = discardWriter{}
+	}
+	if *output != "" {
+		newFileWriter, err := newPointWriter(cmp.Or(*outputFormat, *format))
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("bad -output-format: %w", err))
+		}
+		gzipped, err := compressOutput(*output, *compress)
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("-compress: %w", err))
+		}
+		rf, err := openRotatingFile(*output, *rotateSize, *rotateInterval, gzipped, *compressFlush, newFileWriter)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("opening -output: %w", err))
+		}
+		defer rf.Close()
+		out = rf
+		if *tee && !*quiet {
+			out = teeWriter{stdout, rf}
+		}
+	}
+	defer out.Flush()
 
-		t1 = time.Now()
-		for i:=0; i < *samples; i++ {
-			point, err := sensor.Get()
+	staleness := *maxStaleness
+	if staleness <= 0 {
+		staleness = *latestMaxAge
+	}
+	if staleness <= 0 {
+		staleness = 5 * max(*interval, time.Duration(max(*samples, 1))*time.Second)
+	}
+	h := newHealth(staleness)
+	h.latestMaxAge = cmp.Or(max(*latestMaxAge, 0), staleness)
+	var observers []observer // shared by the readers
+	if airQ != nil {
+		// Before anything asking for the index.
+		observers = append(observers, airQ)
+		h.aqi = airQ.of
+	}
+	h.extended = *extendedColumns
+	var comb *combiner
+	if *combine != "off" {
+		if len(sensorPaths) > 1 {
+			comb = newCombiner(*combine, len(sensorPaths))
+			observers = append(observers, comb)
+			h.combining = true
+		} else {
+			slog.Warn("-combine needs several ports, so there's nothing to combine")
+		}
+	}
+	if smooth != nil {
+		// Before anything asking for the averages.
+		observers = append(observers, smooth)
+	}
+	if rates != nil {
+		// Before anything asking for the rates.
+		observers = append(observers, rates)
+	}
+	var hist *history
+	if *historySize > 0 && !*once && (ln != nil || *statsWindow > 0) {
+		hist = newHistory(*historySize)
+		observers = append(observers, hist)
+	}
+	var window *windowStats
+	if *statsWindow > 0 && !*once {
+		if *interval > 0 && int(*statsWindow / *interval)*len(sensorPaths) > *historySize {
+			slog.Warn("-history-size keeps fewer measurements than -stats-window takes", "history_size", *historySize, "stats_window", *statsWindow)
+		}
+		// After the history, for the measurements to be in it.
+		window = newWindowStats(hist, *statsWindow, *statsMinPoints)
+		observers = append(observers, window)
+	}
+	var (
+		sum              *summarizer
+		sumFile          *summaryFile
+		summaryObservers []summaryObserver
+	)
+	if *dailySummaries && !*once {
+		if *summaryOutput != "" {
+			sumFile, err = openSummaryFile(*summaryOutput, cmp.Or(*outputFormat, *format) == "jsonl")
 			if err != nil {
-				log.Printf("ERROR: sensor.Get: %v", err)
-				continue
+				return withExit(exitOutput, fmt.Errorf("opening -summary-output: %w", err))
 			}
-			pm10 += point.PM10
-			pm25 += point.PM25
-			if *unix {
-				ts = fmt.Sprintf("%v", point.Timestamp.Unix())
-			} else {
-				ts = point.Timestamp.Format(time.RFC3339)
+			defer sumFile.Close()
+		}
+		sum = newSummarizer(cmp.Or(outputLocation, time.Local), len(sensorPaths))
+		if *summaryResume {
+			if err := sum.resume(*output); err != nil {
+				slog.Warn("reading today's measurements back from -output for -daily-summary failed", "error", err)
 			}
 		}
+		observers = append(observers, sum)
+	}
+	t := new(trigger)
+	if *once {
+		*count = 1
+	} else if ln != nil {
+		b := newBroadcaster()
+		observers = append(observers, b)
+		srv, err := serveHTTP(ln, h, hist, b, t)
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("serving HTTP: %w", err))
+		}
+		defer shutdownHTTP(srv)
+	}
+
+	openPort := func(port string) (*sds011.Sensor, error) {
+		return openSensorAt(logger, port, sensorOptions(port)...)
+	}
+	if *simulate {
+		openPort = func(string) (*sds011.Sensor, error) { return newSimulatedSensor(logger) }
+	}
+	var readers []*reader
+	for _, port := range sensorPaths {
+		if port == replayPort {
+			// Replayed by runReplay, not read.
+			continue
+		}
+		h.setOpen(port, false)
+		var sensor *sds011.Sensor
+		err := wait.retry(ctx, "opening "+port, func() (err error) {
+			sensor, err = openPort(port)
+			return err
+		})
+		if err != nil {
+			if len(sensorPaths) == 1 {
+				return withExit(exitSensor, err)
+			}
+			// The others can still be read.
+			slog.Error("skipping sensor", "port", port, "error", err)
+			continue
+		}
+		h.setOpen(port, true)
+		r := newReader(port, sensor)
+		if *simulate {
+			r.reopen = nil
+		}
+		t.add(r.triggers)
+		readers = append(readers, r)
+	}
+	if len(readers) == 0 && *replayPath == "" {
+		return withExit(exitSensor, errors.New("none of the sensors could be opened"))
+	}
+	defer closeReaders(readers, h)
+
+	for _, r := range readers {
+		warnPeriod(r.sensor)
+		if *metadataMode != "off" {
+			runMeta.add(r.port, r.sensor)
+		}
+	}
+	logCalibration()
+
+	metricsOpts := []promexporter.Option{promexporter.WithNamespace(*metricsNamespace), promexporter.WithLabels(metricsConstLabels())}
+	if *metricsLegacyNames {
+		metricsOpts = append(metricsOpts, promexporter.WithLegacyNames())
+	}
+	if airQ != nil {
+		metricsOpts = append(metricsOpts, promexporter.WithAQI(airQ.of))
+	}
+	if smooth != nil {
+		metricsOpts = append(metricsOpts, promexporter.WithSmoothed(smooth.of))
+	}
+	if rates != nil {
+		metricsOpts = append(metricsOpts, promexporter.WithRates(rates.of))
+	}
+	if window != nil {
+		metricsOpts = append(metricsOpts, promexporter.WithWindowStats(window.of))
+	}
+	var cs sensorCollectors
+	for _, r := range readers {
+		c := promexporter.NewCollector(r.sensor, r.port, metricsOpts...)
+		cs = append(cs, c)
+		r.observers = append(r.observers, c)
+	}
+	var combinedObservers []observer
+	if comb != nil {
+		c := promexporter.NewCollector(nil, "", metricsOpts...)
+		cs = append(cs, c)
+		combinedObservers = append(combinedObservers, c, h.forCombined())
+	}
+	if len(cs) > 0 {
+		registry.MustRegister(cs)
+	}
+	if *emitMissing {
+		registry.MustRegister(missingMeasurements)
+	}
+
+	if *remoteWriteURL != "" && !*once {
+		rw, err := startRemoteWrite(remoteWriteFlags(), registry)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting remote write to -remote-write-url: %w", err))
+		}
+		defer rw.Close()
+		// After the collectors, for the new measurements to be in
+		// what's pushed.
+		for _, r := range readers {
+			r.observers = append(r.observers, rw)
+		}
+	}
+
+	var pg *pushgateway
+	if *pushgatewayURL != "" {
+		pg, err = startPushgateway(pushgatewayFlags(), registry)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting pushing to -pushgateway-url: %w", err))
+		}
+		// After the collectors, for the new measurements to be in
+		// what's pushed.
+		for _, r := range readers {
+			r.observers = append(r.observers, pg)
+		}
+	}
 
-		pm25 = pm25 / float64(*samples)
-		pm10 = pm10 / float64(*samples)
-		fmt.Fprintf(os.Stdout, "%s,%.2f,%.2f\n", ts, pm25, pm10)
-		pm10mt.Set(pm10)
-		pm25mt.Set(pm25)
+	if *otlp != "" && !*once {
+		stop, err := startOTLP(context.Background(), *otlp, readers, *tags)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting -otlp export: %w", err))
+		}
+		defer stop()
+	}
+	if *mqttBroker != "" && !*once {
+		pub, err := startMQTT(mqttFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting MQTT publishing to -mqtt-broker: %w", err))
+		}
+		defer pub.Close()
+		observers = append(observers, pub)
+		summaryObservers = append(summaryObservers, pub)
+	}
+
+	if *kafkaBrokers != "" && !*once {
+		kp, err := startKafka(kafkaFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting Kafka output to -kafka-brokers: %w", err))
+		}
+		defer kp.Close()
+		observers = append(observers, kp)
+	}
+
+	if *natsURL != "" && !*once {
+		np, err := startNATS(natsFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting NATS publishing to -nats-url: %w", err))
+		}
+		defer np.Close()
+		observers = append(observers, np)
+	}
+
+	if *redisAddr != "" && !*once {
+		rw, err := startRedis(redisFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting Redis output to -redis-addr: %w", err))
+		}
+		defer rw.Close()
+		observers = append(observers, rw)
+	}
 
-		if (interval > 1 * time.Second) {
-			sensor.Sleep()
-			time.Sleep(time.Until(t1.Add(interval)))
+	if *influxURL != "" && !*once {
+		iw, err := startInflux(influxFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting InfluxDB output to -influx-url: %w", err))
+		}
+		defer iw.Close()
+		observers = append(observers, iw)
+	}
+
+	if *graphiteAddr != "" && !*once {
+		gw, err := startGraphite(*graphiteNetwork, *graphiteAddr, *graphitePrefixFlag, *graphiteBuffer)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting Graphite output to -graphite-addr: %w", err))
+		}
+		defer gw.Close()
+		observers = append(observers, gw)
+	}
+
+	if *zabbixServer != "" && !*once {
+		zs, err := startZabbix(*zabbixServer, *zabbixHost)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting Zabbix output to -zabbix-server: %w", err))
+		}
+		defer zs.Close()
+		observers = append(observers, zs)
+	}
+
+	if *statsdAddr != "" && !*once {
+		sw, err := newStatsd(*statsdAddr, *statsdPrefix, *statsdTagsFormat, *tags)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting StatsD output to -statsd-addr: %w", err))
+		}
+		defer sw.Close()
+		observers = append(observers, sw)
+	}
+
+	var sl *syslogWriter
+	if *syslogAddr != "" && !*once {
+		var err error
+		sl, err = startSyslog(syslogFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting syslog output to -syslog-addr: %w", err))
+		}
+		defer sl.Close()
+		observers = append(observers, sl)
+	}
+
+	if len(*webhookURLs) > 0 && !*once {
+		hooks, err := startWebhooks(*webhookURLs, webhookFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting -webhook-url webhooks: %w", err))
+		}
+		defer hooks.Close()
+		observers = append(observers, hooks)
+		summaryObservers = append(summaryObservers, hooks)
+	}
+
+	if *postgresDSN != "" && !*once {
+		pw, err := startPostgres(postgresFlags())
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("starting PostgreSQL output to -postgres-dsn: %w", err))
+		}
+		defer pw.Close()
+		observers = append(observers, pw)
+	}
+
+	if *sqlitePath != "" {
+		store, err := openSQLite(*sqlitePath, time.Duration(*sqliteRetention))
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("opening -sqlite: %w", err))
+		}
+		defer store.Close()
+		observers = append(observers, store)
+	}
+
+	if (*alertPM25 > 0 || *alertPM10 > 0) && !*once {
+		alerts, err := startAlerts(alertFlags())
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("starting alerts: %w", err))
+		}
+		defer alerts.Close()
+		if sl != nil {
+			alerts.observers = append(alerts.observers, sl)
+		}
+		if alerts.cfg.device == sds011.CombinedDeviceID {
+			combinedObservers = append(combinedObservers, alerts)
+		} else {
+			observers = append(observers, alerts)
+		}
+	}
+
+	if *execCmd != "" && !*once {
+		e, err := startExec(execFlags())
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("starting -exec: %w", err))
+		}
+		defer e.Close()
+		observers = append(observers, e)
+	}
+
+	if *rawSamplesPath != "" {
+		var sensors []*sds011.Sensor
+		for _, r := range readers {
+			sensors = append(sensors, r.sensor)
+		}
+		rs, err := startRawSamples(*rawSamplesPath, sensors)
+		if err != nil {
+			return withExit(exitOutput, fmt.Errorf("opening -raw-samples: %w", err))
+		}
+		defer rs.Close()
+		observers = append(observers, rs)
+	}
+
+	if logToJournal {
+		observers = append(observers, measurementLogger{})
+	}
+
+	if sd := startSystemd(); sd != nil {
+		defer sd.Close()
+		observers = append(observers, sd)
+		for _, r := range readers {
+			r.dev = systemdDevice{r.dev, sd}
+		}
+	}
+
+	s := &shared{out: out, observers: observers}
+	if comb != nil {
+		comb.start(func(point sds011.Point) {
+			if err := s.Write(point); err != nil {
+				slog.Error("writing the combined measurement failed", "error", err)
+			}
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for _, o := range combinedObservers {
+				o.Observe(point)
+			}
+		})
+		defer comb.Close()
+	}
+	if sum != nil {
+		sum.start(func(ds dailySummary) {
+			if err := writeSummary(s, sumFile, ds); err != nil {
+				slog.Error("writing the daily summary failed", "date", ds.Date, "device_id", ds.DeviceID, "error", err)
+			}
+			for _, o := range summaryObservers {
+				o.ObserveSummary(ds)
+			}
+		})
+		defer sum.Close()
+	}
+	if !*once {
+		reloads, stop := loaded.watch()
+		defer stop()
+		reloadCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go applyReloads(reloadCtx, s, reloads, readers)
+	}
+
+	if !*once {
+		t.watch(ctx)
+	}
+	if *replayPath != "" {
+		err = runReplay(ctx, s, h)
+	} else {
+		err = runReaders(ctx, s, h, readers)
+	}
+	stopSignals()
+	slog.Info("shutting down")
+	if pg != nil {
+		err = errors.Join(err, pg.Close())
+	}
+	return err
+}
+
+// applyReloads applies the settings sent to reloads until ctx is
+// done, passing a changed -interval or -samples on to the readers,
+// and asks the readers to open their ports again. Nil settings are
+// left as they are.
+func applyReloads(ctx context.Context, s *shared, reloads <-chan map[string][]string, readers []*reader) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case values := <-reloads:
+			if values != nil {
+				changed := s.applySettings(values)
+				if slices.Contains(changed, "log-level") {
+					reloadLogLevel()
+				}
+				if slices.ContainsFunc(changed, func(name string) bool { return name == "interval" || name == "samples" || name == "tag" }) {
+					runMeta.reload()
+				}
+				if slices.Contains(changed, "tag") {
+					recordTags.set(*tags)
+					if metricsExported() || *otlp != "" || *mqttBroker != "" {
+						slog.Warn("the labels of the metrics, the OTLP attributes and -mqtt-topic keep the tags they started with, restart to apply them")
+					}
+				}
+				if slices.Contains(changed, "interval") || slices.Contains(changed, "samples") {
+					for _, r := range readers {
+						sendNewest(r.timings, timing{*interval, *samples})
+					}
+				}
+			}
+			for _, r := range readers {
+				sendNewest(r.reopens, struct{}{})
+			}
+		}
+	}
+}
+
+// runReaders runs the readers, each with its own observers and the
+// shared ones, until all of them are done, and returns the errors they
+// returned.
+func runReaders(ctx context.Context, s *shared, h *health, readers []*reader) error {
+	errs := make([]error, len(readers))
+	var wg sync.WaitGroup
+	for i, r := range readers {
+		observers := append([]observer{portObserver(r.port), s, h.forPort(r.port)}, r.observers...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := run(ctx, slog.With("port", r.port), r.dev, s, observers, r.controls)
+			if err != nil {
+				err = fmt.Errorf("reading %s: %w", r.port, err)
+				if len(readers) > 1 {
+					slog.Error("stopped reading a sensor", "port", r.port, "error", err)
+				}
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// mqttFlags returns the MQTT configuration set by the flags.
+func mqttFlags() mqttConfig {
+	return mqttConfig{
+		broker:    *mqttBroker,
+		topic:     tagTopic(*mqttTopic, *tags),
+		username:  *mqttUsername,
+		password:  *mqttPassword,
+		qos:       *mqttQoS,
+		retain:    *mqttRetain,
+		caFile:    *mqttCAFile,
+		discovery: *haDiscovery,
+	}
+}
+
+// remoteWriteFlags returns the remote-write configuration set by the flags.
+func remoteWriteFlags() remoteWriteConfig {
+	return remoteWriteConfig{
+		url:      *remoteWriteURL,
+		token:    cmp.Or(*remoteWriteToken, os.Getenv("REMOTE_WRITE_TOKEN")),
+		username: *remoteWriteUser,
+		password: cmp.Or(*remoteWritePassword, os.Getenv("REMOTE_WRITE_PASSWORD")),
+		queue:    *remoteWriteQueue,
+	}
+}
+
+// pushgatewayFlags returns the Pushgateway configuration set by the flags.
+func pushgatewayFlags() pushgatewayConfig {
+	return pushgatewayConfig{
+		url:          *pushgatewayURL,
+		job:          *pushgatewayJob,
+		username:     *pushgatewayUsername,
+		password:     cmp.Or(*pushgatewayPassword, os.Getenv("PUSHGATEWAY_PASSWORD")),
+		timeout:      *pushgatewayTimeout,
+		deleteOnExit: *pushgatewayDelete,
+		final:        *count > 0 || *duration > 0,
+	}
+}
+
+// kafkaFlags returns the Kafka configuration set by the flags.
+func kafkaFlags() kafkaConfig {
+	return kafkaConfig{
+		brokers:     strings.Split(*kafkaBrokers, ","),
+		topic:       *kafkaTopic,
+		acks:        *kafkaAcksFlag,
+		compression: *kafkaCompression,
+		sasl:        *kafkaSASL,
+		username:    *kafkaUsername,
+		password:    cmp.Or(*kafkaPassword, os.Getenv("KAFKA_PASSWORD")),
+		tls:         *kafkaTLS,
+		caFile:      *kafkaCAFile,
+	}
+}
+
+// natsFlags returns the NATS configuration set by the flags.
+func natsFlags() natsConfig {
+	return natsConfig{
+		url:       *natsURL,
+		subject:   *natsSubject,
+		credsFile: *natsCreds,
+		nkeyFile:  *natsNkey,
+		username:  *natsUsername,
+		password:  cmp.Or(*natsPassword, os.Getenv("NATS_PASSWORD")),
+		caFile:    *natsCAFile,
+		jetStream: *natsJetStream,
+		tags:      *tags,
+	}
+}
+
+// redisFlags returns the Redis configuration set by the flags.
+func redisFlags() redisConfig {
+	return redisConfig{
+		addr:       *redisAddr,
+		username:   *redisUsername,
+		password:   cmp.Or(*redisPassword, os.Getenv("REDIS_PASSWORD")),
+		db:         *redisDB,
+		ttl:        *redisTTL,
+		maxLen:     *redisMaxLen,
+		timeSeries: *redisTimeSeries,
+		retention:  *redisRetention,
+	}
+}
+
+// influxFlags returns the InfluxDB configuration set by the flags.
+func influxFlags() influxConfig {
+	return influxConfig{
+		url:           *influxURL,
+		token:         cmp.Or(*influxToken, os.Getenv("INFLUX_TOKEN")),
+		org:           *influxOrg,
+		bucket:        *influxBucket,
+		batchSize:     *influxBatchSize,
+		flushInterval: *influxFlushInterval,
+		tags:          *tags,
+	}
+}
+
+// webhookFlags returns the webhook configuration set by the flags.
+func webhookFlags() webhookConfig {
+	return webhookConfig{
+		timeout: *webhookTimeout,
+		token:   cmp.Or(*webhookToken, os.Getenv("WEBHOOK_TOKEN")),
+		retries: *webhookRetries,
+		batch:   *webhookBatch,
+		aqi:     *webhookAQI,
+	}
+}
+
+// postgresFlags returns the PostgreSQL configuration set by the flags.
+func postgresFlags() postgresConfig {
+	return postgresConfig{
+		dsn:           *postgresDSN,
+		migrate:       *postgresMigrate,
+		batchSize:     *postgresBatchSize,
+		flushInterval: *postgresFlush,
+		buffer:        *postgresBuffer,
+		tags:          *tags,
+	}
+}
+
+// execFlags returns the -exec configuration set by the flags.
+func execFlags() execConfig {
+	return execConfig{
+		cmd:         *execCmd,
+		mode:        *execMode,
+		timeout:     *execTimeout,
+		concurrency: *execConcurrency,
+	}
+}
+
+// alertFlags returns the alert configuration set by the flags.
+func alertFlags() alertConfig {
+	var values func(sds011.Point) (sds011.Point, bool)
+	switch *alertOn {
+	case "smoothed":
+		values = smooth.smoothed
+	case "rate":
+		values = rates.rated
+	}
+	return alertConfig{
+		pm25:        *alertPM25,
+		pm10:        *alertPM10,
+		hysteresis:  *alertHysteresis,
+		consecutive: *alertConsecutive,
+		cmd:         *alertCmd,
+		clearCmd:    *alertClearCmd,
+		url:         *alertURL,
+		device:      strings.ToLower(*alertDevice),
+		values:      values,
+		countOnly:   *replayPath != "",
+		syslog:      *syslogAddr != "",
+	}
+}
+
+// warnPeriod reads the working period of the sensor, for the metrics,
+// and warns if it has one with -interval, which it doesn't go with:
+// the sensor would sleep on its own schedule, and measurements would
+// time out while it does.
+func warnPeriod(sensor sds011.Device) {
+	s, ok := sensor.(*sds011.Sensor)
+	if !ok {
+		return
+	}
+	period, err := s.WorkingPeriod()
+	if err != nil || period == 0 || *interval <= 0 || *powerSave == "hardware" {
+		return
+	}
+	slog.Warn(`the sensor has a working period, which conflicts with -interval; set it to 0 with "sds011 period -set 0"`, "period", time.Duration(period)*time.Minute, "interval", *interval)
+}
+
+// outputOptions returns the options for the output writer set by the
+// flags.
+func outputOptions() ([]pointio.Option, error) {
+	var opts []pointio.Option
+	tsFormat, err := timestampFormatFlag()
+	if err != nil {
+		return nil, err
+	}
+	if tsFormat != "" {
+		opts = append(opts, pointio.WithTimestampFormat(tsFormat))
+	}
+	if *spread {
+		opts = append(opts, pointio.WithColumns(pointio.Spread))
+	}
+	if *rawColumns {
+		opts = append(opts, pointio.WithColumns(pointio.Raw))
+	}
+	if *extendedColumns {
+		opts = append(opts, pointio.WithColumns(pointio.Extended))
+	}
+	if *triggerColumn {
+		opts = append(opts, pointio.WithColumns(pointio.Trigger))
+	}
+	if *emitMissing {
+		opts = append(opts, pointio.WithColumns(pointio.Error), pointio.WithMissing(*missingPlaceholder))
+	}
+	if airQ != nil {
+		opts = append(opts, pointio.WithColumns(pointio.AQI), pointio.WithAQI(airQ.of))
+	}
+	if smooth != nil {
+		opts = append(opts, pointio.WithColumnFunc("pm2_5_smoothed", smooth.column(false)), pointio.WithColumnFunc("pm10_smoothed", smooth.column(true)))
+	}
+	if rates != nil {
+		opts = append(opts, pointio.WithColumnFunc("pm2_5_rate", rates.column(false)), pointio.WithColumnFunc("pm10_rate", rates.column(true)))
+	}
+	if len(sensorPaths) > 1 {
+		opts = append(opts, pointio.WithColumns(pointio.DeviceID), pointio.WithColumnFunc("port", devicePorts.of))
+		if *combine != "off" {
+			opts = append(opts, pointio.WithColumns(pointio.Sensors))
+		}
+	}
+	for _, t := range *tags {
+		opts = append(opts, pointio.WithColumnFunc(t.Key, func(sds011.Point) string { return t.Value }))
+	}
+	if *format == "collectd" || *outputFormat == "collectd" {
+		opt, err := collectdOption()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, opt)
+	}
+	switch *delimiter {
+	case "":
+	case ",", ";", "\t":
+		opts = append(opts, pointio.WithDelimiter(rune((*delimiter)[0])))
+	case `\t`:
+		opts = append(opts, pointio.WithDelimiter('\t'))
+	default:
+		return nil, fmt.Errorf("unsupported -delimiter %q", *delimiter)
+	}
+	return opts, nil
+}
+
+// timestampFormats are the names -timestamp-format takes, and the
+// formats pointio.WithTimestampFormat takes for them.
+var timestampFormats = map[string]string{
+	"rfc3339":     "",
+	"rfc3339nano": time.RFC3339Nano,
+	"unix":        "unix",
+	"unixmilli":   "unixmilli",
+}
+
+// timestampFormatFlag returns the timestamp format -timestamp-format
+// and -unix ask for, for pointio.WithTimestampFormat, or "" for RFC
+// 3339. A layout must have the date and the time of day, which is
+// checked by formatting a time with it and parsing it back, so that a
+// typo fails now rather than garbles every timestamp.
+func timestampFormatFlag() (string, error) {
+	format, named := timestampFormats[*timestampFormat]
+	if !named {
+		format = *timestampFormat
+		ref := time.Date(2001, 2, 3, 16, 5, 6, 0, time.UTC)
+		parsed, err := time.Parse(format, ref.Format(format))
+		if err != nil || !parsed.Truncate(time.Minute).Equal(ref.Truncate(time.Minute)) {
+			return "", fmt.Errorf("-timestamp-format %q isn't a name nor a Go layout with the date and time, like \"2006-01-02 15:04:05\"", format)
+		}
+	}
+	if *unix {
+		if format != "" && format != "unix" {
+			return "", errors.New("-unix and -timestamp-format don't go together")
+		}
+		format = "unix"
+	}
+	return format, nil
+}
+
+// outputLocation is the time zone of the timestamps of the points
+// written and observed, or nil for the local one.
+var outputLocation *time.Location
+
+// timestampLocation returns the time zone -utc or -timezone asks for,
+// or nil if neither is set.
+func timestampLocation() (*time.Location, error) {
+	switch {
+	case *utc && *timezone != "":
+		return nil, errors.New("-utc and -timezone don't go together")
+	case *utc:
+		return time.UTC, nil
+	case *timezone != "":
+		loc, err := time.LoadLocation(*timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown -timezone %q, or no time zone database to look it up in (install tzdata, or set $ZONEINFO): %w", *timezone, err)
+		}
+		return loc, nil
+	}
+	return nil, nil
+}
+
+// inOutputLocation returns point with its timestamp in outputLocation.
+// The timestamp loses its monotonic clock reading, so it's only done
+// to the points going out.
+func inOutputLocation(point sds011.Point) sds011.Point {
+	if outputLocation != nil {
+		point.Timestamp = point.Timestamp.In(outputLocation)
+	}
+	return point
+}
+
+// A timestampRounder rounds the timestamps of the points a reader
+// writes to -round. It isn't safe for concurrent use.
+type timestampRounder struct {
+	to   time.Duration
+	last time.Time // of the last point rounded
+}
+
+// round rounds the timestamp of point to the nearest multiple of
+// r.to, halfway values up, as time.Time.Round does. If that's no later
+// than the timestamp of the previous point, as when two come less
+// than r.to apart, it keeps its own timestamp, with a warning, so that
+// no two in a row get the same one. The times the measurements are
+// scheduled at are precise regardless.
+func (r *timestampRounder) round(logger *slog.Logger, point sds011.Point) sds011.Point {
+	if r.to <= 0 {
+		return point
+	}
+	rounded := point.Timestamp.Round(r.to)
+	if !r.last.IsZero() && !rounded.After(r.last) {
+		logger.Warn("the rounded timestamp repeats the previous one, keeping the precise one", "timestamp", point.Timestamp, "rounded", rounded, "round", r.to)
+		rounded = point.Timestamp
+	}
+	point.Timestamp, r.last = rounded, rounded
+	return point
+}
+
+// An observer is told about every measurement read, and every failure
+// to read one.
+type observer interface {
+	Observe(sds011.Point)
+	ObserveError(error)
+}
+
+// A reloader is an observer that takes the reloadable flags anew when
+// the -config file changes them, between two measurements.
+type reloader interface {
+	observer
+	reload()
+}
+
+// A sampleObserver is an observer that also wants every measurement
+// read, before it's averaged with the others of its -samples, with
+// which of them it is, from 1.
+type sampleObserver interface {
+	observer
+	ObserveSample(sample sds011.Point, n int)
+}
+
+// A durationObserver is an observer that also wants to know how long
+// every measurement took, from waking the sensor up for it, if it was,
+// or else from starting to read it.
+type durationObserver interface {
+	observer
+	ObserveDuration(time.Duration)
+}
+
+// A missingObserver is an observer that is also told about the points
+// -emit-missing writes for the measurements that failed, which the
+// others aren't.
+type missingObserver interface {
+	observer
+	ObserveMissing(sds011.Point)
+}
+
+var missingMeasurements = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sds011_missing_measurements_total",
+	Help: "Measurements that failed, for which -emit-missing wrote a row without values.",
+})
+
+// observedDevice is a device that tells the observers about every
+// failure to read a measurement, even of those that are averaged, and
+// the sample observers about every measurement read.
+type observedDevice struct {
+	sds011.Device
+	observers []observer
+	samples   *int // read so far
+}
+
+func (d observedDevice) GetContext(ctx context.Context) (*sds011.Point, error) {
+	point, err := d.Device.GetContext(ctx)
+	if err != nil && ctx.Err() == nil {
+		for _, o := range d.observers {
+			o.ObserveError(err)
+		}
+	}
+	if err == nil {
+		*d.samples++
+		for _, o := range d.observers {
+			if so, ok := o.(sampleObserver); ok {
+				so.ObserveSample(inOutputLocation(*point), *d.samples)
+			}
+		}
+	}
+	return point, err
+}
+
+// run reads measurements from the sensor until ctx is done, or it
+// took -count of them, or ran for -duration, and prints the averages
+// of every -samples of them. A measurement starts every -interval, or
+// right after the last one if it's 0. With -align, they start on the
+// boundaries of the interval, and the first waits for one too, unless
+// -align=after-first. With -power-save=hardware, the sensor's working
+// period times them instead (see powerSaver). Running out of -duration
+// doesn't cut the measurement in progress short. It returns nil when
+// ctx is done or it's finished, the error writing the output, or the
+// last error reading measurements if it finished without a single one
+// succeeding. A new timing sent to c.timings is taken before starting
+// a measurement. Something sent to c.triggers while waiting for the
+// next measurement makes it take one right away, marked as manual, and
+// then go on waiting; more sent while it does are taken to ask for the
+// same one. Something sent to c.reopens while waiting opens the port
+// again with c.reopen, so never in the middle of a measurement. The
+// first measurement after waking the sensor up starts by discarding
+// -discard-first of them.
+func run(ctx context.Context, logger *slog.Logger, sensor sds011.Device, out pointio.PointWriter, observers []observer, c controls) error {
+	dev := sensor
+	fresh := &wakeDiscard{n: *discardFirst}
+	sensor = wakingDevice{sensor, fresh}
+	if awake, _ := sensor.State(); !awake {
+		sensor.Awake()
+		if err := warmUp(ctx, sensor, *warmup); err != nil {
+			return nil
+		}
+	}
+	// Measurements are read with ctx, and waited for with next,
+	// which is also done when time is up.
+	next := ctx
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		next, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	tm := timing{*interval, *samples}
+	sched := newSchedule(c.power.apply(logger, tm.interval), *warmup, realClock{})
+	if d, ok := dev.(systemdDevice); ok {
+		sched.idle = d.sd.idle
+	}
+	sched.triggers, sched.reopens = c.triggers, c.reopens
+	sched.keepSkipped = *emitMissing
+	sched.align = align.on()
+	rounder := &timestampRounder{to: *roundTo}
+	// emit writes avg, and tells the observers about it and how long
+	// measuring it took since start.
+	emit := func(avg sds011.Point, start time.Time) error {
+		avg = rounder.round(logger, inOutputLocation(avg))
+		took := time.Since(start)
+		for _, o := range observers {
+			if do, ok := o.(durationObserver); ok {
+				do.ObserveDuration(took)
+			}
+		}
+		for _, o := range observers {
+			o.Observe(avg)
+		}
+		if err := out.Write(avg); err != nil {
+			return withExit(exitOutput, fmt.Errorf("writing output: %w", err))
+		}
+		return nil
+	}
+	// writeMissing writes a row for a measurement that failed with
+	// the kind of error given, or "skipped", due at the time given,
+	// and tells the missing observers about it, but not the others.
+	writeMissing := func(due time.Time, deviceID uint16, kind string) error {
+		missingMeasurements.Inc()
+		point := rounder.round(logger, inOutputLocation(sds011.Point{Timestamp: due, DeviceID: deviceID, Missing: kind}))
+		for _, o := range observers {
+			if mo, ok := o.(missingObserver); ok {
+				mo.ObserveMissing(point)
+			}
+		}
+		if err := out.Write(point); err != nil {
+			return withExit(exitOutput, fmt.Errorf("writing output: %w", err))
+		}
+		return nil
+	}
+	// measureNow takes a measurement out of the schedule, waking
+	// the sensor up for it if it's asleep.
+	measureNow := func() error {
+		logger.Info("measuring now, out of schedule")
+		if awake, _ := sensor.State(); !awake {
 			sensor.Awake()
+			if err := warmUp(ctx, sensor, *warmup); err != nil {
+				return nil
+			}
+		}
+		start := fresh.start()
+		avg, ok, err := sample(ctx, observedDevice{calibratedDevice{discardingDevice{sensor, fresh}}, observers, new(int)}, tm.samples)
+		drain(c.triggers)
+		if !ok {
+			if ctx.Err() == nil {
+				logger.Error("measuring out of schedule failed", "error", err, "kind", errorKind(err))
+			}
+			return nil
+		}
+		avg.Manual = true
+		return emit(avg, start)
+	}
+	// keepWaiting takes the measurements and opens the port again as
+	// asked for while waiting returned werr, going on waiting after
+	// each, and returns the error waiting finally returned, or the
+	// error writing a measurement.
+	keepWaiting := func(werr error) (error, error) {
+		for errors.Is(werr, errTriggered) || errors.Is(werr, errReopen) {
+			if errors.Is(werr, errReopen) {
+				reopenPort(next, logger, c.reopen)
+			} else if err := measureNow(); err != nil {
+				return nil, err
+			}
+			werr = sched.resume(next, sensor)
+		}
+		return werr, nil
+	}
+	if sched.align && *align != alignAfterFirst {
+		sched.next = sched.boundaryAfter(time.Now())
+		logger.Info("waiting for the first measurement", "at", sched.next)
+		werr, err := keepWaiting(sched.resume(next, sensor))
+		if err != nil || werr != nil {
+			return err
+		}
+	}
+	succeeded := false
+	failures := 0 // measurements in a row that failed
+	var deviceID uint16
+	for n := 1; ; n++ {
+		select {
+		case t := <-c.timings:
+			if t.interval != tm.interval {
+				sched.setInterval(c.power.apply(logger, t.interval))
+			}
+			tm = t
+		default:
 		}
+		for _, t := range sched.skipped {
+			if err := writeMissing(t, deviceID, "skipped"); err != nil {
+				return err
+			}
+		}
+		sched.skipped = sched.skipped[:0]
+		due := time.Now()
+		if sched.interval > 0 {
+			due = sched.next
+		}
+		start := fresh.start()
+		avg, ok, err := sample(ctx, observedDevice{calibratedDevice{discardingDevice{sensor, fresh}}, observers, new(int)}, tm.samples)
+		if ctx.Err() != nil {
+			return nil
+		}
+		switch {
+		case !ok:
+			// Only the first of a run of failures is worth an error,
+			// the sensor is being reconnected meanwhile.
+			failures++
+			attrs := []any{"error", err, "kind", errorKind(err), "attempt", failures}
+			if deviceID != 0 {
+				attrs = append(attrs, "device_id", fmt.Sprintf("%04x", deviceID))
+			}
+			if failures == 1 {
+				logger.Error("reading measurements failed, retrying", attrs...)
+			} else {
+				logger.Debug("reading measurements failed again", attrs...)
+			}
+			if *emitMissing {
+				if err := writeMissing(due, deviceID, errorKind(err)); err != nil {
+					return err
+				}
+			}
+		case err != nil:
+			logger.Warn("some samples failed", "error", err, "kind", errorKind(err), "device_id", fmt.Sprintf("%04x", avg.DeviceID))
+		}
+		if ok {
+			if failures > 0 {
+				logger.Info("reading measurements again", "device_id", fmt.Sprintf("%04x", avg.DeviceID), "failures", failures)
+				failures = 0
+			}
+			deviceID = avg.DeviceID
+			if err := emit(avg, start); err != nil {
+				return err
+			}
+			succeeded = true
+		}
+		finished := n == *count || next.Err() != nil
+		if !finished {
+			werr, err := keepWaiting(pause(next, sched, sensor, failures))
+			if err != nil {
+				return err
+			}
+			if werr != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				finished = true
+			}
+		}
+		if finished {
+			if !succeeded {
+				return withExit(exitSensor, fmt.Errorf("all %d measurements failed, the last with: %w", n, err))
+			}
+			return nil
+		}
+	}
+}
+
+// sample reads n measurements from the sensor and returns their
+// average, timestamped with the middle of the time they were read
+// over, with the raw values averaged the same way. The average is of
+// the measurements read successfully, and ok is false if there were
+// none. err is the error that made some of them fail, if any did.
+func sample(ctx context.Context, sensor sds011.Device, n int) (avg sds011.Point, ok bool, err error) {
+	agg := sds011.Aggregator{Trim: *trim / 100}
+	raw := sds011.Aggregator{Trim: *trim / 100}
+	summary, err := agg.ReadN(ctx, rawDevice{sensor, &raw}, n)
+	if summary.Count == 0 {
+		return sds011.Point{}, false, err
+	}
+	avg = sds011.Point{
+		PM25:       aggregateOf(summary.PM25),
+		PM10:       aggregateOf(summary.PM10),
+		DeviceID:   summary.DeviceID,
+		Timestamp:  summary.Start.Add(summary.Span() / 2),
+		Samples:    summary.Count,
+		PM25StdDev: summary.PM25.StdDev,
+		PM10StdDev: summary.PM10.StdDev,
+		PM25Min:    summary.PM25.Min,
+		PM25Max:    summary.PM25.Max,
+		PM10Min:    summary.PM10.Min,
+		PM10Max:    summary.PM10.Max,
+	}
+	rawSummary := raw.Summary()
+	avg.PM25Raw = uint16(math.Round(aggregateOf(rawSummary.PM25)))
+	avg.PM10Raw = uint16(math.Round(aggregateOf(rawSummary.PM10)))
+	return avg, true, err
+}
+
+// aggregates are the values of -aggregate.
+var aggregates = []string{"mean", "median", "trimmed"}
+
+// aggregateOf returns the value -aggregate picks out of d.
+func aggregateOf(d sds011.Distribution) float64 {
+	switch *aggregate {
+	case "median":
+		return d.Median
+	case "trimmed":
+		return d.TrimmedMean
 	}
+	return d.Mean
 }
@@ -0,0 +1,87 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// newRegistry makes the metrics of the sinks started by the test
+// registered with a registry of their own, so that they can be started
+// again by other tests.
+func newRegistry(t *testing.T) {
+	t.Helper()
+	old := registry
+	registry = prometheus.NewRegistry()
+	t.Cleanup(func() { registry = old })
+}
+
+// counterValue returns the value of c. The counters of the sinks are
+// shared by the tests, so they should look at how much they grew.
+func counterValue(c prometheus.Counter) float64 {
+	var m dto.Metric
+	c.Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func TestTimestampRounder(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, err := time.Parse("15:04:05.000", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	for _, tc := range []struct {
+		name  string
+		to    time.Duration
+		in    []string
+		want  []string
+		warns int
+	}{
+		{"minutes", time.Minute, []string{"10:00:03.000", "10:01:02.000", "10:02:04.000"}, []string{"10:00:00.000", "10:01:00.000", "10:02:00.000"}, 0},
+		{"up", time.Minute, []string{"10:00:58.000", "10:01:45.000"}, []string{"10:01:00.000", "10:02:00.000"}, 0},
+		{"half up", time.Minute, []string{"10:00:30.000", "10:02:29.999", "10:03:30.000"}, []string{"10:01:00.000", "10:02:00.000", "10:04:00.000"}, 0},
+		{"seconds", time.Second, []string{"10:00:00.499", "10:00:01.500", "10:00:02.501"}, []string{"10:00:00.000", "10:00:02.000", "10:00:03.000"}, 0},
+		// The second rounds to the same minute as the first, so it
+		// keeps its own time, and the third rounds past it.
+		{"duplicate", time.Minute, []string{"10:00:10.000", "10:00:20.000", "10:01:10.000"}, []string{"10:00:00.000", "10:00:20.000", "10:01:00.000"}, 1},
+		{"duplicates", time.Minute, []string{"10:00:00.000", "10:00:01.000", "10:00:02.000"}, []string{"10:00:00.000", "10:00:01.000", "10:00:02.000"}, 2},
+		{"off", 0, []string{"10:00:03.123", "10:00:03.123"}, []string{"10:00:03.123", "10:00:03.123"}, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var log bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&log, nil))
+			r := &timestampRounder{to: tc.to}
+			for i, in := range tc.in {
+				got := r.round(logger, sds011.Point{PM25: float64(i), Timestamp: at(in)})
+				if want := at(tc.want[i]); !got.Timestamp.Equal(want) || got.PM25 != float64(i) {
+					t.Errorf("round(%v) = %v at %v, want %v at %v", in, got.PM25, got.Timestamp.Format("15:04:05.000"), i, tc.want[i])
+				}
+			}
+			if got := strings.Count(log.String(), "level=WARN"); got != tc.warns {
+				t.Errorf("warned %d times, want %d:\n%s", got, tc.warns, log.String())
+			}
+		})
+	}
+}
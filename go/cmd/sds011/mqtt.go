@@ -0,0 +1,309 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+const (
+	// mqttQueueSize is how many measurements wait to be published
+	// while the broker is unreachable. When the queue is full, the
+	// oldest one is dropped.
+	mqttQueueSize = 64
+
+	// mqttPublishTimeout is how long publishing a measurement may
+	// take before it counts as failed.
+	mqttPublishTimeout = 10 * time.Second
+)
+
+var (
+	mqttPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_mqtt_published_total",
+		Help: "Measurements published to the MQTT broker.",
+	})
+	mqttFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_mqtt_failures_total",
+		Help: "Measurements that failed to be published to the MQTT broker.",
+	})
+	mqttDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_mqtt_dropped_total",
+		Help: "Measurements dropped because the MQTT queue was full.",
+	})
+)
+
+// mqttConfig says where and how measurements are published.
+type mqttConfig struct {
+	broker             string
+	topic              string // with the tags of its placeholders put in
+	username, password string
+	qos                int
+	retain             bool
+	caFile             string
+
+	// discovery makes the publisher announce the sensor to Home
+	// Assistant (see homeassistant.go).
+	discovery bool
+}
+
+// statusTopic is where the publisher says if it's online, retained,
+// with the broker saying it's offline when the connection is lost.
+func (cfg mqttConfig) statusTopic() string {
+	return cfg.topic + "/status"
+}
+
+// summaryTopic is where the publisher publishes the daily summaries of
+// -daily-summary.
+func (cfg mqttConfig) summaryTopic() string {
+	return cfg.topic + "/summary"
+}
+
+// An mqttMessage is a message waiting to be published.
+type mqttMessage struct {
+	topic   string
+	retain  bool
+	payload []byte
+}
+
+// mqttPublisher publishes measurements to an MQTT broker. It is an
+// observer.
+type mqttPublisher struct {
+	client mqtt.Client
+	cfg    mqttConfig
+	out    *outbox[mqttMessage]
+
+	// mu is held when announcing the sensor, which happens both when
+	// measurements are observed and from the client's callbacks.
+	mu sync.Mutex
+	// announcedID is the device ID the sensor was last announced to
+	// Home Assistant with, if announced is true.
+	announcedID uint16
+	announced   bool
+
+	// connected is signaled every time the client connects.
+	connected chan struct{}
+}
+
+// startMQTT connects to the broker in the background and starts
+// publishing. The client reconnects on its own whenever the
+// connection is lost.
+func startMQTT(cfg mqttConfig) (*mqttPublisher, error) {
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	p := &mqttPublisher{
+		cfg:       cfg,
+		out:       newOutbox[mqttMessage](mqttQueueSize, mqttDropped, "MQTT"),
+		connected: make(chan struct{}, 1),
+	}
+	opts.SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(cfg.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			slog.Info("connected to the MQTT broker", "broker", cfg.broker)
+			c.Publish(cfg.statusTopic(), 1, true, "online")
+			if cfg.discovery {
+				p.rediscover(c)
+			}
+			select {
+			case p.connected <- struct{}{}:
+			default:
+			}
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("lost the connection to the MQTT broker, reconnecting", "broker", cfg.broker, "error", err)
+		})
+	registry.MustRegister(mqttPublished, mqttFailures, mqttDropped)
+
+	p.client = mqtt.NewClient(opts)
+	// With SetConnectRetry, the token is done only once connected,
+	// which may be never, so it isn't waited for.
+	p.client.Connect()
+	p.out.start(p.publish)
+	return p, nil
+}
+
+// clientOptions returns the options of a client connecting to the
+// broker as cfg says.
+func (cfg mqttConfig) clientOptions() (*mqtt.ClientOptions, error) {
+	if cfg.qos < 0 || cfg.qos > 2 {
+		return nil, fmt.Errorf("-mqtt-qos must be 0, 1 or 2, not %d", cfg.qos)
+	}
+	if cfg.topic == "" {
+		return nil, fmt.Errorf("-mqtt-topic is empty")
+	}
+	if m := natsPlaceholder.FindString(cfg.topic); m != "" {
+		return nil, fmt.Errorf("-mqtt-topic %q has %s, which isn't a -tag", cfg.topic, m)
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.broker).
+		SetClientID(mqttClientID()).
+		SetUsername(cfg.username).
+		SetPassword(cfg.password)
+	if tlsBroker(cfg.broker) {
+		tlsConfig, err := brokerTLSConfig("-mqtt-ca-file", cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	} else if cfg.caFile != "" {
+		return nil, fmt.Errorf("-mqtt-ca-file needs an ssl:// broker, not %q", cfg.broker)
+	}
+	return opts, nil
+}
+
+// tagTopic returns topic with <key> replaced by the value of the tag
+// key, with the wildcards, which can't be in the topics published to,
+// replaced by '_'. Placeholders of no tag are left in.
+func tagTopic(topic string, tags []pointio.Tag) string {
+	return natsPlaceholder.ReplaceAllStringFunc(topic, func(placeholder string) string {
+		for _, t := range tags {
+			if t.Key == placeholder[1:len(placeholder)-1] {
+				return strings.NewReplacer("+", "_", "#", "_").Replace(t.Value)
+			}
+		}
+		return placeholder
+	})
+}
+
+// mqttClientID returns a client ID unlikely to be used by any other
+// client of the broker.
+func mqttClientID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("sds011-%v-%d", host, os.Getpid())
+}
+
+// tlsBroker returns true if the broker URL says to connect with TLS.
+func tlsBroker(broker string) bool {
+	for _, scheme := range []string{"ssl://", "tls://", "mqtts://", "wss://"} {
+		if strings.HasPrefix(broker, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerTLSConfig returns the TLS configuration for connecting to a
+// broker, trusting the certificates in caFile, which the flag named
+// gives, or the system's if it's empty.
+func brokerTLSConfig(flagName, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", flagName, err)
+	}
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s %v", flagName, caFile)
+	}
+	return cfg, nil
+}
+
+func (p *mqttPublisher) Observe(point sds011.Point) {
+	payload, err := json.Marshal(point)
+	if err != nil {
+		slog.Error("encoding the MQTT payload", "error", err)
+		return
+	}
+	if p.cfg.discovery {
+		p.announce(point.DeviceID)
+		p.out.put(p.haStates(point)...)
+	}
+	p.out.put(mqttMessage{p.cfg.topic, p.cfg.retain, payload})
+}
+
+func (p *mqttPublisher) ObserveError(error) {}
+
+// ObserveSummary publishes a daily summary to the summary topic.
+func (p *mqttPublisher) ObserveSummary(ds dailySummary) {
+	payload, err := json.Marshal(ds)
+	if err != nil {
+		slog.Error("encoding the MQTT payload", "error", err)
+		return
+	}
+	p.out.put(mqttMessage{p.cfg.summaryTopic(), p.cfg.retain, payload})
+}
+
+// publish publishes the queued messages until the queue is closed.
+// While the client is disconnected, it waits, and the messages stay
+// queued.
+func (p *mqttPublisher) publish(msgs <-chan mqttMessage) {
+	for msg := range msgs {
+		if !p.waitConnected() {
+			mqttDropped.Inc()
+			continue
+		}
+		token := p.client.Publish(msg.topic, byte(p.cfg.qos), msg.retain, msg.payload)
+		var err error
+		select {
+		case <-token.Done():
+			err = token.Error()
+		case <-time.After(mqttPublishTimeout):
+			err = fmt.Errorf("timed out after %v", mqttPublishTimeout)
+		case <-p.out.stop:
+			err = errors.New("shutting down")
+		}
+		if err != nil {
+			mqttFailures.Inc()
+			slog.Error("publishing to MQTT", "topic", msg.topic, "error", err)
+			continue
+		}
+		mqttPublished.Inc()
+	}
+}
+
+// waitConnected waits until the client is connected. It returns false
+// if it was stopped first.
+func (p *mqttPublisher) waitConnected() bool {
+	for !p.client.IsConnectionOpen() {
+		select {
+		case <-p.connected:
+		case <-p.out.stop:
+			return false
+		}
+	}
+	return true
+}
+
+// Close publishes what's left in the queue, giving up on it after
+// shutdownTimeout, says it's offline, and disconnects.
+func (p *mqttPublisher) Close() {
+	p.out.close()
+	if p.client.IsConnectionOpen() {
+		// Disconnecting cleanly doesn't make the broker publish the
+		// will.
+		p.client.Publish(p.cfg.statusTopic(), 1, true, "offline").WaitTimeout(shutdownTimeout)
+	}
+	p.client.Disconnect(250)
+}
@@ -0,0 +1,293 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+const (
+	// natsQueueSize is how many measurements wait to be published
+	// while the server is unreachable. When the queue is full, the
+	// oldest one is dropped.
+	natsQueueSize = 64
+
+	// natsPublishTimeout is how long JetStream may take to
+	// acknowledge a measurement.
+	natsPublishTimeout = 5 * time.Second
+
+	// natsRetries is how many times publishing a measurement to
+	// JetStream is retried before it's dropped.
+	natsRetries = 5
+)
+
+var (
+	natsPublished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_nats_published_total",
+		Help: "Measurements published to NATS.",
+	})
+	natsFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_nats_failures_total",
+		Help: "Failed attempts to publish a measurement to NATS.",
+	})
+	natsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_nats_dropped_total",
+		Help: "Measurements dropped because publishing them to NATS failed, or too many were waiting.",
+	})
+)
+
+// natsPlaceholder matches the placeholders of -nats-subject.
+var natsPlaceholder = regexp.MustCompile(`<([^<>]+)>`)
+
+// natsConfig says where and how measurements are published.
+type natsConfig struct {
+	url                string
+	subject            string // with placeholders
+	credsFile          string
+	nkeyFile           string
+	username, password string
+	caFile             string
+	jetStream          bool
+	tags               []pointio.Tag
+}
+
+// natsPublisher publishes measurements to NATS, as JSON, on subjects
+// in which <device_id> stands for the device ID, <hostname> for the
+// host name, and <key> for the value of the -tag key. With JetStream,
+// it waits for the server to acknowledge every measurement, retrying if
+// it doesn't. It is an observer.
+type natsPublisher struct {
+	cfg  natsConfig
+	host string
+	conn *nats.Conn
+	js   jetstream.JetStream // nil without cfg.jetStream
+	out  *outbox[*nats.Msg]
+
+	mu   sync.Mutex
+	tags []pointio.Tag
+}
+
+// startNATS connects to the server in the background and starts
+// publishing. The connection is made again whenever it's lost.
+func startNATS(cfg natsConfig) (*natsPublisher, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	// The domain isn't wanted, and its dots would add tokens.
+	host, _, _ = strings.Cut(host, ".")
+	p := &natsPublisher{
+		cfg:  cfg,
+		host: host,
+		tags: cfg.tags,
+		out:  newOutbox[*nats.Msg](natsQueueSize, natsDropped, "NATS"),
+	}
+	if p.conn, err = nats.Connect(cfg.url, opts...); err != nil {
+		return nil, err
+	}
+	if cfg.jetStream {
+		if p.js, err = jetstream.New(p.conn); err != nil {
+			p.conn.Close()
+			return nil, err
+		}
+	}
+	registry.MustRegister(natsPublished, natsFailures, natsDropped)
+	p.out.start(p.publish)
+	return p, nil
+}
+
+// check returns an error if the subject of cfg doesn't make sense.
+// The rest is checked by options.
+func (cfg natsConfig) check() error {
+	if cfg.subject == "" {
+		return errors.New("-nats-subject is empty")
+	}
+	for _, m := range natsPlaceholder.FindAllStringSubmatch(cfg.subject, -1) {
+		if m[1] != "device_id" && m[1] != "hostname" && !hasTag(cfg.tags, m[1]) {
+			return fmt.Errorf("-nats-subject %q has %s, which is neither <device_id>, <hostname> nor a -tag", cfg.subject, m[0])
+		}
+	}
+	return nil
+}
+
+// options returns the options of a connection as cfg says.
+func (cfg natsConfig) options() ([]nats.Option, error) {
+	opts := []nats.Option{
+		nats.Name("sds011"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+		nats.ConnectHandler(func(c *nats.Conn) {
+			slog.Info("connected to NATS", "server", c.ConnectedUrlRedacted())
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			slog.Info("connected to NATS again", "server", c.ConnectedUrlRedacted())
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("lost the connection to NATS, reconnecting", "error", err)
+			}
+		}),
+	}
+	switch {
+	case cfg.credsFile != "" && cfg.nkeyFile != "":
+		return nil, errors.New("-nats-creds and -nats-nkey don't go together")
+	case cfg.credsFile != "":
+		opts = append(opts, nats.UserCredentials(cfg.credsFile))
+	case cfg.nkeyFile != "":
+		opt, err := nats.NkeyOptionFromSeed(cfg.nkeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading -nats-nkey: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+	if cfg.username != "" {
+		opts = append(opts, nats.UserInfo(cfg.username, cfg.password))
+	}
+	if cfg.caFile != "" || strings.HasPrefix(cfg.url, "tls://") {
+		tlsConfig, err := brokerTLSConfig("-nats-ca-file", cfg.caFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	return opts, nil
+}
+
+// hasTag returns true if there's a tag with the given key.
+func hasTag(tags []pointio.Tag, key string) bool {
+	for _, t := range tags {
+		if t.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// subject returns the subject to publish point on.
+func (p *natsPublisher) subject(point sds011.Point) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return natsPlaceholder.ReplaceAllStringFunc(p.cfg.subject, func(placeholder string) string {
+		switch key := placeholder[1 : len(placeholder)-1]; key {
+		case "device_id":
+			return fmt.Sprintf("%04x", point.DeviceID)
+		case "hostname":
+			return natsToken(p.host)
+		default:
+			for _, t := range p.tags {
+				if t.Key == key {
+					return natsToken(t.Value)
+				}
+			}
+		}
+		return placeholder
+	})
+}
+
+// natsToken returns s with the dots, wildcards and spaces, which
+// can't be in a token of a subject, replaced by '_'.
+func natsToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '*' || r == '>' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// reload takes the -tag tags anew, for the measurements to come.
+func (p *natsPublisher) reload() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tags = *tags
+}
+
+func (p *natsPublisher) Observe(point sds011.Point) {
+	payload, err := json.Marshal(point)
+	if err != nil {
+		slog.Error("encoding the NATS payload", "error", err)
+		return
+	}
+	msg := nats.NewMsg(p.subject(point))
+	msg.Data = payload
+	if p.js != nil {
+		// So that JetStream stores a measurement once, however many
+		// times it's retried.
+		msg.Header.Set(jetstream.MsgIDHeader, fmt.Sprintf("%04x-%d", point.DeviceID, point.Timestamp.UnixNano()))
+	}
+	p.out.put(msg)
+}
+
+func (p *natsPublisher) ObserveError(error) {}
+
+// publish publishes the queued measurements until the queue is
+// closed. While disconnected, the connection buffers what's published
+// without JetStream, and JetStream publishing is retried with backoff.
+func (p *natsPublisher) publish(msgs <-chan *nats.Msg) {
+	for msg := range msgs {
+		var err error
+		if p.js != nil {
+			err = deliver(p.out, natsRetries, natsFailures, "publishing to NATS JetStream", func() error {
+				ctx, cancel := context.WithTimeout(context.Background(), natsPublishTimeout)
+				defer cancel()
+				if _, err := p.js.PublishMsg(ctx, msg); err != nil {
+					return &retryableError{err: err}
+				}
+				return nil
+			})
+		} else if err = p.conn.PublishMsg(msg); err != nil {
+			natsFailures.Inc()
+		}
+		if err != nil {
+			natsDropped.Inc()
+			slog.Error("publishing to NATS failed, dropped the measurement", "subject", msg.Subject, "error", err)
+			continue
+		}
+		natsPublished.Inc()
+	}
+}
+
+// Close publishes what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects.
+func (p *natsPublisher) Close() {
+	p.out.close()
+	if p.conn.IsConnected() {
+		if err := p.conn.FlushTimeout(shutdownTimeout); err != nil {
+			slog.Warn("flushing the NATS connection", "error", err)
+		}
+	}
+	p.conn.Close()
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+
+	"github.com/ryszard/sds011/go/sds011/pointio"
+	"github.com/ryszard/sds011/go/sds011/sds011otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// startOTLP starts pushing the metrics of the readers' sensors to the
+// OTLP/gRPC collector at endpoint, with tags as attributes, adding the
+// instruments to their observers. The returned function flushes the
+// metrics and stops.
+func startOTLP(ctx context.Context, endpoint string, readers []*reader, tags []pointio.Tag) (func(), error) {
+	exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpoint(endpoint), otlpmetricgrpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)))
+	meter := provider.Meter("github.com/ryszard/sds011")
+	var attrs []attribute.KeyValue
+	for _, t := range tags {
+		attrs = append(attrs, attribute.String(t.Key, t.Value))
+	}
+	var insts []*sds011otel.Instruments
+	stop := func() {
+		for _, inst := range insts {
+			inst.Close()
+		}
+		provider.Shutdown(context.Background())
+	}
+	for _, r := range readers {
+		inst, err := sds011otel.New(meter, r.sensor, r.port, sds011otel.WithAttributes(attrs...))
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		insts = append(insts, inst)
+		r.observers = append(r.observers, inst)
+	}
+	return stop, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An outbox holds what is waiting to be sent somewhere by a goroutine
+// of its own, so that a slow or unreachable destination doesn't hold
+// up reading the sensor. It has a fixed size, and when it's full, the
+// oldest item is dropped to make room.
+type outbox[T any] struct {
+	items   chan T
+	dropped prometheus.Counter
+	what    string // where the items go, for the logs
+
+	mu     sync.Mutex // held when sending to items
+	closed bool
+
+	// stop is closed when close runs out of time to send what's
+	// left, and finished when sending is over.
+	stop, finished chan struct{}
+}
+
+// newOutbox returns an outbox holding up to size items, which counts
+// the ones it drops in dropped.
+func newOutbox[T any](size int, dropped prometheus.Counter, what string) *outbox[T] {
+	return &outbox[T]{
+		items:    make(chan T, size),
+		dropped:  dropped,
+		what:     what,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// start calls send in a new goroutine. It should send the items until
+// the channel is closed, and give up on them when stop is.
+func (o *outbox[T]) start(send func(items <-chan T)) {
+	go func() {
+		defer close(o.finished)
+		send(o.items)
+	}()
+}
+
+// put adds items to the outbox, unless it's closed.
+func (o *outbox[T]) put(items ...T) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	for _, item := range items {
+		if sendNewest(o.items, item) {
+			o.dropped.Inc()
+			slog.Warn(o.what + " queue full, dropped the oldest item")
+		}
+	}
+}
+
+// sleep waits for d, and returns false if stopped first.
+func (o *outbox[T]) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-o.stop:
+		return false
+	}
+}
+
+// stopped returns true if close ran out of time.
+func (o *outbox[T]) stopped() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops taking items, and waits for what's left to be sent,
+// giving up on it after shutdownTimeout.
+func (o *outbox[T]) close() {
+	o.mu.Lock()
+	o.closed = true
+	close(o.items)
+	o.mu.Unlock()
+	select {
+	case <-o.finished:
+	case <-time.After(shutdownTimeout):
+		close(o.stop)
+		<-o.finished
+	}
+}
+
+// sendNewest sends v to ch without blocking, dropping the oldest
+// element waiting in ch if it's full. It returns true if something
+// was dropped. It must be the only sender on ch.
+func sendNewest[T any](ch chan T, v T) (dropped bool) {
+	for {
+		select {
+		case ch <- v:
+			return dropped
+		default:
+		}
+		select {
+		case <-ch:
+			dropped = true
+		default:
+		}
+	}
+}
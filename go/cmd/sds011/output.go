@@ -0,0 +1,517 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// outputBacklog is how many measurements a rotatingFile keeps while
+// writing them fails, to write them once it works again.
+const outputBacklog = 1000
+
+// newPointWriter returns a function making the writers for format,
+// with the options the flags ask for and extra, starting with a header
+// if the flags ask for one and fresh is true, meaning that nothing was
+// written to w before.
+func newPointWriter(format string, extra ...pointio.Option) (func(w io.Writer, fresh bool) pointio.PointWriter, error) {
+	newWriter := func(w io.Writer, fresh bool) (pointio.PointWriter, error) {
+		opts, err := outputOptions()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts[:len(opts):len(opts)], extra...)
+		opts = append(opts, jsonOptions(fresh)...)
+		if *header && fresh {
+			opts = append(opts, pointio.WithHeader())
+		}
+		return pointio.NewWriter(format, w, opts...)
+	}
+	// Check the format now, rather than when writing the first point.
+	if _, err := newWriter(io.Discard, false); err != nil {
+		return nil, err
+	}
+	return func(w io.Writer, fresh bool) pointio.PointWriter {
+		pw, _ := newWriter(w, fresh)
+		return pw
+	}, nil
+}
+
+// collectdOption returns the option of -format=collectd, with the
+// host and interval collectd's exec plugin passes in
+// $COLLECTD_HOSTNAME and $COLLECTD_INTERVAL, or else the host name and
+// -interval, or how long a measurement of -samples takes without it.
+func collectdOption() (pointio.Option, error) {
+	host := os.Getenv("COLLECTD_HOSTNAME")
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("getting the host name for -format=collectd: %w", err)
+		}
+	}
+	every := *interval
+	if every <= 0 {
+		every = time.Duration(max(*samples, 1)) * time.Second
+	}
+	if s := os.Getenv("COLLECTD_INTERVAL"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("bad $COLLECTD_INTERVAL %q, want a number of seconds", s)
+		}
+		every = time.Duration(v * float64(time.Second))
+	}
+	return pointio.WithCollectd(host, every), nil
+}
+
+// A rotatingFile writes points to a file, opened for appending, and
+// rotates it: closes it, renames it with a timestamp suffix, and
+// starts a new one. It rotates when the file grows past maxSize, when
+// it gets older than maxAge, or on SIGHUP, always between two points,
+// so none are lost. If the file was already moved away when SIGHUP
+// came, for example by logrotate, it is just opened again. When
+// writing fails, say because the disk is full, it logs it and keeps
+// up to outputBacklog points to write before the next ones, rather
+// than fail.
+//
+// If compress is set, the file is gzipped, every time it's opened as
+// another gzip member, and its size is that compressed.
+type rotatingFile struct {
+	path      string
+	maxSize   int64         // 0 for no limit
+	maxAge    time.Duration // 0 for no limit
+	newWriter func(w io.Writer, fresh bool) pointio.PointWriter
+	compress  bool
+	// flushEvery is how long compressed points may wait to be written
+	// out, 0 for not at all.
+	flushEvery time.Duration
+
+	mu      sync.Mutex
+	f       *countingFile
+	gz      *gzip.Writer // writing to f, if compress is set
+	w       pointio.PointWriter
+	opened  time.Time
+	flushed time.Time
+	hup     chan os.Signal
+	// backlog are the points that failed to be written, dropped how
+	// many didn't fit in it.
+	backlog []sds011.Point
+	dropped int
+}
+
+// A countingFile counts the bytes written to the file.
+type countingFile struct {
+	*os.File
+	size int64
+}
+
+func (f *countingFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, compress bool, flushEvery time.Duration, newWriter func(io.Writer, bool) pointio.PointWriter) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		newWriter:  newWriter,
+		compress:   compress,
+		flushEvery: flushEvery,
+		hup:        make(chan os.Signal, 1),
+	}
+	if compress {
+		if err := rf.moveUnfinished(); err != nil {
+			return nil, err
+		}
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	signal.Notify(rf.hup, syscall.SIGHUP)
+	return rf, nil
+}
+
+// moveUnfinished renames the compressed file as if rotating it if its
+// last gzip member wasn't finished, say because of a power failure, as
+// what's appended to it then couldn't be read back. What's in it can,
+// up to where it stops.
+func (rf *rotatingFile) moveUnfinished() error {
+	f, err := os.Open(rf.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.Size() == 0 {
+		return err
+	}
+	zr, err := gzip.NewReader(f)
+	if err == nil {
+		_, err = io.Copy(io.Discard, zr)
+	}
+	if err == nil {
+		return nil
+	}
+	to, rerr := rf.rotatedPath()
+	if rerr != nil {
+		return rerr
+	}
+	slog.Warn("the compressed output wasn't finished, moving it away", "path", rf.path, "to", to, "error", err)
+	return os.Rename(rf.path, to)
+}
+
+// open opens the file, creating it if needed.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = &countingFile{File: f, size: info.Size()}
+	rf.startWriter(rf.f.size == 0)
+	rf.opened = time.Now()
+	return nil
+}
+
+// startWriter starts writing to the file with a new writer, and a new
+// gzip member if compress is set.
+func (rf *rotatingFile) startWriter(fresh bool) {
+	if !rf.compress {
+		rf.w = rf.newWriter(rf.f, fresh)
+		return
+	}
+	rf.gz = gzip.NewWriter(rf.f)
+	rf.w = rf.newWriter(rf.gz, fresh)
+	rf.flushed = time.Now()
+}
+
+// flushCompressed writes out what the gzip writer holds, if it's
+// time, or now is set.
+func (rf *rotatingFile) flushCompressed(now bool) error {
+	if rf.gz == nil || !now && time.Since(rf.flushed) < rf.flushEvery {
+		return nil
+	}
+	rf.flushed = time.Now()
+	return rf.gz.Flush()
+}
+
+// Write writes a point, after those in the backlog, rotating the file
+// first if it's time. If rotating fails, the point is written to the
+// old file. It never fails.
+func (rf *rotatingFile) Write(point sds011.Point) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if err := rf.maybeRotate(); err != nil {
+		slog.Error("rotating output", "path", rf.path, "error", err)
+	}
+	if len(rf.backlog) == outputBacklog {
+		rf.backlog = rf.backlog[1:]
+		rf.dropped++
+	}
+	rf.backlog = append(rf.backlog, point)
+	rf.writeBacklog()
+	return nil
+}
+
+// writeBacklog writes the points in the backlog, until one fails.
+func (rf *rotatingFile) writeBacklog() {
+	failing := len(rf.backlog) > 1
+	for len(rf.backlog) > 0 {
+		err := rf.w.Write(rf.backlog[0])
+		if err == nil {
+			err = rf.flushCompressed(false)
+		}
+		if err != nil {
+			// The writer may be stuck with the error, so the next
+			// try is with a new one.
+			rf.startWriter(false)
+			if !failing {
+				slog.Error("writing output failed, keeping the measurements to try again", "path", rf.path, "error", err)
+			}
+			return
+		}
+		rf.backlog = rf.backlog[1:]
+	}
+	if failing {
+		slog.Info("writing output again", "path", rf.path, "dropped", rf.dropped)
+		rf.dropped = 0
+	}
+	rf.backlog = nil
+}
+
+func (rf *rotatingFile) Flush() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if err := rf.w.Flush(); err != nil {
+		return err
+	}
+	return rf.flushCompressed(true)
+}
+
+func (rf *rotatingFile) maybeRotate() error {
+	select {
+	case <-rf.hup:
+		moved, err := rf.moved()
+		if err != nil {
+			return err
+		}
+		if moved {
+			slog.Info("reopening output", "path", rf.path)
+			return rf.reopen(false)
+		}
+		return rf.reopen(true)
+	default:
+	}
+	if size := rf.f.size; size > 0 && (rf.maxSize > 0 && size >= rf.maxSize || rf.maxAge > 0 && time.Since(rf.opened) >= rf.maxAge) {
+		return rf.reopen(true)
+	}
+	return nil
+}
+
+// moved returns true if the file isn't at its path anymore.
+func (rf *rotatingFile) moved() (bool, error) {
+	info, err := os.Stat(rf.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	ours, err := rf.f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return !os.SameFile(info, ours), nil
+}
+
+// reopen closes the file and opens it again, renaming it first if
+// rename is true.
+func (rf *rotatingFile) reopen(rename bool) error {
+	if err := rf.w.Flush(); err != nil {
+		return err
+	}
+	if rename {
+		to, err := rf.rotatedPath()
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(rf.path, to); err != nil {
+			return err
+		}
+		slog.Info("rotated output", "path", rf.path, "to", to)
+	}
+	old, oldGz := rf.f, rf.gz
+	if err := rf.open(); err != nil {
+		// Keep writing to the old file rather than lose points.
+		return err
+	}
+	var err error
+	if oldGz != nil {
+		err = oldGz.Close()
+	}
+	return errors.Join(err, old.Close())
+}
+
+// rotatedPath returns the path to rename the file to: its own with a
+// timestamp suffix, and a number if that's taken, both before .gz if
+// it's compressed and ends with it.
+func (rf *rotatingFile) rotatedPath() (string, error) {
+	path, ext := rf.path, ""
+	if rf.compress && strings.HasSuffix(path, ".gz") {
+		path, ext = strings.TrimSuffix(path, ".gz"), ".gz"
+	}
+	base := path + "." + time.Now().Format("20060102T150405")
+	to := base + ext
+	for i := 1; ; i++ {
+		_, err := os.Lstat(to)
+		if errors.Is(err, fs.ErrNotExist) {
+			return to, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		to = fmt.Sprintf("%v.%d%v", base, i, ext)
+	}
+}
+
+// reload makes the writer anew, for the reloaded -tag.
+func (rf *rotatingFile) reload() {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.w.Flush()
+	if rf.gz != nil {
+		rf.w = rf.newWriter(rf.gz, false)
+		return
+	}
+	rf.w = rf.newWriter(rf.f, false)
+}
+
+// stdoutWriter writes points to stdout, with a writer that reload
+// makes anew. Unlike rotatingFile, it isn't safe to use from multiple
+// goroutines.
+type stdoutWriter struct {
+	pointio.PointWriter
+	newWriter func(io.Writer, bool) pointio.PointWriter
+}
+
+// writeLine writes line to stdout between the points, after those
+// written so far.
+func (sw *stdoutWriter) writeLine(line []byte) error {
+	if err := sw.Flush(); err != nil {
+		return err
+	}
+	_, err := os.Stdout.Write(line)
+	return err
+}
+
+// reload makes the writer anew, for the reloaded -tag.
+func (sw *stdoutWriter) reload() {
+	sw.Flush()
+	sw.PointWriter = sw.newWriter(os.Stdout, false)
+}
+
+// writeLine writes line to the file between the points, after those
+// written so far, unless some are still in the backlog, which it would
+// then come before.
+func (rf *rotatingFile) writeLine(line []byte) error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if len(rf.backlog) > 0 {
+		return errors.New("writing the output is failing")
+	}
+	if err := rf.w.Flush(); err != nil {
+		return err
+	}
+	var err error
+	if rf.gz != nil {
+		_, err = rf.gz.Write(line)
+	} else {
+		_, err = rf.f.Write(line)
+	}
+	if err == nil {
+		err = rf.flushCompressed(false)
+	}
+	return err
+}
+
+// Close flushes and closes the file, and stops rotating on SIGHUP.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	signal.Stop(rf.hup)
+	rf.writeBacklog()
+	if n := len(rf.backlog); n > 0 {
+		slog.Error("couldn't write some measurements to the output", "path", rf.path, "count", n+rf.dropped)
+	}
+	err := rf.w.Flush()
+	if rf.gz != nil {
+		err = errors.Join(err, rf.gz.Close())
+	}
+	if cerr := rf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// compressOutput returns true if mode, like -compress, says the file
+// at path is to be gzipped.
+func compressOutput(path, mode string) (bool, error) {
+	switch mode {
+	case "auto":
+		return strings.HasSuffix(path, ".gz"), nil
+	case "gzip":
+		return true, nil
+	case "none":
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown compression %q, want gzip, none or auto", mode)
+}
+
+// A teeWriter writes every point to stdout, and to another writer,
+// failing if writing to stdout does.
+type teeWriter struct {
+	stdout *stdoutWriter
+	other  pointio.PointWriter
+}
+
+func (tw teeWriter) Write(point sds011.Point) error {
+	err := tw.stdout.Write(point)
+	tw.other.Write(point)
+	return err
+}
+
+func (tw teeWriter) Flush() error {
+	return errors.Join(tw.stdout.Flush(), tw.other.Flush())
+}
+
+func (tw teeWriter) writeLine(line []byte) error {
+	err := tw.stdout.writeLine(line)
+	if lw, ok := tw.other.(lineWriter); ok {
+		err = errors.Join(err, lw.writeLine(line))
+	}
+	return err
+}
+
+// reload reloads both writers, for the reloaded -tag.
+func (tw teeWriter) reload() {
+	tw.stdout.reload()
+	if r, ok := tw.other.(interface{ reload() }); ok {
+		r.reload()
+	}
+}
+
+// A lineWriter is an output that can have lines other than points
+// written between them, like daily summaries in JSON lines.
+type lineWriter interface {
+	writeLine(line []byte) error
+}
+
+// discardWriter is the output with -quiet, and no -output.
+type discardWriter struct{}
+
+func (discardWriter) Write(sds011.Point) error { return nil }
+func (discardWriter) Flush() error             { return nil }
+
+// otherOutputs returns true if the flags ask for an output other than
+// stdout.
+func otherOutputs() bool {
+	return *output != "" || *addr != "" || *remoteWriteURL != "" || *otlp != "" || *mqttBroker != "" ||
+		*kafkaBrokers != "" || *natsURL != "" || *redisAddr != "" || *influxURL != "" || *graphiteAddr != "" ||
+		*statsdAddr != "" || len(*webhookURLs) > 0 || *postgresDSN != "" || *sqlitePath != "" ||
+		*alertPM25 > 0 || *alertPM10 > 0 || *rawSamplesPath != "" || *pushgatewayURL != "" || *zabbixServer != "" || *execCmd != "" ||
+		*syslogAddr != ""
+}
@@ -0,0 +1,339 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+const (
+	// postgresRetries is how many times inserting a batch is retried
+	// before it's dropped.
+	postgresRetries = 5
+
+	// postgresTimeout is how long inserting a batch, or creating the
+	// table, may take.
+	postgresTimeout = 10 * time.Second
+
+	// postgresMaxBatch is the most rows one INSERT takes, as a
+	// statement can have at most 65535 parameters.
+	postgresMaxBatch = 10000
+)
+
+// postgresSchema creates the sds011_readings table. extra holds what
+// not every measurement has, like the standard deviations of those
+// averaging several samples and the -tag tags, and is NULL if there's
+// nothing.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS sds011_readings (
+	ts timestamptz NOT NULL,
+	device_id text NOT NULL,
+	pm25 real NOT NULL,
+	pm10 real NOT NULL,
+	samples int NOT NULL,
+	extra jsonb
+);
+CREATE INDEX IF NOT EXISTS sds011_readings_device_id_ts ON sds011_readings (device_id, ts DESC);
+`
+
+// postgresHypertable makes the table a TimescaleDB hypertable, if the
+// database has the extension.
+const postgresHypertable = `
+SELECT create_hypertable('sds011_readings', 'ts', if_not_exists => TRUE, migrate_data => TRUE)
+WHERE EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')
+`
+
+var (
+	postgresInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_postgres_inserted_total",
+		Help: "Measurements inserted into PostgreSQL.",
+	})
+	postgresFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_postgres_failures_total",
+		Help: "Failed attempts to insert a batch of measurements into PostgreSQL.",
+	})
+	postgresDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_postgres_dropped_total",
+		Help: "Measurements dropped because inserting them into PostgreSQL kept failing, or too many were waiting.",
+	})
+)
+
+// postgresConfig says where and how measurements are inserted into
+// PostgreSQL.
+type postgresConfig struct {
+	dsn           string
+	migrate       bool // create the table if it doesn't exist
+	batchSize     int
+	flushInterval time.Duration
+	buffer        int // how many measurements can wait
+	tags          []pointio.Tag
+}
+
+// A postgresDB runs statements, like a *pgxpool.Pool, so that the
+// writer can be tested without a database.
+type postgresDB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Close()
+}
+
+// postgresWriter inserts measurements into the sds011_readings table
+// of a PostgreSQL database, in batches, one INSERT for each. It is an
+// observer.
+type postgresWriter struct {
+	cfg      postgresConfig
+	db       postgresDB
+	out      *outbox[sds011.Point]
+	migrated bool
+
+	mu   sync.Mutex
+	tags []pointio.Tag
+}
+
+// startPostgres starts inserting measurements into the database at
+// cfg.dsn, a connection string or URL that libpq would take. It
+// connects when it first has something to insert, and again whenever
+// the connection is lost, so that the database being down doesn't
+// stop the readings.
+func startPostgres(cfg postgresConfig) (*postgresWriter, error) {
+	poolConfig, err := cfg.poolConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Only the loop inserts.
+	poolConfig.MaxConns = 1
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, err
+	}
+	return newPostgresWriter(cfg, pool), nil
+}
+
+// newPostgresWriter starts inserting measurements into db, as cfg
+// says.
+func newPostgresWriter(cfg postgresConfig, db postgresDB) *postgresWriter {
+	pw := &postgresWriter{
+		cfg:      cfg,
+		db:       db,
+		out:      newOutbox[sds011.Point](cfg.buffer, postgresDropped, "PostgreSQL"),
+		migrated: !cfg.migrate,
+		tags:     cfg.tags,
+	}
+	registry.MustRegister(postgresInserted, postgresFailures, postgresDropped)
+	pw.out.start(pw.loop)
+	return pw
+}
+
+// poolConfig returns the configuration of the pool cfg.dsn connects
+// with, or an error if cfg doesn't make sense.
+func (cfg postgresConfig) poolConfig() (*pgxpool.Config, error) {
+	if cfg.batchSize < 1 || cfg.batchSize > postgresMaxBatch {
+		return nil, fmt.Errorf("-postgres-batch-size must be from 1 to %d, not %d", postgresMaxBatch, cfg.batchSize)
+	}
+	if cfg.flushInterval <= 0 {
+		return nil, fmt.Errorf("-postgres-flush-interval must be positive, not %v", cfg.flushInterval)
+	}
+	if cfg.buffer < cfg.batchSize {
+		return nil, fmt.Errorf("-postgres-buffer must be at least -postgres-batch-size, %d, not %d", cfg.batchSize, cfg.buffer)
+	}
+	poolConfig, err := pgxpool.ParseConfig(cfg.dsn)
+	if err != nil {
+		return nil, fmt.Errorf("bad -postgres-dsn: %w", err)
+	}
+	return poolConfig, nil
+}
+
+func (pw *postgresWriter) Observe(point sds011.Point) {
+	pw.out.put(point)
+}
+
+func (pw *postgresWriter) ObserveError(error) {}
+
+// reload takes the -tag tags anew, for the measurements to come.
+func (pw *postgresWriter) reload() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.tags = *tags
+}
+
+// loop inserts the queued measurements every flushInterval, or as soon
+// as there are batchSize of them, until the queue is closed.
+func (pw *postgresWriter) loop(points <-chan sds011.Point) {
+	ticker := time.NewTicker(pw.cfg.flushInterval)
+	defer ticker.Stop()
+	var rows []postgresRow
+	flush := func() {
+		if len(rows) > 0 {
+			pw.insertBatch(rows)
+		}
+		rows = rows[:0]
+	}
+	for {
+		select {
+		case point, ok := <-points:
+			if !ok {
+				flush()
+				return
+			}
+			pw.mu.Lock()
+			rows = append(rows, newPostgresRow(point, pw.tags))
+			pw.mu.Unlock()
+			if len(rows) >= pw.cfg.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// A postgresRow is the values of a row of sds011_readings.
+type postgresRow struct {
+	ts         time.Time
+	deviceID   string
+	pm25, pm10 float64
+	samples    int
+	extra      []byte // nil for NULL
+}
+
+func newPostgresRow(point sds011.Point, tags []pointio.Tag) postgresRow {
+	row := postgresRow{
+		ts:       point.Timestamp,
+		deviceID: fmt.Sprintf("%04x", point.DeviceID),
+		pm25:     point.PM25,
+		pm10:     point.PM10,
+		samples:  max(point.Samples, 1),
+	}
+	extra := map[string]any{}
+	if point.Samples > 1 {
+		extra["pm2_5_stddev"], extra["pm10_stddev"] = point.PM25StdDev, point.PM10StdDev
+	}
+	if point.Manual {
+		extra["trigger"] = "manual"
+	}
+	if len(tags) > 0 {
+		t := make(map[string]string, len(tags))
+		for _, tag := range tags {
+			t[tag.Key] = tag.Value
+		}
+		extra["tags"] = t
+	}
+	if len(extra) > 0 {
+		// Marshaling a map of numbers and strings can't fail.
+		row.extra, _ = json.Marshal(extra)
+	}
+	return row
+}
+
+// insertBatch inserts rows, retrying with backoff if the connection
+// fails, and drops them if it keeps failing or the database refuses
+// them.
+func (pw *postgresWriter) insertBatch(rows []postgresRow) {
+	err := deliver(pw.out, postgresRetries, postgresFailures, "inserting into PostgreSQL", func() error {
+		return postgresRetryable(pw.insert(rows))
+	})
+	if err != nil {
+		postgresDropped.Add(float64(len(rows)))
+		slog.Error("inserting into PostgreSQL failed, dropped the measurements", "count", len(rows), "error", err)
+		return
+	}
+	postgresInserted.Add(float64(len(rows)))
+}
+
+// insert creates the table if it should and hasn't yet, and inserts
+// rows with a single INSERT.
+func (pw *postgresWriter) insert(rows []postgresRow) error {
+	ctx, cancel := context.WithTimeout(context.Background(), postgresTimeout)
+	defer cancel()
+	if !pw.migrated {
+		if _, err := pw.db.Exec(ctx, postgresSchema); err != nil {
+			return fmt.Errorf("creating the sds011_readings table: %w", err)
+		}
+		if _, err := pw.db.Exec(ctx, postgresHypertable); err != nil {
+			return fmt.Errorf("making sds011_readings a hypertable: %w", err)
+		}
+		pw.migrated = true
+	}
+	query, args := postgresInsert(rows)
+	_, err := pw.db.Exec(ctx, query, args...)
+	return err
+}
+
+// postgresInsert returns the INSERT of rows and its arguments.
+func postgresInsert(rows []postgresRow) (string, []any) {
+	var b strings.Builder
+	b.WriteString("INSERT INTO sds011_readings (ts, device_id, pm25, pm10, samples, extra) VALUES ")
+	args := make([]any, 0, 6*len(rows))
+	for i, row := range rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for j := range 6 {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(6*i + j + 1))
+		}
+		b.WriteByte(')')
+		var extra any
+		if row.extra != nil {
+			extra = string(row.extra)
+		}
+		args = append(args, row.ts, row.deviceID, row.pm25, row.pm10, row.samples, extra)
+	}
+	return b.String(), args
+}
+
+// postgresRetryable makes err a retryableError if it may go away: if
+// the connection failed or timed out, or the server is starting up,
+// shutting down, or out of resources, but not if it refused the
+// statement.
+func postgresRetryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return &retryableError{err: err}
+	}
+	for _, code := range []string{"08", "53", "57", "40001", "40P01"} {
+		if strings.HasPrefix(pgErr.Code, code) {
+			return &retryableError{err: err}
+		}
+	}
+	return err
+}
+
+// Close inserts what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects.
+func (pw *postgresWriter) Close() {
+	pw.out.close()
+	pw.db.Close()
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// An execCall is a statement run by a fakeDB.
+type execCall struct {
+	sql  string
+	args []any
+}
+
+// A fakeDB is a postgresDB recording the statements run, and failing
+// them with the errors given, then succeeding.
+type fakeDB struct {
+	mu     sync.Mutex
+	calls  []execCall
+	errs   []error
+	closed bool
+	ran    chan struct{}
+}
+
+func newFakeDB(errs ...error) *fakeDB {
+	return &fakeDB{errs: errs, ran: make(chan struct{}, 100)}
+}
+
+func (db *fakeDB) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.calls = append(db.calls, execCall{sql, args})
+	db.ran <- struct{}{}
+	if len(db.errs) > 0 {
+		err := db.errs[0]
+		db.errs = db.errs[1:]
+		return pgconn.CommandTag{}, err
+	}
+	return pgconn.NewCommandTag("INSERT 0 1"), nil
+}
+
+func (db *fakeDB) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+}
+
+func (db *fakeDB) statements() []execCall {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]execCall(nil), db.calls...)
+}
+
+// wait waits for n statements to be run.
+func (db *fakeDB) wait(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-db.ran:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ran %d statements, want %d", len(db.statements()), n)
+		}
+	}
+}
+
+// rowsInserted returns how many rows each INSERT in calls inserted.
+func rowsInserted(t *testing.T, calls []execCall) []int {
+	t.Helper()
+	var rows []int
+	for _, c := range calls {
+		if !strings.HasPrefix(c.sql, "INSERT INTO sds011_readings ") {
+			t.Errorf("ran %q, want an INSERT", c.sql)
+			continue
+		}
+		if n := strings.Count(c.sql, "("); len(c.args) != 6*(n-1) {
+			t.Errorf("ran an INSERT of %d rows with %d arguments", n-1, len(c.args))
+		}
+		rows = append(rows, len(c.args)/6)
+	}
+	return rows
+}
+
+func postgresPoint(i int) sds011.Point {
+	return sds011.Point{
+		PM25:      float64(i),
+		PM10:      float64(2 * i),
+		DeviceID:  0xa1b2,
+		Timestamp: time.Date(2017, 7, 14, 2, 40, i, 0, time.UTC),
+	}
+}
+
+func TestPostgresBatches(t *testing.T) {
+	newRegistry(t)
+	db := newFakeDB()
+	pw := newPostgresWriter(postgresConfig{batchSize: 3, flushInterval: time.Hour, buffer: 10}, db)
+	inserted := counterValue(postgresInserted)
+	for i := range 7 {
+		pw.Observe(postgresPoint(i))
+	}
+	db.wait(t, 2)
+	// The last measurement waits for the flush interval, or Close.
+	pw.Close()
+
+	calls := db.statements()
+	if got, want := rowsInserted(t, calls), []int{3, 3, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("inserted batches of %v rows, want %v", got, want)
+	}
+	var ts []any
+	for _, c := range calls {
+		for i := 0; i < len(c.args); i += 6 {
+			ts = append(ts, c.args[i])
+		}
+	}
+	for i, v := range ts {
+		if want := postgresPoint(i).Timestamp; v != want {
+			t.Errorf("row %d has ts %v, want %v", i, v, want)
+		}
+	}
+	if got := counterValue(postgresInserted) - inserted; got != 7 {
+		t.Errorf("counted %v measurements inserted, want 7", got)
+	}
+	if !db.closed {
+		t.Error("Close left the database open")
+	}
+}
+
+func TestPostgresFlushInterval(t *testing.T) {
+	newRegistry(t)
+	db := newFakeDB()
+	pw := newPostgresWriter(postgresConfig{batchSize: 100, flushInterval: 10 * time.Millisecond, buffer: 100}, db)
+	defer pw.Close()
+	pw.Observe(postgresPoint(1))
+	pw.Observe(postgresPoint(2))
+	db.wait(t, 1)
+	if got := rowsInserted(t, db.statements()); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("inserted batches of %v rows, want [2]", got)
+	}
+}
+
+func TestPostgresMigrate(t *testing.T) {
+	newRegistry(t)
+	db := newFakeDB()
+	pw := newPostgresWriter(postgresConfig{migrate: true, batchSize: 1, flushInterval: time.Hour, buffer: 10}, db)
+	pw.Observe(postgresPoint(1))
+	pw.Observe(postgresPoint(2))
+	pw.Close()
+	calls := db.statements()
+	if len(calls) != 4 {
+		t.Fatalf("ran %d statements, want 4", len(calls))
+	}
+	if calls[0].sql != postgresSchema || calls[1].sql != postgresHypertable {
+		t.Errorf("ran %q and %q first, want the schema and the hypertable", calls[0].sql, calls[1].sql)
+	}
+	if got := rowsInserted(t, calls[2:]); !reflect.DeepEqual(got, []int{1, 1}) {
+		t.Errorf("inserted batches of %v rows, want [1 1]", got)
+	}
+}
+
+func TestPostgresRetries(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		attempts int
+		inserted float64
+	}{
+		{"connection", errors.New("dial tcp: connection refused"), 2, 1},
+		{"admin shutdown", &pgconn.PgError{Code: "57P01"}, 2, 1},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, 1, 0},
+		{"undefined table", &pgconn.PgError{Code: "42P01"}, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newRegistry(t)
+			db := newFakeDB(tc.err)
+			pw := newPostgresWriter(postgresConfig{batchSize: 1, flushInterval: time.Hour, buffer: 10}, db)
+			inserted, dropped, failures := counterValue(postgresInserted), counterValue(postgresDropped), counterValue(postgresFailures)
+			pw.Observe(postgresPoint(1))
+			db.wait(t, tc.attempts)
+			pw.Close()
+			calls := db.statements()
+			if len(calls) != tc.attempts {
+				t.Errorf("ran %d INSERTs, want %d", len(calls), tc.attempts)
+			}
+			if len(calls) == 2 && !reflect.DeepEqual(calls[0], calls[1]) {
+				t.Errorf("retried %v after %v", calls[1], calls[0])
+			}
+			if got := counterValue(postgresInserted) - inserted; got != tc.inserted {
+				t.Errorf("counted %v measurements inserted, want %v", got, tc.inserted)
+			}
+			if got := counterValue(postgresDropped) - dropped; got != 1-tc.inserted {
+				t.Errorf("counted %v measurements dropped, want %v", got, 1-tc.inserted)
+			}
+			if got := counterValue(postgresFailures) - failures; got != 1 {
+				t.Errorf("counted %v failures, want 1", got)
+			}
+		})
+	}
+}
+
+func TestPostgresInsert(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	rows := []postgresRow{
+		{ts: ts, deviceID: "a1b2", pm25: 12.3, pm10: 20.1, samples: 1},
+		{ts: ts, deviceID: "0001", pm25: 1, pm10: 2, samples: 3, extra: []byte(`{"trigger":"manual"}`)},
+	}
+	query, args := postgresInsert(rows)
+	want := "INSERT INTO sds011_readings (ts, device_id, pm25, pm10, samples, extra) VALUES ($1, $2, $3, $4, $5, $6), ($7, $8, $9, $10, $11, $12)"
+	if query != want {
+		t.Errorf("postgresInsert: got\n%s\nwant\n%s", query, want)
+	}
+	wantArgs := []any{ts, "a1b2", 12.3, 20.1, 1, nil, ts, "0001", 1.0, 2.0, 3, `{"trigger":"manual"}`}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("postgresInsert: got arguments %v, want %v", args, wantArgs)
+	}
+}
+
+func TestPostgresRow(t *testing.T) {
+	point := postgresPoint(1)
+	if row := newPostgresRow(point, nil); row.extra != nil || row.samples != 1 || row.deviceID != "a1b2" {
+		t.Errorf("newPostgresRow(%v) = %+v, want samples 1, device ID a1b2 and no extra", point, row)
+	}
+	point.Samples, point.PM25StdDev, point.PM10StdDev, point.Manual = 5, 0.5, 1.25, true
+	row := newPostgresRow(point, []pointio.Tag{{Key: "room", Value: "kitchen"}})
+	want := `{"pm10_stddev":1.25,"pm2_5_stddev":0.5,"tags":{"room":"kitchen"},"trigger":"manual"}`
+	if string(row.extra) != want || row.samples != 5 {
+		t.Errorf("newPostgresRow(%v) = %+v, want samples 5 and extra %s", point, row, want)
+	}
+}
+
+func TestPostgresConfigCheck(t *testing.T) {
+	good := postgresConfig{dsn: "postgres://localhost/air", batchSize: 10, flushInterval: time.Second, buffer: 10}
+	if _, err := good.poolConfig(); err != nil {
+		t.Errorf("poolConfig(%+v): %v", good, err)
+	}
+	for _, bad := range []func(*postgresConfig){
+		func(c *postgresConfig) { c.batchSize = 0 },
+		func(c *postgresConfig) { c.batchSize, c.buffer = postgresMaxBatch+1, postgresMaxBatch+1 },
+		func(c *postgresConfig) { c.flushInterval = 0 },
+		func(c *postgresConfig) { c.buffer = 9 },
+		func(c *postgresConfig) { c.dsn = "postgres://localhost:port/air" },
+	} {
+		cfg := good
+		bad(&cfg)
+		if _, err := cfg.poolConfig(); err == nil {
+			t.Errorf("poolConfig(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// powerSaves are what -power-save takes.
+var powerSaves = []string{"host", "hardware"}
+
+// A powerSaver switches a reader's sensor to the working period of
+// -power-save=hardware, with which it sleeps and wakes up on its own,
+// and reports a single measurement at the end of every period. It is
+// safe for concurrent use, as it's used by the reader and when
+// closing it.
+type powerSaver struct {
+	sensor sds011.Device
+
+	mu     sync.Mutex
+	period uint8 // the working period set, 0 if it wasn't
+}
+
+// hardwarePeriod returns the working period, in minutes, that
+// -power-save=hardware sets for interval, or why it can't: the
+// sensor's only go from 1 to 30 whole minutes, and start whenever it
+// wakes up.
+func hardwarePeriod(interval time.Duration) (minutes uint8, why string) {
+	switch {
+	case align.on():
+		return 0, "-align needs the sensor woken up on the boundaries"
+	case interval%time.Minute != 0 || interval < time.Minute || interval > 30*time.Minute:
+		return 0, "the working period only goes from 1 to 30 whole minutes"
+	}
+	return uint8(interval / time.Minute), ""
+}
+
+// apply sets the working period of the sensor for interval with
+// -power-save=hardware, or, if it can't be, logs why and sets it back
+// to 0, so that the host puts the sensor to sleep between measurements
+// instead. It returns how long the schedule waits between
+// measurements: 0 with a working period, as the sensor sends one only
+// every period then.
+func (ps *powerSaver) apply(logger *slog.Logger, interval time.Duration) time.Duration {
+	if *powerSave != "hardware" || *once {
+		return interval
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	minutes, why := hardwarePeriod(interval)
+	if why != "" {
+		logger.Warn("-power-save=hardware can't be used with this -interval, putting the sensor to sleep between measurements from the host instead", "interval", interval, "why", why)
+		if err := ps.sensor.SetWorkingPeriod(0); err != nil {
+			logger.Warn("setting the working period back to 0", "error", err)
+		}
+		ps.period = 0
+		return interval
+	}
+	if err := ps.sensor.SetWorkingPeriod(minutes); err != nil {
+		logger.Error("setting the working period failed, putting the sensor to sleep between measurements from the host instead", "minutes", minutes, "error", err)
+		ps.period = 0
+		return interval
+	}
+	ps.period = minutes
+	logger.Info("the sensor sleeps and measures on its own every working period", "minutes", minutes)
+	return 0
+}
+
+// close leaves the working period set with -power-save-keep, and
+// returns true if it did, so that the sensor isn't put to sleep, and
+// goes on measuring on its own. Otherwise it sets it back to 0.
+func (ps *powerSaver) close() (kept bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.period == 0 {
+		return false
+	}
+	if *powerSaveKeep {
+		slog.Info("leaving the working period set, the sensor goes on measuring on its own", "minutes", ps.period)
+		return true
+	}
+	if err := ps.sensor.SetWorkingPeriod(0); err != nil {
+		slog.Warn("setting the working period back to 0", "error", err)
+	}
+	ps.period = 0
+	return false
+}
@@ -0,0 +1,232 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// pushgatewayQueue is how many pushes can wait to be sent. Every push
+// replaces the metrics of the one before, so there's no point in
+// keeping more.
+const pushgatewayQueue = 10
+
+var (
+	pushgatewayPushes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_pushgateway_pushes_total",
+		Help: "Pushes of the metrics to the Pushgateway.",
+	})
+	pushgatewayFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_pushgateway_failures_total",
+		Help: "Failed pushes of the metrics to the Pushgateway.",
+	})
+	pushgatewayDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_pushgateway_dropped_total",
+		Help: "Pushes to the Pushgateway dropped because too many were waiting.",
+	})
+)
+
+// pushgatewayConfig says where and how the metrics are pushed to a
+// Prometheus Pushgateway.
+type pushgatewayConfig struct {
+	url                string
+	job                string
+	username, password string // for basic auth
+	timeout            time.Duration
+	deleteOnExit       bool
+	// final pushes only once, when closing, for runs that end on their
+	// own.
+	final bool
+}
+
+// A pushgateway pushes what -metrics-path serves to a Prometheus
+// Pushgateway, in a group of the job for every device, with its ID as
+// the instance label, as device_id has it: after every measurement,
+// or only when it's closed if cfg.final is set. It must observe the
+// measurements after the sensors' collectors do, for them to be in
+// what's pushed. It is an observer.
+type pushgateway struct {
+	cfg      pushgatewayConfig
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	out      *outbox[uint16] // of the devices to push; nil if final
+
+	mu      sync.Mutex
+	devices []uint16 // that measured, in the order they did
+}
+
+// startPushgateway starts pushing the metrics in gatherer to cfg.url.
+func startPushgateway(cfg pushgatewayConfig, gatherer prometheus.Gatherer) (*pushgateway, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	if u, _ := url.Parse(cfg.url); u.Scheme == "http" && cfg.username != "" {
+		slog.Warn("-pushgateway-url isn't https, so the credentials are sent in the clear")
+	}
+	pg := &pushgateway{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.timeout},
+		gatherer: gatherer,
+	}
+	registry.MustRegister(pushgatewayPushes, pushgatewayFailures, pushgatewayDropped)
+	if !cfg.final {
+		pg.out = newOutbox[uint16](pushgatewayQueue, pushgatewayDropped, "pushgateway")
+		pg.out.start(pg.loop)
+	}
+	return pg, nil
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg pushgatewayConfig) check() error {
+	u, err := url.Parse(cfg.url)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("-pushgateway-url %q isn't an http or https URL", cfg.url)
+	}
+	if cfg.job == "" {
+		return errors.New("-pushgateway-job can't be empty")
+	}
+	if cfg.timeout <= 0 {
+		return fmt.Errorf("-pushgateway-timeout must be positive, not %v", cfg.timeout)
+	}
+	return nil
+}
+
+// Observe queues pushing the metrics of the point's device, unless
+// they're only pushed when closing.
+func (pg *pushgateway) Observe(point sds011.Point) {
+	pg.mu.Lock()
+	if !slices.Contains(pg.devices, point.DeviceID) {
+		pg.devices = append(pg.devices, point.DeviceID)
+	}
+	pg.mu.Unlock()
+	if pg.out != nil {
+		pg.out.put(point.DeviceID)
+	}
+}
+
+func (pg *pushgateway) ObserveError(error) {}
+
+// loop pushes the metrics of the queued devices until the queue is
+// closed. A failed push isn't retried, as the next measurement's
+// replaces it.
+func (pg *pushgateway) loop(devices <-chan uint16) {
+	for id := range devices {
+		if err := pg.push(id); err != nil {
+			slog.Error("pushing to -pushgateway-url failed", "device_id", fmt.Sprintf("%04x", id), "error", err)
+		}
+	}
+}
+
+// pusher returns the Pusher of the group of the device id.
+func (pg *pushgateway) pusher(id uint16) *push.Pusher {
+	p := push.New(pg.cfg.url, pg.cfg.job).
+		Grouping("instance", metricsID(id)).
+		Client(pg.client)
+	if pg.cfg.username != "" {
+		p = p.BasicAuth(pg.cfg.username, pg.cfg.password)
+	}
+	return p
+}
+
+// push replaces the metrics in the group of the device id with the
+// current ones, leaving out those of the other devices.
+func (pg *pushgateway) push(id uint16) error {
+	err := pg.pusher(id).Gatherer(deviceGatherer{pg.gatherer, metricsID(id)}).Push()
+	if err != nil {
+		pushgatewayFailures.Inc()
+		return err
+	}
+	pushgatewayPushes.Inc()
+	return nil
+}
+
+// Close pushes the metrics of every device that measured if they're
+// only pushed when closing, or otherwise sends what's left in the
+// queue, and deletes the groups with -pushgateway-delete-on-exit. It
+// returns an error if the final push failed.
+func (pg *pushgateway) Close() error {
+	pg.mu.Lock()
+	devices := slices.Clone(pg.devices)
+	pg.mu.Unlock()
+	var errs []error
+	if pg.out != nil {
+		pg.out.close()
+	} else {
+		if len(devices) == 0 {
+			slog.Warn("no measurement to push to -pushgateway-url")
+		}
+		for _, id := range devices {
+			if err := pg.push(id); err != nil {
+				errs = append(errs, fmt.Errorf("pushing device %04x: %w", id, err))
+			}
+		}
+	}
+	if pg.cfg.deleteOnExit {
+		for _, id := range devices {
+			if err := pg.pusher(id).Delete(); err != nil {
+				slog.Error("deleting the group from -pushgateway-url failed", "device_id", fmt.Sprintf("%04x", id), "error", err)
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return withExit(exitOutput, fmt.Errorf("pushing to -pushgateway-url: %w", err))
+	}
+	return nil
+}
+
+// metricsID returns the device ID id as the device_id label of the
+// metrics has it.
+func metricsID(id uint16) string {
+	return fmt.Sprintf("%04X", id)
+}
+
+// A deviceGatherer gathers the metrics of a single device: those
+// labeled with its ID as device_id, and those that aren't about a
+// device.
+type deviceGatherer struct {
+	prometheus.Gatherer
+	id string
+}
+
+func (g deviceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	kept := families[:0]
+	for _, f := range families {
+		f.Metric = slices.DeleteFunc(f.Metric, func(m *dto.Metric) bool {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "device_id" {
+					return l.GetValue() != g.id
+				}
+			}
+			return false
+		})
+		if len(f.Metric) > 0 {
+			kept = append(kept, f)
+		}
+	}
+	return kept, err
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A rater keeps the rates of change of the concentrations of every
+// device, for the output, the metrics and the alerts: how much they
+// changed per minute since the measurement before, by the time that
+// actually passed between the two. The first measurement of a device,
+// and one coming more than maxGap after the one before, as after an
+// outage, have none. Missing measurements are skipped. It is an
+// observer, which has to see measurements before anything asks for
+// their rates.
+type rater struct {
+	// maxGap is the longest time between two measurements with a rate,
+	// 0 for three times that between measurements.
+	maxGap time.Duration
+
+	mu      sync.Mutex
+	devices map[uint16]*deviceRate
+}
+
+// deviceRate is what a rater keeps for a device.
+type deviceRate struct {
+	last       sds011.Point // the latest measurement
+	ok         bool         // whether it has a rate
+	pm25, pm10 float64      // its rates, in μg/m³ per minute
+}
+
+// rates is the rater -delta asks for, or nil.
+var rates *rater
+
+// newRater returns the rater -delta and -delta-max-gap ask for, or nil
+// if it's off.
+func newRater() (*rater, error) {
+	if !*delta {
+		if *alertOn == "rate" {
+			return nil, errors.New("-alert-on=rate needs -delta")
+		}
+		return nil, nil
+	}
+	if *deltaMaxGap < 0 {
+		return nil, fmt.Errorf("-delta-max-gap can't be negative, not %v", *deltaMaxGap)
+	}
+	return &rater{maxGap: *deltaMaxGap, devices: make(map[uint16]*deviceRate)}, nil
+}
+
+func (r *rater) Observe(point sds011.Point) {
+	if point.Missing != "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := r.devices[point.DeviceID]
+	if d == nil {
+		d = new(deviceRate)
+		r.devices[point.DeviceID] = d
+	} else {
+		elapsed := point.Timestamp.Sub(d.last.Timestamp)
+		d.ok = elapsed > 0 && elapsed <= r.gap()
+		if d.ok {
+			d.pm25 = (point.PM25 - d.last.PM25) / elapsed.Minutes()
+			d.pm10 = (point.PM10 - d.last.PM10) / elapsed.Minutes()
+		}
+	}
+	d.last = point
+}
+
+func (r *rater) ObserveError(error) {}
+
+// gap returns the longest time between two measurements with a rate.
+func (r *rater) gap() time.Duration {
+	if r.maxGap > 0 {
+		return r.maxGap
+	}
+	every := *interval
+	if every <= 0 {
+		every = time.Duration(max(*samples, 1)) * time.Second
+	}
+	return 3 * every
+}
+
+// of returns the rates at point, and false if it has none. Only the
+// latest measurement of a device has them.
+func (r *rater) of(point sds011.Point) (pm25, pm10 float64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d := r.devices[point.DeviceID]; d != nil && d.ok && point.Missing == "" && point.Timestamp.Equal(d.last.Timestamp) {
+		return d.pm25, d.pm10, true
+	}
+	return 0, 0, false
+}
+
+// rated returns point with its rates instead of its concentrations,
+// and false if it has none.
+func (r *rater) rated(point sds011.Point) (sds011.Point, bool) {
+	var ok bool
+	point.PM25, point.PM10, ok = r.of(point)
+	return point, ok
+}
+
+// column returns the function of the output column of the rate of
+// PM2.5, or PM10 if pm10 is true, which is empty for measurements
+// without one.
+func (r *rater) column(pm10 bool) func(sds011.Point) string {
+	return func(point sds011.Point) string {
+		v25, v10, ok := r.of(point)
+		switch {
+		case !ok:
+			return ""
+		case pm10:
+			return strconv.FormatFloat(v10, 'f', 2, 64)
+		}
+		return strconv.FormatFloat(v25, 'f', 2, 64)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// warmupDiscarded counts the measurements warmUp threw away, for the
+// summary of -raw-samples.
+var warmupDiscarded atomic.Uint64
+
+// A sampleKey tells the samples apart, to find their numbers.
+type sampleKey struct {
+	deviceID uint16
+	ts       int64 // in nanoseconds
+}
+
+// rawSamples writes every sample of the measurements to -raw-samples,
+// with which of its measurement's it is in the sample column, and logs
+// how many it wrote, and how many warmup measurements and frames with
+// bad checksums it left out, when it's closed. It is a sample
+// observer, shared by the readers, so it isn't safe for concurrent
+// use.
+type rawSamples struct {
+	out     pointio.PointWriter
+	close   func() error
+	written int
+	sensors []*sds011.Sensor
+	// warmup and checksums are warmupDiscarded and the frames of the
+	// sensors with bad checksums when it started.
+	warmup, checksums uint64
+
+	// numbers are the numbers of the latest samples, as many as the
+	// output can hold on to while writing fails, with their keys in
+	// the order they came.
+	numbers map[sampleKey]int
+	keys    []sampleKey
+}
+
+// startRawSamples starts writing the samples of sensors to path, or
+// stderr for "-", in -format, rotating and compressing the file as the
+// -raw-samples flags say.
+func startRawSamples(path string, sensors []*sds011.Sensor) (*rawSamples, error) {
+	rs := &rawSamples{numbers: make(map[sampleKey]int), sensors: sensors}
+	rs.warmup, rs.checksums = warmupDiscarded.Load(), rs.badChecksums()
+	newWriter, err := newPointWriter(*format, pointio.WithColumnFunc("sample", rs.number))
+	if err != nil {
+		return nil, fmt.Errorf("bad -format: %w", err)
+	}
+	if path == "-" {
+		rs.out = newWriter(os.Stderr, true)
+		rs.close = rs.out.Flush
+		return rs, nil
+	}
+	gzipped, err := compressOutput(path, *rawCompress)
+	if err != nil {
+		return nil, fmt.Errorf("-raw-samples-compress: %w", err)
+	}
+	rf, err := openRotatingFile(path, *rawRotateSize, *rawRotateInterval, gzipped, *compressFlush, newWriter)
+	if err != nil {
+		return nil, err
+	}
+	rs.out, rs.close = rf, rf.Close
+	return rs, nil
+}
+
+// number returns the number of sample in its measurement.
+func (rs *rawSamples) number(sample sds011.Point) string {
+	n, ok := rs.numbers[sampleKey{sample.DeviceID, sample.Timestamp.UnixNano()}]
+	if !ok {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func (rs *rawSamples) ObserveSample(sample sds011.Point, n int) {
+	key := sampleKey{sample.DeviceID, sample.Timestamp.UnixNano()}
+	rs.numbers[key] = n
+	rs.keys = append(rs.keys, key)
+	if len(rs.keys) > outputBacklog+1 {
+		delete(rs.numbers, rs.keys[0])
+		rs.keys = rs.keys[1:]
+	}
+	if err := rs.out.Write(sample); err != nil {
+		slog.Error("writing a raw sample", "error", err)
+		return
+	}
+	rs.written++
+}
+
+func (rs *rawSamples) Observe(sds011.Point) {}
+
+func (rs *rawSamples) ObserveError(error) {}
+
+// badChecksums returns how many frames with bad checksums the sensors
+// received.
+func (rs *rawSamples) badChecksums() uint64 {
+	var n uint64
+	for _, s := range rs.sensors {
+		n += s.Stats().BadChecksums
+	}
+	return n
+}
+
+// Close flushes and closes the output, and logs the summary.
+func (rs *rawSamples) Close() {
+	if err := rs.close(); err != nil {
+		slog.Error("closing -raw-samples", "error", err)
+	}
+	slog.Info("wrote the raw samples", "written", rs.written,
+		"warmup_discarded", warmupDiscarded.Load()-rs.warmup, "bad_checksums", rs.badChecksums()-rs.checksums)
+}
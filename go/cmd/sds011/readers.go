@@ -0,0 +1,281 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+	"github.com/ryszard/sds011/go/sds011/promexporter"
+)
+
+// sensorPaths are the ports watch reads, once it started.
+var sensorPaths []string
+
+// sensorPorts returns the ports -port_path names: a comma-separated
+// list of paths, or of patterns like /dev/ttyUSB*, which stand for the
+// paths matching them. "auto" stands for the first port with a sensor,
+// and can't go with others.
+func sensorPorts() ([]string, error) {
+	if *portPath == "auto" {
+		path, err := findSensor()
+		if err != nil {
+			return nil, fmt.Errorf("looking for a sensor: %w", err)
+		}
+		slog.Info("found sensor", "port", path)
+		return []string{path}, nil
+	}
+	var ports []string
+	for _, p := range strings.Split(*portPath, ",") {
+		p = strings.TrimSpace(p)
+		switch {
+		case p == "":
+		case p == "auto":
+			return nil, fmt.Errorf(`-port_path %q: "auto" can't go with other ports`, *portPath)
+		case strings.ContainsAny(p, `*?[`):
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, fmt.Errorf("-port_path %q: %w", p, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("-port_path %q matches no ports", p)
+			}
+			ports = append(ports, matches...)
+		default:
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("-port_path %q names no ports", *portPath)
+	}
+	// A port matching two patterns is still read once.
+	var unique []string
+	for _, p := range ports {
+		if !slices.Contains(unique, p) {
+			unique = append(unique, p)
+		}
+	}
+	return unique, nil
+}
+
+// parseHexID parses a device ID written as the output has it, in hex,
+// maybe starting with 0x.
+func parseHexID(s string) (uint16, error) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 16)
+	return uint16(id), err
+}
+
+// A reader reads the sensor connected to one of the ports, on its own
+// schedule, and tells its own observers and the shared ones about
+// the measurements.
+type reader struct {
+	port      string
+	sensor    *sds011.Sensor
+	dev       sds011.Device // the sensor, maybe wrapped
+	collector *promexporter.Collector
+	observers []observer
+	controls
+}
+
+// controls tell a reader what to do while it runs.
+type controls struct {
+	timings  chan timing   // the new -interval and -samples after SIGHUP
+	triggers chan struct{} // measurements asked for out of schedule
+	reopens  chan struct{} // asking to open the port again, on SIGHUP
+	// reopen opens the port again. It is nil if it can't be.
+	reopen func(context.Context) error
+	// power sets the working period of -power-save=hardware.
+	power *powerSaver
+}
+
+// timing is when and how many samples a reader reads.
+type timing struct {
+	interval time.Duration
+	samples  int
+}
+
+// newReader returns a reader for the sensor at port.
+func newReader(port string, sensor *sds011.Sensor) *reader {
+	return &reader{port: port, sensor: sensor, dev: sensor, controls: controls{
+		timings:  make(chan timing, 1),
+		triggers: make(chan struct{}, 1),
+		reopens:  make(chan struct{}, 1),
+		reopen:   sensor.Reopen,
+		power:    &powerSaver{sensor: sensor},
+	}}
+}
+
+// shared are the output and the observers all the readers share. They
+// are used by one reader at a time, so they don't have to be safe for
+// concurrent use. It is an observer, a sample observer and a missing
+// observer.
+type shared struct {
+	mu        sync.Mutex
+	out       pointio.PointWriter
+	observers []observer
+}
+
+func (s *shared) Write(point sds011.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Write(point)
+}
+
+// writeLine writes line between the points written, if the output
+// can have it.
+func (s *shared) writeLine(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if lw, ok := s.out.(lineWriter); ok {
+		return lw.writeLine(line)
+	}
+	return nil
+}
+
+func (s *shared) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.out.Flush()
+}
+
+func (s *shared) Observe(point sds011.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.observers {
+		o.Observe(point)
+	}
+}
+
+func (s *shared) ObserveError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.observers {
+		o.ObserveError(err)
+	}
+}
+
+func (s *shared) ObserveSample(sample sds011.Point, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.observers {
+		if so, ok := o.(sampleObserver); ok {
+			so.ObserveSample(sample, n)
+		}
+	}
+}
+
+func (s *shared) ObserveMissing(point sds011.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.observers {
+		if mo, ok := o.(missingObserver); ok {
+			mo.ObserveMissing(point)
+		}
+	}
+}
+
+// applySettings applies the settings re-read from the -config file,
+// and returns the names of those that changed. The observers that can
+// take the changes, and the output if -tag changed, are reloaded.
+func (s *shared) applySettings(values map[string][]string) (changed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed = loaded.reload(values)
+	if len(changed) > 0 {
+		for _, o := range s.observers {
+			if r, ok := o.(reloader); ok {
+				r.reload()
+			}
+		}
+	}
+	if r, ok := s.out.(interface{ reload() }); ok && slices.Contains(changed, "tag") {
+		r.reload()
+	}
+	return changed
+}
+
+// devicePorts are the ports of the devices measurements were read
+// from.
+var devicePorts portMap
+
+type portMap struct {
+	mu    sync.Mutex
+	ports map[uint16]string
+}
+
+// of returns the port of the device that took point.
+func (m *portMap) of(point sds011.Point) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ports[point.DeviceID]
+}
+
+// portObserver notes the port it's for as that of the devices whose
+// measurements it sees.
+type portObserver string
+
+func (p portObserver) Observe(point sds011.Point) {
+	devicePorts.mu.Lock()
+	defer devicePorts.mu.Unlock()
+	if devicePorts.ports == nil {
+		devicePorts.ports = make(map[uint16]string)
+	}
+	devicePorts.ports[point.DeviceID] = string(p)
+}
+
+func (portObserver) ObserveError(error) {}
+
+// sensorCollectors collects the metrics of all the readers' sensors,
+// which are described the same, so that they are registered as one.
+type sensorCollectors []*promexporter.Collector
+
+func (cs sensorCollectors) Describe(ch chan<- *prometheus.Desc) {
+	cs[0].Describe(ch)
+}
+
+func (cs sensorCollectors) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range cs {
+		c.Collect(ch)
+	}
+}
+
+// closeReaders puts the readers' sensors to sleep, all at once, unless
+// they're left measuring on their own with -power-save-keep, and
+// closes them.
+func closeReaders(readers []*reader, h *health) {
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !r.power.close() {
+				sleepSensor(r.sensor)
+			}
+			h.setOpen(r.port, false)
+			r.sensor.Close()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// retryMinBackoff and retryMaxBackoff bound how long watch waits
+// before reading a sensor again after a measurement failed, and
+// before looking for a sensor again while -wait-for-device. The wait
+// doubles every time.
+const (
+	retryMinBackoff = time.Second
+	retryMaxBackoff = 30 * time.Second
+)
+
+// reopenTimeout is how long reopenPort waits for the port to open
+// again, before going on while the sensor keeps trying.
+const reopenTimeout = 30 * time.Second
+
+// retryBackoff returns how long to wait after the nth failure in a
+// row, give or take a random half, so that sensors that failed
+// together don't all try again at once.
+func retryBackoff(n int) time.Duration {
+	d := min(retryMinBackoff<<min(max(n-1, 0), 16), retryMaxBackoff)
+	return min(d/2+rand.N(d), retryMaxBackoff)
+}
+
+// sensorOptions are the options of the sensors watch reads: their
+// ports are opened again when they fail, and with -watchdog, when
+// they go silent.
+func sensorOptions(port string) []sds011.Option {
+	opts := []sds011.Option{sds011.WithAutoReconnect(sds011.ReconnectPolicy{
+		MaxBackoff: *reconnectMaxBackoff,
+		OnReconnect: func(err error) {
+			slog.Info("sensor reconnected", "event", "reconnect", "port", port, "after", err)
+		},
+	})}
+	if *watchdogSilence > 0 {
+		opts = append(opts, sds011.WithWatchdog(*watchdogSilence, nil))
+	}
+	return opts
+}
+
+// A deviceWait keeps trying to find and open the sensors until
+// -wait-for-device is up, counted from when watch started, so that it
+// can start before the USB adapters show up after boot.
+type deviceWait struct {
+	deadline time.Time
+}
+
+func newDeviceWait(d time.Duration) deviceWait {
+	return deviceWait{deadline: time.Now().Add(d)}
+}
+
+// retry calls try until it succeeds, returning nil, or until the wait
+// is over or ctx is done, returning its last error. Without
+// -wait-for-device, it calls try just once. what says what try
+// does, for the logs.
+func (w deviceWait) retry(ctx context.Context, what string, try func() error) error {
+	for n := 1; ; n++ {
+		err := try()
+		if err == nil {
+			if n > 1 {
+				slog.Info("done waiting for the sensor", "what", what)
+			}
+			return nil
+		}
+		left := time.Until(w.deadline)
+		if left <= 0 {
+			return err
+		}
+		backoff := min(retryBackoff(n), left)
+		if n == 1 {
+			slog.Warn("waiting for the sensor", "what", what, "error", err, "for", left.Round(time.Second))
+		} else {
+			slog.Debug("still waiting for the sensor", "what", what, "error", err, "backoff", backoff)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// reopenPort opens the port of a sensor again with reopen, if it can
+// be, as SIGHUP asks for.
+func reopenPort(ctx context.Context, logger *slog.Logger, reopen func(context.Context) error) {
+	if reopen == nil {
+		logger.Info("not reopening the port, it isn't a real one")
+		return
+	}
+	waiting, cancel := context.WithTimeout(ctx, reopenTimeout)
+	defer cancel()
+	err := reopen(waiting)
+	switch {
+	case ctx.Err() != nil:
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("the port isn't open again yet, still trying", "waited", reopenTimeout)
+	case err != nil:
+		logger.Error("reopening the port failed", "error", err)
+	default:
+		logger.Info("reopened the port")
+	}
+}
+
+// pause waits for the next measurement on sched, or after failures
+// measurements in a row failed, for retryBackoff if that's longer, so
+// that a sensor that keeps failing at once isn't read again and again
+// without a break. The schedule starts over after that.
+func pause(ctx context.Context, sched *schedule, sensor sds011.Device, failures int) error {
+	if backoff := retryBackoff(failures); failures > 0 && sched.interval < backoff {
+		if err := sched.sleep(ctx, backoff); err != nil {
+			return err
+		}
+		sched.setInterval(sched.interval)
+		return nil
+	}
+	return sched.wait(ctx, sensor)
+}
@@ -0,0 +1,216 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+const (
+	// redisQueueSize is how many measurements wait to be written
+	// while Redis is unreachable. When the queue is full, the oldest
+	// one is dropped.
+	redisQueueSize = 64
+
+	// redisTimeout is how long writing a batch of measurements may
+	// take.
+	redisTimeout = 5 * time.Second
+)
+
+var (
+	redisWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_redis_written_total",
+		Help: "Measurements written to Redis.",
+	})
+	redisFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_redis_write_failures_total",
+		Help: "Failed attempts to write a batch of measurements to Redis.",
+	})
+	redisDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_redis_dropped_total",
+		Help: "Measurements dropped because writing them to Redis failed, or too many were waiting.",
+	})
+)
+
+// redisConfig says where and how measurements are written to Redis.
+type redisConfig struct {
+	addr               string
+	username, password string
+	db                 int
+	ttl                time.Duration // of the latest keys, 0 for none
+	maxLen             int64         // of the streams
+	timeSeries         bool
+	retention          time.Duration // of the time series, 0 for forever
+}
+
+// redisWriter writes measurements to Redis: every device's latest as
+// JSON, in sds011:<device ID>:latest, expiring after cfg.ttl, and its
+// history, capped, in the stream sds011:<device ID>:history, or with
+// cfg.timeSeries, in the RedisTimeSeries sds011:<device ID>:pm2_5 and
+// sds011:<device ID>:pm10. What's waiting is written together, in a
+// pipeline. It is an observer.
+type redisWriter struct {
+	cfg    redisConfig
+	client *redis.Client
+	out    *outbox[sds011.Point]
+}
+
+// startRedis starts writing measurements to the Redis server at
+// cfg.addr. The client connects when it first has something to write,
+// and again whenever the connection is lost.
+func startRedis(cfg redisConfig) (*redisWriter, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	redis.SetLogger(redisLogger{})
+	rw := &redisWriter{
+		cfg: cfg,
+		client: redis.NewClient(&redis.Options{
+			Addr:         cfg.addr,
+			Username:     cfg.username,
+			Password:     cfg.password,
+			DB:           cfg.db,
+			DialTimeout:  redisTimeout,
+			ReadTimeout:  redisTimeout,
+			WriteTimeout: redisTimeout,
+		}),
+		out: newOutbox[sds011.Point](redisQueueSize, redisDropped, "Redis"),
+	}
+	registry.MustRegister(redisWritten, redisFailures, redisDropped)
+	rw.out.start(rw.loop)
+	return rw, nil
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg redisConfig) check() error {
+	if _, _, err := net.SplitHostPort(cfg.addr); err != nil {
+		return fmt.Errorf("bad -redis-addr: %w", err)
+	}
+	if cfg.db < 0 {
+		return fmt.Errorf("-redis-db can't be negative, not %d", cfg.db)
+	}
+	if cfg.ttl < 0 || cfg.retention < 0 {
+		return fmt.Errorf("-redis-ttl and -redis-retention can't be negative")
+	}
+	if cfg.maxLen < 1 {
+		return fmt.Errorf("-redis-maxlen must be at least 1, not %d", cfg.maxLen)
+	}
+	return nil
+}
+
+func (rw *redisWriter) Observe(point sds011.Point) {
+	rw.out.put(point)
+}
+
+func (rw *redisWriter) ObserveError(error) {}
+
+// loop writes the queued measurements, all those waiting at once,
+// until the queue is closed.
+func (rw *redisWriter) loop(points <-chan sds011.Point) {
+	var batch []sds011.Point
+	for point := range points {
+		batch = append(batch[:0], point)
+	waiting:
+		for len(batch) < redisQueueSize {
+			select {
+			case point, ok := <-points:
+				if !ok {
+					break waiting
+				}
+				batch = append(batch, point)
+			default:
+				break waiting
+			}
+		}
+		if rw.out.stopped() {
+			redisDropped.Add(float64(len(batch)))
+			continue
+		}
+		if err := rw.write(batch); err != nil {
+			redisFailures.Inc()
+			redisDropped.Add(float64(len(batch)))
+			slog.Warn("writing to Redis failed, dropped the measurements", "count", len(batch), "error", err)
+			continue
+		}
+		redisWritten.Add(float64(len(batch)))
+	}
+}
+
+// write writes batch in a pipeline.
+func (rw *redisWriter) write(batch []sds011.Point) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := rw.client.Pipeline()
+	for _, point := range batch {
+		payload, err := json.Marshal(point)
+		if err != nil {
+			return fmt.Errorf("encoding a measurement: %w", err)
+		}
+		id := fmt.Sprintf("%04x", point.DeviceID)
+		key := "sds011:" + id + ":"
+		pipe.Set(ctx, key+"latest", payload, rw.cfg.ttl)
+		if !rw.cfg.timeSeries {
+			pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: key + "history",
+				MaxLen: rw.cfg.maxLen,
+				Approx: true,
+				Values: []string{
+					"timestamp", point.Timestamp.Format(time.RFC3339Nano),
+					"pm2_5", strconv.FormatFloat(point.PM25, 'f', -1, 64),
+					"pm10", strconv.FormatFloat(point.PM10, 'f', -1, 64),
+				},
+			})
+			continue
+		}
+		for _, s := range []struct {
+			name  string
+			value float64
+		}{{"pm2_5", point.PM25}, {"pm10", point.PM10}} {
+			pipe.TSAddWithArgs(ctx, key+s.name, point.Timestamp.UnixMilli(), s.value, &redis.TSOptions{
+				Retention:       int(rw.cfg.retention.Milliseconds()),
+				DuplicatePolicy: "LAST",
+				Labels:          map[string]string{"device_id": id, "particulate": s.name},
+			})
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// redisLogger logs what the Redis client says, like every failed
+// attempt to connect, at debug level, as the failed writes are logged
+// already.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.DebugContext(ctx, "redis: "+fmt.Sprintf(format, v...))
+}
+
+// Close writes what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects.
+func (rw *redisWriter) Close() {
+	rw.out.close()
+	rw.client.Close()
+}
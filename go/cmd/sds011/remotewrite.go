@@ -0,0 +1,261 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryszard/sds011/go/sds011"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteRetries is how many times sending a request is
+	// retried before it's dropped.
+	remoteWriteRetries = 5
+
+	// remoteWriteTimeout is how long sending a request may take.
+	remoteWriteTimeout = 10 * time.Second
+)
+
+var (
+	remoteWriteSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_remote_write_sent_total",
+		Help: "Remote-write requests sent, one for every measurement.",
+	})
+	remoteWriteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_remote_write_failures_total",
+		Help: "Failed attempts to send a remote-write request.",
+	})
+	remoteWriteDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_remote_write_dropped_total",
+		Help: "Remote-write requests dropped because sending them kept failing, or too many were waiting.",
+	})
+)
+
+// remoteWriteConfig says where and how the metrics are pushed with
+// the Prometheus remote-write protocol.
+type remoteWriteConfig struct {
+	url                string
+	token              string // bearer token
+	username, password string // for basic auth
+	queue              int    // how many requests can wait
+}
+
+// remoteWriter pushes what -metrics-path serves, after every
+// measurement, to a Prometheus remote-write endpoint, as a request
+// with a sample of every series, labeled the same. It must observe
+// the measurements after the sensors' collectors do, for them to be
+// in the samples. It is an observer.
+type remoteWriter struct {
+	endpoint string
+	header   http.Header
+	client   *http.Client
+	gatherer prometheus.Gatherer
+	out      *outbox[[]byte]
+}
+
+// startRemoteWrite starts pushing the metrics in gatherer to
+// cfg.url.
+func startRemoteWrite(cfg remoteWriteConfig, gatherer prometheus.Gatherer) (*remoteWriter, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(cfg.url)
+	header := http.Header{
+		"Content-Type":                      {"application/x-protobuf"},
+		"Content-Encoding":                  {"snappy"},
+		"User-Agent":                        {"sds011"},
+		"X-Prometheus-Remote-Write-Version": {"0.1.0"},
+	}
+	switch {
+	case cfg.token != "":
+		header.Set("Authorization", "Bearer "+cfg.token)
+	case cfg.username != "":
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(cfg.username, cfg.password)
+		header.Set("Authorization", req.Header.Get("Authorization"))
+	}
+	if u.Scheme == "http" && header.Get("Authorization") != "" {
+		slog.Warn("-remote-write-url isn't https, so the credentials are sent in the clear")
+	}
+	rw := &remoteWriter{
+		endpoint: u.String(),
+		header:   header,
+		client:   &http.Client{Timeout: remoteWriteTimeout},
+		gatherer: gatherer,
+		out:      newOutbox[[]byte](cfg.queue, remoteWriteDropped, "remote write"),
+	}
+	registry.MustRegister(remoteWriteSent, remoteWriteFailures, remoteWriteDropped)
+	rw.out.start(rw.loop)
+	return rw, nil
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg remoteWriteConfig) check() error {
+	u, err := url.Parse(cfg.url)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("-remote-write-url %q isn't an http or https URL", cfg.url)
+	}
+	if cfg.token != "" && cfg.username != "" {
+		return errors.New("-remote-write-token and -remote-write-username can't be used together")
+	}
+	if cfg.queue < 1 {
+		return fmt.Errorf("-remote-write-queue must be at least 1, not %d", cfg.queue)
+	}
+	return nil
+}
+
+// Observe gathers the metrics and queues the request with them.
+func (rw *remoteWriter) Observe(sds011.Point) {
+	families, err := rw.gatherer.Gather()
+	if err != nil {
+		// Like promhttp, send what could be gathered.
+		slog.Warn("gathering the metrics to remote write", "error", err)
+	}
+	req := appendWriteRequest(nil, families, time.Now().UnixMilli())
+	rw.out.put(snappy.Encode(nil, req))
+}
+
+func (rw *remoteWriter) ObserveError(error) {}
+
+// loop sends the queued requests until the queue is closed, retrying
+// with backoff, or after as long as the server asks with Retry-After,
+// if it fails or doesn't answer, and drops them if it keeps doing so
+// or refuses them.
+func (rw *remoteWriter) loop(requests <-chan []byte) {
+	for body := range requests {
+		err := deliver(rw.out, remoteWriteRetries, remoteWriteFailures, "remote write", func() error {
+			return post(rw.client, rw.endpoint, rw.header, body, rw.out.stop)
+		})
+		if err != nil {
+			remoteWriteDropped.Inc()
+			slog.Error("remote write failed, dropped the request", "error", err)
+			continue
+		}
+		remoteWriteSent.Inc()
+	}
+}
+
+// Close sends what's left in the queue, giving up on it after
+// shutdownTimeout.
+func (rw *remoteWriter) Close() {
+	rw.out.close()
+}
+
+// A remoteLabel is a label of a remote-write series.
+type remoteLabel struct{ name, value string }
+
+// appendWriteRequest appends the remote-write WriteRequest protobuf
+// with the series of families to b, their samples taken at ts unless
+// they say when, in milliseconds since the epoch. The series are
+// named and labeled as the text exposition format has them, so that
+// summaries and histograms become the _sum, _count, and the quantile
+// or _bucket series.
+func appendWriteRequest(b []byte, families []*dto.MetricFamily, ts int64) []byte {
+	var series []byte
+	add := func(name string, labels []remoteLabel, value float64, ts int64) {
+		labels = append(slices.Clip(labels), remoteLabel{"__name__", name})
+		// The labels must be sorted by name.
+		slices.SortFunc(labels, func(a, b remoteLabel) int { return cmp.Compare(a.name, b.name) })
+		series = series[:0]
+		for _, l := range labels {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, l.name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, l.value)
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, series)
+	}
+	for _, f := range families {
+		name := f.GetName()
+		for _, m := range f.GetMetric() {
+			labels := make([]remoteLabel, 0, len(m.GetLabel())+2)
+			for _, l := range m.GetLabel() {
+				labels = append(labels, remoteLabel{l.GetName(), l.GetValue()})
+			}
+			with := func(name, value string) []remoteLabel {
+				return append(slices.Clip(labels), remoteLabel{name, value})
+			}
+			t := ts
+			if m.TimestampMs != nil {
+				t = m.GetTimestampMs()
+			}
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, labels, m.GetCounter().GetValue(), t)
+			case dto.MetricType_GAUGE:
+				add(name, labels, m.GetGauge().GetValue(), t)
+			case dto.MetricType_UNTYPED:
+				add(name, labels, m.GetUntyped().GetValue(), t)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, with("quantile", formatLabelFloat(q.GetQuantile())), q.GetValue(), t)
+				}
+				add(name+"_sum", labels, s.GetSampleSum(), t)
+				add(name+"_count", labels, float64(s.GetSampleCount()), t)
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+				h := m.GetHistogram()
+				inf := false
+				for _, bucket := range h.GetBucket() {
+					inf = inf || math.IsInf(bucket.GetUpperBound(), 1)
+					add(name+"_bucket", with("le", formatLabelFloat(bucket.GetUpperBound())), float64(bucket.GetCumulativeCount()), t)
+				}
+				if !inf {
+					add(name+"_bucket", with("le", "+Inf"), float64(h.GetSampleCount()), t)
+				}
+				add(name+"_sum", labels, h.GetSampleSum(), t)
+				add(name+"_count", labels, float64(h.GetSampleCount()), t)
+			}
+		}
+	}
+	return b
+}
+
+// formatLabelFloat formats the le or quantile label the way the text
+// exposition format does.
+func formatLabelFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,239 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/ryszard/sds011/go/sds011"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// A remoteSeries is a series of a decoded WriteRequest, with its only
+// sample.
+type remoteSeries struct {
+	labels string // like {__name__="x", a="b"}
+	value  float64
+	ts     int64
+}
+
+// decodeWriteRequest decodes a WriteRequest protobuf, checking that
+// every series has sorted labels and a single sample.
+func decodeWriteRequest(t *testing.T, b []byte) []remoteSeries {
+	t.Helper()
+	var series []remoteSeries
+	for _, ts := range decodeFields(t, b, 1) {
+		var s remoteSeries
+		var labels []string
+		last := ""
+		for _, l := range decodeFields(t, ts, 1) {
+			name := string(decodeFields(t, l, 1)[0])
+			value := string(decodeFields(t, l, 2)[0])
+			if name <= last {
+				t.Errorf("label %q after %q", name, last)
+			}
+			last = name
+			labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+		}
+		s.labels = "{" + strings.Join(labels, ", ") + "}"
+		samples := decodeFields(t, ts, 2)
+		if len(samples) != 1 {
+			t.Fatalf("series %v has %d samples, want 1", s.labels, len(samples))
+		}
+		sample := samples[0]
+		for len(sample) > 0 {
+			num, typ, n := protowire.ConsumeTag(sample)
+			if n < 0 {
+				t.Fatalf("bad sample: %v", protowire.ParseError(n))
+			}
+			sample = sample[n:]
+			switch {
+			case num == 1 && typ == protowire.Fixed64Type:
+				v, n := protowire.ConsumeFixed64(sample)
+				s.value, sample = math.Float64frombits(v), sample[max(n, 0):]
+			case num == 2 && typ == protowire.VarintType:
+				v, n := protowire.ConsumeVarint(sample)
+				s.ts, sample = int64(v), sample[max(n, 0):]
+			default:
+				t.Fatalf("unexpected field %d of type %v in a sample", num, typ)
+			}
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// decodeFields returns the values of the length-delimited fields num
+// of the message b, failing on fields of other types.
+func decodeFields(t *testing.T, b []byte, num protowire.Number) [][]byte {
+	t.Helper()
+	var values [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			t.Fatalf("bad tag: %v", protowire.ParseError(l))
+		}
+		b = b[l:]
+		if typ != protowire.BytesType {
+			t.Fatalf("field %d has type %v, want bytes", n, typ)
+		}
+		v, l := protowire.ConsumeBytes(b)
+		if l < 0 {
+			t.Fatalf("bad field %d: %v", n, protowire.ParseError(l))
+		}
+		b = b[l:]
+		if n == num {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// testGatherer returns a registry with metrics of every type the
+// remote writer converts.
+func testGatherer() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "sds011_pm25", Help: "PM2.5."}, []string{"device_id", "host"})
+	gauge.WithLabelValues("a1b2", "pi4").Set(12.3)
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "sds011_frames_total", Help: "Frames."})
+	counter.Add(42)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "sds011_latency_seconds", Help: "Latency.", Buckets: []float64{0.1, 1}})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	summary := prometheus.NewSummary(prometheus.SummaryOpts{Name: "sds011_pm10", Help: "PM10.", Objectives: map[float64]float64{0.5: 0.05}})
+	summary.Observe(20.1)
+	reg.MustRegister(gauge, counter, histogram, summary)
+	return reg
+}
+
+func TestAppendWriteRequest(t *testing.T) {
+	got := decodeWriteRequest(t, appendWriteRequest(nil, gatherAll(t, testGatherer()), 1500000000000))
+	const ts = 1500000000000
+	want := []remoteSeries{
+		{`{__name__="sds011_frames_total"}`, 42, ts},
+		{`{__name__="sds011_latency_seconds_bucket", le="0.1"}`, 1, ts},
+		{`{__name__="sds011_latency_seconds_bucket", le="1"}`, 2, ts},
+		{`{__name__="sds011_latency_seconds_bucket", le="+Inf"}`, 3, ts},
+		{`{__name__="sds011_latency_seconds_sum"}`, 2.55, ts},
+		{`{__name__="sds011_latency_seconds_count"}`, 3, ts},
+		{`{__name__="sds011_pm10", quantile="0.5"}`, 20.1, ts},
+		{`{__name__="sds011_pm10_sum"}`, 20.1, ts},
+		{`{__name__="sds011_pm10_count"}`, 1, ts},
+		{`{__name__="sds011_pm25", device_id="a1b2", host="pi4"}`, 12.3, ts},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("appendWriteRequest: got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func gatherAll(t *testing.T, g prometheus.Gatherer) []*dto.MetricFamily {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func TestRemoteWrite(t *testing.T) {
+	newRegistry(t)
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Header, body}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	rw, err := startRemoteWrite(remoteWriteConfig{url: server.URL + "/api/v1/write", username: "pi", password: "s3cret", queue: 10}, testGatherer())
+	if err != nil {
+		t.Fatalf("startRemoteWrite: %v", err)
+	}
+	sent := counterValue(remoteWriteSent)
+	before := time.Now().UnixMilli()
+	rw.Observe(sds011.Point{})
+	rw.Close()
+	after := time.Now().UnixMilli()
+
+	var r request
+	select {
+	case r = <-requests:
+	default:
+		t.Fatal("nothing was sent")
+	}
+	for k, v := range map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Basic cGk6czNjcmV0",
+	} {
+		if got := r.header.Get(k); got != v {
+			t.Errorf("sent %s %q, want %q", k, got, v)
+		}
+	}
+	body, err := snappy.Decode(nil, r.body)
+	if err != nil {
+		t.Fatalf("the body isn't snappy-compressed: %v", err)
+	}
+	series := decodeWriteRequest(t, body)
+	if len(series) != 10 {
+		t.Errorf("sent %d series, want 10", len(series))
+	}
+	for _, s := range series {
+		if s.ts < before || s.ts > after {
+			t.Errorf("series %v has timestamp %v, want from %v to %v", s.labels, s.ts, before, after)
+		}
+		if s.labels == `{__name__="sds011_pm25", device_id="a1b2", host="pi4"}` && s.value != 12.3 {
+			t.Errorf("series %v has value %v, want 12.3", s.labels, s.value)
+		}
+	}
+	if got := counterValue(remoteWriteSent) - sent; got != 1 {
+		t.Errorf("counted %v requests sent, want 1", got)
+	}
+}
+
+func TestRemoteWriteConfigCheck(t *testing.T) {
+	good := remoteWriteConfig{url: "https://prometheus/api/v1/write", token: "t", queue: 1}
+	if err := good.check(); err != nil {
+		t.Errorf("check(%+v): %v", good, err)
+	}
+	for _, bad := range []func(*remoteWriteConfig){
+		func(c *remoteWriteConfig) { c.url = "prometheus:9090" },
+		func(c *remoteWriteConfig) { c.username = "pi" },
+		func(c *remoteWriteConfig) { c.queue = 0 },
+	} {
+		cfg := good
+		bad(&cfg)
+		if err := cfg.check(); err == nil {
+			t.Errorf("check(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// replayPort is the port the measurements of -replay are of, for the
+// logs and HTTP answers.
+const replayPort = "replay"
+
+// alertsFired counts the alerts that started, for the summary -replay
+// ends with.
+var alertsFired atomic.Int64
+
+// checkReplay returns an error if -replay goes with flags it can't, as
+// they measure, or export metrics, which would be misleading for
+// measurements of the past.
+func checkReplay() error {
+	if *replayPath == "" {
+		return nil
+	}
+	switch {
+	case *replaySpeed < 0:
+		return fmt.Errorf("-replay-speed can't be negative, not %v", *replaySpeed)
+	case *simulate || *once:
+		return errors.New("-replay can't go with -simulate or -once")
+	case *remoteWriteURL != "" || *pushgatewayURL != "" || *otlp != "":
+		return errors.New("-replay doesn't export metrics, so it can't go with -remote-write-url, -pushgateway-url or -otlp")
+	}
+	return nil
+}
+
+// isCapture returns true if the file at path is a capture, or a
+// -debug dump, rather than measurements: if its first line, other
+// than comments, is a frame with its time and direction.
+func isCapture(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return false, nil
+		}
+		_, err := time.Parse(time.RFC3339Nano, fields[0])
+		return err == nil && (fields[1] == sds011.Sent.String() || fields[1] == sds011.Received.String()), nil
+	}
+	return false, scanner.Err()
+}
+
+// A replay feeds the measurements of -replay to the output and the
+// observers, as if they were just measured, keeping their timestamps.
+// The file is either measurements written by watch, taken as they are,
+// or a capture of a sensor, of which every -samples frames are
+// aggregated and calibrated like those of a sensor read. They come as
+// fast as they can, or, with -replay-speed, at the pace they were
+// recorded at, that many times faster.
+type replay struct {
+	path      string
+	out       pointio.PointWriter
+	observers []observer
+
+	// What was replayed, for the summary.
+	rows, missing int
+	first, last   time.Time
+}
+
+// runReplay replays -replay until it's exhausted or ctx is done, and
+// logs a summary of it.
+func runReplay(ctx context.Context, s *shared, h *health) error {
+	rp := &replay{
+		path:      *replayPath,
+		out:       s,
+		observers: []observer{portObserver(replayPort), s, h.forPort(replayPort)},
+	}
+	capture, err := isCapture(rp.path)
+	if err != nil {
+		return withExit(exitSensor, fmt.Errorf("reading -replay: %w", err))
+	}
+	fired := alertsFired.Load()
+	if capture {
+		err = rp.capture(ctx)
+	} else {
+		err = rp.measurements(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if rp.rows == 0 {
+		return withExit(exitFailed, fmt.Errorf("-replay %s has no measurements", rp.path))
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d measurements of %s, %d of them missing, from %s to %s; alerts that would have fired: %d\n",
+		rp.rows, rp.path, rp.missing, rp.first.Format(time.RFC3339), rp.last.Format(time.RFC3339), alertsFired.Load()-fired)
+	return nil
+}
+
+// measurements replays a file of measurements.
+func (rp *replay) measurements(ctx context.Context) error {
+	pf, err := openPointFile(rp.path)
+	if err != nil {
+		return withExit(exitSensor, fmt.Errorf("reading -replay: %w", err))
+	}
+	defer pf.Close()
+	var pace pacer
+	for !rp.done(ctx) {
+		point, err := pf.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return withExit(exitSensor, fmt.Errorf("-replay: %w", err))
+		}
+		if !pace.wait(ctx, point.Timestamp) {
+			return nil
+		}
+		if err := rp.emit(point); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capture replays a capture, which paces itself.
+func (rp *replay) capture(ctx context.Context) error {
+	f, err := os.Open(rp.path)
+	if err != nil {
+		return withExit(exitSensor, fmt.Errorf("reading -replay: %w", err))
+	}
+	defer f.Close()
+	sensor, err := sds011.NewFromCapture(f, sds011.WithReplaySpeed(*replaySpeed), sds011.WithLogger(slog.With("port", replayPort)))
+	if err != nil {
+		return withExit(exitSensor, fmt.Errorf("replaying -replay: %w", err))
+	}
+	defer sensor.Close()
+	for !rp.done(ctx) {
+		avg, ok, err := sample(ctx, observedDevice{calibratedDevice{sensor}, rp.observers, new(int)}, max(*samples, 1))
+		if ok {
+			if err := rp.emit(avg); err != nil {
+				return err
+			}
+		}
+		switch {
+		case errors.Is(err, sds011.ErrClosed) || ctx.Err() != nil:
+			// The capture is over.
+			return nil
+		case err != nil && !ok:
+			slog.Warn("replaying a measurement failed", "error", err, "kind", errorKind(err))
+		}
+	}
+	return nil
+}
+
+// done returns true if ctx is done, or -count measurements were
+// replayed.
+func (rp *replay) done(ctx context.Context) bool {
+	return ctx.Err() != nil || *count > 0 && rp.rows >= *count
+}
+
+// emit writes point, and tells the observers about it, as watch does
+// with the measurements it reads, or those of -emit-missing if it's
+// missing.
+func (rp *replay) emit(point sds011.Point) error {
+	point = inOutputLocation(point)
+	rp.rows++
+	if rp.first.IsZero() {
+		rp.first = point.Timestamp
+	}
+	rp.last = point.Timestamp
+	if point.Missing != "" {
+		rp.missing++
+		for _, o := range rp.observers {
+			if mo, ok := o.(missingObserver); ok {
+				mo.ObserveMissing(point)
+			}
+		}
+	} else {
+		for _, o := range rp.observers {
+			o.Observe(point)
+		}
+	}
+	if err := rp.out.Write(point); err != nil {
+		return withExit(exitOutput, fmt.Errorf("writing output: %w", err))
+	}
+	return nil
+}
+
+// A pacer waits for the measurements of a replay to be due, at the
+// pace they were recorded at, -replay-speed times faster, or not at
+// all if it's 0.
+type pacer struct {
+	first, start time.Time
+}
+
+// wait waits until a measurement taken at t is due, and returns false
+// if ctx is done first.
+func (p *pacer) wait(ctx context.Context, t time.Time) bool {
+	if *replaySpeed == 0 {
+		return true
+	}
+	if p.first.IsZero() {
+		p.first, p.start = t, time.Now()
+		return true
+	}
+	due := p.start.Add(time.Duration(float64(t.Sub(p.first)) / *replaySpeed))
+	select {
+	case <-time.After(time.Until(due)):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A clock tells the time and waits, so that the schedule can be run
+// without waiting for real.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// alignCheck is how often an aligned schedule looks at the clock
+// while waiting, in case it was set.
+const alignCheck = time.Minute
+
+// A schedule starts measurements every interval, at fixed times
+// counted from the first one, so that the cadence doesn't drift with
+// how long measuring takes.
+type schedule struct {
+	interval time.Duration
+	// align makes the start times fall on the boundaries of the
+	// interval instead, counted from midnight on the clock (see
+	// boundaryAfter).
+	align bool
+	// warmup is how long the sensor needs to be awake before
+	// measuring. It is put to sleep between measurements only if
+	// they are further apart than that.
+	warmup time.Duration
+	clock  clock
+	next   time.Time
+	// idle, if set, is called with how long the schedule is going
+	// to wait before it does.
+	idle func(time.Duration)
+	// triggers, if set, cut waiting short, for a measurement out of
+	// the schedule (see errTriggered).
+	triggers <-chan struct{}
+	// reopens, if set, cut waiting short, to open the port again
+	// (see errReopen).
+	reopens <-chan struct{}
+	// keepSkipped makes advance add the start times it skips to
+	// skipped.
+	keepSkipped bool
+	skipped     []time.Time
+}
+
+// errTriggered is returned by schedule.wait when a measurement was
+// asked for while waiting. The schedule stays as it was, and
+// schedule.resume waits for the next start time.
+var errTriggered = errors.New("measurement triggered")
+
+// errReopen is returned by schedule.wait when opening the port again
+// was asked for while waiting, like errTriggered.
+var errReopen = errors.New("reopening the port")
+
+func newSchedule(interval, warmup time.Duration, clock clock) *schedule {
+	return &schedule{interval: interval, warmup: warmup, clock: clock, next: clock.Now()}
+}
+
+// setInterval changes the interval, counting the start times from
+// now.
+func (s *schedule) setInterval(interval time.Duration) {
+	s.interval, s.next = interval, s.clock.Now()
+	if s.align {
+		s.next = s.boundaryAfter(s.next)
+	}
+}
+
+// boundaryAfter returns the first boundary of the interval after t:
+// the first time after it that is a whole number of intervals after
+// midnight on the clock, like :00, :15, :30 and :45 for 15 minutes.
+// Boundaries are counted on the clock rather than in elapsed time, so
+// they stay on the quarter hours across DST changes. The result has no
+// monotonic clock reading, so that waiting for it follows the wall
+// clock if it's set.
+func (s *schedule) boundaryAfter(t time.Time) time.Time {
+	y, m, d := t.Date()
+	h, minute, sec := t.Clock()
+	sinceMidnight := time.Duration(h)*time.Hour + time.Duration(minute)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	for k := sinceMidnight/s.interval + 1; ; k++ {
+		// time.Date normalizes the nanoseconds into the wall clock
+		// time. When the clock is set back for DST, the boundary can
+		// be the first of the two times it reads so, before t.
+		b := time.Date(y, m, d, 0, 0, 0, int(k*s.interval), t.Location())
+		if b.After(t) {
+			return b
+		}
+	}
+}
+
+// advance moves the schedule to the first start time after now, and
+// returns how many start times were skipped because the last
+// measurement took longer than the interval.
+func (s *schedule) advance(now time.Time) (skipped int) {
+	if s.align {
+		next := s.boundaryAfter(now)
+		for t := s.boundaryAfter(s.next); t.Before(next); t = s.boundaryAfter(t) {
+			if s.keepSkipped {
+				s.skipped = append(s.skipped, t)
+			}
+			skipped++
+		}
+		s.next = next
+		return skipped
+	}
+	s.next = s.next.Add(s.interval)
+	for s.next.Before(now) {
+		if s.keepSkipped {
+			s.skipped = append(s.skipped, s.next)
+		}
+		s.next = s.next.Add(s.interval)
+		skipped++
+	}
+	return skipped
+}
+
+// wait waits for the next measurement to start, putting the sensor to
+// sleep in the meantime if there is time to warm it up again
+// afterwards (see warmUp). With no interval, it returns at once. It
+// returns ctx.Err() if ctx is done first, or errTriggered or
+// errReopen, leaving the sensor as it is.
+func (s *schedule) wait(ctx context.Context, sensor sds011.Device) error {
+	if s.interval <= 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-s.triggers:
+			return errTriggered
+		case <-s.reopens:
+			return errReopen
+		default:
+			return nil
+		}
+	}
+	if skipped := s.advance(s.clock.Now()); skipped > 0 {
+		slog.Warn("measuring took longer than the interval, skipping", "skipped", skipped, "interval", s.interval)
+	}
+	return s.resume(ctx, sensor)
+}
+
+// resume is wait without moving on to the next start time, for after
+// errTriggered or errReopen.
+func (s *schedule) resume(ctx context.Context, sensor sds011.Device) error {
+	if left := s.untilWake(); left > 0 {
+		if err := sensor.Sleep(); err != nil {
+			slog.Warn("putting the sensor to sleep", "error", err)
+		}
+		for left > 0 {
+			if s.align {
+				left = min(left, alignCheck)
+			}
+			if err := s.sleep(ctx, left); err != nil {
+				return err
+			}
+			left = s.untilWake()
+		}
+		if err := sensor.Awake(); err != nil {
+			slog.Warn("waking the sensor up", "error", err)
+		}
+		return warmUp(ctx, sensor, s.next.Sub(s.clock.Now()))
+	}
+	return s.sleep(ctx, s.next.Sub(s.clock.Now()))
+}
+
+// untilWake returns how long it is until the sensor has to wake up
+// for the next measurement. If the schedule is aligned and the clock
+// was set back, the next measurement is moved to the first boundary
+// after now, rather than waiting for longer than the interval.
+func (s *schedule) untilWake() time.Duration {
+	now := s.clock.Now()
+	if s.align && s.next.Sub(now) > s.interval {
+		s.next = s.boundaryAfter(now)
+	}
+	return s.next.Add(-s.warmup).Sub(now)
+}
+
+// warmUp reads and discards the measurements the sensor sends for d
+// after it wakes up, as they are too low until the fan has blown the
+// old air out of it. It returns ctx.Err() if ctx is done first.
+func warmUp(ctx context.Context, sensor sds011.Device, d time.Duration) error {
+	warm, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	discarded := 0
+	for warm.Err() == nil {
+		if _, err := sensor.GetContext(warm); err == nil {
+			discarded++
+		}
+	}
+	warmupDiscarded.Add(uint64(discarded))
+	slog.Debug("warmed up", "duration", d, "discarded", discarded)
+	return ctx.Err()
+}
+
+// wakeDiscard is how many measurements are still to be discarded after
+// the sensor last woke up, and when it did.
+type wakeDiscard struct {
+	n    int // how many to discard after every wake
+	left int
+	woke time.Time // zero once a measurement started from it
+}
+
+// start returns when the measurement starting now began: when the
+// sensor woke up for it, if it did.
+func (d *wakeDiscard) start() time.Time {
+	t := time.Now()
+	if !d.woke.IsZero() {
+		t, d.woke = d.woke, time.Time{}
+	}
+	return t
+}
+
+// wakingDevice is a device that has the next measurement discard
+// the first ones when it's woken up.
+type wakingDevice struct {
+	sds011.Device
+	discard *wakeDiscard
+}
+
+func (d wakingDevice) Awake() error {
+	err := d.Device.Awake()
+	if err == nil {
+		d.discard.left, d.discard.woke = d.discard.n, time.Now()
+	}
+	return err
+}
+
+// discardingDevice is a device that throws away the measurements left
+// to discard before returning one.
+type discardingDevice struct {
+	sds011.Device
+	discard *wakeDiscard
+}
+
+func (d discardingDevice) GetContext(ctx context.Context) (*sds011.Point, error) {
+	for d.discard.left > 0 {
+		point, err := d.Device.GetContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.discard.left--
+		slog.Debug("discarded a measurement after waking up", "pm2_5", point.PM25, "pm10", point.PM10, "left", d.discard.left)
+	}
+	return d.Device.GetContext(ctx)
+}
+
+// sleep waits for d, or until ctx is done, a measurement is
+// triggered or opening the port again is asked for.
+func (s *schedule) sleep(ctx context.Context, d time.Duration) error {
+	if s.idle != nil {
+		s.idle(d)
+	}
+	select {
+	case <-s.clock.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.triggers:
+		return errTriggered
+	case <-s.reopens:
+		return errReopen
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// A fakeClock is a clock whose time only moves when it's waited on,
+// at once, or when the test says so.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// block makes After never fire.
+	block bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.block {
+		return nil
+	}
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// powerDevice is a mock counting how many times it was put to sleep
+// and woken up.
+type powerDevice struct {
+	*sds011test.Mock
+	sleeps, wakes int
+}
+
+func (d *powerDevice) Sleep() error {
+	d.sleeps++
+	return d.Mock.Sleep()
+}
+
+func (d *powerDevice) Awake() error {
+	d.wakes++
+	return d.Mock.Awake()
+}
+
+func newPowerDevice(t *testing.T) *powerDevice {
+	d := &powerDevice{Mock: sds011test.NewMock()}
+	t.Cleanup(d.Close)
+	return d
+}
+
+var scheduleStart = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func TestScheduleCadence(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart}
+	// The warm-up takes real time, so it's kept short.
+	const warmup = 10 * time.Millisecond
+	s := newSchedule(10*time.Minute, warmup, clock)
+	dev := newPowerDevice(t)
+
+	for i := 1; i <= 4; i++ {
+		// However long measuring takes, the next one starts on time.
+		clock.advance(time.Duration(i) * time.Minute)
+		if err := s.wait(context.Background(), dev); err != nil {
+			t.Fatalf("wait: %v", err)
+		}
+		want := scheduleStart.Add(time.Duration(i) * 10 * time.Minute)
+		if !s.next.Equal(want) {
+			t.Errorf("measurement %d scheduled at %v, want %v", i, s.next, want)
+		}
+		// The sensor is woken up the warm-up before it.
+		if now := clock.Now(); !now.Equal(want.Add(-warmup)) {
+			t.Errorf("measurement %d: woke the sensor up at %v, want %v", i, now, want.Add(-warmup))
+		}
+		if awake, _ := dev.State(); !awake {
+			t.Errorf("measurement %d: the sensor is asleep", i)
+		}
+		clock.advance(warmup)
+	}
+	if dev.sleeps != 4 || dev.wakes != 4 {
+		t.Errorf("put the sensor to sleep %d times and woke it up %d times, want 4 and 4", dev.sleeps, dev.wakes)
+	}
+}
+
+func TestScheduleSkipsMissedStarts(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart}
+	s := newSchedule(10*time.Minute, 0, clock)
+	s.keepSkipped = true
+
+	// Measuring took 25 minutes: the starts at 10 and 20 minutes are
+	// skipped rather than caught up with.
+	if skipped := s.advance(scheduleStart.Add(25 * time.Minute)); skipped != 2 {
+		t.Errorf("advance skipped %d start times, want 2", skipped)
+	}
+	if want := scheduleStart.Add(30 * time.Minute); !s.next.Equal(want) {
+		t.Errorf("next measurement at %v, want %v", s.next, want)
+	}
+	want := []time.Time{scheduleStart.Add(10 * time.Minute), scheduleStart.Add(20 * time.Minute)}
+	if len(s.skipped) != 2 || !s.skipped[0].Equal(want[0]) || !s.skipped[1].Equal(want[1]) {
+		t.Errorf("skipped %v, want %v", s.skipped, want)
+	}
+	if skipped := s.advance(scheduleStart.Add(31 * time.Minute)); skipped != 0 {
+		t.Errorf("advance skipped %d start times, want 0", skipped)
+	}
+}
+
+func TestScheduleStaysAwakeWithoutHeadroom(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart}
+	s := newSchedule(20*time.Second, 30*time.Second, clock)
+	var waits []time.Duration
+	s.idle = func(d time.Duration) { waits = append(waits, d) }
+	dev := newPowerDevice(t)
+
+	clock.advance(5 * time.Second)
+	if err := s.wait(context.Background(), dev); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if dev.sleeps != 0 || dev.wakes != 0 {
+		t.Errorf("put the sensor to sleep %d times and woke it up %d times with an interval shorter than the warm-up, want neither", dev.sleeps, dev.wakes)
+	}
+	if len(waits) != 1 || waits[0] != 15*time.Second {
+		t.Errorf("waited for %v, want 15s", waits)
+	}
+	if want := scheduleStart.Add(20 * time.Second); !clock.Now().Equal(want) {
+		t.Errorf("wait returned at %v, want %v", clock.Now(), want)
+	}
+}
+
+func TestScheduleWithoutInterval(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart, block: true}
+	s := newSchedule(0, time.Minute, clock)
+	if err := s.wait(context.Background(), newPowerDevice(t)); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.wait(ctx, newPowerDevice(t)); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait with ctx done: got error %v, want context.Canceled", err)
+	}
+}
+
+func TestScheduleTriggered(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart, block: true}
+	s := newSchedule(10*time.Minute, 0, clock)
+	triggers := make(chan struct{}, 1)
+	s.triggers = triggers
+	dev := newPowerDevice(t)
+
+	triggers <- struct{}{}
+	if err := s.wait(context.Background(), dev); !errors.Is(err, errTriggered) {
+		t.Fatalf("wait with a trigger: got error %v, want errTriggered", err)
+	}
+	// The schedule stays as it was.
+	if want := scheduleStart.Add(10 * time.Minute); !s.next.Equal(want) {
+		t.Errorf("after a trigger, next measurement at %v, want %v", s.next, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.resume(ctx, dev); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("resume: got error %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestScheduleAligned(t *testing.T) {
+	clock := &fakeClock{now: scheduleStart.Add(7*time.Minute + 30*time.Second)}
+	s := newSchedule(15*time.Minute, 0, clock)
+	s.align = true
+	s.setInterval(15 * time.Minute)
+	if want := scheduleStart.Add(15 * time.Minute); !s.next.Equal(want) {
+		t.Errorf("aligned schedule starts at %v, want %v", s.next, want)
+	}
+	// Measuring past the next boundary skips it.
+	if skipped := s.advance(scheduleStart.Add(31 * time.Minute)); skipped != 1 {
+		t.Errorf("advance skipped %d start times, want 1", skipped)
+	}
+	if want := scheduleStart.Add(45 * time.Minute); !s.next.Equal(want) {
+		t.Errorf("next measurement at %v, want %v", s.next, want)
+	}
+}
+
+func TestBoundaryAfterDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Warsaw")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	s := &schedule{interval: 15 * time.Minute}
+	// Clocks went forward from 2:00 to 3:00 on 31 March 2024.
+	before := time.Date(2024, 3, 31, 1, 50, 0, 0, loc)
+	if got, want := s.boundaryAfter(before), time.Date(2024, 3, 31, 3, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("boundaryAfter(%v) = %v, want %v", before, got, want)
+	}
+	after := time.Date(2024, 3, 31, 3, 5, 0, 0, loc)
+	if got, want := s.boundaryAfter(after), time.Date(2024, 3, 31, 3, 15, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("boundaryAfter(%v) = %v, want %v", after, got, want)
+	}
+}
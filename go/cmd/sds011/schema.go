@@ -0,0 +1,251 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	runtimedebug "runtime/debug"
+	"sync"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// schemaVersion is the version of the JSON of measurements, in its
+// schema field. It goes up whenever the fields of record or
+// runMetadata, or those of sds011.Point.MarshalJSON, change.
+const schemaVersion = 3
+
+// metadataModes are what -metadata takes.
+var metadataModes = []string{"record", "header", "off"}
+
+// A record is the JSON of a measurement that -format=jsonl, /latest
+// and webhooks write: the fields of sds011.Point.MarshalJSON,
+// followed by its own, and by one for every -tag tag. Without a
+// point, it's the header -metadata=header starts -format=jsonl with,
+// of just the schema and the metadata.
+type record struct {
+	Point *sds011.Point `json:"-"`
+	// extended adds the columns of -extended-columns to the point's.
+	extended bool
+	tags     []pointio.Tag
+
+	AgeSeconds  *int64       `json:"age_seconds,omitempty"` // for /latest
+	AQI         *int         `json:"aqi,omitempty"`
+	AQICategory string       `json:"aqi_category,omitempty"`
+	Port        string       `json:"port,omitempty"`
+	Schema      int          `json:"schema"`
+	Metadata    *runMetadata `json:"metadata,omitempty"`
+	// Devices are the latest records of the devices combined, by
+	// device ID, for /latest with -combine.
+	Devices map[string]record `json:"devices,omitempty"`
+}
+
+// newRecord returns the record of point, with the metadata of its port
+// unless -metadata=off, and the tags.
+func newRecord(point sds011.Point, port string) record {
+	r := record{Point: &point, Schema: schemaVersion, tags: recordTags.get()}
+	if *metadataMode != "off" {
+		r.Metadata = runMeta.of(port)
+	}
+	return r
+}
+
+// withAQI adds the index and category fn returns for the point.
+func (r record) withAQI(fn func(sds011.Point) (int, string)) record {
+	if r.Point.Missing == "" {
+		index, category := fn(*r.Point)
+		r.AQI, r.AQICategory = &index, category
+	}
+	return r
+}
+
+func (r record) MarshalJSON() ([]byte, error) {
+	type fields record // without this method
+	rest, err := json.Marshal(fields(r))
+	if err != nil || r.Point == nil {
+		return rest, err
+	}
+	b, err := json.Marshal(*r.Point)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || b[len(b)-1] != '}' {
+		return nil, errors.New("a point isn't encoded as a JSON object")
+	}
+	b = b[:len(b)-1]
+	if r.extended && r.Point.Missing == "" {
+		b = pointio.AppendExtendedJSON(b, *r.Point)
+	}
+	b = append(append(b, ','), rest[1:]...)
+	return appendTagFields(b, r.tags)
+}
+
+// appendTagFields adds a field for every tag to b, a JSON object.
+func appendTagFields(b []byte, tags []pointio.Tag) ([]byte, error) {
+	for _, t := range tags {
+		key, err := json.Marshal(t.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(t.Value)
+		if err != nil {
+			return nil, err
+		}
+		b = fmt.Appendf(b[:len(b)-1], `,%s:%s}`, key, value)
+	}
+	return b, nil
+}
+
+// runMetadata describes the run that read a sensor's measurements, for
+// -metadata.
+type runMetadata struct {
+	Hostname        string            `json:"hostname"`
+	Port            string            `json:"port"`
+	DeviceID        string            `json:"device_id,omitempty"` // unless the sensor didn't say
+	Firmware        string            `json:"firmware,omitempty"`
+	Version         string            `json:"version"` // of sds011
+	IntervalSeconds float64           `json:"interval_seconds"`
+	Samples         int               `json:"samples"`
+	Tags            map[string]string `json:"tags,omitempty"` // of -tag
+}
+
+// runMeta is the metadata of the sensors read.
+var runMeta metadataSet
+
+// A metadataSet holds the metadata of every sensor read, by port.
+type metadataSet struct {
+	mu      sync.Mutex
+	sensors map[string]*runMetadata
+	ports   []string // in the order they were added
+}
+
+// add asks the sensor at port for its device ID and firmware, and adds
+// its metadata. The rest is the same for all sensors, and is set by
+// reload.
+func (m *metadataSet) add(port string, sensor *sds011.Sensor) {
+	meta := &runMetadata{Port: port}
+	if id, err := sensor.DeviceID(); err == nil {
+		meta.DeviceID = fmt.Sprintf("%04x", id)
+	} else {
+		slog.Warn("asking the sensor for its device ID for -metadata", "port", port, "error", err)
+	}
+	if fw, err := sensor.Firmware(); err == nil {
+		meta.Firmware = fw.String()
+	} else {
+		slog.Warn("asking the sensor for its firmware for -metadata", "port", port, "error", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sensors == nil {
+		m.sensors = make(map[string]*runMetadata)
+	}
+	m.sensors[port] = meta
+	m.ports = append(m.ports, port)
+	m.reloadLocked()
+}
+
+// reload takes the -interval, -samples and -tag flags again, after
+// they were changed.
+func (m *metadataSet) reload() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reloadLocked()
+}
+
+func (m *metadataSet) reloadLocked() {
+	host, _ := os.Hostname()
+	var tagMap map[string]string
+	if len(*tags) > 0 {
+		tagMap = make(map[string]string, len(*tags))
+		for _, t := range *tags {
+			tagMap[t.Key] = t.Value
+		}
+	}
+	for _, meta := range m.sensors {
+		meta.Hostname, meta.Version, meta.Tags = host, toolVersion(), tagMap
+		meta.IntervalSeconds, meta.Samples = interval.Seconds(), *samples
+	}
+}
+
+// of returns a copy of the metadata of the sensor at port, or of the
+// only one if port is empty, as for a measurement whose port isn't
+// known yet. It returns nil if there's none.
+func (m *metadataSet) of(port string) *runMetadata {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if port == "" && len(m.ports) == 1 {
+		port = m.ports[0]
+	}
+	meta, ok := m.sensors[port]
+	if !ok {
+		return nil
+	}
+	c := *meta
+	return &c
+}
+
+// headers returns the records -metadata=header starts -format=jsonl
+// with, one for every sensor.
+func (m *metadataSet) headers() []any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	headers := make([]any, 0, len(m.ports))
+	for _, port := range m.ports {
+		meta := *m.sensors[port]
+		headers = append(headers, record{Schema: schemaVersion, Metadata: &meta})
+	}
+	return headers
+}
+
+// jsonOptions returns the options making -format=jsonl write records,
+// starting with the headers of -metadata=header if fresh is set. The
+// writer adds the tags itself, as columns.
+func jsonOptions(fresh bool) []pointio.Option {
+	opts := []pointio.Option{pointio.WithJSONMarshal(func(point sds011.Point) ([]byte, error) {
+		r := newRecord(point, devicePorts.of(point))
+		if *metadataMode != "record" {
+			r.Metadata = nil
+		}
+		r.tags = nil
+		return json.Marshal(r)
+	})}
+	if *metadataMode == "header" && fresh {
+		opts = append(opts, pointio.WithJSONHeader(runMeta.headers))
+	}
+	return opts
+}
+
+// toolVersion returns the version of sds011: that of its module, or
+// the commit it was built from, if it's known.
+func toolVersion() string {
+	info, ok := runtimedebug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return "devel"
+}
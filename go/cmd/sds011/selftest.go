@@ -0,0 +1,304 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+const (
+	// minFrameRate is the slowest rate of data frames that passes, as
+	// the sensor sends one every second when it works continuously.
+	minFrameRate = 0.5
+
+	// maxBadFrames is the highest fraction of bad frames that passes.
+	maxBadFrames = 0.05
+
+	// maxValue is the highest concentration the sensor reports, in
+	// µg/m³.
+	maxValue = 999.9
+)
+
+// A selftestStep is the outcome of one of the checks of selftest.
+type selftestStep struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"` // pass, fail or skip
+	Detail   string  `json:"detail,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// selftestData is what the data frames collected showed.
+type selftestData struct {
+	Frames       uint64  `json:"frames"`
+	FrameRate    float64 `json:"frame_rate"`
+	BadFrames    uint64  `json:"bad_frames"`
+	BadFrameRate float64 `json:"bad_frame_rate"`
+	PM25Mean     float64 `json:"pm2_5_mean"`
+	PM10Mean     float64 `json:"pm10_mean"`
+	PM25StdDev   float64 `json:"pm2_5_stddev"`
+	PM10StdDev   float64 `json:"pm10_stddev"`
+}
+
+// selftestReport is what selftest prints.
+type selftestReport struct {
+	Result string         `json:"result"` // pass or fail
+	Port   string         `json:"port"`
+	Steps  []selftestStep `json:"steps"`
+	Data   *selftestData  `json:"data,omitempty"` // nil if there were no frames
+}
+
+// step runs the check fn, which returns what it found or why it
+// failed, and adds it to the report. It returns false if it failed.
+func (r *selftestReport) step(name string, fn func() (string, error)) bool {
+	start := time.Now()
+	detail, err := fn()
+	s := selftestStep{Name: name, Status: "pass", Detail: detail, Duration: time.Since(start).Round(time.Millisecond).Seconds()}
+	if err != nil {
+		s.Status, s.Error = "fail", err.Error()
+	}
+	r.Steps = append(r.Steps, s)
+	return err == nil
+}
+
+// skip adds a check that wasn't done to the report.
+func (r *selftestReport) skip(name, why string) {
+	r.Steps = append(r.Steps, selftestStep{Name: name, Status: "skip", Detail: why})
+}
+
+// selftest checks the sensor at -port_path, step by step, and prints
+// what it found to w, as aligned text or as JSON. Every command waits
+// for -timeout, and every data frame for -data-timeout, so that a dead
+// sensor fails quickly. It returns an error if a check failed.
+func selftest(ctx context.Context, w io.Writer, logger *slog.Logger, asJSON bool) error {
+	r := &selftestReport{Port: *portPath}
+	var sensor *sds011.Sensor
+	opened := r.step("open", func() (string, error) {
+		var err error
+		sensor, err = openSensor(logger,
+			sds011.WithCommandTimeout(*selftestFlags.timeout),
+			sds011.WithDataTimeout(*selftestFlags.dataTimeout),
+			sds011.WithRangeCheck(false))
+		r.Port = *portPath
+		if err != nil {
+			return "", err
+		}
+		return *portPath, nil
+	})
+	if opened {
+		defer sensor.Close()
+		runSelftest(ctx, r, sensor)
+	}
+
+	failed := 0
+	for _, s := range r.Steps {
+		if s.Status == "fail" {
+			failed++
+		}
+	}
+	r.Result = "pass"
+	if failed > 0 {
+		r.Result = "fail"
+	}
+	if err := r.print(w, asJSON); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return withExit(exitSensor, fmt.Errorf("%d of %d checks failed", failed, len(r.Steps)))
+	}
+	return nil
+}
+
+// runSelftest does the checks of the open sensor, putting it back to
+// sleep at the end if it was asleep.
+func runSelftest(ctx context.Context, r *selftestReport, sensor *sds011.Sensor) {
+	if awake, err := sensor.State(); err == nil && !awake {
+		defer sensor.Sleep()
+	}
+	r.step("firmware", func() (string, error) {
+		fw, err := sensor.Firmware()
+		if err != nil {
+			return "", err
+		}
+		return fw.String(), nil
+	})
+	if sensor.Model() == sds011.SDS018 {
+		r.skip("device ID", "the SDS018 doesn't report it")
+	} else {
+		r.step("device ID", func() (string, error) {
+			id, err := sensor.DeviceID()
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%04X", id), nil
+		})
+	}
+	active := true
+	r.step("reporting mode", func() (string, error) {
+		var err error
+		if active, err = sensor.ReportMode(); err != nil {
+			active = true
+			return "", err
+		}
+		if !active {
+			return "query", nil
+		}
+		return "active", nil
+	})
+	r.step("sleep", func() (string, error) {
+		return "confirmed", sensor.Sleep()
+	})
+	if !r.step("wake", func() (string, error) {
+		return "confirmed", sensor.Awake()
+	}) {
+		r.skip("data frames", "the sensor didn't wake up")
+		r.skip("values", "no data frames")
+		return
+	}
+
+	var points []sds011.Point
+	before := sensor.Stats()
+	start := time.Now()
+	r.step("data frames", func() (string, error) {
+		collect, cancel := context.WithTimeout(ctx, *selftestFlags.duration)
+		defer cancel()
+		var stopped error
+		for collect.Err() == nil && stopped == nil {
+			var point *sds011.Point
+			var err error
+			if active {
+				point, err = sensor.GetContext(collect)
+			} else {
+				point, err = sensor.Query()
+				if err == nil {
+					sleepCtx(collect, time.Second)
+				}
+			}
+			switch {
+			case err == nil:
+				points = append(points, *point)
+			case collect.Err() != nil:
+			case errors.Is(err, sds011.ErrTimeout) || !sds011.Recoverable(err):
+				// A dead sensor fails in -data-timeout, not -duration.
+				stopped = err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		after := sensor.Stats()
+		elapsed := time.Since(start).Seconds()
+		d := &selftestData{Frames: after.Frames - before.Frames}
+		d.BadFrames = after.BadHeaders + after.BadLengths + after.BadChecksums - before.BadHeaders - before.BadLengths - before.BadChecksums
+		d.FrameRate = math.Round(float64(len(points))/elapsed*100) / 100
+		if d.Frames > 0 {
+			d.BadFrameRate = math.Round(float64(d.BadFrames)/float64(d.Frames)*1000) / 1000
+		}
+		r.Data = d
+		detail := fmt.Sprintf("%d in %.0fs, %.2f/s, %d bad (%.1f%%)", len(points), elapsed, d.FrameRate, d.BadFrames, 100*d.BadFrameRate)
+		switch {
+		case stopped != nil:
+			return detail, stopped
+		case d.FrameRate < minFrameRate:
+			return detail, fmt.Errorf("fewer than %v frames a second: is a working period set?", minFrameRate)
+		case d.BadFrameRate > maxBadFrames:
+			return detail, fmt.Errorf("more than %v%% bad frames: check the cabling", 100*maxBadFrames)
+		}
+		return detail, nil
+	})
+	if len(points) == 0 {
+		r.skip("values", "no data frames")
+		return
+	}
+	r.step("values", func() (string, error) {
+		var agg sds011.Aggregator
+		var problems []string
+		zero, outOfRange, inverted := 0, 0, 0
+		for _, p := range points {
+			agg.Add(p)
+			switch {
+			case p.PM25 == 0 && p.PM10 == 0:
+				zero++
+			case p.PM25 < 0 || p.PM10 < 0 || p.PM25 > maxValue || p.PM10 > maxValue:
+				outOfRange++
+			case p.PM25 > p.PM10:
+				inverted++
+			}
+		}
+		s := agg.Summary()
+		if r.Data != nil {
+			r.Data.PM25Mean, r.Data.PM10Mean = math.Round(s.PM25.Mean*100)/100, math.Round(s.PM10.Mean*100)/100
+			r.Data.PM25StdDev, r.Data.PM10StdDev = math.Round(s.PM25.StdDev*100)/100, math.Round(s.PM10.StdDev*100)/100
+		}
+		detail := fmt.Sprintf("PM2.5 %.1f±%.1f, PM10 %.1f±%.1f µg/m³", s.PM25.Mean, s.PM25.StdDev, s.PM10.Mean, s.PM10.StdDev)
+		if zero == len(points) {
+			problems = append(problems, "all zero: is the fan or the laser broken?")
+		}
+		if outOfRange > 0 {
+			problems = append(problems, fmt.Sprintf("%d out of range", outOfRange))
+		}
+		if inverted > len(points)/10 {
+			problems = append(problems, fmt.Sprintf("PM2.5 above PM10 in %d", inverted))
+		}
+		if len(points) > 1 && s.PM25.StdDev == 0 && s.PM10.StdDev == 0 && zero < len(points) {
+			problems = append(problems, "never changing: is the sensor stuck?")
+		}
+		if len(problems) > 0 {
+			return detail, errors.New(strings.Join(problems, ", "))
+		}
+		return detail, nil
+	})
+}
+
+// sleepCtx waits for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// print writes the report to w.
+func (r *selftestReport) print(w io.Writer, asJSON bool) error {
+	if asJSON {
+		return json.NewEncoder(w).Encode(r)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, s := range r.Steps {
+		what := s.Detail
+		if s.Error != "" {
+			what = strings.TrimPrefix(what+": "+s.Error, ": ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(s.Status), s.Name, what)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\n%s: %s\n", strings.ToUpper(r.Result), r.Port)
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// simulatedPort is the port the -simulate sensor is at, for the logs,
+// metrics and HTTP answers.
+const simulatedPort = "simulated"
+
+// checkSimulation returns an error if the -simulate flags are out of
+// range.
+func checkSimulation() error {
+	if *simulatePM25 < 0 || *simulatePM10 < 0 || *simulateDiurnal < 0 || *simulateWalk < 0 || *simulateSpikes < 0 {
+		return errors.New("the -simulate flags can't be negative")
+	}
+	return nil
+}
+
+// newSimulatedSensor returns a sensor connected to a fake one, which
+// measures what a Simulation made of the -simulate flags makes up. It
+// answers commands like a real one does, so it goes to sleep and
+// wakes up on schedule, and reports its own device ID.
+func newSimulatedSensor(logger *slog.Logger) (*sds011.Sensor, error) {
+	seed := *simulateSeed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	sim := &sds011test.Simulation{
+		PM25:    *simulatePM25,
+		PM10:    *simulatePM10,
+		Diurnal: *simulateDiurnal,
+		Walk:    *simulateWalk,
+		Spikes:  *simulateSpikes,
+		Seed:    seed,
+	}
+	debugOpts, err := debugOptions(simulatedPort)
+	if err != nil {
+		return nil, err
+	}
+	sensor, fake, err := sds011test.NewSensor(append([]sds011.Option{sds011.WithLogger(logger.With("port", simulatedPort))}, debugOpts...)...)
+	if err != nil {
+		return nil, err
+	}
+	fake.SetSource(sim.Reading)
+	slog.Info("simulating a sensor", "device_id", fmt.Sprintf("%04x", fake.DeviceID()), "seed", seed)
+	return sensor, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+var (
+	// smoothings are the values of -smoothing.
+	smoothings = []string{"off", "ema"}
+
+	// alertSeries are the values of -alert-on.
+	alertSeries = []string{"raw", "smoothed", "rate"}
+)
+
+// A smoother keeps the exponential moving average of the
+// concentrations of every device, for the output, the metrics and the
+// alerts. Each measurement moves the averages alpha of the way to its
+// values, and one coming more than reset after the previous one, as
+// after an outage, starts them over. It is an observer, which has to
+// see measurements before anything asks for their averages.
+type smoother struct {
+	alpha float64
+	reset time.Duration // 0 for never
+
+	mu      sync.Mutex
+	devices map[uint16]*deviceEMA
+}
+
+// deviceEMA is what a smoother keeps for a device.
+type deviceEMA struct {
+	last       sds011.Point // the latest measurement
+	pm25, pm10 float64      // the averages up to last
+}
+
+// smooth is the smoother -smoothing asks for, or nil.
+var smooth *smoother
+
+// newSmoother returns the smoother -smoothing, -smoothing-alpha and
+// -smoothing-reset ask for, or nil if it's off.
+func newSmoother() (*smoother, error) {
+	if !slices.Contains(smoothings, *smoothing) {
+		return nil, fmt.Errorf("unknown -smoothing %q, want one of %v", *smoothing, strings.Join(smoothings, ", "))
+	}
+	if !slices.Contains(alertSeries, *alertOn) {
+		return nil, fmt.Errorf("unknown -alert-on %q, want one of %v", *alertOn, strings.Join(alertSeries, ", "))
+	}
+	if *smoothing == "off" {
+		if *alertOn == "smoothed" {
+			return nil, errors.New("-alert-on=smoothed needs -smoothing")
+		}
+		return nil, nil
+	}
+	if !(*smoothingAlpha > 0 && *smoothingAlpha <= 1) {
+		return nil, fmt.Errorf("-smoothing-alpha must be above 0 and at most 1, not %v", *smoothingAlpha)
+	}
+	if *smoothingReset < 0 {
+		return nil, fmt.Errorf("-smoothing-reset can't be negative, not %v", *smoothingReset)
+	}
+	return &smoother{alpha: *smoothingAlpha, reset: *smoothingReset, devices: make(map[uint16]*deviceEMA)}, nil
+}
+
+func (s *smoother) Observe(point sds011.Point) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.devices[point.DeviceID]
+	switch {
+	case d == nil:
+		d = new(deviceEMA)
+		s.devices[point.DeviceID] = d
+		d.pm25, d.pm10 = point.PM25, point.PM10
+	case s.reset > 0 && point.Timestamp.Sub(d.last.Timestamp) > s.reset:
+		d.pm25, d.pm10 = point.PM25, point.PM10
+	default:
+		d.pm25 += s.alpha * (point.PM25 - d.pm25)
+		d.pm10 += s.alpha * (point.PM10 - d.pm10)
+	}
+	d.last = point
+}
+
+func (s *smoother) ObserveError(error) {}
+
+// of returns the averages up to point. For the latest measurement of
+// a device, that's what Observe computed; others are their own
+// averages.
+func (s *smoother) of(point sds011.Point) (pm25, pm10 float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := s.devices[point.DeviceID]; d != nil && point.Timestamp.Equal(d.last.Timestamp) {
+		return d.pm25, d.pm10
+	}
+	return point.PM25, point.PM10
+}
+
+// smoothed returns point with the averages up to it instead of its
+// concentrations, and true, as every point has them.
+func (s *smoother) smoothed(point sds011.Point) (sds011.Point, bool) {
+	point.PM25, point.PM10 = s.of(point)
+	return point, true
+}
+
+// column returns the function of the output column of the average of
+// PM2.5, or PM10 if pm10 is true, which is empty for missing points.
+func (s *smoother) column(pm10 bool) func(sds011.Point) string {
+	return func(point sds011.Point) string {
+		if point.Missing != "" {
+			return ""
+		}
+		v25, v10 := s.of(point)
+		if pm10 {
+			return strconv.FormatFloat(v10, 'f', 2, 64)
+		}
+		return strconv.FormatFloat(v25, 'f', 2, 64)
+	}
+}
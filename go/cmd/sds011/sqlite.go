@@ -0,0 +1,216 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+const (
+	// sqliteQueueSize is how many measurements wait to be stored
+	// while the database is busy.
+	sqliteQueueSize = 1000
+
+	// sqliteRetries is how many times storing measurements is
+	// retried while the database is busy, on top of the driver
+	// waiting for up to sqliteBusyTimeout every time.
+	sqliteRetries     = 5
+	sqliteBusyTimeout = 5 * time.Second
+
+	// sqlitePruneInterval is how often rows older than the retention
+	// are deleted.
+	sqlitePruneInterval = time.Hour
+)
+
+// sqliteSchema creates the readings table. Timestamps are in seconds
+// since the epoch, so that SQLite's date functions take them with the
+// 'unixepoch' modifier, and the device ID is four hex digits. The
+// standard deviations are NULL unless the measurement averages several
+// samples.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ts INTEGER NOT NULL,
+	device_id TEXT NOT NULL,
+	pm25 REAL NOT NULL,
+	pm10 REAL NOT NULL,
+	samples INTEGER NOT NULL,
+	stddev25 REAL,
+	stddev10 REAL
+);
+CREATE INDEX IF NOT EXISTS readings_ts ON readings (ts);
+`
+
+var (
+	sqliteInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_sqlite_inserted_total",
+		Help: "Measurements stored in the SQLite database.",
+	})
+	sqliteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_sqlite_failures_total",
+		Help: "Failed attempts to store measurements in the SQLite database.",
+	})
+	sqliteDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_sqlite_dropped_total",
+		Help: "Measurements that couldn't be stored in the SQLite database.",
+	})
+)
+
+// sqliteStore stores measurements in a SQLite database. It is an
+// observer.
+type sqliteStore struct {
+	db        *sql.DB
+	retention time.Duration // 0 to keep everything
+	pruned    time.Time
+	out       *outbox[sds011.Point]
+}
+
+// openSQLite opens the database at path, creating it and the readings
+// table if needed, and starts storing measurements in it. Rows older
+// than retention are deleted every now and then, unless it's 0.
+func openSQLite(path string, retention time.Duration) (*sqliteStore, error) {
+	if retention < 0 {
+		return nil, fmt.Errorf("negative -sqlite-retention %v", retention)
+	}
+	q := url.Values{"_pragma": {
+		fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()),
+		"journal_mode(WAL)",
+	}}
+	db, err := sql.Open("sqlite", "file:"+path+"?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// Writers would only wait for each other.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating the readings table in %v: %w", path, err)
+	}
+	s := &sqliteStore{
+		db:        db,
+		retention: retention,
+		out:       newOutbox[sds011.Point](sqliteQueueSize, sqliteDropped, "SQLite"),
+	}
+	registry.MustRegister(sqliteInserted, sqliteFailures, sqliteDropped)
+	s.out.start(s.store)
+	return s, nil
+}
+
+func (s *sqliteStore) Observe(point sds011.Point) {
+	s.out.put(point)
+}
+
+func (s *sqliteStore) ObserveError(error) {}
+
+// store stores the queued measurements until the queue is closed,
+// all those waiting in one transaction.
+func (s *sqliteStore) store(points <-chan sds011.Point) {
+	var batch []sds011.Point
+	for point := range points {
+		batch = append(batch[:0], point)
+	drain:
+		for len(batch) < sqliteQueueSize {
+			select {
+			case point, ok := <-points:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, point)
+			default:
+				break drain
+			}
+		}
+		err := deliver(s.out, sqliteRetries, sqliteFailures, "writing to SQLite", func() error {
+			return retryBusy(s.insert(batch))
+		})
+		if err != nil {
+			sqliteDropped.Add(float64(len(batch)))
+			slog.Error("writing to SQLite failed, dropped the measurements", "count", len(batch), "error", err)
+		} else {
+			sqliteInserted.Add(float64(len(batch)))
+		}
+		if s.retention > 0 && time.Since(s.pruned) >= sqlitePruneInterval {
+			s.prune()
+		}
+	}
+}
+
+// insert inserts points in one transaction.
+func (s *sqliteStore) insert(points []sds011.Point) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO readings (ts, device_id, pm25, pm10, samples, stddev25, stddev10) VALUES (?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range points {
+		var stddev25, stddev10 sql.NullFloat64
+		if p.Samples > 1 {
+			stddev25 = sql.NullFloat64{Float64: p.PM25StdDev, Valid: true}
+			stddev10 = sql.NullFloat64{Float64: p.PM10StdDev, Valid: true}
+		}
+		if _, err := stmt.Exec(p.Timestamp.Unix(), fmt.Sprintf("%04x", p.DeviceID), p.PM25, p.PM10, max(p.Samples, 1), stddev25, stddev10); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes the rows older than the retention.
+func (s *sqliteStore) prune() {
+	s.pruned = time.Now()
+	res, err := s.db.Exec(`DELETE FROM readings WHERE ts < ?`, s.pruned.Add(-s.retention).Unix())
+	if err != nil {
+		slog.Warn("deleting old readings from SQLite failed", "error", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		slog.Info("deleted old readings from SQLite", "count", n)
+	}
+}
+
+// retryBusy returns err, as a retryableError if it means that the
+// database is locked by another connection.
+func retryBusy(err error) error {
+	var serr *sqlite.Error
+	if errors.As(err, &serr) {
+		switch serr.Code() & 0xff {
+		case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+			return &retryableError{err: err}
+		}
+	}
+	return err
+}
+
+// Close stores what's left in the queue, giving up on it after
+// shutdownTimeout, and closes the database.
+func (s *sqliteStore) Close() {
+	s.out.close()
+	s.db.Close()
+}
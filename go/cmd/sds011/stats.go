@@ -0,0 +1,380 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// groupings are what -group-by takes.
+var groupings = []string{"hour", "day", "week", "month", "none"}
+
+// A statsGroup is the points read for one of the groups of -group-by.
+type statsGroup struct {
+	start, end time.Time
+	agg        sds011.Aggregator
+	missing    int
+	devices    map[uint16]bool
+}
+
+// printStats reads the points in the files at paths, or stdin for
+// "-", and prints their stats for every group of them, as aligned text
+// or as JSON lines.
+func printStats(w io.Writer, paths []string, asJSON bool) error {
+	groupBy := *statsFlags.groupBy
+	if !slices.Contains(groupings, groupBy) {
+		return fmt.Errorf("unknown -group-by %q, want one of %v", groupBy, groupings)
+	}
+	if *statsFlags.interval < 0 {
+		return fmt.Errorf("-interval can't be negative, not %v", *statsFlags.interval)
+	}
+	loc, err := timestampLocation()
+	if err != nil {
+		return err
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	from, err := parseStatsTime(*statsFlags.from, loc)
+	if err != nil {
+		return fmt.Errorf("bad -from: %w", err)
+	}
+	to, err := parseStatsTime(*statsFlags.to, loc)
+	if err != nil {
+		return fmt.Errorf("bad -to: %w", err)
+	}
+
+	groups := map[int64]*statsGroup{}
+	var first, last time.Time
+	var gaps []time.Duration
+	previous := map[uint16]time.Time{} // by device ID, for the gaps
+	add := func(point sds011.Point) {
+		t := point.Timestamp.In(loc)
+		if !from.IsZero() && t.Before(from) || !to.IsZero() && !t.Before(to) {
+			return
+		}
+		if first.IsZero() || t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+		if !point.Manual {
+			if p, ok := previous[point.DeviceID]; ok && t.After(p) {
+				gaps = append(gaps, t.Sub(p))
+			}
+			previous[point.DeviceID] = t
+		}
+		start, end := groupBounds(t, groupBy)
+		g := groups[start.Unix()]
+		if g == nil {
+			g = &statsGroup{start: start, end: end, devices: map[uint16]bool{}}
+			groups[start.Unix()] = g
+		}
+		g.devices[point.DeviceID] = true
+		if point.Missing != "" {
+			g.missing++
+			return
+		}
+		g.agg.Add(point)
+	}
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	for _, path := range paths {
+		if err := readPoints(path, add); err != nil {
+			return err
+		}
+	}
+	if len(groups) == 0 {
+		return errors.New("no measurements to summarize")
+	}
+
+	interval := *statsFlags.interval
+	if interval == 0 && len(gaps) > 0 {
+		slices.Sort(gaps)
+		interval = gaps[len(gaps)/2]
+		slog.Info("took the interval from the measurements", "interval", interval)
+	}
+	// The expected measurements are counted from the first to the
+	// last, unless -from and -to say otherwise.
+	lo, hi := first, last.Add(interval)
+	if !from.IsZero() {
+		lo = from
+	}
+	if !to.IsZero() {
+		hi = to
+	}
+
+	keys := make([]int64, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var tw *tabwriter.Writer
+	if !asJSON {
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "group\tcount\tmissing\tpm2_5_mean\tpm2_5_median\tpm2_5_min\tpm2_5_max\tpm2_5_p95\tpm10_mean\tpm10_median\tpm10_min\tpm10_max\tpm10_p95\tpresent\t")
+	}
+	enc := json.NewEncoder(w)
+	for _, k := range keys {
+		g := groups[k]
+		row := g.stats(groupBy, interval, lo, hi)
+		if asJSON {
+			if err := enc.Encode(row); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t\n", row.Group, row.Count, row.Missing, row.PM25.columns(), row.PM10.columns(), percent(row.Present))
+	}
+	if tw != nil {
+		return tw.Flush()
+	}
+	return nil
+}
+
+// statsRow is what is printed for a group, with the JSON field names
+// that -format json prints.
+type statsRow struct {
+	Group   string    `json:"group"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Count   int       `json:"count"`
+	Missing int       `json:"missing"`
+	PM25    *levels   `json:"pm2_5"` // nil if there were no values
+	PM10    *levels   `json:"pm10"`
+	// Present is the percentage of the measurements expected at the
+	// interval that there are values for, nil if the interval isn't
+	// known.
+	Present *float64 `json:"present_percent"`
+}
+
+// levels are the stats of the values of a particulate.
+type levels struct {
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	P95    float64 `json:"p95"`
+}
+
+func newLevels(d sds011.Distribution) *levels {
+	round := func(v float64) float64 { return math.Round(v*100) / 100 }
+	return &levels{round(d.Mean), round(d.Median), round(d.Min), round(d.Max), round(d.P95)}
+}
+
+// columns returns the levels as tab-separated columns, dashes if
+// there are none.
+func (l *levels) columns() string {
+	if l == nil {
+		return "-\t-\t-\t-\t-"
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	return f(l.Mean) + "\t" + f(l.Median) + "\t" + f(l.Min) + "\t" + f(l.Max) + "\t" + f(l.P95)
+}
+
+func percent(p *float64) string {
+	if p == nil {
+		return "-"
+	}
+	return strconv.FormatFloat(*p, 'f', 1, 64) + "%"
+}
+
+// stats returns the row of the group. The measurements expected in it
+// are those every interval from lo to hi, for every device it has
+// points of.
+func (g *statsGroup) stats(groupBy string, interval time.Duration, lo, hi time.Time) statsRow {
+	s := g.agg.Summary()
+	row := statsRow{Group: groupLabel(g.start, groupBy), Count: s.Count, Missing: g.missing}
+	row.Start, row.End = lo, hi
+	if groupBy != "none" {
+		row.Start, row.End = g.start, g.end
+	}
+	if s.Count > 0 {
+		row.PM25, row.PM10 = newLevels(s.PM25), newLevels(s.PM10)
+	}
+	if interval > 0 {
+		lo, hi = maxTime(lo, row.Start), minTime(hi, row.End)
+		expected := math.Ceil(float64(hi.Sub(lo))/float64(interval)) * float64(len(g.devices))
+		if expected > 0 {
+			p := math.Round(min(100, 100*float64(s.Count)/expected)*10) / 10
+			row.Present = &p
+		}
+	}
+	return row
+}
+
+// groupBounds returns the start and the end of the group of -group-by
+// that t is in, in its time zone, assuming it's off UTC by whole
+// hours. Weeks start on Monday. With no grouping, both are zero.
+func groupBounds(t time.Time, groupBy string) (start, end time.Time) {
+	y, m, d := t.Date()
+	switch groupBy {
+	case "hour":
+		// Not by the clock, which reads the same hour twice when
+		// it's set back.
+		start = t.Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	case "day":
+		start = time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 1)
+	case "week":
+		start = time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 0, 7)
+	case "month":
+		start = time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+		return start, start.AddDate(0, 1, 0)
+	}
+	return time.Time{}, time.Time{}
+}
+
+// groupLabel names the group starting at start.
+func groupLabel(start time.Time, groupBy string) string {
+	switch groupBy {
+	case "hour":
+		return start.Format("2006-01-02 15:00")
+	case "day", "week":
+		return start.Format(time.DateOnly)
+	case "month":
+		return start.Format("2006-01")
+	}
+	return "all"
+}
+
+// parseStatsTime parses a date, or a date and time in RFC 3339
+// format, in loc unless it says its time zone. It returns the zero
+// time for "".
+func parseStatsTime(s string, loc *time.Location) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, loc); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", s, loc); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q isn't a date like 2024-03-01, nor a time like 2024-03-01T12:00:00", s)
+	}
+	return t, nil
+}
+
+// readPoints calls fn with every point in the file at path, or stdin
+// for "-", which can be compressed with gzip. A compressed file that
+// ends unfinished, as after a power failure, is read up to where it
+// does, with a warning.
+func readPoints(path string, fn func(sds011.Point)) error {
+	pf, err := openPointFile(path)
+	if err != nil {
+		return err
+	}
+	defer pf.Close()
+	for {
+		point, err := pf.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(point)
+	}
+}
+
+// A pointFile reads the points in a file, or stdin for "-", which can
+// be compressed with gzip.
+type pointFile struct {
+	path       string
+	f          *os.File
+	compressed bool
+	pr         *pointio.Reader
+}
+
+func openPointFile(path string) (*pointFile, error) {
+	pf := &pointFile{path: path, f: os.Stdin}
+	if path != "-" {
+		var err error
+		if pf.f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	br := bufio.NewReader(pf.f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			pf.Close()
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		r, pf.compressed = zr, true
+	}
+	pf.pr = pointio.NewReader(r)
+	return pf, nil
+}
+
+// Read returns the next point, or io.EOF if there are no more. A
+// compressed file that ends unfinished, as after a power failure, is
+// read up to where it does, with a warning.
+func (pf *pointFile) Read() (sds011.Point, error) {
+	point, err := pf.pr.Read()
+	switch {
+	case err == io.EOF:
+	case errors.Is(err, io.ErrUnexpectedEOF) && pf.compressed:
+		slog.Warn("the compressed input ends unfinished, reading it up to there", "path", pf.path)
+		err = io.EOF
+	case err != nil:
+		err = fmt.Errorf("reading %s: %w", pf.path, err)
+	}
+	return point, err
+}
+
+func (pf *pointFile) Close() error {
+	if pf.f == os.Stdin {
+		return nil
+	}
+	return pf.f.Close()
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+var (
+	statsdSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_statsd_sent_total",
+		Help: "Measurements sent to StatsD.",
+	})
+	statsdFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_statsd_failures_total",
+		Help: "Measurements that failed to be sent to StatsD.",
+	})
+)
+
+// statsdTagsFormats are the values of -statsd-tags-format.
+var statsdTagsFormats = []string{"none", "dogstatsd"}
+
+// statsdEscaper replaces the characters that DogStatsD gives a meaning
+// to in tags.
+var statsdEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// statsdWriter sends measurements to StatsD over UDP, as the gauges
+//
+//	<prefix>.pm25:12.3|g
+//	<prefix>.pm10:20.1|g
+//
+// in one datagram, with DogStatsD tags like |#device_id:a1b2,host:pi4
+// after each if tagged. Sending doesn't wait for anything, so it's
+// done right away, and failures are only counted. It is an observer.
+type statsdWriter struct {
+	conn   net.Conn
+	prefix string
+	tagged bool
+	tags   []pointio.Tag // the first is the device ID
+	buf    []byte
+}
+
+// newStatsd returns a writer sending measurements to the StatsD
+// server at addr, tagged with tags if tagsFormat is "dogstatsd".
+func newStatsd(addr, prefix, tagsFormat string, tags []pointio.Tag) (*statsdWriter, error) {
+	if err := checkStatsdTagsFormat(tagsFormat); err != nil {
+		return nil, err
+	}
+	// Dialing UDP only resolves the address.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	sw := &statsdWriter{
+		conn:   conn,
+		prefix: strings.TrimSuffix(prefix, "."),
+		tagged: tagsFormat == "dogstatsd",
+		tags:   append([]pointio.Tag{{Key: "device_id"}, {Key: "host", Value: host}}, tags...),
+	}
+	registry.MustRegister(statsdSent, statsdFailures)
+	return sw, nil
+}
+
+// checkStatsdTagsFormat returns an error if -statsd-tags-format is
+// unknown.
+func checkStatsdTagsFormat(tagsFormat string) error {
+	if !slices.Contains(statsdTagsFormats, tagsFormat) {
+		return fmt.Errorf("unknown -statsd-tags-format %q, want one of %v", tagsFormat, strings.Join(statsdTagsFormats, ", "))
+	}
+	return nil
+}
+
+func (sw *statsdWriter) Observe(point sds011.Point) {
+	sw.tags[0].Value = fmt.Sprintf("%04x", point.DeviceID)
+	b := sw.appendGauge(sw.buf[:0], "pm25", point.PM25)
+	b = append(b, '\n')
+	b = sw.appendGauge(b, "pm10", point.PM10)
+	sw.buf = b
+	if _, err := sw.conn.Write(b); err != nil {
+		statsdFailures.Inc()
+		slog.Debug("sending to StatsD failed", "error", err)
+		return
+	}
+	statsdSent.Inc()
+}
+
+func (sw *statsdWriter) ObserveError(error) {}
+
+// reload takes the -tag tags anew.
+func (sw *statsdWriter) reload() {
+	sw.tags = append(sw.tags[:2:2], *tags...)
+}
+
+// appendGauge appends the gauge name set to value to b.
+func (sw *statsdWriter) appendGauge(b []byte, name string, value float64) []byte {
+	if sw.prefix != "" {
+		b = append(b, sw.prefix...)
+		b = append(b, '.')
+	}
+	b = append(b, name...)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, value, 'f', -1, 64)
+	b = append(b, "|g"...)
+	if !sw.tagged {
+		return b
+	}
+	b = append(b, "|#"...)
+	first := true
+	for i, tag := range sw.tags {
+		if tag.Value == "" || slices.ContainsFunc(sw.tags[i+1:], func(t pointio.Tag) bool { return t.Key == tag.Key }) {
+			continue
+		}
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		b = append(b, statsdEscaper.Replace(tag.Key)...)
+		b = append(b, ':')
+		b = append(b, statsdEscaper.Replace(tag.Value)...)
+	}
+	return b
+}
+
+// Close closes the connection.
+func (sw *statsdWriter) Close() {
+	sw.conn.Close()
+}
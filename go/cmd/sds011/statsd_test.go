@@ -0,0 +1,145 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// listenStatsd returns a UDP listener standing for a StatsD server.
+func listenStatsd(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// receiveDatagram returns the next datagram conn receives.
+func receiveDatagram(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("receiving from StatsD: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestStatsdWireFormat(t *testing.T) {
+	host, _ := os.Hostname()
+	point := sds011.Point{PM25: 12.3, PM10: 20.1, DeviceID: 0xa1b2}
+	for _, tc := range []struct {
+		name, prefix, tagsFormat string
+		tags                     []pointio.Tag
+		want                     string
+	}{
+		{"plain", "sds011", "none", nil, "sds011.pm25:12.3|g\nsds011.pm10:20.1|g"},
+		{"trailing dot", "home.sds011.", "none", nil, "home.sds011.pm25:12.3|g\nhome.sds011.pm10:20.1|g"},
+		{"no prefix", "", "none", nil, "pm25:12.3|g\npm10:20.1|g"},
+		{"untagged ignores tags", "sds011", "none", []pointio.Tag{{Key: "room", Value: "kitchen"}}, "sds011.pm25:12.3|g\nsds011.pm10:20.1|g"},
+		{
+			"dogstatsd", "sds011", "dogstatsd", nil,
+			"sds011.pm25:12.3|g|#device_id:a1b2,host:" + host + "\nsds011.pm10:20.1|g|#device_id:a1b2,host:" + host,
+		},
+		{
+			"dogstatsd with tags", "sds011", "dogstatsd",
+			[]pointio.Tag{{Key: "room", Value: "a,b|c#d"}, {Key: "host", Value: "pi4"}, {Key: "empty"}},
+			"sds011.pm25:12.3|g|#device_id:a1b2,room:a_b_c_d,host:pi4\nsds011.pm10:20.1|g|#device_id:a1b2,room:a_b_c_d,host:pi4",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newRegistry(t)
+			conn := listenStatsd(t)
+			sw, err := newStatsd(conn.LocalAddr().String(), tc.prefix, tc.tagsFormat, tc.tags)
+			if err != nil {
+				t.Fatalf("newStatsd: %v", err)
+			}
+			defer sw.Close()
+			sw.Observe(point)
+			if got := receiveDatagram(t, conn); got != tc.want {
+				t.Errorf("sent %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStatsdDeviceID(t *testing.T) {
+	newRegistry(t)
+	conn := listenStatsd(t)
+	sw, err := newStatsd(conn.LocalAddr().String(), "sds011", "dogstatsd", []pointio.Tag{{Key: "host", Value: "pi4"}})
+	if err != nil {
+		t.Fatalf("newStatsd: %v", err)
+	}
+	defer sw.Close()
+	sent := counterValue(statsdSent)
+	for _, tc := range []struct {
+		point sds011.Point
+		want  string
+	}{
+		{sds011.Point{PM25: 1, PM10: 2.25, DeviceID: 0x0001}, "sds011.pm25:1|g|#device_id:0001,host:pi4\nsds011.pm10:2.25|g|#device_id:0001,host:pi4"},
+		{sds011.Point{PM25: 999.9, PM10: 0, DeviceID: 0xffee}, "sds011.pm25:999.9|g|#device_id:ffee,host:pi4\nsds011.pm10:0|g|#device_id:ffee,host:pi4"},
+	} {
+		sw.Observe(tc.point)
+		if got := receiveDatagram(t, conn); got != tc.want {
+			t.Errorf("sent %q for %v, want %q", got, tc.point, tc.want)
+		}
+	}
+	if got := counterValue(statsdSent) - sent; got != 2 {
+		t.Errorf("counted %v measurements sent, want 2", got)
+	}
+}
+
+func TestStatsdFailuresAreCounted(t *testing.T) {
+	newRegistry(t)
+	conn := listenStatsd(t)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	sw, err := newStatsd(addr, "sds011", "none", nil)
+	if err != nil {
+		t.Fatalf("newStatsd: %v", err)
+	}
+	defer sw.Close()
+	sent, failures := counterValue(statsdSent), counterValue(statsdFailures)
+	const n = 5
+	for range n {
+		sw.Observe(sds011.Point{PM25: 1, PM10: 2})
+		// Let the refusal of the last datagram come back.
+		time.Sleep(10 * time.Millisecond)
+	}
+	gotSent, gotFailures := counterValue(statsdSent)-sent, counterValue(statsdFailures)-failures
+	if gotSent+gotFailures != n {
+		t.Errorf("counted %v measurements sent and %v failures, want %v in all", gotSent, gotFailures, n)
+	}
+	if gotFailures == 0 {
+		t.Error("counted no failures sending to a closed port")
+	}
+}
+
+func TestStatsdBadTagsFormat(t *testing.T) {
+	newRegistry(t)
+	if _, err := newStatsd("127.0.0.1:8125", "sds011", "influx", nil); err == nil {
+		t.Error("newStatsd succeeded with -statsd-tags-format=influx")
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+const (
+	// streamQueueSize is how many events wait to be sent to a client
+	// before it's disconnected for being too slow.
+	streamQueueSize = 16
+
+	// streamWriteTimeout is how long sending an event to a client
+	// may take.
+	streamWriteTimeout = 10 * time.Second
+
+	// streamPongTimeout is how long a WebSocket client may take to
+	// answer a ping, which it gets every streamPingInterval.
+	streamPongTimeout  = 60 * time.Second
+	streamPingInterval = streamPongTimeout * 9 / 10
+)
+
+var (
+	streamClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sds011_stream_clients",
+		Help: "Clients connected to /stream and /events.",
+	})
+	streamDisconnected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_stream_slow_clients_total",
+		Help: "Clients of /stream and /events disconnected because they didn't keep up.",
+	})
+)
+
+// A streamEvent is a measurement or a sample, encoded as
+// sds011.Point.MarshalJSON does, with its kind as "type".
+type streamEvent struct {
+	kind string // "measurement" or "sample"
+	data []byte
+}
+
+// streamClient is a client of /stream or /events.
+type streamClient struct {
+	events  chan streamEvent // closed when the client is to be disconnected
+	samples bool             // set if the client wants the samples too
+	slow    bool             // set if it's disconnected for not keeping up
+}
+
+// broadcaster sends every measurement, and sample, to the clients of
+// /stream and /events. It is an observer.
+type broadcaster struct {
+	mu      sync.Mutex
+	clients map[*streamClient]bool
+	closed  bool
+}
+
+func newBroadcaster() *broadcaster {
+	registry.MustRegister(streamClients, streamDisconnected)
+	return &broadcaster{clients: make(map[*streamClient]bool)}
+}
+
+func (b *broadcaster) Observe(point sds011.Point) {
+	b.send("measurement", point)
+}
+
+// ObserveSample sends every sample, whether or not it's averaged, to
+// the clients that asked for them.
+func (b *broadcaster) ObserveSample(sample sds011.Point, _ int) {
+	b.send("sample", sample)
+}
+
+func (b *broadcaster) ObserveError(error) {}
+
+func (b *broadcaster) send(kind string, point sds011.Point) {
+	data, err := json.Marshal(point)
+	if err != nil || len(data) < 2 || data[0] != '{' {
+		return
+	}
+	event := streamEvent{kind: kind, data: fmt.Appendf(nil, `{"type":%q,%s`, kind, data[1:])}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		if kind == "sample" && !c.samples {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			c.slow = true
+			b.removeLocked(c)
+			streamDisconnected.Inc()
+		}
+	}
+}
+
+// subscribe adds a client, or returns nil if the server is shutting
+// down.
+func (b *broadcaster) subscribe(samples bool) *streamClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	c := &streamClient{events: make(chan streamEvent, streamQueueSize), samples: samples}
+	b.clients[c] = true
+	streamClients.Inc()
+	return c
+}
+
+// unsubscribe removes a client, if it's still there.
+func (b *broadcaster) unsubscribe(c *streamClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(c)
+}
+
+func (b *broadcaster) removeLocked(c *streamClient) {
+	if b.clients[c] {
+		delete(b.clients, c)
+		close(c.events)
+		streamClients.Dec()
+	}
+}
+
+// close disconnects all the clients, and makes the new ones go away.
+// It's called when the HTTP server shuts down, which doesn't wait for
+// hijacked connections, and waits forever for the streams of events.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		b.removeLocked(c)
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	HandshakeTimeout: streamWriteTimeout,
+}
+
+// serveStream upgrades the connection to a WebSocket, and sends it
+// every measurement as a JSON text message, and every sample too if
+// the samples query parameter is 1.
+func (b *broadcaster) serveStream(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader answered with the error
+	}
+	defer conn.Close()
+	c := b.subscribe(r.URL.Query().Get("samples") == "1")
+	if c == nil {
+		closeWebSocket(conn, websocket.CloseGoingAway, "shutting down")
+		return
+	}
+	defer b.unsubscribe(c)
+
+	// The client isn't expected to send anything, but reading is
+	// what handles pongs and the closing handshake.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(streamPongTimeout))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case event, ok := <-c.events:
+			if !ok {
+				if c.slow {
+					closeWebSocket(conn, websocket.CloseTryAgainLater, "too slow")
+				} else {
+					closeWebSocket(conn, websocket.CloseGoingAway, "shutting down")
+				}
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteMessage(websocket.TextMessage, event.data); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// closeWebSocket starts the closing handshake, without waiting for the
+// client's answer.
+func closeWebSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(streamWriteTimeout))
+}
+
+// serveEvents sends the same events as serveStream as Server-Sent
+// Events, named measurement or sample, with a comment every
+// streamPingInterval to keep the connection open.
+func (b *broadcaster) serveEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The events don't stop, so the server's write timeout mustn't
+	// cut them off.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	c := b.subscribe(r.URL.Query().Get("samples") == "1")
+	if c == nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer b.unsubscribe(c)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case event, ok := <-c.events:
+			if !ok {
+				if c.slow {
+					slog.Debug("disconnected a slow client of /events", "remote", r.RemoteAddr)
+				}
+				return
+			}
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.kind, event.data)
+		case <-ping.C:
+			rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
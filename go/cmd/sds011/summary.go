@@ -0,0 +1,466 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// summaryBacklog is how many daily summaries wait to be written before
+// the oldest are dropped.
+const summaryBacklog = 16
+
+// summaryColumns are the columns of the CSV of -summary-output, before
+// one for every -tag tag.
+var summaryColumns = []string{
+	"date", "device_id", "hours", "measurements", "expected", "completeness_percent",
+	"pm2_5_mean", "pm2_5_min", "pm2_5_max", "pm2_5_max_at",
+	"pm10_mean", "pm10_min", "pm10_max", "pm10_max_at",
+}
+
+// A dailySummary sums up a day of the measurements of a device, for
+// -daily-summary. Its concentrations are null if none of them
+// succeeded.
+type dailySummary struct {
+	Type     string `json:"type"` // daily_summary
+	Date     string `json:"date"`
+	DeviceID string `json:"device_id"`
+	// Hours is how long the day was, 23 or 25 when the clocks change.
+	Hours int `json:"hours"`
+	// Measurements is how many scheduled measurements succeeded, of
+	// the Expected in a day as long as that at -interval.
+	Measurements int     `json:"measurements"`
+	Expected     int     `json:"expected"`
+	Completeness float64 `json:"completeness_percent"`
+
+	PM25Mean  *float64   `json:"pm2_5_mean"`
+	PM25Min   *float64   `json:"pm2_5_min"`
+	PM25Max   *float64   `json:"pm2_5_max"`
+	PM25MaxAt *time.Time `json:"pm2_5_max_at"`
+	PM10Mean  *float64   `json:"pm10_mean"`
+	PM10Min   *float64   `json:"pm10_min"`
+	PM10Max   *float64   `json:"pm10_max"`
+	PM10MaxAt *time.Time `json:"pm10_max_at"`
+
+	tags []pointio.Tag
+}
+
+func (ds dailySummary) MarshalJSON() ([]byte, error) {
+	type fields dailySummary // without this method
+	b, err := json.Marshal(fields(ds))
+	if err != nil {
+		return nil, err
+	}
+	return appendTagFields(b, ds.tags)
+}
+
+// row returns the values of the columns of ds, in the order of
+// summaryColumns, and then of its tags.
+func (ds dailySummary) row() []string {
+	number := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	at := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	row := []string{
+		ds.Date, ds.DeviceID, strconv.Itoa(ds.Hours), strconv.Itoa(ds.Measurements), strconv.Itoa(ds.Expected), number(&ds.Completeness),
+		number(ds.PM25Mean), number(ds.PM25Min), number(ds.PM25Max), at(ds.PM25MaxAt),
+		number(ds.PM10Mean), number(ds.PM10Min), number(ds.PM10Max), at(ds.PM10MaxAt),
+	}
+	for _, t := range ds.tags {
+		row = append(row, t.Value)
+	}
+	return row
+}
+
+// A summaryObserver is an output that the daily summaries are passed
+// to, besides the measurements.
+type summaryObserver interface {
+	ObserveSummary(dailySummary)
+}
+
+// A summarizer sums up the measurements of every device when every day
+// in loc ends, at midnight, or when a measurement of the next day
+// comes first, for -daily-summary. Measurements of -trigger are in the
+// concentrations, but not in how many came, as they weren't expected.
+// What was measured of the day when the summarizer is closed is lost,
+// unless -summary-resume reads it back the next time. The summaries
+// are passed to emit in a goroutine of its own, as the summarizer
+// observes measurements with the lock of the shared observers held. It
+// is an observer.
+type summarizer struct {
+	loc     *time.Location
+	sensors int // how many there are
+
+	mu               sync.Mutex
+	dayStart, dayEnd time.Time // of the day summed up
+	devices          map[uint16]*daySums
+	// untold are the sums of the measurements read back without a
+	// device ID, of the only sensor.
+	untold    *daySums
+	timer     *time.Timer // at the end of the day
+	closed    bool
+	summaries chan dailySummary
+	done      chan struct{}
+}
+
+// daySums are what a summarizer adds up of the measurements of a
+// device.
+type daySums struct {
+	scheduled  int // measurements that succeeded, other than -trigger's
+	pm25, pm10 channelSums
+}
+
+// channelSums are what a summarizer adds up of the values of a
+// channel.
+type channelSums struct {
+	n             int
+	sum, min, max float64
+	maxAt         time.Time
+}
+
+func (c *channelSums) add(v float64, at time.Time) {
+	if c.n == 0 || v < c.min {
+		c.min = v
+	}
+	if c.n == 0 || v > c.max {
+		c.max, c.maxAt = v, at
+	}
+	c.n++
+	c.sum += v
+}
+
+// checkDailySummary returns an error if -daily-summary and the flags
+// going with it don't make sense together with the outputs.
+func checkDailySummary() error {
+	if !*dailySummaries {
+		if *summaryOutput != "" || *summaryResume {
+			return errors.New("-summary-output and -summary-resume need -daily-summary")
+		}
+		return nil
+	}
+	if *summaryResume && *output == "" {
+		return errors.New("-summary-resume needs -output, to read today's measurements back from")
+	}
+	if *summaryOutput != "" {
+		return nil
+	}
+	var formats []string
+	if !*quiet && (*output == "" || *tee) {
+		formats = append(formats, *format)
+	}
+	if *output != "" {
+		formats = append(formats, cmp.Or(*outputFormat, *format))
+	}
+	if len(formats) == 0 || slices.ContainsFunc(formats, func(f string) bool { return f != "jsonl" }) {
+		return errors.New("-daily-summary writes the summaries in the output only if it's -format=jsonl, so it needs -summary-output")
+	}
+	return nil
+}
+
+// newSummarizer returns a summarizer of the days in loc, of the
+// measurements of sensors sensors.
+func newSummarizer(loc *time.Location, sensors int) *summarizer {
+	return &summarizer{
+		loc:       loc,
+		sensors:   sensors,
+		devices:   make(map[uint16]*daySums),
+		summaries: make(chan dailySummary, summaryBacklog),
+		done:      make(chan struct{}),
+	}
+}
+
+// start passes the summaries to emit until the summarizer is closed.
+func (s *summarizer) start(emit func(dailySummary)) {
+	go func() {
+		defer close(s.done)
+		for ds := range s.summaries {
+			emit(ds)
+		}
+	}()
+}
+
+// resume adds the measurements of today in the output file at path,
+// if it exists, as if they were observed. Those without a device ID,
+// as in CSV without the column, are taken to be of the only sensor,
+// once it measures, and left out if there are more.
+func (s *summarizer) resume(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dayStart.IsZero() {
+		s.beginLocked(time.Now().In(s.loc))
+	}
+	n, untold := 0, 0
+	err := readPoints(path, func(point sds011.Point) {
+		if t := point.Timestamp; point.Combined > 0 || t.Before(s.dayStart) || !t.Before(s.dayEnd) {
+			return
+		}
+		n++
+		if point.DeviceID != 0 {
+			s.addLocked(s.sumsLocked(point.DeviceID), point)
+			return
+		}
+		untold++
+		if s.sensors == 1 {
+			if s.untold == nil {
+				s.untold = new(daySums)
+			}
+			s.addLocked(s.untold, point)
+		}
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("read today's measurements back from -output for -daily-summary", "path", path, "count", n)
+	if untold > 0 && s.sensors > 1 {
+		slog.Warn("-output doesn't say which sensor some of today's measurements are of, so -daily-summary leaves them out", "count", untold)
+	}
+	return nil
+}
+
+func (s *summarizer) Observe(point sds011.Point) {
+	if point.Combined > 0 {
+		// Summed up with those of the sensors.
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	t := point.Timestamp.In(s.loc)
+	switch {
+	case s.dayStart.IsZero():
+		s.beginLocked(t)
+	case !t.Before(s.dayEnd):
+		s.flushLocked()
+		s.beginLocked(t)
+	case t.Before(s.dayStart):
+		// Of the day already summed up.
+		return
+	}
+	if s.untold != nil {
+		if _, ok := s.devices[point.DeviceID]; !ok {
+			s.devices[point.DeviceID] = s.untold
+		}
+		s.untold = nil
+	}
+	s.addLocked(s.sumsLocked(point.DeviceID), point)
+}
+
+func (s *summarizer) ObserveError(error) {}
+
+// sumsLocked returns the sums of the device id.
+func (s *summarizer) sumsLocked(id uint16) *daySums {
+	d := s.devices[id]
+	if d == nil {
+		d = new(daySums)
+		s.devices[id] = d
+	}
+	return d
+}
+
+// addLocked adds point to the sums d.
+func (s *summarizer) addLocked(d *daySums, point sds011.Point) {
+	if point.Missing != "" {
+		return
+	}
+	if !point.Manual {
+		d.scheduled++
+	}
+	at := point.Timestamp.In(s.loc).Truncate(time.Second) // as the points have it
+	d.pm25.add(point.PM25, at)
+	d.pm10.add(point.PM10, at)
+}
+
+// beginLocked starts summing up the day of t.
+func (s *summarizer) beginLocked(t time.Time) {
+	s.dayStart, s.dayEnd = groupBounds(t, "day")
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = time.AfterFunc(time.Until(s.dayEnd), s.midnight)
+}
+
+// midnight sums up the day that ended, and begins the next. The timer
+// runs on the monotonic clock, so if the wall clock was set back in
+// the meantime, it waits for the rest of the day.
+func (s *summarizer) midnight() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if left := time.Until(s.dayEnd); left > 0 {
+		s.timer = time.AfterFunc(left, s.midnight)
+		return
+	}
+	s.flushLocked()
+	s.beginLocked(s.dayEnd)
+}
+
+// flushLocked passes on the summaries of the day, and clears the sums.
+func (s *summarizer) flushLocked() {
+	ids := make([]uint16, 0, len(s.devices))
+	for id := range s.devices {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		if sendNewest(s.summaries, s.summary(id, s.devices[id])) {
+			slog.Warn("writing daily summaries is too slow, dropped the oldest")
+		}
+	}
+	clear(s.devices)
+	s.untold = nil
+}
+
+// summary returns the summary of the sums d of the device id.
+func (s *summarizer) summary(id uint16, d *daySums) dailySummary {
+	every := *interval
+	if every <= 0 {
+		every = time.Duration(max(*samples, 1)) * time.Second
+	}
+	length := s.dayEnd.Sub(s.dayStart)
+	expected := max(int(length/every), 1)
+	ds := dailySummary{
+		Type:         "daily_summary",
+		Date:         s.dayStart.Format(time.DateOnly),
+		DeviceID:     fmt.Sprintf("%04x", id),
+		Hours:        int(math.Round(length.Hours())),
+		Measurements: d.scheduled,
+		Expected:     expected,
+		Completeness: min(100, math.Round(1000*float64(d.scheduled)/float64(expected))/10),
+		tags:         recordTags.get(),
+	}
+	if d.pm25.n > 0 {
+		ds.PM25Mean, ds.PM25Min, ds.PM25Max, ds.PM25MaxAt = d.pm25.values()
+		ds.PM10Mean, ds.PM10Min, ds.PM10Max, ds.PM10MaxAt = d.pm10.values()
+	}
+	return ds
+}
+
+// values returns the mean, rounded to hundredths, the lowest and the
+// highest value, and when that was.
+func (c *channelSums) values() (mean, low, high *float64, at *time.Time) {
+	m := math.Round(100*c.sum/float64(c.n)) / 100
+	l, h, t := c.min, c.max, c.maxAt
+	return &m, &l, &h, &t
+}
+
+// Close stops summing up, losing the sums of the day so far, and waits
+// for the summaries to be passed on.
+func (s *summarizer) Close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	close(s.summaries)
+	s.mu.Unlock()
+	<-s.done
+}
+
+// writeSummary writes ds to sf, or, if it's nil, as a JSON line
+// between the points s writes.
+func writeSummary(s *shared, sf *summaryFile, ds dailySummary) error {
+	if sf != nil {
+		return sf.write(ds)
+	}
+	b, err := json.Marshal(ds)
+	if err != nil {
+		return err
+	}
+	return s.writeLine(append(b, '\n'))
+}
+
+// A summaryFile is -summary-output, which the daily summaries are
+// appended to, as CSV with a header starting the file, or as JSON
+// lines.
+type summaryFile struct {
+	f         *os.File
+	jsonLines bool
+	fresh     bool // nothing was written to it yet
+}
+
+// openSummaryFile opens the file at path to append daily summaries to,
+// as JSON lines if jsonLines is set, creating it if needed.
+func openSummaryFile(path string, jsonLines bool) (*summaryFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &summaryFile{f: f, jsonLines: jsonLines, fresh: info.Size() == 0}, nil
+}
+
+func (sf *summaryFile) write(ds dailySummary) error {
+	if sf.jsonLines {
+		b, err := json.Marshal(ds)
+		if err != nil {
+			return err
+		}
+		_, err = sf.f.Write(append(b, '\n'))
+		return err
+	}
+	w := csv.NewWriter(sf.f)
+	if sf.fresh {
+		header := slices.Clone(summaryColumns)
+		for _, t := range ds.tags {
+			header = append(header, t.Key)
+		}
+		w.Write(header)
+	}
+	w.Write(ds.row())
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	sf.fresh = false
+	return nil
+}
+
+func (sf *summaryFile) Close() error {
+	return sf.f.Close()
+}
@@ -0,0 +1,326 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+const (
+	// syslogTimeout is how long connecting to the syslog server and
+	// sending it a message may take.
+	syslogTimeout = 5 * time.Second
+
+	// syslogQueue is how many messages wait to be sent.
+	syslogQueue = 1000
+
+	// The severities of the messages: measurements are informational,
+	// alerts starting and clearing warnings.
+	syslogInfo    = 6
+	syslogWarning = 4
+)
+
+// syslogFacilities are the facilities -syslog-facility takes, by name.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogParams are the names of the parameters of the structured data
+// of a measurement, which -tag keys can't be.
+var syslogParams = []string{"pm25", "pm10", "device"}
+
+var (
+	syslogSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_syslog_sent_total",
+		Help: "Messages sent to syslog.",
+	})
+	syslogFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_syslog_failures_total",
+		Help: "Failed attempts to send a message to syslog.",
+	})
+	syslogDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_syslog_dropped_total",
+		Help: "Messages dropped because too many were waiting to be sent to syslog, or sending them over a datagram socket failed.",
+	})
+)
+
+// syslogConfig says where and how measurements are sent to syslog.
+type syslogConfig struct {
+	addr     string // a udp://, tcp:// or unixgram:// URL
+	facility string
+	appName  string
+	pen      int // the private enterprise number of the SD-ID
+}
+
+// A syslogWriter sends measurements, and alerts starting and clearing,
+// to syslog as RFC 5424 messages, with the values as structured data,
+// like
+//
+//	<30>1 2017-07-14T02:40:00.5+02:00 host sds011 4242 measurement [sds011@32473 pm25="12.3" pm10="20.1" device="a1b2"] PM2.5 12.3 ug/m3, PM10 20.1 ug/m3
+//
+// with the -tag tags as parameters too. Over TCP, messages are framed
+// by octet counting, as RFC 6587 has it, and it reconnects when sending
+// fails, and sends again. Over UDP and Unix datagram sockets, every
+// message is a datagram, and those that fail to be sent are dropped. It
+// is an observer, and an alertObserver.
+type syslogWriter struct {
+	network, addr string
+	facility      int
+	header        string // HOSTNAME, APP-NAME and PROCID
+	sdID          string
+	out           *outbox[[]byte]
+	conn          net.Conn
+}
+
+// startSyslog starts sending measurements to syslog as cfg says.
+func startSyslog(cfg syslogConfig) (*syslogWriter, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	network, addr, _ := cfg.target()
+	host, _ := os.Hostname()
+	if !syslogName(host, 255) {
+		host = "-"
+	}
+	sw := &syslogWriter{
+		network:  network,
+		addr:     addr,
+		facility: syslogFacilities[cfg.facility],
+		header:   host + " " + cfg.appName + " " + strconv.Itoa(os.Getpid()),
+		sdID:     "sds011@" + strconv.Itoa(cfg.pen),
+		out:      newOutbox[[]byte](syslogQueue, syslogDropped, "syslog"),
+	}
+	registry.MustRegister(syslogSent, syslogFailures, syslogDropped)
+	sw.out.start(sw.send)
+	return sw, nil
+}
+
+// syslogFlags returns the syslog configuration set by the flags.
+func syslogFlags() syslogConfig {
+	return syslogConfig{
+		addr:     *syslogAddr,
+		facility: *syslogFacility,
+		appName:  *syslogAppName,
+		pen:      *syslogPEN,
+	}
+}
+
+// check returns an error if cfg doesn't make sense.
+func (cfg syslogConfig) check() error {
+	if _, _, err := cfg.target(); err != nil {
+		return err
+	}
+	if _, ok := syslogFacilities[cfg.facility]; !ok {
+		return fmt.Errorf("-syslog-facility %q isn't one of kern, user, mail, daemon, auth, syslog, lpr, news, uucp, cron, authpriv, ftp or local0 to local7", cfg.facility)
+	}
+	if !syslogName(cfg.appName, 48) {
+		return fmt.Errorf("-syslog-app-name %q isn't 1 to 48 printable ASCII characters", cfg.appName)
+	}
+	if cfg.pen < 1 {
+		return fmt.Errorf("-syslog-pen must be positive, not %d", cfg.pen)
+	}
+	return nil
+}
+
+// target returns the network and address of cfg.addr, with port 514 if
+// it has none.
+func (cfg syslogConfig) target() (network, addr string, err error) {
+	u, err := url.Parse(cfg.addr)
+	if err != nil {
+		return "", "", fmt.Errorf("bad -syslog-addr: %w", err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Hostname() == "" || u.Path != "" {
+			break
+		}
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "514")
+		}
+		return u.Scheme, addr, nil
+	case "unixgram":
+		if u.Host != "" || u.Path == "" {
+			break
+		}
+		return u.Scheme, u.Path, nil
+	}
+	return "", "", fmt.Errorf("-syslog-addr %q isn't udp://host:port, tcp://host:port or unixgram:///path", cfg.addr)
+}
+
+// syslogName returns true if s can be a header field of at most n
+// characters, which are printable ASCII.
+func syslogName(s string, n int) bool {
+	return s != "" && len(s) <= n && !strings.ContainsFunc(s, func(r rune) bool { return r < '!' || r > '~' })
+}
+
+// syslogParamName returns true if s can be the name of a parameter of
+// structured data, of at most 32 printable ASCII characters but '=',
+// ']', '"' and space.
+func syslogParamName(s string) bool {
+	return syslogName(s, 32) && !strings.ContainsAny(s, `=]"`)
+}
+
+func (sw *syslogWriter) Observe(point sds011.Point) {
+	params := append(pointParams(point), recordTags.get()...)
+	msg := fmt.Sprintf("PM2.5 %.1f ug/m3, PM10 %.1f ug/m3", point.PM25, point.PM10)
+	sw.out.put(sw.message(syslogInfo, point.Timestamp, "measurement", params, msg))
+}
+
+func (sw *syslogWriter) ObserveError(error) {}
+
+// ObserveAlert sends e at warning severity, whether the alert starts
+// or clears.
+func (sw *syslogWriter) ObserveAlert(e alertEvent) {
+	state, msg := "clear", "particulate levels back below the alert thresholds"
+	if e.active {
+		state, msg = "alert", "particulate levels above the alert thresholds"
+	}
+	params := append([]pointio.Tag{{Key: "state", Value: state}}, pointParams(e.point)...)
+	if e.pm25 > 0 {
+		params = append(params, pointio.Tag{Key: "pm25_threshold", Value: strconv.FormatFloat(e.pm25, 'f', -1, 64)})
+	}
+	if e.pm10 > 0 {
+		params = append(params, pointio.Tag{Key: "pm10_threshold", Value: strconv.FormatFloat(e.pm10, 'f', -1, 64)})
+	}
+	sw.out.put(sw.message(syslogWarning, e.point.Timestamp, "alert", params, msg))
+}
+
+// pointParams returns the parameters of structured data of the values
+// and device of point.
+func pointParams(point sds011.Point) []pointio.Tag {
+	return []pointio.Tag{
+		{Key: syslogParams[0], Value: strconv.FormatFloat(point.PM25, 'f', 1, 64)},
+		{Key: syslogParams[1], Value: strconv.FormatFloat(point.PM10, 'f', 1, 64)},
+		{Key: syslogParams[2], Value: deviceName(point)},
+	}
+}
+
+// message returns the message of severity at ts, with msgID, the
+// structured data element of params, and msg, which must be ASCII, as
+// there's no BOM before it.
+func (sw *syslogWriter) message(severity int, ts time.Time, msgID string, params []pointio.Tag, msg string) []byte {
+	b := fmt.Appendf(nil, "<%d>1 ", sw.facility*8+severity)
+	if ts.IsZero() {
+		b = append(b, '-')
+	} else {
+		// TIME-SECFRAC has at most 6 digits.
+		b = ts.AppendFormat(b, "2006-01-02T15:04:05.999999Z07:00")
+	}
+	b = append(b, ' ')
+	b = append(b, sw.header...)
+	b = append(b, ' ')
+	b = append(b, msgID...)
+	b = append(b, " ["...)
+	b = append(b, sw.sdID...)
+	for _, p := range params {
+		b = append(b, ' ')
+		b = append(b, p.Key...)
+		b = append(b, `="`...)
+		b = appendParamValue(b, p.Value)
+		b = append(b, '"')
+	}
+	b = append(b, "] "...)
+	return append(b, msg...)
+}
+
+// appendParamValue appends s to b as the value of a parameter of
+// structured data, with '"', '\' and ']' escaped by a backslash.
+func appendParamValue(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' || c == ']' {
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// send sends the queued messages until the queue is closed.
+func (sw *syslogWriter) send(messages <-chan []byte) {
+	defer func() {
+		if sw.conn != nil {
+			sw.conn.Close()
+		}
+	}()
+	backoff := time.Second
+	for msg := range messages {
+		for {
+			if sw.out.stopped() {
+				syslogDropped.Inc()
+				break
+			}
+			err := sw.write(msg)
+			if err == nil {
+				syslogSent.Inc()
+				backoff = time.Second
+				break
+			}
+			syslogFailures.Inc()
+			if sw.network != "tcp" {
+				syslogDropped.Inc()
+				slog.Debug("sending to syslog failed, dropped the message", "error", err)
+				break
+			}
+			slog.Warn("sending to syslog failed, reconnecting", "error", err, "backoff", backoff)
+			if !sw.out.sleep(backoff) {
+				syslogDropped.Inc()
+				break
+			}
+			backoff = min(2*backoff, time.Minute)
+		}
+	}
+}
+
+// write sends msg, framed by its length over TCP, connecting first if
+// needed. If sending fails, the connection is closed.
+func (sw *syslogWriter) write(msg []byte) error {
+	if sw.conn == nil {
+		conn, err := net.DialTimeout(sw.network, sw.addr, syslogTimeout)
+		if err != nil {
+			return err
+		}
+		sw.conn = conn
+	}
+	if sw.network == "tcp" {
+		msg = append(strconv.AppendInt(nil, int64(len(msg)), 10), append([]byte{' '}, msg...)...)
+	}
+	sw.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := sw.conn.Write(msg)
+	if err != nil {
+		sw.conn.Close()
+		sw.conn = nil
+	}
+	return err
+}
+
+// Close sends what's left in the queue, giving up on it after
+// shutdownTimeout, and disconnects.
+func (sw *syslogWriter) Close() {
+	sw.out.close()
+}
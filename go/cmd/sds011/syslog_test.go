@@ -0,0 +1,247 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// rfc5424 matches a SYSLOG-MSG of RFC 5424 with structured data and
+// an ASCII MSG, capturing PRI and the fields of the header.
+var rfc5424 = func() *regexp.Regexp {
+	const (
+		printASCII = `[!-~]`
+		sdName     = `[!#-<>-\\^-~]{1,32}` // PRINTUSASCII but '=', ']' and '"'
+		paramVal   = `(?:[^"\\\]]|\\["\\\]])*`
+		sdElement  = `\[` + sdName + `(?: ` + sdName + `="` + paramVal + `")*\]`
+		timestamp  = `-|\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d{1,6})?(?:Z|[+-]\d{2}:\d{2})`
+	)
+	return regexp.MustCompile(`^<(\d{1,3})>1 (` + timestamp + `) (` + printASCII + `{1,255}) (` + printASCII + `{1,48}) (` + printASCII + `{1,128}) (` + printASCII + `{1,32}) (-|(?:` + sdElement + `)+)(?: ([ -~]*))?$`)
+}()
+
+// checkRFC5424 checks that msg matches the grammar of RFC 5424, and
+// returns its fields: PRI, TIMESTAMP, HOSTNAME, APP-NAME, PROCID,
+// MSGID, STRUCTURED-DATA and MSG.
+func checkRFC5424(t *testing.T, msg string) []string {
+	t.Helper()
+	m := rfc5424.FindStringSubmatch(msg)
+	if m == nil {
+		t.Fatalf("%q isn't an RFC 5424 message", msg)
+	}
+	if pri, _ := strconv.Atoi(m[1]); pri > 191 || len(m[1]) > 1 && m[1][0] == '0' {
+		t.Errorf("%q has PRI %v", msg, m[1])
+	}
+	return m[1:]
+}
+
+// syslogHeader is what startSyslog puts after the timestamp.
+func syslogHeader() string {
+	host, _ := os.Hostname()
+	if !syslogName(host, 255) {
+		host = "-"
+	}
+	return host + " sds011 " + strconv.Itoa(os.Getpid())
+}
+
+func syslogListener(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receiveSyslog(t *testing.T, conn net.PacketConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("receiving from syslog: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestRFC5424Grammar(t *testing.T) {
+	for _, msg := range []string{
+		`<30> 2017-07-14T02:40:00Z host sds011 1 measurement [sds011@1] hi`,
+		`<30>1 2017-07-14T02:40:00.1234567Z host sds011 1 measurement [sds011@1] hi`,
+		`<30>1 2017-07-14 02:40:00Z host sds011 1 measurement [sds011@1] hi`,
+		`<30>1 - host sds011 1 measurement [sds011@1 a="x"y"] hi`,
+		`<30>1 - host sds011 1 measurement [sds011@1 a="x]"] hi`,
+		`<30>1 - host sds011 1 measurement [sds011@1 a=x] hi`,
+		`<30>1 - host sds011 1 measurement [sds011@1 a b="x"] hi`,
+		`<30>1 - host sds011 1 measurement sds011@1 hi`,
+		`<30>1 - host sds011 1 [sds011@1] hi`,
+		`<30>1 - host sds011 1 measurement [sds011@1] ünïcode`,
+	} {
+		if rfc5424.MatchString(msg) {
+			t.Errorf("%q matches the grammar", msg)
+		}
+	}
+}
+
+func TestSyslogMeasurement(t *testing.T) {
+	newRegistry(t)
+	conn := syslogListener(t)
+	defer recordTags.set(nil)
+	recordTags.set([]pointio.Tag{{Key: "room", Value: `the "big" one`}})
+	sw, err := startSyslog(syslogConfig{addr: "udp://" + conn.LocalAddr().String(), facility: "local0", appName: "sds011", pen: 32473})
+	if err != nil {
+		t.Fatalf("startSyslog: %v", err)
+	}
+	defer sw.Close()
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 500000000, time.FixedZone("CEST", 2*60*60))
+	sw.Observe(sds011.Point{PM25: 12.3, PM10: 20.1, DeviceID: 0xa1b2, Timestamp: ts})
+
+	msg := receiveSyslog(t, conn)
+	want := `<134>1 2017-07-14T02:40:00.5+02:00 ` + syslogHeader() + ` measurement [sds011@32473 pm25="12.3" pm10="20.1" device="a1b2" room="the \"big\" one"] PM2.5 12.3 ug/m3, PM10 20.1 ug/m3`
+	if msg != want {
+		t.Errorf("sent\n%s\nwant\n%s", msg, want)
+	}
+	checkRFC5424(t, msg)
+}
+
+func TestSyslogAlert(t *testing.T) {
+	newRegistry(t)
+	conn := syslogListener(t)
+	sw, err := startSyslog(syslogConfig{addr: "udp://" + conn.LocalAddr().String(), facility: "daemon", appName: "sds011", pen: 1})
+	if err != nil {
+		t.Fatalf("startSyslog: %v", err)
+	}
+	defer sw.Close()
+	ts := time.Date(2017, 7, 14, 0, 40, 0, 123456789, time.UTC)
+	point := sds011.Point{PM25: 40, PM10: 20.1, DeviceID: 0xa1b2, Timestamp: ts}
+	sw.ObserveAlert(alertEvent{active: true, point: point, pm25: 35})
+	sw.ObserveAlert(alertEvent{active: false, point: point, pm25: 35, pm10: 50.5})
+
+	for _, want := range []string{
+		`<28>1 2017-07-14T00:40:00.123456Z ` + syslogHeader() + ` alert [sds011@1 state="alert" pm25="40.0" pm10="20.1" device="a1b2" pm25_threshold="35"] particulate levels above the alert thresholds`,
+		`<28>1 2017-07-14T00:40:00.123456Z ` + syslogHeader() + ` alert [sds011@1 state="clear" pm25="40.0" pm10="20.1" device="a1b2" pm25_threshold="35" pm10_threshold="50.5"] particulate levels back below the alert thresholds`,
+	} {
+		msg := receiveSyslog(t, conn)
+		if msg != want {
+			t.Errorf("sent\n%s\nwant\n%s", msg, want)
+		}
+		checkRFC5424(t, msg)
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	sw := &syslogWriter{facility: 23, header: "- sds011 1", sdID: "sds011@32473"}
+	for _, tc := range []struct {
+		name   string
+		ts     time.Time
+		params []pointio.Tag
+		want   string
+	}{
+		{"no timestamp", time.Time{}, nil, `<190>1 - - sds011 1 measurement [sds011@32473] hi`},
+		{"whole seconds", time.Date(2017, 7, 14, 0, 40, 0, 0, time.UTC), nil, `<190>1 2017-07-14T00:40:00Z - sds011 1 measurement [sds011@32473] hi`},
+		{"escaped", time.Time{}, []pointio.Tag{{Key: "a", Value: `x"y\z]`}, {Key: "b"}}, `<190>1 - - sds011 1 measurement [sds011@32473 a="x\"y\\z\]" b=""] hi`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := string(sw.message(syslogInfo, tc.ts, "measurement", tc.params, "hi"))
+			if msg != tc.want {
+				t.Errorf("message: got\n%s\nwant\n%s", msg, tc.want)
+			}
+			f := checkRFC5424(t, msg)
+			if f[0] != "190" || f[6] != tc.want[strings.Index(tc.want, "["):strings.LastIndex(tc.want, "]")+1] || f[7] != "hi" {
+				t.Errorf("%q parsed as %q", msg, f)
+			}
+		})
+	}
+}
+
+func TestSyslogTCPFraming(t *testing.T) {
+	newRegistry(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sw, err := startSyslog(syslogConfig{addr: "tcp://" + l.Addr().String(), facility: "user", appName: "sds011", pen: 32473})
+	if err != nil {
+		t.Fatalf("startSyslog: %v", err)
+	}
+	for i := range 2 {
+		sw.Observe(sds011.Point{PM25: float64(i), PM10: 2, DeviceID: 0xa1b2})
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i := range 2 {
+		// RFC 6587 octet counting: MSG-LEN SP SYSLOG-MSG.
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatalf("reading the length of message %d: %v", i, err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("message %d has length %q", i, length)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatalf("reading the %d bytes of message %d: %v", n, i, err)
+		}
+		f := checkRFC5424(t, string(msg))
+		if f[0] != "14" || f[1] != "-" || !strings.HasPrefix(f[7], "PM2.5 "+strconv.Itoa(i)+".0 ") {
+			t.Errorf("message %d is %q", i, msg)
+		}
+	}
+	sw.Close()
+}
+
+func TestSyslogConfigCheck(t *testing.T) {
+	good := syslogConfig{addr: "udp://localhost", facility: "local7", appName: "sds011", pen: 32473}
+	if err := good.check(); err != nil {
+		t.Errorf("check(%+v): %v", good, err)
+	}
+	if network, addr, _ := good.target(); network != "udp" || addr != "localhost:514" {
+		t.Errorf("target(%q) = %q, %q, want udp and localhost:514", good.addr, network, addr)
+	}
+	for _, bad := range []func(*syslogConfig){
+		func(c *syslogConfig) { c.addr = "localhost:514" },
+		func(c *syslogConfig) { c.addr = "tcp:///dev/log" },
+		func(c *syslogConfig) { c.addr = "unixgram://localhost" },
+		func(c *syslogConfig) { c.facility = "local8" },
+		func(c *syslogConfig) { c.appName = "" },
+		func(c *syslogConfig) { c.appName = "sds 011" },
+		func(c *syslogConfig) { c.appName = strings.Repeat("x", 49) },
+		func(c *syslogConfig) { c.pen = 0 },
+	} {
+		cfg := good
+		bad(&cfg)
+		if err := cfg.check(); err == nil {
+			t.Errorf("check(%+v) succeeded", cfg)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// systemd tells systemd how the service is doing, as sd_notify(3)
+// does: that it's ready once the sensor sent something, what the
+// latest measurement is, and, if the unit has WatchdogSec, that it
+// isn't hung. It is an observer.
+type systemd struct {
+	conn     net.Conn
+	watchdog time.Duration // 0 if the watchdog is off
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu    sync.Mutex
+	ready bool
+	// alive is until when the service counts as not hung. Reading
+	// the sensor pushes it forward, and so does waiting for the
+	// next measurement.
+	alive time.Time
+}
+
+// startSystemd connects to $NOTIFY_SOCKET, and starts pinging the
+// watchdog if $WATCHDOG_USEC is set for this process. It returns nil
+// if the service wasn't started by systemd with Type=notify. It unsets
+// the variables, so that the commands it runs don't inherit them.
+func startSystemd() *systemd {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	usec, _ := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		usec = 0
+	}
+	for _, name := range []string{"NOTIFY_SOCKET", "WATCHDOG_USEC", "WATCHDOG_PID"} {
+		os.Unsetenv(name)
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		slog.Warn("connecting to systemd", "socket", socket, "error", err)
+		return nil
+	}
+	sd := &systemd{
+		conn:     conn,
+		watchdog: time.Duration(usec) * time.Microsecond,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	sd.alive = time.Now().Add(sd.watchdog)
+	go sd.ping()
+	return sd
+}
+
+// notify sends state, like "READY=1", to systemd.
+func (sd *systemd) notify(state string) {
+	if _, err := sd.conn.Write([]byte(state)); err != nil {
+		slog.Debug("notifying systemd", "state", state, "error", err)
+	}
+}
+
+// ping pings the watchdog every half of its timeout, for as long as
+// the service is alive, until it's closed.
+func (sd *systemd) ping() {
+	defer close(sd.done)
+	if sd.watchdog <= 0 {
+		return
+	}
+	ticker := time.NewTicker(sd.watchdog / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sd.mu.Lock()
+			alive := time.Now().Before(sd.alive)
+			sd.mu.Unlock()
+			if alive {
+				sd.notify("WATCHDOG=1")
+			}
+		case <-sd.stop:
+			return
+		}
+	}
+}
+
+// read notes that reading the sensor returned, which it does in time
+// even if it fails, and that it's ready if it sent a measurement.
+func (sd *systemd) read(err error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.alive = time.Now().Add(sd.watchdog)
+	if err == nil && !sd.ready {
+		sd.ready = true
+		sd.notify("READY=1\nSTATUS=reading measurements")
+	}
+}
+
+// idle notes that the service is waiting for d for the next
+// measurement.
+func (sd *systemd) idle(d time.Duration) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	sd.alive = time.Now().Add(d + sd.watchdog)
+}
+
+func (sd *systemd) Observe(point sds011.Point) {
+	sd.notify("STATUS=latest measurement: " + point.String())
+}
+
+func (sd *systemd) ObserveError(error) {}
+
+// Close tells systemd that the service is stopping.
+func (sd *systemd) Close() {
+	close(sd.stop)
+	<-sd.done
+	sd.notify("STOPPING=1")
+	sd.conn.Close()
+}
+
+// systemdDevice is a device that tells systemd about every read.
+type systemdDevice struct {
+	sds011.Device
+	sd *systemd
+}
+
+func (d systemdDevice) GetContext(ctx context.Context) (*sds011.Point, error) {
+	point, err := d.Device.GetContext(ctx)
+	d.sd.read(err)
+	return point, err
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011/pointio"
+)
+
+// tagReserved are the names -tag keys can't have, as the columns and
+// JSON fields of measurements and daily summaries, and the tags the
+// outputs add, already have them. A type field also makes readers skip
+// a JSON line.
+var tagReserved = []string{
+	"timestamp", "pm2_5", "pm10", "pm2_5_raw", "pm10_raw", "device_id", "port", "seq",
+	"aqi", "aqi_category", "samples", "pm2_5_stddev", "pm10_stddev", "trigger", "error", "missing",
+	"sample_count", "pm2_5_min", "pm2_5_max", "pm10_min", "pm10_max", "sensors",
+	"pm2_5_smoothed", "pm10_smoothed", "pm2_5_rate", "pm10_rate", "age_seconds", "schema", "metadata", "devices",
+	"sensor", "host", "hostname",
+	// Those of daily summaries.
+	"type", "date", "hours", "measurements", "expected", "completeness_percent",
+	"pm2_5_mean", "pm2_5_max_at", "pm10_mean", "pm10_max_at",
+}
+
+// metricLabels are the labels of the metrics of the sensors, which
+// -tag keys can't be when they're labels too.
+var metricLabels = []string{"device_id", "port", "kind", "category", "reason", "buffer"}
+
+// checkTags returns an error for every tag whose key an output in use
+// can't take, or that is among the names they already have.
+func checkTags(tags []pointio.Tag) error {
+	var errs []error
+	for _, t := range tags {
+		if slices.Contains(tagReserved, t.Key) {
+			errs = append(errs, fmt.Errorf("-tag key %q is taken, the measurements already have it", t.Key))
+			continue
+		}
+		if strings.ContainsFunc(t.Key+t.Value, unicode.IsControl) {
+			errs = append(errs, fmt.Errorf("-tag %s has control characters", t.Key))
+		}
+		if metricsExported() {
+			switch {
+			case !labelName.MatchString(t.Key) || strings.HasPrefix(t.Key, "__"):
+				errs = append(errs, fmt.Errorf("-tag key %q isn't a valid Prometheus label name, of letters, digits and _, not starting with a digit or __", t.Key))
+			case slices.Contains(metricLabels, t.Key):
+				errs = append(errs, fmt.Errorf("-tag key %q is taken, the metrics already have it as a label", t.Key))
+			case metricsLabels[t.Key] != "":
+				errs = append(errs, fmt.Errorf("-tag key %q is in -metrics-labels too", t.Key))
+			}
+		}
+		if *statsdAddr != "" && *statsdTagsFormat == "dogstatsd" && strings.ContainsAny(t.Key+t.Value, ":|,#") {
+			errs = append(errs, fmt.Errorf("-tag %s has :, |, , or #, which DogStatsD tags can't have", t.Key))
+		}
+		if *syslogAddr != "" {
+			switch {
+			case !syslogParamName(t.Key):
+				errs = append(errs, fmt.Errorf("-tag key %q isn't a valid syslog parameter name, of at most 32 printable ASCII characters but =, ] and \"", t.Key))
+			case slices.Contains(syslogParams, t.Key):
+				errs = append(errs, fmt.Errorf("-tag key %q is taken, the syslog messages already have it", t.Key))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// metricsExported returns true if the metrics of the sensors leave
+// sds011, by -listen-address, -pushgateway-url or -remote-write-url,
+// for the tags to be labels of them.
+func metricsExported() bool {
+	return *addr != "" || *pushgatewayURL != "" || *remoteWriteURL != ""
+}
+
+// metricsConstLabels returns the labels of -metrics-labels, and the
+// tags, if the metrics are exported.
+func metricsConstLabels() prometheus.Labels {
+	labels := maps.Clone(prometheus.Labels(metricsLabels))
+	if metricsExported() {
+		for _, t := range *tags {
+			labels[t.Key] = t.Value
+		}
+	}
+	return labels
+}
+
+// mergeTags returns the tags of values, like those of the -config
+// file, with those of over, like those of the command line, replacing
+// them when they have the same key.
+func mergeTags(values []string, over tagsFlag) (tagsFlag, error) {
+	var merged tagsFlag
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if err := merged.Set(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range over {
+		merged.put(t)
+	}
+	return merged, nil
+}
+
+// sameKeys returns true if a and b have the same keys, in any order.
+func sameKeys(a, b []pointio.Tag) bool {
+	keys := func(tags []pointio.Tag) []string {
+		var ks []string
+		for _, t := range tags {
+			ks = append(ks, t.Key)
+		}
+		slices.Sort(ks)
+		return ks
+	}
+	return slices.Equal(keys(a), keys(b))
+}
+
+// recordTags are the -tag tags of the records of measurements, set
+// when starting, and again when they're reloaded.
+var recordTags tagSet
+
+// A tagSet holds tags that are read and set from different
+// goroutines.
+type tagSet struct {
+	mu   sync.Mutex
+	tags []pointio.Tag
+}
+
+func (s *tagSet) get() []pointio.Tag {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tags
+}
+
+func (s *tagSet) set(tags []pointio.Tag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags = slices.Clone(tags)
+}
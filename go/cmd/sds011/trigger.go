@@ -0,0 +1,91 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// A trigger asks the readers for a measurement right away, out of
+// their schedules, on SIGUSR1 where there is one, and on POST
+// /trigger.
+type trigger struct {
+	mu       sync.Mutex
+	triggers []chan struct{}
+}
+
+// add makes fire send to ch, without waiting.
+func (t *trigger) add(ch chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.triggers = append(t.triggers, ch)
+}
+
+// fire asks all the readers for a measurement, and returns how many
+// there are.
+func (t *trigger) fire() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ch := range t.triggers {
+		sendNewest(ch, struct{}{})
+	}
+	return len(t.triggers)
+}
+
+// watch fires on every SIGUSR1, until ctx is done.
+func (t *trigger) watch(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	if !notifyTrigger(sig) {
+		return
+	}
+	go func() {
+		defer signal.Stop(sig)
+		for {
+			select {
+			case <-sig:
+				slog.Info("SIGUSR1, measuring now")
+				t.fire()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// serveTrigger answers POST /trigger with 202, once it asked for a
+// measurement, or 503 if there's no sensor being read to ask.
+func (t *trigger) serveTrigger(w http.ResponseWriter, r *http.Request) {
+	if t.fire() == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, healthJSON{Status: "no sensor"})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, healthJSON{Status: "triggered"})
+}
+
+// drain empties ch, without waiting.
+func drain(ch chan struct{}) {
+	for {
+		select {
+		case <-ch:
+		default:
+			return
+		}
+	}
+}
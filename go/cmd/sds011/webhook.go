@@ -0,0 +1,242 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/aqi"
+)
+
+// webhookQueueSize is how many measurements wait for each webhook
+// while it's failing, on top of a batch.
+const webhookQueueSize = 100
+
+var (
+	webhookDelivered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_webhook_delivered_total",
+		Help: "Measurements delivered to webhooks.",
+	})
+	webhookFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_webhook_failures_total",
+		Help: "Failed attempts to deliver measurements to webhooks.",
+	})
+	webhookDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_webhook_dropped_total",
+		Help: "Measurements dropped because delivering them to a webhook kept failing, or too many were waiting.",
+	})
+)
+
+// webhookConfig says how measurements are delivered to webhooks.
+type webhookConfig struct {
+	timeout time.Duration
+	token   string // sent as a bearer token, if not empty
+	retries int
+	batch   int  // measurements per request
+	aqi     bool // whether to add the AQI
+}
+
+// webhooks delivers measurements to webhooks. It is an observer.
+type webhooks []*webhook
+
+// A webhook POSTs measurements as JSON to a URL. Each webhook has a
+// goroutine of its own, so that a slow one holds up neither reading
+// the sensor nor the other webhooks.
+type webhook struct {
+	url    string
+	cfg    webhookConfig
+	client *http.Client
+	header http.Header
+	out    *outbox[webhookItem]
+}
+
+// A webhookItem is what a webhook delivers: a measurement, or a daily
+// summary.
+type webhookItem struct {
+	point   sds011.Point
+	summary *dailySummary
+}
+
+// startWebhooks starts delivering measurements to urls.
+func startWebhooks(urls []string, cfg webhookConfig) (webhooks, error) {
+	if err := cfg.check(urls); err != nil {
+		return nil, err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if cfg.token != "" {
+		header.Set("Authorization", "Bearer "+cfg.token)
+	}
+	var hooks webhooks
+	for _, u := range urls {
+		hooks = append(hooks, &webhook{
+			url:    u,
+			cfg:    cfg,
+			client: &http.Client{Timeout: cfg.timeout},
+			header: header,
+			out:    newOutbox[webhookItem](webhookQueueSize+cfg.batch, webhookDropped, "webhook"),
+		})
+	}
+	registry.MustRegister(webhookDelivered, webhookFailures, webhookDropped)
+	for _, hook := range hooks {
+		hook.out.start(hook.deliver)
+	}
+	return hooks, nil
+}
+
+// check returns an error if cfg, or any of the urls, doesn't make
+// sense.
+func (cfg webhookConfig) check(urls []string) error {
+	if cfg.timeout <= 0 {
+		return fmt.Errorf("-webhook-timeout must be positive, not %v", cfg.timeout)
+	}
+	if cfg.retries < 0 {
+		return fmt.Errorf("-webhook-retries can't be negative")
+	}
+	if cfg.batch < 1 {
+		return fmt.Errorf("-webhook-batch must be at least 1, not %d", cfg.batch)
+	}
+	for _, u := range urls {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("-webhook-url %q isn't an http or https URL", u)
+		}
+	}
+	return nil
+}
+
+func (hooks webhooks) Observe(point sds011.Point) {
+	for _, hook := range hooks {
+		hook.out.put(webhookItem{point: point})
+	}
+}
+
+func (hooks webhooks) ObserveError(error) {}
+
+// ObserveSummary delivers a daily summary, after the measurements
+// before it.
+func (hooks webhooks) ObserveSummary(ds dailySummary) {
+	for _, hook := range hooks {
+		hook.out.put(webhookItem{summary: &ds})
+	}
+}
+
+// Close delivers what's left, giving up on it after shutdownTimeout.
+func (hooks webhooks) Close() {
+	for _, hook := range hooks {
+		hook.out.close()
+	}
+}
+
+// deliver delivers the queued measurements, batch at a time, until
+// the queue is closed, and then what's left. A daily summary cuts the
+// batch short, and goes on its own.
+func (hook *webhook) deliver(items <-chan webhookItem) {
+	var batch []sds011.Point
+	for item := range items {
+		if item.summary != nil {
+			if len(batch) > 0 {
+				hook.post(batch)
+				batch = batch[:0]
+			}
+			hook.postSummary(*item.summary)
+			continue
+		}
+		if batch = append(batch, item.point); len(batch) == hook.cfg.batch {
+			hook.post(batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		hook.post(batch)
+	}
+}
+
+// post POSTs the points in batch: as a JSON object if there's only
+// one in a batch, and as an array of them if there can be more.
+func (hook *webhook) post(batch []sds011.Point) {
+	var body []byte
+	var err error
+	if hook.cfg.batch == 1 {
+		body, err = hook.encode(batch[0])
+	} else {
+		msgs := make([]json.RawMessage, len(batch))
+		for i, point := range batch {
+			if msgs[i], err = hook.encode(point); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			body, err = json.Marshal(msgs)
+		}
+	}
+	if err == nil {
+		err = deliver(hook.out, hook.cfg.retries, webhookFailures, "delivering to a webhook", func() error {
+			return post(hook.client, hook.url, hook.header, body, hook.out.stop)
+		})
+	}
+	if err != nil {
+		webhookDropped.Add(float64(len(batch)))
+		slog.Error("delivering to a webhook failed, dropped the measurements", "url", redactURL(hook.url), "count", len(batch), "error", err)
+		return
+	}
+	webhookDelivered.Add(float64(len(batch)))
+}
+
+// postSummary POSTs a daily summary, as a JSON object.
+func (hook *webhook) postSummary(ds dailySummary) {
+	body, err := json.Marshal(ds)
+	if err == nil {
+		err = deliver(hook.out, hook.cfg.retries, webhookFailures, "delivering to a webhook", func() error {
+			return post(hook.client, hook.url, hook.header, body, hook.out.stop)
+		})
+	}
+	if err != nil {
+		webhookDropped.Inc()
+		slog.Error("delivering to a webhook failed, dropped the daily summary", "url", redactURL(hook.url), "date", ds.Date, "error", err)
+		return
+	}
+	webhookDelivered.Inc()
+}
+
+// encode returns the record of point, with its US EPA AQI as "aqi"
+// and "aqi_category" if it's wanted.
+func (hook *webhook) encode(point sds011.Point) ([]byte, error) {
+	r := newRecord(point, devicePorts.of(point))
+	if hook.cfg.aqi {
+		r = r.withAQI(func(point sds011.Point) (int, string) {
+			result := aqi.FromPoint(point)
+			return result.Index, result.Category.String()
+		})
+	}
+	return json.Marshal(r)
+}
+
+// redactURL returns u without its user info and query, which may hold
+// secrets, for the logs.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "?"
+	}
+	parsed.User = nil
+	parsed.RawQuery = ""
+	return parsed.String()
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// windowStats computes the distribution of the concentrations of every
+// device over the measurements in the history taken in the window up
+// to its latest, for the metrics. Missing measurements are left out,
+// so gaps make for fewer values rather than a longer window. It is an
+// observer, which has to see measurements after the history does.
+type windowStats struct {
+	hist      *history
+	window    time.Duration
+	minPoints int // fewer make for no distribution
+
+	mu      sync.Mutex
+	devices map[uint16]*deviceWindow
+}
+
+// deviceWindow is the distribution of a device's concentrations over
+// the window up to latest.
+type deviceWindow struct {
+	latest     time.Time
+	pm25, pm10 sds011.Distribution
+	ok         bool
+}
+
+// newWindowStats returns window stats over the measurements in hist,
+// which must be kept at least as long as window.
+func newWindowStats(hist *history, window time.Duration, minPoints int) *windowStats {
+	return &windowStats{hist: hist, window: window, minPoints: minPoints, devices: make(map[uint16]*deviceWindow)}
+}
+
+func (ws *windowStats) Observe(point sds011.Point) {
+	points := ws.hist.since(point.Timestamp.Add(-ws.window), func(p sds011.Point) bool {
+		return p.DeviceID == point.DeviceID && p.Missing == "" && !p.Timestamp.After(point.Timestamp)
+	}, 0)
+	d := &deviceWindow{latest: point.Timestamp, ok: len(points) >= max(ws.minPoints, 1)}
+	if d.ok {
+		var agg sds011.Aggregator
+		for _, p := range points {
+			agg.Add(p)
+		}
+		s := agg.Summary()
+		d.pm25, d.pm10 = s.PM25, s.PM10
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.devices[point.DeviceID] = d
+}
+
+func (ws *windowStats) ObserveError(error) {}
+
+// of returns the distributions over the window up to point, which must
+// be the latest measurement of its device, and false if there were
+// too few measurements in it.
+func (ws *windowStats) of(point sds011.Point) (pm25, pm10 sds011.Distribution, ok bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	d := ws.devices[point.DeviceID]
+	if d == nil || !d.latest.Equal(point.Timestamp) {
+		return sds011.Distribution{}, sds011.Distribution{}, false
+	}
+	return d.pm25, d.pm10, d.ok
+}
@@ -0,0 +1,246 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+const (
+	// zabbixTimeout is how long connecting to the Zabbix server,
+	// sending it a measurement and reading its answer may take.
+	zabbixTimeout = 5 * time.Second
+
+	// zabbixRetries is how many times sending a measurement is retried
+	// while the server can't be reached, before it's dropped.
+	zabbixRetries = 5
+
+	// zabbixQueue is how many measurements wait to be sent.
+	zabbixQueue = 100
+
+	// zabbixMaxResponse is the longest answer of the server read.
+	zabbixMaxResponse = 64 << 10
+)
+
+// zabbixHeader starts every message of the Zabbix sender protocol,
+// followed by the length of the JSON after it, as 4 bytes, and 4
+// reserved ones, both little-endian.
+var zabbixHeader = []byte("ZBXD\x01")
+
+var (
+	zabbixSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_zabbix_sent_total",
+		Help: "Measurements sent to Zabbix.",
+	})
+	zabbixFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_zabbix_failures_total",
+		Help: "Failed attempts to send a measurement to Zabbix.",
+	})
+	zabbixItemsFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_zabbix_items_failed_total",
+		Help: "Values sent that the Zabbix server didn't process, say because their items don't exist.",
+	})
+	zabbixDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sds011_zabbix_dropped_total",
+		Help: "Measurements dropped because sending them to Zabbix kept failing, or too many were waiting.",
+	})
+)
+
+// zabbixSender sends measurements to a Zabbix server or proxy with the
+// sender protocol, as trapper items of the host, keyed as
+//
+//	sds011.pm25[<device ID>]
+//	sds011.pm10[<device ID>]
+//
+// both values of a measurement in the same request. It reconnects for
+// every request, as the server closes the connection after answering.
+// It is an observer.
+type zabbixSender struct {
+	addr string
+	host string
+	out  *outbox[sds011.Point]
+}
+
+// A zabbixValue is a value of sender data.
+type zabbixValue struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+	NS    int    `json:"ns"`
+}
+
+// startZabbix starts sending measurements to the Zabbix server at
+// addr, port 10051 if it has none, as the values of host, this
+// machine's hostname if it's empty.
+func startZabbix(addr, host string) (*zabbixSender, error) {
+	addr, host, err := zabbixTarget(addr, host)
+	if err != nil {
+		return nil, err
+	}
+	zs := &zabbixSender{
+		addr: addr,
+		host: host,
+		out:  newOutbox[sds011.Point](zabbixQueue, zabbixDropped, "Zabbix"),
+	}
+	registry.MustRegister(zabbixSent, zabbixFailures, zabbixItemsFailed, zabbixDropped)
+	zs.out.start(zs.send)
+	return zs, nil
+}
+
+// zabbixTarget returns addr with the port of the Zabbix server if it
+// has none, and host, or this machine's hostname if it's empty, or an
+// error if they don't make sense.
+func zabbixTarget(addr, host string) (string, string, error) {
+	if host == "" {
+		host, _ = os.Hostname()
+		if host == "" {
+			return "", "", errors.New("can't tell the hostname, so -zabbix-host must be set")
+		}
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "10051")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("bad -zabbix-server: %w", err)
+		}
+	}
+	return addr, host, nil
+}
+
+func (zs *zabbixSender) Observe(point sds011.Point) {
+	zs.out.put(point)
+}
+
+func (zs *zabbixSender) ObserveError(error) {}
+
+// send sends the queued measurements until the queue is closed,
+// retrying with backoff while the server can't be reached.
+func (zs *zabbixSender) send(points <-chan sds011.Point) {
+	for point := range points {
+		err := deliver(zs.out, zabbixRetries, zabbixFailures, "sending to Zabbix", func() error {
+			return zs.write(point)
+		})
+		if err != nil {
+			zabbixDropped.Inc()
+			slog.Error("sending to Zabbix failed, dropped the measurement", "error", err)
+			continue
+		}
+		zabbixSent.Inc()
+	}
+}
+
+// write sends the values of point in a request, and checks the
+// server's answer. Values the server didn't process are logged and
+// counted, but not sent again, as they won't be processed the next
+// time either.
+func (zs *zabbixSender) write(point sds011.Point) error {
+	id := fmt.Sprintf("%04x", point.DeviceID)
+	clock, ns := point.Timestamp.Unix(), point.Timestamp.Nanosecond()
+	values := []zabbixValue{
+		{zs.host, "sds011.pm25[" + id + "]", strconv.FormatFloat(point.PM25, 'f', 2, 64), clock, ns},
+		{zs.host, "sds011.pm10[" + id + "]", strconv.FormatFloat(point.PM10, 'f', 2, 64), clock, ns},
+	}
+	body, err := json.Marshal(struct {
+		Request string        `json:"request"`
+		Data    []zabbixValue `json:"data"`
+	}{"sender data", values})
+	if err != nil {
+		return err
+	}
+	resp, err := zs.exchange(body)
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	var answer struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(resp, &answer); err != nil {
+		return fmt.Errorf("bad answer from Zabbix: %w", err)
+	}
+	if answer.Response != "success" {
+		return fmt.Errorf("Zabbix answered %q: %v", answer.Response, answer.Info)
+	}
+	var processed, failed int
+	if _, err := fmt.Sscanf(answer.Info, "processed: %d; failed: %d", &processed, &failed); err != nil {
+		slog.Warn("can't tell how many values Zabbix processed", "info", answer.Info)
+		return nil
+	}
+	if failed > 0 {
+		zabbixItemsFailed.Add(float64(failed))
+		slog.Warn("Zabbix didn't process some of the values: are the trapper items of -zabbix-host set up?",
+			"host", zs.host, "device_id", id, "processed", processed, "failed", failed)
+	}
+	return nil
+}
+
+// exchange sends body to the server as a message of the sender
+// protocol, and returns the JSON of its answer.
+func (zs *zabbixSender) exchange(body []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", zs.addr, zabbixTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(zabbixTimeout))
+	if _, err := conn.Write(appendZabbixMessage(nil, body)); err != nil {
+		return nil, err
+	}
+	var header [13]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, fmt.Errorf("reading the answer: %w", err)
+	}
+	if !bytes.HasPrefix(header[:], zabbixHeader[:4]) {
+		return nil, errors.New("the answer doesn't start with ZBXD")
+	}
+	n := binary.LittleEndian.Uint32(header[5:9])
+	if n > zabbixMaxResponse {
+		return nil, fmt.Errorf("the answer is too long, %d bytes", n)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("reading the answer: %w", err)
+	}
+	return resp, nil
+}
+
+// appendZabbixMessage appends body to b as a message of the sender
+// protocol: zabbixHeader, the length of body and the reserved bytes,
+// and body.
+func appendZabbixMessage(b, body []byte) []byte {
+	b = append(b, zabbixHeader...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)))
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	return append(b, body...)
+}
+
+// Close sends what's left in the queue, giving up on it after
+// shutdownTimeout.
+func (zs *zabbixSender) Close() {
+	zs.out.close()
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A zabbixRequest is a message received by a fake Zabbix server.
+type zabbixRequest struct {
+	header []byte // the 13 bytes before the JSON
+	body   string
+}
+
+// fakeZabbix starts a server reading a message of the sender protocol
+// from every connection and answering it with the next of answers, or
+// closing the connection without answering if it's empty. It sends
+// what it read to the channel returned.
+func fakeZabbix(t *testing.T, answers ...string) (string, <-chan zabbixRequest) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	requests := make(chan zabbixRequest, 10)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			header := make([]byte, 13)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				t.Errorf("reading the header: %v", err)
+				conn.Close()
+				continue
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(header[5:9]))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				t.Errorf("reading the %d bytes of the body: %v", len(body), err)
+			}
+			requests <- zabbixRequest{header, string(body)}
+			if i < len(answers) && answers[i] != "" {
+				conn.Write(appendZabbixMessage(nil, []byte(answers[i])))
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String(), requests
+}
+
+func receiveZabbix(t *testing.T, requests <-chan zabbixRequest) zabbixRequest {
+	t.Helper()
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was sent to Zabbix")
+		return zabbixRequest{}
+	}
+}
+
+const zabbixSuccess = `{"response":"success","info":"processed: 2; failed: 0; total: 2; seconds spent: 0.000055"}`
+
+func TestZabbixFraming(t *testing.T) {
+	newRegistry(t)
+	addr, requests := fakeZabbix(t, zabbixSuccess)
+	zs, err := startZabbix(addr, "pi4")
+	if err != nil {
+		t.Fatalf("startZabbix: %v", err)
+	}
+	sent := counterValue(zabbixSent)
+	zs.Observe(sds011.Point{PM25: 12.3, PM10: 20.1, DeviceID: 0xa1b2, Timestamp: time.Unix(1500000000, 500)})
+	r := receiveZabbix(t, requests)
+	zs.Close()
+
+	if !bytes.Equal(r.header[:5], []byte("ZBXD\x01")) {
+		t.Errorf("the message starts with %q, want ZBXD\\x01", r.header[:5])
+	}
+	if n := binary.LittleEndian.Uint32(r.header[5:9]); int(n) != len(r.body) {
+		t.Errorf("the header says the body is %d bytes, but it's %d", n, len(r.body))
+	}
+	if reserved := r.header[9:]; !bytes.Equal(reserved, make([]byte, 4)) {
+		t.Errorf("the reserved bytes are %x, want zeros", reserved)
+	}
+	want := `{"request":"sender data","data":[` +
+		`{"host":"pi4","key":"sds011.pm25[a1b2]","value":"12.30","clock":1500000000,"ns":500},` +
+		`{"host":"pi4","key":"sds011.pm10[a1b2]","value":"20.10","clock":1500000000,"ns":500}]}`
+	if r.body != want {
+		t.Errorf("sent\n%s\nwant\n%s", r.body, want)
+	}
+	if got := counterValue(zabbixSent) - sent; got != 1 {
+		t.Errorf("counted %v measurements sent, want 1", got)
+	}
+}
+
+func TestZabbixAppendMessage(t *testing.T) {
+	got := appendZabbixMessage([]byte("x"), []byte(`{"a":1}`))
+	want := []byte("xZBXD\x01\x07\x00\x00\x00\x00\x00\x00\x00{\"a\":1}")
+	if !bytes.Equal(got, want) {
+		t.Errorf("appendZabbixMessage: got %q, want %q", got, want)
+	}
+}
+
+func TestZabbixAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		answers               []string
+		attempts              int
+		sent, dropped, failed float64
+		failures              float64
+	}{
+		{"items failed", []string{`{"response":"success","info":"processed: 1; failed: 1; total: 2; seconds spent: 0.000055"}`}, 1, 1, 0, 1, 0},
+		{"odd info", []string{`{"response":"success","info":"all good"}`}, 1, 1, 0, 0, 0},
+		{"refused", []string{`{"response":"failed","info":"host not found"}`}, 1, 0, 1, 0, 1},
+		{"not JSON", []string{`ZBXD`}, 1, 0, 1, 0, 1},
+		{"no answer", []string{"", zabbixSuccess}, 2, 1, 0, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			newRegistry(t)
+			addr, requests := fakeZabbix(t, tc.answers...)
+			zs, err := startZabbix(addr, "pi4")
+			if err != nil {
+				t.Fatalf("startZabbix: %v", err)
+			}
+			sent, dropped := counterValue(zabbixSent), counterValue(zabbixDropped)
+			failed, failures := counterValue(zabbixItemsFailed), counterValue(zabbixFailures)
+			zs.Observe(sds011.Point{PM25: 1, PM10: 2, DeviceID: 0xa1b2})
+			var bodies []string
+			for range tc.attempts {
+				bodies = append(bodies, receiveZabbix(t, requests).body)
+			}
+			zs.Close()
+			if len(bodies) == 2 && bodies[0] != bodies[1] {
+				t.Errorf("sent %s after failing to send %s", bodies[1], bodies[0])
+			}
+			for _, c := range []struct {
+				what      string
+				got, want float64
+			}{
+				{"measurements sent", counterValue(zabbixSent) - sent, tc.sent},
+				{"measurements dropped", counterValue(zabbixDropped) - dropped, tc.dropped},
+				{"items failed", counterValue(zabbixItemsFailed) - failed, tc.failed},
+				{"failures", counterValue(zabbixFailures) - failures, tc.failures},
+			} {
+				if c.got != c.want {
+					t.Errorf("counted %v %s, want %v", c.got, c.what, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestZabbixTarget(t *testing.T) {
+	for _, tc := range []struct {
+		addr, host         string
+		wantAddr, wantHost string
+	}{
+		{"zabbix", "pi4", "zabbix:10051", "pi4"},
+		{"zabbix:20051", "pi4", "zabbix:20051", "pi4"},
+		{"10.0.0.1", "pi4", "10.0.0.1:10051", "pi4"},
+		{"::1", "pi4", "[::1]:10051", "pi4"},
+		{"[::1]:20051", "pi4", "[::1]:20051", "pi4"},
+	} {
+		addr, host, err := zabbixTarget(tc.addr, tc.host)
+		if err != nil || addr != tc.wantAddr || host != tc.wantHost {
+			t.Errorf("zabbixTarget(%q, %q) = %q, %q, %v, want %q, %q", tc.addr, tc.host, addr, host, err, tc.wantAddr, tc.wantHost)
+		}
+	}
+}
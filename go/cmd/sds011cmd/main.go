@@ -22,7 +22,7 @@ func main() {
 
 	switch cmd := flag.Arg(0); cmd {
 	case "cycle":
-		dutyCycle, err := sensor.Cycle()
+		dutyCycle, err := sensor.WorkingPeriod()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -32,7 +32,7 @@ func main() {
 		if err != nil {
 			log.Fatalf("bad number: %v", flag.Arg(1))
 		}
-		if err := sensor.SetCycle(uint8(v)); err != nil {
+		if err := sensor.SetWorkingPeriod(uint8(v)); err != nil {
 			log.Fatal(err)
 		}
 
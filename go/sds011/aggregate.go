@@ -0,0 +1,298 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Distribution describes the values of one of the PM channels.
+type Distribution struct {
+	Mean   float64
+	Median float64 // the middle value, or the mean of the middle two
+	// TrimmedMean is the mean without the highest and the lowest
+	// values (see Aggregator.Trim).
+	TrimmedMean float64
+	Min         float64
+	Max         float64
+	// P95 is the 95th percentile, interpolated between the values
+	// around it.
+	P95 float64
+	// StdDev is the sample standard deviation. It's 0 for fewer
+	// than two values.
+	StdDev float64
+	// Rejected is the number of values left out as outliers (see
+	// Aggregator.RejectOutliers). The other stats are computed
+	// without them.
+	Rejected int
+}
+
+// Summary describes the points added to an Aggregator.
+type Summary struct {
+	// Count is the number of points. If it's 0, the rest of the
+	// summary is zero too.
+	Count int
+	PM25  Distribution
+	PM10  Distribution
+	// Start and End are the timestamps of the earliest and the
+	// latest point.
+	Start time.Time
+	End   time.Time
+	// DeviceID is the device ID of the latest point.
+	DeviceID uint16
+	// Expected is the number of measurements the sensor sent over
+	// the span, including those lost, as told by the points'
+	// sequence numbers (see Point.Seq). If some points don't have
+	// one, it's the same as Count.
+	Expected int
+}
+
+// Span returns the time covered by the points.
+func (s Summary) Span() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// Completeness returns the percentage of the measurements expected
+// that were received, or 0 if there were none.
+func (s Summary) Completeness() float64 {
+	if s.Expected == 0 {
+		return 0
+	}
+	return 100 * float64(s.Count) / float64(s.Expected)
+}
+
+// An Aggregator summarizes points, for example those read over an
+// interval. The zero Aggregator is ready to use. It is safe to use
+// from multiple goroutines, so one can add the points received from
+// Points while another reads the summary, but its fields must not be
+// changed while it's in use.
+type Aggregator struct {
+	// RejectOutliers makes the summary leave out the values more
+	// than K times their median absolute deviation (MAD) away from
+	// the median, like a single spike among normal readings. The
+	// MAD counts as at least the sensor's resolution of 0.1 μg/m³,
+	// so that when most of the values are the same, the MAD being 0
+	// doesn't make all the others outliers.
+	RejectOutliers bool
+	// K defaults to 3.
+	K float64
+	// Trim is the fraction of the values left out at each end for
+	// the trimmed mean, from 0 to 0.5. It defaults to 0.1, leaving
+	// out the top and bottom 10%.
+	Trim float64
+
+	mu     sync.Mutex
+	points []Point
+}
+
+// Add adds a point.
+func (agg *Aggregator) Add(point Point) {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	agg.points = append(agg.points, point)
+}
+
+// Summary returns the summary of the points added since the
+// aggregator was created or reset.
+func (agg *Aggregator) Summary() Summary {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	if len(agg.points) == 0 {
+		return Summary{}
+	}
+	s := Summary{
+		Count: len(agg.points),
+		Start: agg.points[0].Timestamp,
+		End:   agg.points[0].Timestamp,
+	}
+	pm25 := make([]float64, len(agg.points))
+	pm10 := make([]float64, len(agg.points))
+	first, last := agg.points[0].Seq, agg.points[0].Seq
+	for i, p := range agg.points {
+		first, last = min(first, p.Seq), max(last, p.Seq)
+		pm25[i], pm10[i] = p.PM25, p.PM10
+		if p.Timestamp.Before(s.Start) {
+			s.Start = p.Timestamp
+		}
+		if !p.Timestamp.Before(s.End) {
+			s.End = p.Timestamp
+			s.DeviceID = p.DeviceID
+		}
+	}
+	s.Expected = s.Count
+	if first != 0 {
+		s.Expected = max(s.Count, int(last-first+1))
+	}
+	s.PM25 = agg.stats(pm25)
+	s.PM10 = agg.stats(pm10)
+	return s
+}
+
+// Reset drops the points added so far.
+func (agg *Aggregator) Reset() {
+	agg.mu.Lock()
+	defer agg.mu.Unlock()
+	agg.points = agg.points[:0]
+}
+
+// stats returns the stats of values, which must not be empty. It may
+// reorder values.
+func (agg *Aggregator) stats(values []float64) Distribution {
+	slices.Sort(values)
+	var s Distribution
+	if agg.RejectOutliers {
+		values, s.Rejected = agg.rejectOutliers(values)
+	}
+	s.Median = median(values)
+	s.P95 = percentile(values, 95)
+	s.Min, s.Max = values[0], values[len(values)-1]
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	s.Mean = sum / float64(len(values))
+	s.TrimmedMean = agg.trimmedMean(values)
+	if len(values) > 1 {
+		var squares float64
+		for _, v := range values {
+			squares += (v - s.Mean) * (v - s.Mean)
+		}
+		s.StdDev = math.Sqrt(squares / float64(len(values)-1))
+	}
+	return s
+}
+
+// minMAD is the least median absolute deviation rejectOutliers takes,
+// the sensor's resolution.
+const minMAD = 0.1
+
+// rejectOutliers returns the sorted values without the outliers, and
+// how many of them there were.
+func (agg *Aggregator) rejectOutliers(values []float64) ([]float64, int) {
+	k := agg.K
+	if k == 0 {
+		k = 3
+	}
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	slices.Sort(deviations)
+	limit := k * max(median(deviations), minMAD)
+
+	kept := values[:0]
+	for _, v := range values {
+		if math.Abs(v-m) <= limit {
+			kept = append(kept, v)
+		}
+	}
+	return kept, len(values) - len(kept)
+}
+
+// trimmedMean returns the mean of sorted values, which must not be
+// empty, without the top and bottom Trim of them.
+func (agg *Aggregator) trimmedMean(sorted []float64) float64 {
+	trim := agg.Trim
+	if trim == 0 {
+		trim = 0.1
+	}
+	n := int(float64(len(sorted)) * min(trim, 0.5))
+	if 2*n >= len(sorted) {
+		// Leave the middle value, or the middle two.
+		n = (len(sorted) - 1) / 2
+	}
+	kept := sorted[n : len(sorted)-n]
+	var sum float64
+	for _, v := range kept {
+		sum += v
+	}
+	return sum / float64(len(kept))
+}
+
+// median returns the median of sorted values, which must not be
+// empty.
+func median(sorted []float64) float64 {
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// percentile returns the pth percentile of sorted values, which must
+// not be empty, interpolating linearly between the closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p / 100 * float64(len(sorted)-1)
+	i := int(rank)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (rank-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// GetN reads n measurements and summarizes them. See ReadN.
+func (sensor *Sensor) GetN(ctx context.Context, n int) (Summary, error) {
+	// Read all of them in the same duty cycle.
+	end, err := sensor.beginCycle(ctx)
+	if err != nil {
+		return Summary{}, &PartialError{Want: n, Err: err}
+	}
+	defer end()
+	return ReadN(ctx, sensor, n)
+}
+
+// ReadN reads n measurements from d and summarizes them. Reads that
+// fail in a way the sensor recovers from, like bad checksums, are
+// skipped and don't count, but only up to n of them. If ReadN gets
+// fewer than n measurements, because of those errors, because ctx is
+// done, or because reading stops working, it returns the summary of
+// those it got and a *PartialError.
+func ReadN(ctx context.Context, d Device, n int) (Summary, error) {
+	var agg Aggregator
+	return agg.ReadN(ctx, d, n)
+}
+
+// ReadN is like the ReadN function, but adds the measurements to agg,
+// and returns its summary, so that it can reject outliers or trim
+// them.
+func (agg *Aggregator) ReadN(ctx context.Context, d Device, n int) (Summary, error) {
+	var err error
+	got := 0
+	for failures := 0; got < n; {
+		var point *Point
+		point, err = d.GetContext(ctx)
+		if err == nil {
+			agg.Add(*point)
+			got++
+			continue
+		}
+		if ctx.Err() != nil || !Recoverable(err) {
+			break
+		}
+		if failures++; failures > n {
+			break
+		}
+	}
+	summary := agg.Summary()
+	if got < n {
+		return summary, &PartialError{Got: got, Want: n, Err: err}
+	}
+	return summary, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// aggregate returns the summary of points with the PM2.5 values given,
+// and PM10 twice as high.
+func aggregate(agg *sds011.Aggregator, pm25 ...float64) sds011.Summary {
+	for _, v := range pm25 {
+		agg.Add(sds011.Point{PM25: v, PM10: 2 * v})
+	}
+	return agg.Summary()
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+func TestAggregatorSpike(t *testing.T) {
+	normal := []float64{12.1, 12.3, 12.2, 12.4, 12.3, 12.0, 12.5, 12.3, 12.2}
+	withSpike := append([]float64{999.9}, normal...)
+	clean := aggregate(&sds011.Aggregator{RejectOutliers: true}, normal...)
+	robust := aggregate(&sds011.Aggregator{RejectOutliers: true}, withSpike...)
+	plain := aggregate(&sds011.Aggregator{}, withSpike...)
+
+	if robust.PM25.Rejected != 1 || robust.PM10.Rejected != 1 {
+		t.Errorf("rejected %d PM2.5 and %d PM10 values, want the spike only", robust.PM25.Rejected, robust.PM10.Rejected)
+	}
+	if clean.PM25.Rejected != 0 {
+		t.Errorf("rejected %d normal readings", clean.PM25.Rejected)
+	}
+	for _, c := range []struct {
+		what      string
+		got, want float64
+	}{
+		{"median", robust.PM25.Median, clean.PM25.Median},
+		{"trimmed mean", robust.PM25.TrimmedMean, clean.PM25.TrimmedMean},
+		{"mean", robust.PM25.Mean, clean.PM25.Mean},
+		{"max", robust.PM25.Max, 12.5},
+		{"PM10 median", robust.PM10.Median, clean.PM10.Median},
+	} {
+		if !near(c.got, c.want) {
+			t.Errorf("the %s with the spike rejected is %v, want %v", c.what, c.got, c.want)
+		}
+	}
+	if robust.Count != 10 {
+		t.Errorf("counted %d points, want 10 with the spike", robust.Count)
+	}
+	// Without rejection, the median barely moves, but the mean does.
+	if !near(plain.PM25.Median, 12.3) || plain.PM25.Mean < 100 || plain.PM25.Rejected != 0 {
+		t.Errorf("without rejection: median %v, mean %v, %d rejected", plain.PM25.Median, plain.PM25.Mean, plain.PM25.Rejected)
+	}
+}
+
+func TestAggregatorMADZero(t *testing.T) {
+	// Most of the readings are the same, so their MAD is 0, but those
+	// a step or two of the sensor's resolution away aren't outliers.
+	agg := &sds011.Aggregator{RejectOutliers: true}
+	s := aggregate(agg, 12.3, 12.3, 12.3, 12.3, 12.3, 12.3, 12.4, 12.2, 12.5, 999.9)
+	if s.PM25.Rejected != 1 {
+		t.Errorf("rejected %d values, want the spike only", s.PM25.Rejected)
+	}
+	if want := (6*12.3 + 12.4 + 12.2 + 12.5) / 9; !near(s.PM25.Mean, want) {
+		t.Errorf("mean %v, want %v", s.PM25.Mean, want)
+	}
+	if !near(s.PM25.Median, 12.3) || !near(s.PM25.Max, 12.5) {
+		t.Errorf("median %v and max %v, want 12.3 and 12.5", s.PM25.Median, s.PM25.Max)
+	}
+
+	agg.Reset()
+	s = aggregate(agg, 5, 5, 5, 5)
+	if s.PM25.Rejected != 0 || s.PM25.Mean != 5 || s.PM25.StdDev != 0 {
+		t.Errorf("identical values: %+v", s.PM25)
+	}
+}
+
+func TestAggregatorK(t *testing.T) {
+	values := []float64{10, 11, 12, 13, 14, 20}
+	// The median is 12.5 and the MAD 1.5, so 20 is 5 MADs away.
+	for _, tc := range []struct {
+		k        float64
+		rejected int
+	}{{0, 1}, {3, 1}, {6, 0}} {
+		s := aggregate(&sds011.Aggregator{RejectOutliers: true, K: tc.k}, values...)
+		if s.PM25.Rejected != tc.rejected {
+			t.Errorf("K=%v rejected %d values, want %d", tc.k, s.PM25.Rejected, tc.rejected)
+		}
+	}
+}
+
+func TestAggregatorStats(t *testing.T) {
+	agg := &sds011.Aggregator{Trim: 0.2}
+	s := aggregate(agg, 5, 1, 4, 2, 3, 100, 6, 7, 8, 9)
+	for _, c := range []struct {
+		what      string
+		got, want float64
+	}{
+		{"mean", s.PM25.Mean, 14.5},
+		{"median", s.PM25.Median, 5.5},
+		// Without the 2 lowest and the 2 highest.
+		{"trimmed mean", s.PM25.TrimmedMean, 5.5},
+		{"min", s.PM25.Min, 1},
+		{"max", s.PM25.Max, 100},
+		{"p95", s.PM25.P95, 9 + 0.55*91},
+	} {
+		if !near(c.got, c.want) {
+			t.Errorf("the %s is %v, want %v", c.what, c.got, c.want)
+		}
+	}
+	if s := (&sds011.Aggregator{}).Summary(); s.Count != 0 {
+		t.Errorf("the summary of nothing is %+v", s)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aqi computes the US EPA Air Quality Index from PM2.5 and
+// PM10 concentrations, with the breakpoints revised in 2024.
+//
+// The index is defined for 24-hour averages of the concentrations, so
+// passing it single readings gives an idea of the air quality, not
+// the official index.
+package aqi
+
+import (
+	"math"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// Category is the level of health concern of an index.
+type Category int
+
+const (
+	Good Category = iota
+	Moderate
+	UnhealthyForSensitiveGroups
+	Unhealthy
+	VeryUnhealthy
+	Hazardous
+	// BeyondAQI is for concentrations above the highest
+	// breakpoint. Their index is reported as 500.
+	BeyondAQI
+)
+
+// String returns the name of the category, like "Moderate".
+func (c Category) String() string {
+	switch c {
+	case Good:
+		return "Good"
+	case Moderate:
+		return "Moderate"
+	case UnhealthyForSensitiveGroups:
+		return "Unhealthy for Sensitive Groups"
+	case Unhealthy:
+		return "Unhealthy"
+	case VeryUnhealthy:
+		return "Very Unhealthy"
+	case Hazardous:
+		return "Hazardous"
+	case BeyondAQI:
+		return "Beyond the AQI"
+	}
+	return "Unknown"
+}
+
+// Pollutant is what an index was computed for.
+type Pollutant int
+
+const (
+	PM25 Pollutant = iota
+	PM10
+)
+
+// String returns "PM2.5" or "PM10".
+func (p Pollutant) String() string {
+	if p == PM10 {
+		return "PM10"
+	}
+	return "PM2.5"
+}
+
+// breakpoint maps concentrations from Low to High to indices from
+// IndexLow to IndexHigh.
+type breakpoint struct {
+	Low, High           float64
+	IndexLow, IndexHigh int
+	Category            Category
+}
+
+var pm25Breakpoints = []breakpoint{
+	{0.0, 9.0, 0, 50, Good},
+	{9.1, 35.4, 51, 100, Moderate},
+	{35.5, 55.4, 101, 150, UnhealthyForSensitiveGroups},
+	{55.5, 125.4, 151, 200, Unhealthy},
+	{125.5, 225.4, 201, 300, VeryUnhealthy},
+	{225.5, 325.4, 301, 500, Hazardous},
+}
+
+var pm10Breakpoints = []breakpoint{
+	{0, 54, 0, 50, Good},
+	{55, 154, 51, 100, Moderate},
+	{155, 254, 101, 150, UnhealthyForSensitiveGroups},
+	{255, 354, 151, 200, Unhealthy},
+	{355, 424, 201, 300, VeryUnhealthy},
+	{425, 604, 301, 500, Hazardous},
+}
+
+// FromPM25 returns the index for a PM2.5 concentration in μg/m³,
+// which is first truncated to 0.1 μg/m³.
+func FromPM25(ugm3 float64) (index int, category Category) {
+	// The small bias keeps values like 0.3, which is stored as
+	// slightly less, from being truncated a step too low.
+	return compute(pm25Breakpoints, math.Floor(ugm3*10+1e-9)/10)
+}
+
+// FromPM10 returns the index for a PM10 concentration in μg/m³, which
+// is first truncated to an integer.
+func FromPM10(ugm3 float64) (index int, category Category) {
+	return compute(pm10Breakpoints, math.Floor(ugm3+1e-9))
+}
+
+// compute interpolates the index of the truncated concentration c
+// between the breakpoints of its range.
+func compute(breakpoints []breakpoint, c float64) (int, Category) {
+	c = max(c, 0)
+	for _, bp := range breakpoints {
+		if c > bp.High {
+			continue
+		}
+		index := float64(bp.IndexHigh-bp.IndexLow)/(bp.High-bp.Low)*(c-bp.Low) + float64(bp.IndexLow)
+		return int(math.Round(index)), bp.Category
+	}
+	return breakpoints[len(breakpoints)-1].IndexHigh, BeyondAQI
+}
+
+// Result is the index of a measurement.
+type Result struct {
+	Index    int
+	Category Category
+	// Pollutant is the one with the higher index, which
+	// determines the overall one.
+	Pollutant Pollutant
+}
+
+// FromPoint returns the higher of the PM2.5 and PM10 indices of
+// point.
+func FromPoint(point sds011.Point) Result {
+	index, category := FromPM25(point.PM25)
+	result := Result{Index: index, Category: category, Pollutant: PM25}
+	if index, category := FromPM10(point.PM10); index > result.Index {
+		result = Result{Index: index, Category: category, Pollutant: PM10}
+	}
+	return result
+}
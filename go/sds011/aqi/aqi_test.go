@@ -0,0 +1,179 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aqi_test
+
+import (
+	"testing"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/aqi"
+)
+
+func TestFromPM25(t *testing.T) {
+	for _, tc := range []struct {
+		ugm3     float64
+		index    int
+		category aqi.Category
+	}{
+		// The edges of the breakpoints.
+		{0, 0, aqi.Good},
+		{9.0, 50, aqi.Good},
+		{9.1, 51, aqi.Moderate},
+		{35.4, 100, aqi.Moderate},
+		{35.5, 101, aqi.UnhealthyForSensitiveGroups},
+		{55.4, 150, aqi.UnhealthyForSensitiveGroups},
+		{55.5, 151, aqi.Unhealthy},
+		{125.4, 200, aqi.Unhealthy},
+		{125.5, 201, aqi.VeryUnhealthy},
+		{225.4, 300, aqi.VeryUnhealthy},
+		{225.5, 301, aqi.Hazardous},
+		{325.4, 500, aqi.Hazardous},
+		// Within them.
+		{4.5, 25, aqi.Good},
+		{12.0, 56, aqi.Moderate},
+		{35.9, 102, aqi.UnhealthyForSensitiveGroups},
+		{150.0, 225, aqi.VeryUnhealthy},
+		// Truncated to 0.1 μg/m³.
+		{0.3, 2, aqi.Good},
+		{9.09, 50, aqi.Good},
+		{35.49, 100, aqi.Moderate},
+		{55.45, 150, aqi.UnhealthyForSensitiveGroups},
+		// Above the top breakpoint.
+		{325.5, 500, aqi.BeyondAQI},
+		{999.9, 500, aqi.BeyondAQI},
+		// Below zero, which the sensor never reports.
+		{-1, 0, aqi.Good},
+	} {
+		index, category := aqi.FromPM25(tc.ugm3)
+		if index != tc.index || category != tc.category {
+			t.Errorf("FromPM25(%v) = %d, %v, want %d, %v", tc.ugm3, index, category, tc.index, tc.category)
+		}
+	}
+}
+
+func TestFromPM10(t *testing.T) {
+	for _, tc := range []struct {
+		ugm3     float64
+		index    int
+		category aqi.Category
+	}{
+		// The edges of the breakpoints.
+		{0, 0, aqi.Good},
+		{54, 50, aqi.Good},
+		{55, 51, aqi.Moderate},
+		{154, 100, aqi.Moderate},
+		{155, 101, aqi.UnhealthyForSensitiveGroups},
+		{254, 150, aqi.UnhealthyForSensitiveGroups},
+		{255, 151, aqi.Unhealthy},
+		{354, 200, aqi.Unhealthy},
+		{355, 201, aqi.VeryUnhealthy},
+		{424, 300, aqi.VeryUnhealthy},
+		{425, 301, aqi.Hazardous},
+		{604, 500, aqi.Hazardous},
+		// Within them.
+		{20, 19, aqi.Good},
+		{120, 83, aqi.Moderate},
+		{160, 103, aqi.UnhealthyForSensitiveGroups},
+		// Truncated to an integer.
+		{54.9, 50, aqi.Good},
+		{154.99, 100, aqi.Moderate},
+		{604.5, 500, aqi.Hazardous},
+		// Above the top breakpoint.
+		{605, 500, aqi.BeyondAQI},
+		{1999.9, 500, aqi.BeyondAQI},
+	} {
+		index, category := aqi.FromPM10(tc.ugm3)
+		if index != tc.index || category != tc.category {
+			t.Errorf("FromPM10(%v) = %d, %v, want %d, %v", tc.ugm3, index, category, tc.index, tc.category)
+		}
+	}
+}
+
+// TestCategoryBoundaries checks that values on either side of the
+// boundary between two categories land in the right one, however
+// little below the boundary they are.
+func TestCategoryBoundaries(t *testing.T) {
+	for _, tc := range []struct {
+		pollutant    aqi.Pollutant
+		below, at    float64 // the last value of a category and the first of the next
+		lower, upper aqi.Category
+	}{
+		{aqi.PM25, 9.0, 9.1, aqi.Good, aqi.Moderate},
+		{aqi.PM25, 35.4, 35.5, aqi.Moderate, aqi.UnhealthyForSensitiveGroups},
+		{aqi.PM25, 55.4, 55.5, aqi.UnhealthyForSensitiveGroups, aqi.Unhealthy},
+		{aqi.PM25, 125.4, 125.5, aqi.Unhealthy, aqi.VeryUnhealthy},
+		{aqi.PM25, 225.4, 225.5, aqi.VeryUnhealthy, aqi.Hazardous},
+		{aqi.PM25, 325.4, 325.5, aqi.Hazardous, aqi.BeyondAQI},
+		{aqi.PM10, 54, 55, aqi.Good, aqi.Moderate},
+		{aqi.PM10, 154, 155, aqi.Moderate, aqi.UnhealthyForSensitiveGroups},
+		{aqi.PM10, 254, 255, aqi.UnhealthyForSensitiveGroups, aqi.Unhealthy},
+		{aqi.PM10, 354, 355, aqi.Unhealthy, aqi.VeryUnhealthy},
+		{aqi.PM10, 424, 425, aqi.VeryUnhealthy, aqi.Hazardous},
+		{aqi.PM10, 604, 605, aqi.Hazardous, aqi.BeyondAQI},
+	} {
+		from := aqi.FromPM25
+		if tc.pollutant == aqi.PM10 {
+			from = aqi.FromPM10
+		}
+		for _, v := range []float64{tc.below, (tc.below + tc.at) / 2, tc.at - 1e-6} {
+			if _, got := from(v); got != tc.lower {
+				t.Errorf("%v %v: got category %v, want %v", tc.pollutant, v, got, tc.lower)
+			}
+		}
+		for _, v := range []float64{tc.at, tc.at + 1e-6} {
+			if _, got := from(v); got != tc.upper {
+				t.Errorf("%v %v: got category %v, want %v", tc.pollutant, v, got, tc.upper)
+			}
+		}
+	}
+}
+
+func TestFromPoint(t *testing.T) {
+	for _, tc := range []struct {
+		pm25, pm10 float64
+		want       aqi.Result
+	}{
+		{8.2, 120, aqi.Result{83, aqi.Moderate, aqi.PM10}},
+		{40, 20, aqi.Result{112, aqi.UnhealthyForSensitiveGroups, aqi.PM25}},
+		{35.5, 154, aqi.Result{101, aqi.UnhealthyForSensitiveGroups, aqi.PM25}},
+		{35.4, 155, aqi.Result{101, aqi.UnhealthyForSensitiveGroups, aqi.PM10}},
+		// A tie goes to PM2.5.
+		{9.0, 54, aqi.Result{50, aqi.Good, aqi.PM25}},
+		{400, 10, aqi.Result{500, aqi.BeyondAQI, aqi.PM25}},
+		{10, 700, aqi.Result{500, aqi.BeyondAQI, aqi.PM10}},
+	} {
+		got := aqi.FromPoint(sds011.Point{PM25: tc.pm25, PM10: tc.pm10})
+		if got != tc.want {
+			t.Errorf("FromPoint(PM2.5 %v, PM10 %v) = %+v, want %+v", tc.pm25, tc.pm10, got, tc.want)
+		}
+	}
+}
+
+func TestCategoryString(t *testing.T) {
+	for c, want := range map[aqi.Category]string{
+		aqi.Good:                        "Good",
+		aqi.Moderate:                    "Moderate",
+		aqi.UnhealthyForSensitiveGroups: "Unhealthy for Sensitive Groups",
+		aqi.Unhealthy:                   "Unhealthy",
+		aqi.VeryUnhealthy:               "Very Unhealthy",
+		aqi.Hazardous:                   "Hazardous",
+		aqi.BeyondAQI:                   "Beyond the AQI",
+		aqi.Category(-1):                "Unknown",
+	} {
+		if got := c.String(); got != want {
+			t.Errorf("Category(%d).String() = %q, want %q", int(c), got, want)
+		}
+	}
+}
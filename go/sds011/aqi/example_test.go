@@ -0,0 +1,69 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aqi_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/aqi"
+)
+
+func ExampleFromPM25() {
+	index, category := aqi.FromPM25(35.4)
+	fmt.Println(index, category)
+	// Output: 100 Moderate
+}
+
+func ExampleFromPM10() {
+	index, category := aqi.FromPM10(160)
+	fmt.Println(index, category)
+	// Output: 103 Unhealthy for Sensitive Groups
+}
+
+func ExampleFromPoint() {
+	// The index of a point is the higher of its two, which here is
+	// the one for PM10.
+	result := aqi.FromPoint(sds011.Point{PM25: 8.2, PM10: 120})
+	fmt.Printf("%d %v, from %v\n", result.Index, result.Category, result.Pollutant)
+	// Output: 83 Moderate, from PM10
+}
+
+func ExampleNowCast() {
+	var nc aqi.NowCast
+	start := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	// Readings every 20 minutes, rising through the morning.
+	for i, v := range []float64{10, 12, 11, 20, 22, 24, 40, 38, 45} {
+		nc.Add(start.Add(time.Duration(i)*20*time.Minute), v)
+	}
+	pm25, err := nc.Read()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	index, category := aqi.FromPM25(pm25)
+	fmt.Printf("NowCast %.1f μg/m³, AQI %d %v\n", pm25, index, category)
+	// Output: NowCast 31.3 μg/m³, AQI 92 Moderate
+}
+
+func ExampleNowCast_notEnoughData() {
+	var nc aqi.NowCast
+	nc.Add(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC), 10)
+	if _, err := nc.Read(); err != nil {
+		fmt.Println(err)
+	}
+	// Output: not enough data for NowCast
+}
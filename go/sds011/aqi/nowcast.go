@@ -0,0 +1,130 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aqi
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// ErrNotEnoughData is returned by NowCast.Read when there aren't
+// values for at least 2 of the last 3 hours.
+var ErrNotEnoughData = errors.New("not enough data for NowCast")
+
+// nowCastHours is how many hours NowCast averages.
+const nowCastHours = 12
+
+// NowCast computes the EPA NowCast of PM concentrations: a weighted
+// average of the last 12 hourly averages, in which recent hours count
+// more the more the concentration has been changing. It's what the EPA
+// uses to report the index before 24 hours of data are available, and
+// what FromPM25 and FromPM10 should be given instead of single
+// readings.
+//
+// The zero NowCast is ready to use. It isn't safe for concurrent use.
+type NowCast struct {
+	// hours are the values added for each hour, oldest first.
+	hours []hour
+}
+
+// hour holds the values added for a clock hour.
+type hour struct {
+	start time.Time
+	sum   float64
+	n     int
+}
+
+// Add adds a concentration measured at t. The values for each clock
+// hour are averaged, so they can be hourly averages, or readings
+// taken at any interval. Values more than 12 hours older than the
+// newest one are dropped.
+func (nc *NowCast) Add(t time.Time, v float64) {
+	start := t.Truncate(time.Hour)
+	i := sort.Search(len(nc.hours), func(i int) bool { return !nc.hours[i].start.Before(start) })
+	if i < len(nc.hours) && nc.hours[i].start.Equal(start) {
+		nc.hours[i].sum += v
+		nc.hours[i].n++
+	} else {
+		nc.hours = append(nc.hours, hour{})
+		copy(nc.hours[i+1:], nc.hours[i:])
+		nc.hours[i] = hour{start: start, sum: v, n: 1}
+	}
+
+	oldest := nc.hours[len(nc.hours)-1].start.Add(-(nowCastHours - 1) * time.Hour)
+	drop := 0
+	for drop < len(nc.hours) && nc.hours[drop].start.Before(oldest) {
+		drop++
+	}
+	nc.hours = nc.hours[drop:]
+}
+
+// Read returns the NowCast for the hour of the newest value. It
+// returns ErrNotEnoughData unless there are values for at least 2 of
+// the last 3 hours, counting that one. Hours without values are left
+// out of the average.
+func (nc *NowCast) Read() (float64, error) {
+	if len(nc.hours) == 0 {
+		return 0, ErrNotEnoughData
+	}
+	newest := nc.hours[len(nc.hours)-1].start
+	// values[i] is the average of the hour i hours before the
+	// newest one, or NaN if there were no values for it.
+	var values [nowCastHours]float64
+	for i := range values {
+		values[i] = math.NaN()
+	}
+	for _, h := range nc.hours {
+		values[int(newest.Sub(h.start)/time.Hour)] = h.sum / float64(h.n)
+	}
+
+	recent := 0
+	for _, v := range values[:3] {
+		if !math.IsNaN(v) {
+			recent++
+		}
+	}
+	if recent < 2 {
+		return 0, ErrNotEnoughData
+	}
+
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			lo, hi = min(lo, v), max(hi, v)
+		}
+	}
+	weight := 1.0
+	if hi > 0 {
+		weight = max(lo/hi, 0.5)
+	}
+
+	var sum, weights float64
+	for i, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		w := math.Pow(weight, float64(i))
+		sum += w * v
+		weights += w
+	}
+	return sum / weights, nil
+}
+
+// Reset drops all the values added.
+func (nc *NowCast) Reset() {
+	nc.hours = nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// WithAutoSleep makes the sensor go to sleep when Get, GetContext and
+// Query haven't been called for idle, to spare its laser and fan. The
+// next of them to be called wakes it up again before reading (see
+// WithWakeWarmup). Sleeping and waking up explicitly, with Sleep and
+// Awake, turns this off until the sensor is idle again.
+func WithAutoSleep(idle time.Duration) Option {
+	return func(c *config) error {
+		if idle < 0 {
+			return errors.New("negative auto-sleep idle time")
+		}
+		c.autoSleep = idle
+		return nil
+	}
+}
+
+// WithWakeWarmup sets how long to wait after a sensor put to sleep by
+// WithAutoSleep is woken up, before reading from it (see
+// WakeAndWarm). It is 0 by default.
+func WithWakeWarmup(warmup time.Duration) Option {
+	return func(c *config) error {
+		if warmup < 0 {
+			return errors.New("negative warmup")
+		}
+		c.wakeWarmup = warmup
+		return nil
+	}
+}
+
+// AutoSleeps returns how many times the sensor was put to sleep
+// because it was idle.
+func (sensor *Sensor) AutoSleeps() uint64 {
+	return sensor.autoSleeps.Load()
+}
+
+// use marks the start of a Get or Query call, and returns a function
+// marking its end. The sensor isn't put to sleep while one is in
+// progress.
+func (sensor *Sensor) use() func() {
+	sensor.users.Add(1)
+	sensor.lastUse.Store(time.Now().UnixNano())
+	return func() {
+		sensor.lastUse.Store(time.Now().UnixNano())
+		sensor.users.Add(-1)
+	}
+}
+
+// wakeIfAutoSlept wakes the sensor up and warms it up if it was put to
+// sleep for being idle. It must be called after use.
+func (sensor *Sensor) wakeIfAutoSlept(ctx context.Context) error {
+	if !sensor.autoSlept.Load() {
+		return nil
+	}
+	sensor.cmdMu.Lock()
+	if !sensor.autoSlept.Load() {
+		// Someone else woke it up in the meantime.
+		sensor.cmdMu.Unlock()
+		return nil
+	}
+	sensor.restoreSettings()
+	_, err := sensor.exchangeLocked(commandWorkState, modeSet, singleValue(workStateMeasuring))
+	if err == nil {
+		sensor.setAwake(true, "auto-wake")
+		sensor.autoSlept.Store(false)
+		sensor.Flush()
+	}
+	sensor.cmdMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if sensor.wakeWarmup > 0 {
+		return sensor.warm(ctx, sensor.wakeWarmup)
+	}
+	return nil
+}
+
+// autoSleepLoop puts the sensor to sleep whenever it's idle for
+// autoSleep, until it's closed.
+func (sensor *Sensor) autoSleepLoop() {
+	timer := time.NewTimer(sensor.autoSleep)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-sensor.done:
+			return
+		}
+		timer.Reset(sensor.maybeAutoSleep())
+	}
+}
+
+// maybeAutoSleep puts the sensor to sleep if it's idle, and returns
+// when to check again.
+func (sensor *Sensor) maybeAutoSleep() time.Duration {
+	idle := func() time.Duration {
+		return time.Since(time.Unix(0, sensor.lastUse.Load()))
+	}
+	if sensor.users.Load() > 0 {
+		return sensor.autoSleep
+	}
+	if d := idle(); d < sensor.autoSleep {
+		return sensor.autoSleep - d
+	}
+
+	sensor.cmdMu.Lock()
+	defer sensor.cmdMu.Unlock()
+	// A call that started after the checks above waits for cmdMu in
+	// wakeIfAutoSlept, or will see autoSlept set, so it's enough to
+	// check again with cmdMu held.
+	if sensor.autoSlept.Load() || sensor.users.Load() > 0 || idle() < sensor.autoSleep {
+		return sensor.autoSleep
+	}
+	if _, err := sensor.exchangeLocked(commandWorkState, modeSet, singleValue(workStateSleeping)); err != nil {
+		if !errors.Is(err, ErrClosed) {
+			sensor.logger.Warn("auto-sleep failed", "error", err)
+		}
+		return sensor.autoSleep
+	}
+	sensor.setAwake(false, "auto-sleep", "idle", idle())
+	sensor.autoSlept.Store(true)
+	sensor.autoSleeps.Add(1)
+	return sensor.autoSleep
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import "time"
+
+// Calibration corrects a sensor's readings, as Scale*x+Offset for
+// each of them. A zero Scale is taken to be 1, so the zero Calibration
+// leaves readings as they are.
+type Calibration struct {
+	PM25Scale  float64
+	PM25Offset float64
+	PM10Scale  float64
+	PM10Offset float64
+}
+
+// Apply corrects the PM values of point. The raw values are left as
+// they are. Values that would come out negative are set to zero.
+func (c Calibration) Apply(point *Point) {
+	c.apply(point)
+}
+
+// apply is Apply, returning false if a value had to be set to zero.
+func (c Calibration) apply(point *Point) bool {
+	pm25, ok25 := correct(point.PM25, c.PM25Scale, c.PM25Offset)
+	pm10, ok10 := correct(point.PM10, c.PM10Scale, c.PM10Offset)
+	point.PM25, point.PM10 = pm25, pm10
+	return ok25 && ok10
+}
+
+func correct(x, scale, offset float64) (float64, bool) {
+	if scale == 0 {
+		scale = 1
+	}
+	y := scale*x + offset
+	return max(y, 0), y >= 0
+}
+
+// SetCalibration makes the sensor correct the points returned by Get,
+// GetContext, Query and Points with c.
+func (sensor *Sensor) SetCalibration(c Calibration) {
+	sensor.calibration.Store(&c)
+}
+
+// Calibration returns the sensor's calibration.
+func (sensor *Sensor) Calibration() Calibration {
+	if c := sensor.calibration.Load(); c != nil {
+		return *c
+	}
+	return Calibration{}
+}
+
+// point returns the measurement in f, with the calibration applied,
+// and the gap before it, if there was one. It returns a *RangeError if
+// the range is checked and the measurement is out of it.
+func (sensor *Sensor) point(f *frame) (*Point, *Gap, error) {
+	ts := time.Now()
+	if sensor.stampArrival {
+		ts = f.arrived
+	}
+	point := f.resp.point(ts)
+	point.Seq = f.seq
+	inRange := point.PM25Raw <= maxRaw && point.PM10Raw <= maxRaw
+	if c := sensor.calibration.Load(); c != nil && !c.apply(point) {
+		inRange = false
+	}
+	if sensor.rangeCheck && !inRange {
+		sensor.gaps.lose(f.seq, lostOutOfRange)
+		return nil, nil, &RangeError{Point: *point}
+	}
+	return point, sensor.checkGap(point.Seq), nil
+}
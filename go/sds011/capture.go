@@ -0,0 +1,200 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A capture records the bytes going through a port, in the format
+// described in WithCapture.
+type capture struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// record writes a line for b, ignoring errors: a broken capture
+// shouldn't break the sensor.
+func (c *capture) record(dir Direction, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c.w, "%s %v % x\n", time.Now().Format(time.RFC3339Nano), dir, b)
+}
+
+// A timedPort is a port that knows when the bytes it returns arrived,
+// like a replayed capture, rather than them arriving as they're read.
+type timedPort interface {
+	// arrived returns when the bytes returned by the last call to
+	// Read arrived, or the zero time if that's when they were read.
+	arrived() time.Time
+}
+
+// capturedPort is a port whose traffic is recorded.
+type capturedPort struct {
+	io.ReadWriteCloser
+	capture *capture
+}
+
+func (p capturedPort) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	p.capture.record(Received, b[:n])
+	return n, err
+}
+
+func (p capturedPort) Write(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Write(b)
+	p.capture.record(Sent, b[:n])
+	return n, err
+}
+
+func (p capturedPort) arrived() time.Time {
+	if tp, ok := p.ReadWriteCloser.(timedPort); ok {
+		return tp.arrived()
+	}
+	return time.Time{}
+}
+
+// replayPort plays back the bytes received in a capture.
+type replayPort struct {
+	scanner *bufio.Scanner
+	speed   float64
+	// first is the time of the first chunk in the capture, start
+	// when it was replayed.
+	first, start time.Time
+
+	// pending is what's left of the last chunk read from the
+	// capture, and at when it was captured.
+	pending []byte
+	at      time.Time
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (p *replayPort) Read(b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// next reads the next received chunk from the capture into pending,
+// waiting until it's due.
+func (p *replayPort) next() error {
+	for p.scanner.Scan() {
+		ts, dir, data, err := parseCaptureLine(p.scanner.Text())
+		if err != nil {
+			return err
+		}
+		if dir != Received.String() {
+			continue
+		}
+		if p.first.IsZero() {
+			p.first, p.start = ts, time.Now()
+		}
+		if p.speed > 0 {
+			due := p.start.Add(time.Duration(float64(ts.Sub(p.first)) / p.speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-p.closed:
+				return io.ErrClosedPipe
+			}
+		}
+		p.pending, p.at = data, ts
+		return nil
+	}
+	if err := p.scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (p *replayPort) arrived() time.Time {
+	return p.at
+}
+
+// Write discards b: the capture already holds what the sensor
+// replied.
+func (p *replayPort) Write(b []byte) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	default:
+		return len(b), nil
+	}
+}
+
+func (p *replayPort) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// parseCaptureLine splits a line of a capture. dir is empty for
+// blank lines, and for those with just a comment.
+func parseCaptureLine(line string) (ts time.Time, dir string, data []byte, err error) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return time.Time{}, "", nil, nil
+	}
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 {
+		return time.Time{}, "", nil, fmt.Errorf("bad capture line %q", line)
+	}
+	if ts, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("bad capture line %q: %w", line, err)
+	}
+	if data, err = hex.DecodeString(strings.ReplaceAll(fields[2], " ", "")); err != nil {
+		return time.Time{}, "", nil, fmt.Errorf("bad capture line %q: %w", line, err)
+	}
+	return ts, fields[1], data, nil
+}
+
+// NewFromCapture returns a sensor replaying a capture written by a
+// sensor with WithCapture. The bytes the sensor received are received
+// again, at the same pace (see WithReplaySpeed), and when the capture
+// ends reading fails with ErrClosed, as if the port was closed. The
+// points read are stamped with when their frames were captured, so
+// they have no monotonic clock reading.
+//
+// Commands can be sent, but they are ignored: the replies are those
+// in the capture, so they only arrive if the same commands were sent
+// at the same time when capturing.
+func NewFromCapture(r io.Reader, opts ...Option) (*Sensor, error) {
+	cfg, err := makeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	port := &replayPort{
+		scanner: bufio.NewScanner(r),
+		speed:   cfg.replaySpeed,
+		closed:  make(chan struct{}),
+	}
+	return newSensor(port, cfg, nil), nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	var capture syncBuffer
+	sensor, fake := newSensor(t, sds011.WithCapture(&capture), sds011.WithTimestamps(sds011.FrameArrival))
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(time.Hour)
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	var want []*sds011.Point
+	for _, v := range []float64{1.5, 22.3, 499.9} {
+		fake.Enqueue(v, v*2)
+		fake.Measure()
+		point, err := sensor.Get()
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		want = append(want, point)
+		time.Sleep(10 * time.Millisecond)
+	}
+	sensor.Close()
+	if !strings.Contains(capture.String(), " sent aa b4 06 01 01 ") {
+		t.Errorf("capture doesn't have the wake command:\n%s", capture.String())
+	}
+
+	// Capturing the replay records the same bytes again.
+	var again syncBuffer
+	replay, err := sds011.NewFromCapture(strings.NewReader(capture.String()), sds011.WithReplaySpeed(0), sds011.WithCapture(&again))
+	if err != nil {
+		t.Fatalf("NewFromCapture: %v", err)
+	}
+	defer replay.Close()
+	for _, w := range want {
+		got, err := replay.Get()
+		if err != nil {
+			t.Fatalf("Get from the replay: %v", err)
+		}
+		if got.PM25Raw != w.PM25Raw || got.PM10Raw != w.PM10Raw || got.DeviceID != w.DeviceID {
+			t.Errorf("Get from the replay: got %v, want %v", got, w)
+		}
+		// Points are stamped with when their frames were captured,
+		// which is when they were received, give or take the time it
+		// took to write the capture.
+		if d := got.Timestamp.Sub(w.Timestamp); d < -50*time.Millisecond || d > 50*time.Millisecond {
+			t.Errorf("Get from the replay: got a point stamped %v, want about %v", got.Timestamp, w.Timestamp)
+		}
+		if got.Timestamp != got.Timestamp.Round(0) {
+			t.Errorf("Get from the replay: got a timestamp with a monotonic clock reading")
+		}
+	}
+	if _, err := replay.Get(); !errors.Is(err, sds011.ErrClosed) {
+		t.Errorf("Get at the end of the capture: got error %v, want ErrClosed", err)
+	}
+	if got, want := receivedBytes(again.String()), receivedBytes(capture.String()); got != want {
+		t.Errorf("capturing the replay received\n%s\nwant\n%s", got, want)
+	}
+}
+
+// receivedBytes returns the bytes received in a capture, in hex.
+func receivedBytes(capture string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(capture, "\n") {
+		if fields := strings.SplitN(line, " ", 3); len(fields) == 3 && fields[1] == "received" {
+			b.WriteString(fields[2] + " ")
+		}
+	}
+	return b.String()
+}
+
+func TestReplayPace(t *testing.T) {
+	capture := "2024-05-01T10:00:00Z received aa c0 7b 00 c8 01 a1 60 45 ab\n" +
+		"# a comment\n" +
+		"2024-05-01T10:00:00.2Z sent aa b4 04 00 00 00 00 00 00 00 00 00 00 00 00 ff ff 02 ab\n" +
+		"2024-05-01T10:00:00.2Z received aa c0 7c 00 c8 01 a1 60 46 ab\n"
+	replay, err := sds011.NewFromCapture(strings.NewReader(capture), sds011.WithTimestamps(sds011.FrameArrival))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	start := time.Now()
+	for i, want := range []string{"2024-05-01T10:00:00Z", "2024-05-01T10:00:00.2Z"} {
+		point, err := replay.Get()
+		if err != nil {
+			t.Fatalf("Get #%d: %v", i, err)
+		}
+		if got := point.Timestamp.UTC().Format(time.RFC3339Nano); got != want {
+			t.Errorf("Get #%d: got a point stamped %v, want %v", i, got, want)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("replaying 200ms of capture took %v", elapsed)
+	}
+}
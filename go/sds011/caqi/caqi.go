@@ -0,0 +1,126 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package caqi computes the European Common Air Quality Index (CAQI)
+// from PM2.5 and PM10 concentrations, with the hourly grid. Its API
+// mirrors that of package aqi.
+package caqi
+
+import (
+	"math"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// Category is the band an index falls in.
+type Category int
+
+const (
+	VeryLow Category = iota
+	Low
+	Medium
+	High
+	VeryHigh
+)
+
+// String returns the name of the category, like "Medium".
+func (c Category) String() string {
+	switch c {
+	case VeryLow:
+		return "Very Low"
+	case Low:
+		return "Low"
+	case Medium:
+		return "Medium"
+	case High:
+		return "High"
+	case VeryHigh:
+		return "Very High"
+	}
+	return "Unknown"
+}
+
+// Pollutant is what an index was computed for.
+type Pollutant int
+
+const (
+	PM25 Pollutant = iota
+	PM10
+)
+
+// String returns "PM2.5" or "PM10".
+func (p Pollutant) String() string {
+	if p == PM10 {
+		return "PM10"
+	}
+	return "PM2.5"
+}
+
+// grid holds the concentrations at the edges of the bands, which
+// correspond to the indices 0, 25, 50, 75 and 100.
+type grid [5]float64
+
+var (
+	pm25Grid = grid{0, 15, 30, 55, 110}
+	pm10Grid = grid{0, 25, 50, 90, 180}
+)
+
+// FromPM25 returns the hourly index for a PM2.5 concentration in
+// μg/m³.
+func FromPM25(ugm3 float64) (index int, category Category) {
+	return compute(pm25Grid, ugm3)
+}
+
+// FromPM10 returns the hourly index for a PM10 concentration in
+// μg/m³.
+func FromPM10(ugm3 float64) (index int, category Category) {
+	return compute(pm10Grid, ugm3)
+}
+
+// compute interpolates the index of the concentration c within its
+// band. Above the highest edge, where the grid has no upper bound,
+// the index keeps growing at the rate of the High band.
+func compute(g grid, c float64) (int, Category) {
+	c = max(c, 0)
+	band := 0
+	for band < len(g)-2 && c > g[band+1] {
+		band++
+	}
+	index := 25*float64(band) + 25*(c-g[band])/(g[band+1]-g[band])
+	category := Category(band)
+	if c > g[len(g)-1] {
+		category = VeryHigh
+	}
+	return int(math.Round(index)), category
+}
+
+// Result is the index of a measurement.
+type Result struct {
+	Index    int
+	Category Category
+	// Pollutant is the one with the higher index, which
+	// determines the overall one.
+	Pollutant Pollutant
+}
+
+// FromPoint returns the higher of the PM2.5 and PM10 indices of
+// point.
+func FromPoint(point sds011.Point) Result {
+	index, category := FromPM25(point.PM25)
+	result := Result{Index: index, Category: category, Pollutant: PM25}
+	if index, category := FromPM10(point.PM10); index > result.Index {
+		result = Result{Index: index, Category: category, Pollutant: PM10}
+	}
+	return result
+}
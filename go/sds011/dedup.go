@@ -0,0 +1,86 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"sync"
+	"time"
+)
+
+// A Dedup drops points repeating the previous one. In active mode the
+// sensor often reports the same values for several seconds in a row,
+// which carries no information. A point is dropped if its PM values
+// are equal to those of the last point kept, and it was taken less
+// than MinInterval after it, so that at least one point is kept every
+// MinInterval and a stable reading doesn't look like an outage.
+//
+// The zero Dedup keeps all points with different values, however
+// close in time. It is safe to use from multiple goroutines, but
+// MinInterval must not be changed while it's in use.
+type Dedup struct {
+	MinInterval time.Duration
+
+	mu         sync.Mutex
+	last       *Point
+	suppressed uint64
+}
+
+// Keep returns true if point should be kept, and records it as the
+// last point kept if so.
+func (d *Dedup) Keep(point Point) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.last != nil && point.PM25 == d.last.PM25 && point.PM10 == d.last.PM10 &&
+		point.Timestamp.Sub(d.last.Timestamp) < d.MinInterval {
+		d.suppressed++
+		return false
+	}
+	d.last = &point
+	return true
+}
+
+// Suppressed returns the number of points dropped.
+func (d *Dedup) Suppressed() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.suppressed
+}
+
+// Filter returns a channel receiving the points from in that are
+// kept, for example those from Sensor.Points. It is closed when in
+// is.
+func (d *Dedup) Filter(in <-chan Point) <-chan Point {
+	out := make(chan Point)
+	go func() {
+		defer close(out)
+		for point := range in {
+			if d.Keep(point) {
+				out <- point
+			}
+		}
+	}()
+	return out
+}
+
+// Func returns a function calling fn with the points that are kept,
+// to pass to Sensor.Listen.
+func (d *Dedup) Func(fn func(Point) error) func(Point) error {
+	return func(point Point) error {
+		if !d.Keep(point) {
+			return nil
+		}
+		return fn(point)
+	}
+}
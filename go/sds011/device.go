@@ -0,0 +1,33 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import "context"
+
+// Device is what code using a sensor usually needs from it. *Sensor
+// implements it, and so does sds011test.Mock, which makes it easy to
+// test such code without talking to a sensor.
+type Device interface {
+	Get() (*Point, error)
+	GetContext(ctx context.Context) (*Point, error)
+	Query() (*Point, error)
+	Sleep() error
+	Awake() error
+	State() (awake bool, err error)
+	SetWorkingPeriod(minutes uint8) error
+	Close()
+}
+
+var _ Device = (*Sensor)(nil)
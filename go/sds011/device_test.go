@@ -0,0 +1,71 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// Both break the build if they stop implementing Device.
+var (
+	_ sds011.Device = (*sds011.Sensor)(nil)
+	_ sds011.Device = (*sds011test.Mock)(nil)
+)
+
+// measureOnce is code written against a Device: it wakes it up, reads
+// a measurement and puts it back to sleep.
+func measureOnce(dev sds011.Device) (*sds011.Point, error) {
+	if err := dev.Awake(); err != nil {
+		return nil, err
+	}
+	point, err := dev.Get()
+	if err != nil {
+		return nil, err
+	}
+	return point, dev.Sleep()
+}
+
+func TestDevice(t *testing.T) {
+	// The fake doesn't reply to State when it's asleep.
+	sensor, fake := newSensor(t, sds011.WithCommandTimeout(100*time.Millisecond))
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(20 * time.Millisecond)
+	fake.Enqueue(12.3, 45.6)
+	mock := sds011test.NewMock()
+	defer mock.Close()
+	mock.Push(sds011.Point{PM25: 12.3, PM10: 45.6})
+
+	for name, dev := range map[string]sds011.Device{"Sensor": sensor, "Mock": mock} {
+		point, err := measureOnce(dev)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if point.PM25 != 12.3 || point.PM10 != 45.6 {
+			t.Errorf("%s: got %v, want PM2.5 12.3, PM10 45.6", name, point)
+		}
+		if awake, err := dev.State(); awake || err != nil {
+			t.Errorf("%s: State() = %v, %v after Sleep, want false, nil", name, awake, err)
+		}
+		dev.Close()
+		if _, err := dev.Get(); !errors.Is(err, sds011.ErrClosed) {
+			t.Errorf("%s: Get after Close: got error %v, want ErrClosed", name, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// cycleLinger is how long a sensor in duty cycle mode stays awake
+// after a call is done, in case another one follows right away.
+const cycleLinger = 2 * time.Second
+
+// WithDutyCycle makes the sensor manage its own sleep, for sensors
+// running on batteries or solar power. It is put to sleep when it's
+// created, and Get, GetContext, GetN and Query wake it up, wait for
+// warmup (see WakeAndWarm), read, and put it back to sleep. Calls made
+// while it's awake, or shortly after, share the same wake cycle, so
+// they don't switch the fan on and off over and over again. Failing
+// to put the sensor to sleep is logged, and doesn't make the call
+// that read the measurement fail.
+func WithDutyCycle(warmup time.Duration) Option {
+	return func(c *config) error {
+		if warmup < 0 {
+			return errors.New("negative warmup")
+		}
+		c.dutyCycle = &warmup
+		return nil
+	}
+}
+
+// dutyCycle is the state of a sensor in duty cycle mode.
+type dutyCycle struct {
+	warmup time.Duration
+
+	mu sync.Mutex
+	// users is the number of calls in progress.
+	users int
+	// wake is the current wake cycle, or nil if the sensor is
+	// asleep.
+	wake *wakeCycle
+	// sleep puts the sensor to sleep once it's been unused for
+	// cycleLinger, if it's not nil.
+	sleep *time.Timer
+	// last is how long the last cycle took.
+	last time.Duration
+}
+
+// wakeCycle is a period during which the sensor is awake.
+type wakeCycle struct {
+	start time.Time
+	// ready is closed when the sensor warmed up, or waking it up
+	// failed with err.
+	ready chan struct{}
+	err   error
+}
+
+// LastCycle returns how long the last wake cycle took, from waking
+// the sensor up until it was put to sleep again, or 0 if there
+// wasn't one yet or the sensor isn't in duty cycle mode (see
+// WithDutyCycle).
+func (sensor *Sensor) LastCycle() time.Duration {
+	if sensor.cycle == nil {
+		return 0
+	}
+	sensor.cycle.mu.Lock()
+	defer sensor.cycle.mu.Unlock()
+	return sensor.cycle.last
+}
+
+// beginCycle makes sure the sensor is awake and warmed up, if it's in
+// duty cycle mode, and returns a function to call when done with it.
+func (sensor *Sensor) beginCycle(ctx context.Context) (end func(), err error) {
+	c := sensor.cycle
+	if c == nil {
+		return func() {}, nil
+	}
+	c.mu.Lock()
+	c.users++
+	if c.sleep != nil {
+		c.sleep.Stop()
+		c.sleep = nil
+	}
+	if c.wake == nil {
+		c.wake = &wakeCycle{start: time.Now(), ready: make(chan struct{})}
+		go sensor.wakeUp(c.wake)
+	}
+	w := c.wake
+	c.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		err = w.err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		sensor.endCycle()
+		return nil, err
+	}
+	return sensor.endCycle, nil
+}
+
+// wakeUp wakes the sensor up for w.
+func (sensor *Sensor) wakeUp(w *wakeCycle) {
+	c := sensor.cycle
+	w.err = sensor.Awake()
+	if w.err == nil {
+		w.err = sensor.warm(context.Background(), c.warmup)
+	}
+	if w.err != nil {
+		// Try again with the next call.
+		c.mu.Lock()
+		if c.wake == w {
+			c.wake = nil
+		}
+		c.mu.Unlock()
+	}
+	close(w.ready)
+}
+
+func (sensor *Sensor) endCycle() {
+	c := sensor.cycle
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users--
+	if c.users == 0 && c.wake != nil {
+		c.sleep = time.AfterFunc(cycleLinger, sensor.sleepCycle)
+	}
+}
+
+// sleepCycle puts the sensor to sleep at the end of a cycle, unless
+// it's being used again.
+func (sensor *Sensor) sleepCycle() {
+	c := sensor.cycle
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users > 0 || c.wake == nil {
+		return
+	}
+	select {
+	case <-c.wake.ready:
+	default:
+		// Still waking up, for a call that gave up waiting.
+		c.sleep = time.AfterFunc(cycleLinger, sensor.sleepCycle)
+		return
+	}
+	c.last = time.Since(c.wake.start)
+	c.wake, c.sleep = nil, nil
+	if err := sensor.Sleep(); err != nil {
+		if !errors.Is(err, ErrClosed) {
+			sensor.logger.Warn("putting sensor to sleep after duty cycle failed", "error", err)
+		}
+		return
+	}
+	sensor.logger.Info("duty cycle done", "duration", c.last)
+}
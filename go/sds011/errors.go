@@ -0,0 +1,143 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the sensor's methods are wrapped, so check for
+// these with errors.Is.
+var (
+	// ErrTimeout means that the sensor didn't send a frame in time.
+	// It usually means that the sensor is asleep.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrClosed means that the sensor, or the port it uses, was
+	// closed.
+	ErrClosed = errors.New("sensor closed")
+
+	// ErrDisconnected means that the port stopped working, and the
+	// sensor is trying to open it again (see WithAutoReconnect).
+	ErrDisconnected = errors.New("sensor disconnected")
+
+	// ErrDeviceGone means that the device behind the port went
+	// away, for example because the USB adapter was unplugged.
+	// After that, the sensor fails with the same error until it
+	// reconnects (see WithAutoReconnect and WithOnDisconnect).
+	ErrDeviceGone = errors.New("device gone")
+
+	// ErrChecksum means that a frame's checksum didn't match its
+	// contents. Use errors.As with a *ChecksumError for the details.
+	ErrChecksum = errors.New("bad checksum")
+
+	// ErrBadHeader means that a frame didn't start or end with the
+	// expected bytes.
+	ErrBadHeader = errors.New("bad header")
+
+	// ErrNotAcknowledged means that the sensor replied to a command,
+	// but the reply didn't confirm it, for example because it
+	// carried a different value than the one that was set.
+	ErrNotAcknowledged = errors.New("command not acknowledged")
+
+	// ErrOutOfRange means that a measurement was outside of the
+	// range the sensor can report (see WithRangeCheck). Use
+	// errors.As with a *RangeError to get it.
+	ErrOutOfRange = errors.New("measurement out of range")
+
+	// ErrPortBusy means that another process is using the serial
+	// port. Use errors.As with a *PortBusyError for the details.
+	ErrPortBusy = errors.New("port busy")
+
+	// ErrGap means that measurements were lost between two points
+	// read. Use errors.As with a *Gap for the details.
+	ErrGap = errors.New("measurements lost")
+
+	// ErrUnsupported means that the command isn't understood by
+	// the sensor's model (see WithModel).
+	ErrUnsupported = errors.New("not supported")
+)
+
+// A ChecksumError is returned when a frame's checksum doesn't match
+// its contents.
+type ChecksumError struct {
+	Frame    []byte // the whole frame
+	Expected byte   // the checksum computed from the frame's data
+	Actual   byte   // the checksum sent in the frame
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("bad checksum: expected %#02x, got %#02x in frame % x", e.Expected, e.Actual, e.Frame)
+}
+
+// Is makes errors.Is(err, ErrChecksum) true for a ChecksumError.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
+// A PortBusyError is returned by New when another process holds the
+// lock on the serial port (see WithoutLock).
+type PortBusyError struct {
+	Path string
+	PID  int // the process holding the lock, or 0 if it isn't known
+}
+
+func (e *PortBusyError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("port %v busy: used by another process", e.Path)
+	}
+	return fmt.Sprintf("port %v busy: used by process %d", e.Path, e.PID)
+}
+
+// Is makes errors.Is(err, ErrPortBusy) true for a PortBusyError.
+func (e *PortBusyError) Is(target error) bool {
+	return target == ErrPortBusy
+}
+
+// A PartialError is returned with a summary of fewer measurements
+// than were asked for (see ReadN).
+type PartialError struct {
+	Got, Want int
+	Err       error // the last error reading a measurement
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("got %d of %d measurements: %v", e.Got, e.Want, e.Err)
+}
+
+func (e *PartialError) Unwrap() error {
+	return e.Err
+}
+
+// maxRaw is the largest value the sensor reports, 999.9 μg/m³ in
+// tenths.
+const maxRaw = 9999
+
+// A RangeError is returned for a measurement outside of the range the
+// sensor can report: above 999.9 μg/m³, or below zero after
+// calibration.
+type RangeError struct {
+	Point Point // the measurement, with the calibration applied
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("measurement out of range: PM2.5 %v (raw %v), PM10 %v (raw %v)", e.Point.PM25, e.Point.PM25Raw, e.Point.PM10, e.Point.PM10Raw)
+}
+
+// Is makes errors.Is(err, ErrOutOfRange) true for a RangeError.
+func (e *RangeError) Is(target error) bool {
+	return target == ErrOutOfRange
+}
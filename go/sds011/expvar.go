@@ -0,0 +1,55 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"expvar"
+	"time"
+)
+
+// expvarState is what PublishExpvar publishes.
+type expvarState struct {
+	PM25           *float64   `json:"pm2_5"`
+	PM10           *float64   `json:"pm10"`
+	LastFrame      *time.Time `json:"last_frame"`
+	Frames         uint64     `json:"frames"`
+	ChecksumErrors uint64     `json:"checksum_errors"`
+	Reconnects     uint64     `json:"reconnects"`
+}
+
+// PublishExpvar publishes the state of the sensor as the expvar
+// variable with the given name: the latest raw PM2.5 and PM10 values
+// (which are null until there is one), when the last correct frame was
+// received, the number of frames received, how many of them had bad
+// checksums, and how many times the sensor reconnected. Like
+// expvar.Publish, it panics if the name is already taken.
+func (sensor *Sensor) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		state := expvarState{
+			Frames:         sensor.frames.Load(),
+			ChecksumErrors: sensor.checksumErrors.Load(),
+			Reconnects:     sensor.Reconnects(),
+		}
+		if latest := sensor.latest.Load(); latest != 0 {
+			pm25, pm10 := float64(uint16(latest>>16))/10, float64(uint16(latest))/10
+			state.PM25, state.PM10 = &pm25, &pm10
+		}
+		if ns := sensor.lastFrame.Load(); ns != 0 {
+			t := time.Unix(0, ns)
+			state.LastFrame = &t
+		}
+		return state
+	}))
+}
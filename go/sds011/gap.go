@@ -0,0 +1,158 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// A Gap is reported when measurements were lost between two points
+// read from a sensor, as told by their sequence numbers (see
+// Point.Seq). Points sends it to its error channel, Listen passes it
+// to OnError, and WithOnGap makes the sensor call a function with it.
+type Gap struct {
+	// After and Before are the sequence numbers of the points
+	// around the gap.
+	After, Before uint64
+
+	// Why the measurements were lost. They add up to Missing().
+	Checksum   int // the frame had a bad checksum
+	Resync     int // the frame was cut short or garbled
+	OutOfRange int // the measurement was out of range (see WithRangeCheck)
+	Dropped    int // nobody read the frame in time (see WithMeasurementBuffer)
+}
+
+// Missing returns the number of measurements lost.
+func (g *Gap) Missing() int {
+	return int(g.Before - g.After - 1)
+}
+
+func (g *Gap) Error() string {
+	var reasons []string
+	for _, r := range []struct {
+		n    int
+		name string
+	}{
+		{g.Checksum, "bad checksum"},
+		{g.Resync, "resync"},
+		{g.OutOfRange, "out of range"},
+		{g.Dropped, "dropped"},
+	} {
+		if r.n > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d %v", r.n, r.name))
+		}
+	}
+	return fmt.Sprintf("%d measurements lost between #%d and #%d (%v)", g.Missing(), g.After, g.Before, strings.Join(reasons, ", "))
+}
+
+// Is makes errors.Is(err, ErrGap) true for a Gap.
+func (g *Gap) Is(target error) bool {
+	return target == ErrGap
+}
+
+// WithOnGap makes the sensor call fn with every gap between the points
+// read from it. fn is called from the goroutine reading the point, so
+// it shouldn't take long.
+func WithOnGap(fn func(*Gap)) Option {
+	return func(c *config) error {
+		c.onGap = fn
+		return nil
+	}
+}
+
+type lossReason uint8
+
+const (
+	lostChecksum lossReason = iota
+	lostResync
+	lostOutOfRange
+)
+
+type loss struct {
+	seq    uint64
+	reason lossReason
+}
+
+// maxLosses is how many losses are remembered. Older ones are
+// reported as dropped.
+const maxLosses = 256
+
+// gapState keeps track of the last point read and of the measurements
+// lost after it for which the reason is known.
+type gapState struct {
+	mu     sync.Mutex
+	last   uint64
+	losses []loss
+}
+
+// lose records that the measurement seq was lost.
+func (gs *gapState) lose(seq uint64, reason lossReason) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if len(gs.losses) == maxLosses {
+		gs.losses = gs.losses[1:]
+	}
+	gs.losses = append(gs.losses, loss{seq, reason})
+}
+
+// checkGap records that the point seq was read, and returns the gap
+// before it, if there was one. The sensor's gap callback is called
+// with it. No gap is reported before the first point read.
+func (sensor *Sensor) checkGap(seq uint64) *Gap {
+	if seq == 0 {
+		return nil
+	}
+	gs := &sensor.gaps
+	gs.mu.Lock()
+	last := gs.last
+	if seq > last {
+		gs.last = seq
+	}
+	var gap *Gap
+	if last != 0 && seq > last+1 {
+		gap = &Gap{After: last, Before: seq}
+	}
+	// Forget the losses up to seq, counting those in the gap.
+	kept := gs.losses[:0]
+	for _, l := range gs.losses {
+		switch {
+		case l.seq > seq:
+			kept = append(kept, l)
+		case gap != nil && l.seq > last:
+			switch l.reason {
+			case lostChecksum:
+				gap.Checksum++
+			case lostResync:
+				gap.Resync++
+			case lostOutOfRange:
+				gap.OutOfRange++
+			}
+		}
+	}
+	gs.losses = kept
+	gs.mu.Unlock()
+
+	if gap == nil {
+		return nil
+	}
+	gap.Dropped = gap.Missing() - gap.Checksum - gap.Resync - gap.OutOfRange
+	sensor.logger.Warn("measurements lost", "gap", gap)
+	if sensor.onGap != nil {
+		sensor.onGap(gap)
+	}
+	return gap
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+// HumidityCorrection removes the effect of humidity from readings.
+// In humid air particles take up water and grow, and droplets scatter
+// light like particles do, so the sensor reads high. The correction
+// follows κ-Köhler theory: the dry value is the reading divided by
+//
+//	1 + (Kappa/DensityRatio) / (100/RH - 1)
+//
+// as in Crilley et al., "Evaluation of a low-cost optical particle
+// counter (Alphasense OPC-N2) for ambient air monitoring", Atmospheric
+// Measurement Techniques 11, 2018.
+type HumidityCorrection struct {
+	// Kappa is the hygroscopicity of the particles.
+	Kappa float64
+	// DensityRatio is the density of the particles relative to
+	// that of water.
+	DensityRatio float64
+	// Threshold is the relative humidity, in percent, below which
+	// readings are left as they are.
+	Threshold float64
+}
+
+// DefaultHumidityCorrection is the correction used by CorrectHumidity,
+// with the coefficients found by Crilley et al.
+var DefaultHumidityCorrection = HumidityCorrection{
+	Kappa:        0.62,
+	DensityRatio: 1.65,
+	Threshold:    50,
+}
+
+// maxHumidity is the highest relative humidity corrections are
+// computed for. At 100% the correction grows without bounds.
+const maxHumidity = 99
+
+// Apply returns point with its PM values corrected for the relative
+// humidity rh, in percent. Humidity above 99% is taken to be 99%. The
+// raw values are left as they are.
+func (h HumidityCorrection) Apply(point Point, rh float64) Point {
+	if rh < h.Threshold || rh <= 0 {
+		return point
+	}
+	rh = min(rh, maxHumidity)
+	growth := 1 + (h.Kappa/h.DensityRatio)/(100/rh-1)
+	point.PM25 = max(point.PM25/growth, 0)
+	point.PM10 = max(point.PM10/growth, 0)
+	return point
+}
+
+// CorrectHumidity corrects point for the relative humidity rh, in
+// percent, with DefaultHumidityCorrection.
+func CorrectHumidity(point Point, rh float64) Point {
+	return DefaultHumidityCorrection.Apply(point, rh)
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+func TestCorrectHumidity(t *testing.T) {
+	for _, tc := range []struct {
+		rh         float64
+		pm25, pm10 float64
+	}{
+		{-10, 10, 20},
+		{0, 10, 20},
+		{30, 10, 20},
+		{49.9, 10, 20},
+		{50, 7.2687224669603525, 14.537444933920705},
+		{75, 4.700854700854699, 9.401709401709399},
+		{90, 2.282157676348548, 4.564315352697096},
+		{99, 0.2617801047120435, 0.523560209424087},
+		// Above 99% it's taken to be 99%.
+		{100, 0.2617801047120435, 0.523560209424087},
+		{150, 0.2617801047120435, 0.523560209424087},
+	} {
+		point := sds011.Point{PM25: 10, PM10: 20, PM25Raw: 100, PM10Raw: 200}
+		got := sds011.CorrectHumidity(point, tc.rh)
+		if math.Abs(got.PM25-tc.pm25) > 1e-9 || math.Abs(got.PM10-tc.pm10) > 1e-9 {
+			t.Errorf("CorrectHumidity(%v%%) = %v and %v, want %v and %v", tc.rh, got.PM25, got.PM10, tc.pm25, tc.pm10)
+		}
+		if got.PM25Raw != 100 || got.PM10Raw != 200 {
+			t.Errorf("CorrectHumidity(%v%%) changed the raw values to %v and %v", tc.rh, got.PM25Raw, got.PM10Raw)
+		}
+	}
+}
+
+func TestHumidityCorrectionApply(t *testing.T) {
+	h := sds011.HumidityCorrection{Kappa: 0.5, DensityRatio: 1, Threshold: 60}
+	point := sds011.Point{PM25: 10, PM10: 10}
+	if got := h.Apply(point, 59); got.PM25 != 10 {
+		t.Errorf("Apply below the threshold: got %v, want 10", got.PM25)
+	}
+	if got := h.Apply(point, 60); math.Abs(got.PM25-5.714285714285714) > 1e-9 {
+		t.Errorf("Apply at the threshold: got %v, want 5.714", got.PM25)
+	}
+	// The correction only ever lowers readings, and never below 0.
+	prev := point.PM25
+	for rh := 60.0; rh <= 100; rh++ {
+		got := h.Apply(point, rh)
+		if got.PM25 > prev || got.PM25 < 0 {
+			t.Errorf("Apply(%v%%) = %v, after %v for less humid air", rh, got.PM25, prev)
+		}
+		prev = got.PM25
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import "fmt"
+
+// A Model is one of the Nova Fitness sensors speaking the same
+// protocol as the SDS011. They send the same measurement frames, but
+// don't all understand the same commands.
+//
+// The sensors don't say what model they are, so it can't be detected;
+// use WithModel to set it. Sensors are assumed to be SDS011 by
+// default.
+type Model int
+
+const (
+	// SDS011 understands every command.
+	SDS011 Model = iota
+	// SDS018 can't change its device ID or working period.
+	SDS018
+	// SDS021 understands every command.
+	SDS021
+)
+
+// String returns the model's name, like "SDS011".
+func (m Model) String() string {
+	switch m {
+	case SDS011:
+		return "SDS011"
+	case SDS018:
+		return "SDS018"
+	case SDS021:
+		return "SDS021"
+	}
+	return fmt.Sprintf("Model(%d)", int(m))
+}
+
+// supports returns true if the model understands cmd.
+func (m Model) supports(cmd command) bool {
+	if m == SDS018 {
+		return cmd != commandDeviceID && cmd != commandWorkingPeriod
+	}
+	return true
+}
+
+// Model returns the model of the sensor, as set by WithModel.
+func (sensor *Sensor) Model() Model {
+	return sensor.model
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dialTimeout limits how long reconnecting to a sensor over the network
+// waits for each connection.
+const dialTimeout = 10 * time.Second
+
+// NewFromAddr returns a sensor connected over the network, through a
+// transparent serial to TCP bridge like ser2net or ESP-Link. addr is
+// a URL like "tcp://host:port". ctx limits dialling the first
+// connection; when reconnecting (see WithAutoReconnect), each attempt
+// gives up after 10 seconds. Options that only make sense for serial
+// ports, like WithBaudRate, are ignored, as the bridge sets up the
+// serial side.
+func NewFromAddr(ctx context.Context, addr string, opts ...Option) (*Sensor, error) {
+	cfg, err := makeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	network, hostport, err := parseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, hostport)
+	if err != nil {
+		return nil, err
+	}
+	open := func() (io.ReadWriteCloser, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		return dialer.DialContext(ctx, network, hostport)
+	}
+	return newSensor(conn, cfg, open), nil
+}
+
+// isAddr returns true if path is a URL NewFromAddr takes rather than
+// the path of a serial port.
+func isAddr(path string) bool {
+	return strings.HasPrefix(path, "tcp://") || strings.HasPrefix(path, "tcp4://") || strings.HasPrefix(path, "tcp6://")
+}
+
+// parseAddr splits a URL like tcp://host:port into the network and
+// address to dial.
+func parseAddr(addr string) (network, hostport string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("bad address %q: %w", addr, err)
+	}
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return "", "", fmt.Errorf("bad address %q: unsupported scheme %q", addr, u.Scheme)
+	}
+	if u.Port() == "" {
+		return "", "", fmt.Errorf("bad address %q: no port", addr)
+	}
+	return u.Scheme, u.Host, nil
+}
@@ -0,0 +1,366 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// config holds the settings that can be changed with options.
+type config struct {
+	baudRate          int
+	readTimeout       time.Duration
+	commandTimeout    time.Duration
+	logger            *slog.Logger
+	retries           int
+	retryBackoff      time.Duration
+	reconnect         *ReconnectPolicy
+	streamBuffer      int
+	measurementBuffer int
+	dropPolicy        DropPolicy
+	target            uint16
+	trace             TraceFunc
+	model             Model
+	opener            Opener
+	calibration       *Calibration
+	capture           io.Writer
+	replaySpeed       float64
+	autoSleep         time.Duration
+	wakeWarmup        time.Duration
+	loadUsage         func() (time.Duration, error)
+	saveUsage         func(time.Duration) error
+	rangeCheck        bool
+	dutyCycle         *time.Duration
+	lock              bool
+	watchdog          *watchdog
+	onDisconnect      func(error)
+	timestamps        TimestampSource
+	onGap             func(*Gap)
+	onReject          func(b []byte, reason error)
+}
+
+func defaultConfig() config {
+	return config{
+		baudRate:          9600,
+		readTimeout:       automaticTimeout,
+		commandTimeout:    time.Second,
+		logger:            slog.New(slog.DiscardHandler),
+		streamBuffer:      16,
+		measurementBuffer: 16,
+		target:            Broadcast,
+		opener:            OpenSerial,
+		replaySpeed:       1,
+		rangeCheck:        true,
+		lock:              true,
+	}
+}
+
+// makeConfig applies opts to the default configuration.
+func makeConfig(opts []Option) (config, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		if err := opt(&cfg); err != nil {
+			return config{}, err
+		}
+	}
+	return cfg, nil
+}
+
+// An Option changes how New or NewFromPort set up a sensor.
+type Option func(*config) error
+
+// WithBaudRate sets the baud rate of the serial port. The SDS011 uses
+// 9600, which is the default.
+func WithBaudRate(rate int) Option {
+	return func(c *config) error {
+		if rate <= 0 {
+			return fmt.Errorf("bad baud rate: %v", rate)
+		}
+		c.baudRate = rate
+		return nil
+	}
+}
+
+// WithDataTimeout sets how long Get waits for a measurement (see
+// Sensor.SetReadTimeout).
+func WithDataTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout < 0 {
+			return fmt.Errorf("bad data timeout: %v", timeout)
+		}
+		c.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadTimeout is the same as WithDataTimeout.
+//
+// Deprecated: Use WithDataTimeout.
+func WithReadTimeout(timeout time.Duration) Option {
+	return WithDataTimeout(timeout)
+}
+
+// WithCommandTimeout sets how long commands, and Query, wait for the
+// sensor's reply. The default is 1 second.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(c *config) error {
+		if timeout <= 0 {
+			return fmt.Errorf("bad command timeout: %v", timeout)
+		}
+		c.commandTimeout = timeout
+		return nil
+	}
+}
+
+// WithLogger makes the sensor log what it's doing to logger. Commands
+// sent and frames received are logged at the debug level, problems
+// the sensor recovers from, like frames with bad checksums, at the
+// warn level. By default the sensor doesn't log anything.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		c.logger = logger
+		return nil
+	}
+}
+
+// WithCommandRetry makes commands, like Sleep, Awake or
+// SetWorkingPeriod, be sent up to attempts times if the sensor
+// doesn't reply to them, or its reply is corrupted or doesn't confirm
+// the command. The sensor waits for backoff before the second
+// attempt, and twice as long before each next one, give or take a
+// random half, so that it doesn't keep hitting a hiccup of the port
+// at the same time. Reading measurements isn't retried. By default,
+// commands are only sent once.
+func WithCommandRetry(attempts int, backoff time.Duration) Option {
+	return func(c *config) error {
+		if attempts < 1 {
+			return fmt.Errorf("bad number of attempts: %v", attempts)
+		}
+		if backoff < 0 {
+			return errors.New("negative command retry backoff")
+		}
+		c.retries = attempts - 1
+		c.retryBackoff = backoff
+		return nil
+	}
+}
+
+// WithRetries is like WithCommandRetry with retries+1 attempts,
+// leaving the backoff as it is.
+//
+// Deprecated: Use WithCommandRetry.
+func WithRetries(retries int) Option {
+	return func(c *config) error {
+		if retries < 0 {
+			return fmt.Errorf("bad number of retries: %v", retries)
+		}
+		return WithCommandRetry(retries+1, c.retryBackoff)(c)
+	}
+}
+
+// WithMeasurementBuffer sets how many measurements the sensor keeps
+// when nobody reads them, for example while the consumer of Points is
+// busy. When there are more, one is dropped, as WithDropPolicy says.
+// The default is 16.
+func WithMeasurementBuffer(size int) Option {
+	return func(c *config) error {
+		if size < 1 {
+			return fmt.Errorf("bad measurement buffer size: %v", size)
+		}
+		c.measurementBuffer = size
+		return nil
+	}
+}
+
+// A DropPolicy says which measurement to drop when a buffer is full.
+type DropPolicy int
+
+const (
+	// DropOldest drops the oldest measurement in the buffer, to
+	// make room for the new one. It's the default, as it keeps
+	// the data current.
+	DropOldest DropPolicy = iota
+	// DropNewest drops the new measurement, keeping the buffer as
+	// it is.
+	DropNewest
+)
+
+// WithDropPolicy sets which measurement is dropped when the sensor's
+// buffer (see WithMeasurementBuffer), or the buffer of a channel
+// returned by Points or Subscribe, is full. Stats counts them.
+func WithDropPolicy(policy DropPolicy) Option {
+	return func(c *config) error {
+		if policy != DropOldest && policy != DropNewest {
+			return fmt.Errorf("bad drop policy: %v", policy)
+		}
+		c.dropPolicy = policy
+		return nil
+	}
+}
+
+// WithStreamBuffer sets how many measurements, and errors, the
+// channels returned by Points hold before they start dropping the
+// oldest ones. The default is 16.
+func WithStreamBuffer(size int) Option {
+	return func(c *config) error {
+		if size < 1 {
+			return fmt.Errorf("bad stream buffer size: %v", size)
+		}
+		c.streamBuffer = size
+		return nil
+	}
+}
+
+// WithTargetDevice addresses commands to the device with the given ID
+// instead of broadcasting them (see Sensor.SetTarget).
+func WithTargetDevice(id uint16) Option {
+	return func(c *config) error {
+		c.target = id
+		return nil
+	}
+}
+
+// WithTrace makes the sensor pass every frame it sends and receives to
+// fn (see Sensor.SetTraceFunc).
+func WithTrace(fn TraceFunc) Option {
+	return func(c *config) error {
+		c.trace = fn
+		return nil
+	}
+}
+
+// WithModel says what model the sensor is. Methods sending commands
+// the model doesn't understand return an error wrapping
+// ErrUnsupported instead. The default is SDS011.
+func WithModel(m Model) Option {
+	return func(c *config) error {
+		if m < SDS011 || m > SDS021 {
+			return fmt.Errorf("bad model: %v", m)
+		}
+		c.model = m
+		return nil
+	}
+}
+
+// WithOpener makes New open the port with open instead of OpenSerial.
+func WithOpener(open Opener) Option {
+	return func(c *config) error {
+		if open == nil {
+			return errors.New("nil opener")
+		}
+		c.opener = open
+		return nil
+	}
+}
+
+// WithCalibration makes the sensor correct its readings with c (see
+// Sensor.SetCalibration).
+func WithCalibration(c Calibration) Option {
+	return func(cfg *config) error {
+		cfg.calibration = &c
+		return nil
+	}
+}
+
+// WithoutLock makes New skip locking the serial port. By default, it
+// takes an advisory lock on it (flock on Unix), and fails with an
+// error wrapping ErrPortBusy if another process holds it, as two
+// processes reading the same port each get parts of the frames. On
+// Windows ports can't be shared anyway, so it makes no difference.
+func WithoutLock() Option {
+	return func(c *config) error {
+		c.lock = false
+		return nil
+	}
+}
+
+// A TimestampSource says what the timestamps of points are.
+type TimestampSource int
+
+const (
+	// FrameArrival stamps points with when the first byte of
+	// their frame was read from the port, which is the closest to
+	// when the sensor sent it. It's the default.
+	FrameArrival TimestampSource = iota
+	// ReadReturn stamps points with when Get or Query returned
+	// them, which may be later if they waited to be read.
+	ReadReturn
+)
+
+// WithTimestamps sets what the timestamps of the points read are.
+// Either way, they carry a monotonic clock reading too, so the time
+// between points computed with Sub isn't affected by changes of the
+// system clock.
+func WithTimestamps(src TimestampSource) Option {
+	return func(c *config) error {
+		if src != FrameArrival && src != ReadReturn {
+			return fmt.Errorf("bad timestamp source: %v", src)
+		}
+		c.timestamps = src
+		return nil
+	}
+}
+
+// WithRangeCheck sets whether measurements outside of the range the
+// sensor can report, or coming out negative after calibration, are
+// errors wrapping ErrOutOfRange. They are by default, since they
+// can only come from frames corrupted in a way the checksum didn't
+// catch.
+func WithRangeCheck(check bool) Option {
+	return func(c *config) error {
+		c.rangeCheck = check
+		return nil
+	}
+}
+
+// WithCapture makes the sensor write all the bytes it sends and
+// receives to w, with their time, so that they can be replayed with
+// NewFromCapture. Each chunk of bytes is a line like:
+//
+//	2024-05-01T10:00:00.123456789Z received aa c0 7b 00 c8 01 a1 60 45 ab
+//
+// with the time in RFC 3339 format, "sent" or "received", and the
+// bytes in hex. When replaying, a # and what follows it on a line is
+// a comment, and lines saying something else than "sent" or
+// "received" are skipped. Errors writing to w are ignored.
+func WithCapture(w io.Writer) Option {
+	return func(c *config) error {
+		if w == nil {
+			return errors.New("nil capture writer")
+		}
+		c.capture = w
+		return nil
+	}
+}
+
+// WithReplaySpeed sets how fast NewFromCapture replays a capture,
+// relative to how fast the bytes were received: 2 replays it twice as
+// fast. 0 replays it without waiting at all. The default is 1.
+func WithReplaySpeed(speed float64) Option {
+	return func(c *config) error {
+		if speed < 0 {
+			return fmt.Errorf("bad replay speed: %v", speed)
+		}
+		c.replaySpeed = speed
+		return nil
+	}
+}
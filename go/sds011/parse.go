@@ -0,0 +1,86 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// A Reply is the sensor's reply to a command.
+type Reply struct {
+	Command  byte    // the command replied to
+	Data     [3]byte // what the sensor replied, which depends on the command
+	DeviceID uint16  // the ID of the sensor that replied
+}
+
+// ParseFrame decodes a frame with a measurement, as sent by the
+// sensor. b must hold exactly one frame. The point's timestamp is
+// left zero, as the frame doesn't carry one. ParseFrame returns an
+// error wrapping io.ErrUnexpectedEOF if b is too short, ErrBadHeader
+// if it isn't a measurement frame, and ErrChecksum if the frame is
+// corrupted. Like a sensor does by default (see WithRangeCheck), it
+// returns a *RangeError, which holds the point, for values above
+// 999.9 μg/m³.
+func ParseFrame(b []byte) (Point, error) {
+	resp, err := parseResponse(b)
+	if err != nil {
+		return Point{}, err
+	}
+	if resp.IsReply() {
+		return Point{}, fmt.Errorf("%w: reply instead of measurement: % x", ErrBadHeader, b)
+	}
+	point := resp.point(time.Time{})
+	if point.PM25Raw > maxRaw || point.PM10Raw > maxRaw {
+		return Point{}, &RangeError{Point: *point}
+	}
+	return *point, nil
+}
+
+// ParseReply decodes a frame with a reply to a command. It returns the
+// same errors as ParseFrame, with ErrBadHeader for a measurement
+// frame.
+func ParseReply(b []byte) (Reply, error) {
+	resp, err := parseResponse(b)
+	if err != nil {
+		return Reply{}, err
+	}
+	if !resp.IsReply() {
+		return Reply{}, fmt.Errorf("%w: measurement instead of reply: % x", ErrBadHeader, b)
+	}
+	reply := Reply{Command: resp.Data[0], DeviceID: resp.ID()}
+	copy(reply.Data[:], resp.Data[1:4])
+	return reply, nil
+}
+
+// parseResponse decodes the frame in b. If it isn't correct, it also
+// returns the error saying why, along with what was decoded.
+func parseResponse(b []byte) (response, error) {
+	if len(b) != responseSize {
+		if len(b) < responseSize {
+			return response{}, fmt.Errorf("frame of %d bytes, want %d: %w", len(b), responseSize, io.ErrUnexpectedEOF)
+		}
+		return response{}, fmt.Errorf("frame of %d bytes, want %d", len(b), responseSize)
+	}
+	resp := response{
+		Header:   b[0],
+		Command:  b[1],
+		CheckSum: b[8],
+		Tail:     b[9],
+	}
+	copy(resp.Data[:], b[2:8])
+	return resp, resp.IsCorrect()
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+func TestParseFrame(t *testing.T) {
+	badChecksum := measurementFrame(123, 456)
+	badChecksum[8]++
+	badTail := measurementFrame(123, 456)
+	badTail[9] = 0xAC
+	badHeader := measurementFrame(123, 456)
+	badHeader[0] = 0xAB
+	badCommand := measurementFrame(123, 456)
+	badCommand[1] = 0xC1
+
+	for _, tc := range []struct {
+		name       string
+		frame      []byte
+		pm25, pm10 uint16
+		err        error
+	}{
+		{"measurement", measurementFrame(123, 456), 123, 456, nil},
+		{"zero", measurementFrame(0, 0), 0, 0, nil},
+		{"max", measurementFrame(9999, 9999), 9999, 9999, nil},
+		{"pm10 max", measurementFrame(1, 9999), 1, 9999, nil},
+		{"pm2.5 above max", measurementFrame(10000, 1), 0, 0, sds011.ErrOutOfRange},
+		{"pm10 above max", measurementFrame(1, 10000), 0, 0, sds011.ErrOutOfRange},
+		{"both above max", measurementFrame(0xFFFF, 0xFFFF), 0, 0, sds011.ErrOutOfRange},
+		{"empty", nil, 0, 0, io.ErrUnexpectedEOF},
+		{"truncated", measurementFrame(123, 456)[:9], 0, 0, io.ErrUnexpectedEOF},
+		{"header only", []byte{0xAA, 0xC0}, 0, 0, io.ErrUnexpectedEOF},
+		{"bad checksum", badChecksum, 0, 0, sds011.ErrChecksum},
+		{"bad tail", badTail, 0, 0, sds011.ErrBadHeader},
+		{"bad header", badHeader, 0, 0, sds011.ErrBadHeader},
+		{"bad command", badCommand, 0, 0, sds011.ErrBadHeader},
+		{"reply", replyFrame(sds011test.CommandWorkState, 0, 1), 0, 0, sds011.ErrBadHeader},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			point, err := sds011.ParseFrame(tc.frame)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("ParseFrame(% x): got error %v, want %v", tc.frame, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseFrame(% x): %v", tc.frame, err)
+			}
+			if point.PM25Raw != tc.pm25 || point.PM10Raw != tc.pm10 {
+				t.Errorf("ParseFrame(% x): got raw values %d and %d, want %d and %d", tc.frame, point.PM25Raw, point.PM10Raw, tc.pm25, tc.pm10)
+			}
+			if point.PM25 != float64(tc.pm25)/10 || point.PM10 != float64(tc.pm10)/10 {
+				t.Errorf("ParseFrame(% x): got %v and %v μg/m³, want %v and %v", tc.frame, point.PM25, point.PM10, float64(tc.pm25)/10, float64(tc.pm10)/10)
+			}
+			if point.DeviceID != 0xA160 {
+				t.Errorf("ParseFrame(% x): got device ID %04X, want A160", tc.frame, point.DeviceID)
+			}
+			if !point.Timestamp.IsZero() {
+				t.Errorf("ParseFrame(% x): got timestamp %v, want zero", tc.frame, point.Timestamp)
+			}
+		})
+	}
+}
+
+func TestParseFrameRangeError(t *testing.T) {
+	_, err := sds011.ParseFrame(measurementFrame(64255, 100))
+	var re *sds011.RangeError
+	if !errors.As(err, &re) {
+		t.Fatalf("ParseFrame of 6425.5 μg/m³: got error %v, want a *RangeError", err)
+	}
+	if re.Point.PM25Raw != 64255 || re.Point.PM25 != 6425.5 || re.Point.PM10Raw != 100 {
+		t.Errorf("RangeError holds %+v, want the decoded point", re.Point)
+	}
+}
+
+func TestParseFrameTooLong(t *testing.T) {
+	b := append(measurementFrame(123, 456), 0xAA)
+	if _, err := sds011.ParseFrame(b); err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ParseFrame of 11 bytes: got error %v, want one for a frame too long", err)
+	}
+}
+
+func TestParseChecksumError(t *testing.T) {
+	b := measurementFrame(123, 456)
+	want := b[8]
+	b[8]++
+	_, err := sds011.ParseFrame(b)
+	var ce *sds011.ChecksumError
+	if !errors.As(err, &ce) {
+		t.Fatalf("ParseFrame with a bad checksum: got error %v, want a *ChecksumError", err)
+	}
+	if ce.Expected != want || ce.Actual != want+1 {
+		t.Errorf("ChecksumError: got expected %#02x and actual %#02x, want %#02x and %#02x", ce.Expected, ce.Actual, want, want+1)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	reply, err := sds011.ParseReply(replyFrame(sds011test.CommandFirmware, 15, 7, 10))
+	if err != nil {
+		t.Fatalf("ParseReply: %v", err)
+	}
+	want := sds011.Reply{Command: sds011test.CommandFirmware, Data: [3]byte{15, 7, 10}, DeviceID: 0xA160}
+	if reply != want {
+		t.Errorf("ParseReply: got %+v, want %+v", reply, want)
+	}
+	if _, err := sds011.ParseReply(measurementFrame(1, 2)); !errors.Is(err, sds011.ErrBadHeader) {
+		t.Errorf("ParseReply of a measurement: got error %v, want ErrBadHeader", err)
+	}
+}
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add(measurementFrame(123, 456))
+	f.Add(measurementFrame(9999, 9999))
+	f.Add(measurementFrame(0xFFFF, 0))
+	f.Add(replyFrame(sds011test.CommandWorkState, 1, 1))
+	f.Add([]byte{0xAA, 0xC0})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		point, err := sds011.ParseFrame(b)
+		var re *sds011.RangeError
+		if errors.As(err, &re) {
+			if re.Point.PM25Raw <= 9999 && re.Point.PM10Raw <= 9999 {
+				t.Fatalf("ParseFrame(% x): out of range error for %+v", b, re.Point)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		if point.PM25Raw > 9999 || point.PM10Raw > 9999 {
+			t.Fatalf("ParseFrame(% x) accepted %+v, out of range", b, point)
+		}
+		// Only a well formed measurement frame is accepted, and its
+		// values are the ones it carries.
+		if len(b) != 10 || b[0] != 0xAA || b[1] != 0xC0 || b[9] != 0xAB {
+			t.Fatalf("ParseFrame accepted % x", b)
+		}
+		var sum byte
+		for _, v := range b[2:8] {
+			sum += v
+		}
+		if sum != b[8] {
+			t.Fatalf("ParseFrame accepted % x with a bad checksum", b)
+		}
+		if point.PM25Raw != binary.LittleEndian.Uint16(b[2:4]) || point.PM10Raw != binary.LittleEndian.Uint16(b[4:6]) {
+			t.Fatalf("ParseFrame(% x): got raw values %d and %d", b, point.PM25Raw, point.PM10Raw)
+		}
+		if point.DeviceID != binary.BigEndian.Uint16(b[6:8]) {
+			t.Fatalf("ParseFrame(% x): got device ID %04X", b, point.DeviceID)
+		}
+	})
+}
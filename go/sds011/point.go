@@ -0,0 +1,240 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Point represents a single reading from the sensor.
+//
+// PM25 and PM10 are in μg/m³. The sensor reports them as integers in
+// tenths of μg/m³, which PM25Raw and PM10Raw hold, so that for points
+// read from the sensor PM25 == float64(PM25Raw)/10 and
+// PM10 == float64(PM10Raw)/10 hold, unless the sensor has a
+// calibration (see Sensor.SetCalibration). The raw values are never
+// calibrated.
+type Point struct {
+	PM25      float64
+	PM10      float64
+	PM25Raw   uint16
+	PM10Raw   uint16
+	DeviceID  uint16 // the ID of the sensor that took the reading
+	Timestamp time.Time
+	// Seq numbers the measurements received by a sensor, starting
+	// from 1, including those that were lost, so that the points
+	// missing between two can be told (see Gap). It is 0 for points
+	// that didn't come from a sensor.
+	Seq uint64
+	// Samples is the number of measurements averaged into the
+	// point, or 0 if it is a single one.
+	Samples int
+	// PM25StdDev and PM10StdDev are the sample standard deviations
+	// of the measurements averaged into the point, if there were
+	// several.
+	PM25StdDev float64
+	PM10StdDev float64
+	// PM25Min, PM25Max, PM10Min and PM10Max are the lowest and the
+	// highest of the measurements averaged into the point, if it's
+	// an average.
+	PM25Min, PM25Max float64
+	PM10Min, PM10Max float64
+	// Manual is true for a point measured on request, out of the
+	// schedule the others were measured on.
+	Manual bool
+	// Missing, if not empty, makes the point stand for a measurement
+	// that failed, saying what kind of error made it fail. Its PM
+	// values are meaningless then.
+	Missing string
+	// Combined, if not 0, makes the point a combination, like the
+	// mean, of the measurements of that many sensors taken at about
+	// the same time, rather than one of a sensor. Its DeviceID is 0,
+	// and CombinedDeviceID stands for it where it's written out.
+	Combined int
+}
+
+// CombinedDeviceID is what the device ID of combined points (see
+// Point.Combined) is written as.
+const CombinedDeviceID = "combined"
+
+// newPoint returns a point for the raw values reported by a sensor.
+func newPoint(pm25, pm10, id uint16, ts time.Time) *Point {
+	return &Point{
+		PM25:      float64(pm25) / 10,
+		PM10:      float64(pm10) / 10,
+		PM25Raw:   pm25,
+		PM10Raw:   pm10,
+		DeviceID:  id,
+		Timestamp: ts,
+	}
+}
+
+// tenths converts a value in μg/m³ to the raw value the sensor would
+// report for it.
+func tenths(v float64) uint16 {
+	return uint16(math.Round(v * 10))
+}
+
+// String formats the point for logging, like
+// "2024-05-01T10:00:00Z PM2.5=12.3 PM10=20.1 μg/m³".
+func (point Point) String() string {
+	return fmt.Sprintf("%s PM2.5=%.1f PM10=%.1f μg/m³", point.Timestamp.Format(time.RFC3339), point.PM25, point.PM10)
+}
+
+// MarshalText encodes the point as comma-separated values: the
+// timestamp in RFC 3339 format, PM2.5 and PM10, with two decimal
+// places, like "2024-05-01T10:00:00Z,12.30,20.10". The device ID
+// isn't included.
+func (point Point) MarshalText() ([]byte, error) {
+	b := point.Timestamp.AppendFormat(nil, time.RFC3339)
+	b = append(b, ',')
+	b = strconv.AppendFloat(b, point.PM25, 'f', 2, 64)
+	b = append(b, ',')
+	b = strconv.AppendFloat(b, point.PM10, 'f', 2, 64)
+	return b, nil
+}
+
+// UnmarshalText decodes a point encoded by MarshalText. The raw
+// values are computed from the decoded ones, rounded to the sensor's
+// resolution, and the device ID is 0.
+func (point *Point) UnmarshalText(b []byte) error {
+	fields := strings.Split(string(b), ",")
+	if len(fields) != 3 {
+		return fmt.Errorf("point: %d fields in %q, want 3", len(fields), b)
+	}
+	ts, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return fmt.Errorf("point timestamp: %w", err)
+	}
+	pm25, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return fmt.Errorf("point PM2.5: %w", err)
+	}
+	pm10, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return fmt.Errorf("point PM10: %w", err)
+	}
+	*point = *newPoint(tenths(pm25), tenths(pm10), 0, ts)
+	// Calibrated values can have two decimal places.
+	point.PM25, point.PM10 = pm25, pm10
+	return nil
+}
+
+// pointJSON is how a Point looks in JSON.
+type pointJSON struct {
+	Timestamp string       `json:"timestamp"`
+	PM25      *json.Number `json:"pm2_5"` // nil for missing points
+	PM10      *json.Number `json:"pm10"`
+	DeviceID  string       `json:"device_id"`
+	Seq       uint64       `json:"seq,omitempty"`
+	Samples   int          `json:"samples,omitempty"`
+	PM25SD    json.Number  `json:"pm2_5_stddev,omitempty"`
+	PM10SD    json.Number  `json:"pm10_stddev,omitempty"`
+	Trigger   string       `json:"trigger,omitempty"`
+	Missing   string       `json:"missing,omitempty"`
+	Sensors   int          `json:"sensors,omitempty"` // of combined points
+}
+
+// MarshalJSON encodes the point as an object with the fields
+// "timestamp" (in RFC 3339 format), "pm2_5", "pm10" and "device_id"
+// (four hex digits), and "seq" if the point has a sequence number.
+// Averages also have "samples", and if there were several,
+// "pm2_5_stddev" and "pm10_stddev", and manual points have "trigger"
+// set to "manual". Combined points have CombinedDeviceID as
+// "device_id", and how many sensors they combine as "sensors". The
+// values have one decimal place, which is the sensor's resolution,
+// and the deviations two. Missing points have "missing" instead, and
+// "pm2_5" and "pm10" are null.
+func (point Point) MarshalJSON() ([]byte, error) {
+	j := pointJSON{
+		Timestamp: point.Timestamp.Format(time.RFC3339),
+		DeviceID:  fmt.Sprintf("%04x", point.DeviceID),
+		Seq:       point.Seq,
+		Samples:   point.Samples,
+		Missing:   point.Missing,
+	}
+	if point.Combined > 0 {
+		j.DeviceID, j.Sensors = CombinedDeviceID, point.Combined
+	}
+	if point.Missing == "" {
+		pm25 := json.Number(strconv.FormatFloat(point.PM25, 'f', 1, 64))
+		pm10 := json.Number(strconv.FormatFloat(point.PM10, 'f', 1, 64))
+		j.PM25, j.PM10 = &pm25, &pm10
+	}
+	if point.Manual {
+		j.Trigger = "manual"
+	}
+	if point.Samples > 1 {
+		j.PM25SD = json.Number(strconv.FormatFloat(point.PM25StdDev, 'f', 2, 64))
+		j.PM10SD = json.Number(strconv.FormatFloat(point.PM10StdDev, 'f', 2, 64))
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes a point encoded by MarshalJSON. The raw
+// values are computed from the decoded ones.
+func (point *Point) UnmarshalJSON(b []byte) error {
+	var j pointJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	ts, err := time.Parse(time.RFC3339, j.Timestamp)
+	if err != nil {
+		return fmt.Errorf("point timestamp: %w", err)
+	}
+	var id uint64
+	if j.DeviceID != CombinedDeviceID {
+		if id, err = strconv.ParseUint(j.DeviceID, 16, 16); err != nil {
+			return fmt.Errorf("point device_id: %w", err)
+		}
+	}
+	if j.Missing != "" {
+		*point = Point{DeviceID: uint16(id), Timestamp: ts, Missing: j.Missing}
+	} else {
+		if j.PM25 == nil || j.PM10 == nil {
+			return errors.New("point: pm2_5 or pm10 is null, but it isn't missing")
+		}
+		pm25, err := j.PM25.Float64()
+		if err != nil {
+			return fmt.Errorf("point pm2_5: %w", err)
+		}
+		pm10, err := j.PM10.Float64()
+		if err != nil {
+			return fmt.Errorf("point pm10: %w", err)
+		}
+		*point = *newPoint(tenths(pm25), tenths(pm10), uint16(id), ts)
+	}
+	point.Seq, point.Samples, point.Manual = j.Seq, j.Samples, j.Trigger == "manual"
+	if j.DeviceID == CombinedDeviceID {
+		point.Combined = max(j.Sensors, 1)
+	}
+	if j.PM25SD != "" {
+		if point.PM25StdDev, err = j.PM25SD.Float64(); err != nil {
+			return fmt.Errorf("point pm2_5_stddev: %w", err)
+		}
+	}
+	if j.PM10SD != "" {
+		if point.PM10StdDev, err = j.PM10SD.Float64(); err != nil {
+			return fmt.Errorf("point pm10_stddev: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// golden compares got with the contents of testdata/name, or writes
+// it there with -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output doesn't match %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+// samePoint returns true if a and b are equal, with timestamps
+// compared as instants.
+func samePoint(a, b sds011.Point) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return false
+	}
+	a.Timestamp, b.Timestamp = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+var goldenTime = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+var jsonPoints = []struct {
+	name  string
+	point sds011.Point
+	// exact is true if the point survives a round trip unchanged.
+	exact bool
+}{
+	{"measurement", sds011.Point{PM25: 12.3, PM10: 45.6, PM25Raw: 123, PM10Raw: 456, DeviceID: 0xA160, Timestamp: goldenTime, Seq: 7}, true},
+	{"zero", sds011.Point{Timestamp: goldenTime}, true},
+	{"max", sds011.Point{PM25: 999.9, PM10: 999.9, PM25Raw: 9999, PM10Raw: 9999, DeviceID: 0xFFFE, Timestamp: goldenTime}, true},
+	{"offset", sds011.Point{PM25: 1, PM10: 2, PM25Raw: 10, PM10Raw: 20, DeviceID: 1, Timestamp: goldenTime.In(time.FixedZone("CEST", 2*60*60))}, true},
+	{"sub-second", sds011.Point{PM25: 1, PM10: 2, PM25Raw: 10, PM10Raw: 20, Timestamp: goldenTime.Add(999 * time.Millisecond)}, false},
+	{"calibrated", sds011.Point{PM25: 12.349, PM10: 20.05, PM25Raw: 110, PM10Raw: 190, Timestamp: goldenTime}, false},
+	{"average", sds011.Point{PM25: 10.5, PM10: 20.5, PM25Raw: 105, PM10Raw: 205, DeviceID: 0xA160, Timestamp: goldenTime, Samples: 4, PM25StdDev: 1.234, PM10StdDev: 0.5}, false},
+	{"manual", sds011.Point{PM25: 3.1, PM10: 4.2, PM25Raw: 31, PM10Raw: 42, DeviceID: 0xA160, Timestamp: goldenTime, Manual: true}, true},
+	{"missing", sds011.Point{DeviceID: 0xA160, Timestamp: goldenTime, Missing: "timeout"}, true},
+	{"combined", sds011.Point{PM25: 5, PM10: 6, PM25Raw: 50, PM10Raw: 60, Timestamp: goldenTime, Combined: 3}, true},
+}
+
+func TestPointJSONGolden(t *testing.T) {
+	var out bytes.Buffer
+	for _, tc := range jsonPoints {
+		b, err := json.Marshal(tc.point)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tc.name, err)
+		}
+		out.WriteString(tc.name + ": ")
+		out.Write(b)
+		out.WriteByte('\n')
+	}
+	golden(t, "point_json.golden", out.Bytes())
+}
+
+func TestPointJSONRoundTrip(t *testing.T) {
+	for _, tc := range jsonPoints {
+		b, err := json.Marshal(tc.point)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tc.name, err)
+		}
+		var got sds011.Point
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: Unmarshal(%s): %v", tc.name, b, err)
+		}
+		if tc.exact && !samePoint(got, tc.point) {
+			t.Errorf("%s: round trip through %s: got %+v, want %+v", tc.name, b, got, tc.point)
+		}
+		// Whatever was lost, encoding the point again gives the
+		// same JSON.
+		again, err := json.Marshal(got)
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", tc.name, err)
+		}
+		if !bytes.Equal(again, b) {
+			t.Errorf("%s: encoding the decoded point gives %s, want %s", tc.name, again, b)
+		}
+	}
+}
+
+func TestPointUnmarshalJSONErrors(t *testing.T) {
+	for _, in := range []string{
+		`{"timestamp":"yesterday","pm2_5":1.0,"pm10":2.0,"device_id":"a160"}`,
+		`{"timestamp":"2024-05-01T10:00:00Z","pm2_5":null,"pm10":2.0,"device_id":"a160"}`,
+		`{"timestamp":"2024-05-01T10:00:00Z","pm2_5":1.0,"pm10":2.0,"device_id":"sensor"}`,
+		`{"timestamp":"2024-05-01T10:00:00Z","pm2_5":"x","pm10":2.0,"device_id":"a160"}`,
+		`[]`,
+	} {
+		var p sds011.Point
+		if err := json.Unmarshal([]byte(in), &p); err == nil {
+			t.Errorf("Unmarshal(%s) = nil error, want one", in)
+		}
+	}
+}
+
+func TestPointTextGolden(t *testing.T) {
+	var out bytes.Buffer
+	for _, tc := range jsonPoints {
+		b, err := tc.point.MarshalText()
+		if err != nil {
+			t.Fatalf("%s: MarshalText: %v", tc.name, err)
+		}
+		out.WriteString(tc.name + ": ")
+		out.Write(b)
+		out.WriteString("\n" + tc.name + ": " + tc.point.String() + "\n")
+	}
+	golden(t, "point_text.golden", out.Bytes())
+}
+
+func TestPointTextRoundTrip(t *testing.T) {
+	for _, tc := range jsonPoints {
+		if tc.point.Missing != "" || tc.point.Samples > 0 || tc.point.Manual || tc.point.Combined > 0 || tc.point.DeviceID != 0 || tc.point.Seq != 0 {
+			// The text form only has the timestamp and the values.
+			continue
+		}
+		b, err := tc.point.MarshalText()
+		if err != nil {
+			t.Fatalf("%s: MarshalText: %v", tc.name, err)
+		}
+		var got sds011.Point
+		if err := got.UnmarshalText(b); err != nil {
+			t.Fatalf("%s: UnmarshalText(%s): %v", tc.name, b, err)
+		}
+		if tc.exact && !samePoint(got, tc.point) {
+			t.Errorf("%s: round trip through %s: got %+v, want %+v", tc.name, b, got, tc.point)
+		}
+		again, err := got.MarshalText()
+		if err != nil {
+			t.Fatalf("%s: MarshalText: %v", tc.name, err)
+		}
+		if !bytes.Equal(again, b) {
+			t.Errorf("%s: encoding the decoded point gives %s, want %s", tc.name, again, b)
+		}
+	}
+}
+
+func TestPointUnmarshalText(t *testing.T) {
+	var p sds011.Point
+	if err := p.UnmarshalText([]byte("2024-05-01T12:00:00+02:00,12.30,20.15")); err != nil {
+		t.Fatalf("UnmarshalText: %v", err)
+	}
+	want := sds011.Point{PM25: 12.3, PM10: 20.15, PM25Raw: 123, PM10Raw: 202, Timestamp: goldenTime}
+	if !samePoint(p, want) {
+		t.Errorf("UnmarshalText: got %+v, want %+v", p, want)
+	}
+	for _, in := range []string{
+		"",
+		"2024-05-01T10:00:00Z,12.30",
+		"2024-05-01T10:00:00Z,12.30,20.10,1",
+		"yesterday,12.30,20.10",
+		"2024-05-01T10:00:00Z,twelve,20.10",
+		"2024-05-01T10:00:00Z,12.30,",
+	} {
+		if err := p.UnmarshalText([]byte(in)); err == nil {
+			t.Errorf("UnmarshalText(%q) = nil error, want one", in)
+		}
+	}
+}
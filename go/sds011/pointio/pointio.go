@@ -0,0 +1,733 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pointio writes sensor measurements as CSV, TSV, JSON lines,
+// InfluxDB line protocol, or the PUTVAL commands of collectd's exec
+// plugin, and reads back the first three.
+package pointio
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/aqi"
+)
+
+// A PointWriter writes points to an underlying writer. Its methods
+// are safe to call from multiple goroutines.
+type PointWriter interface {
+	// Write writes one point.
+	Write(sds011.Point) error
+	// Flush writes any buffered data to the underlying writer.
+	Flush() error
+}
+
+// A Column is an optional column of the CSV and TSV writers.
+type Column int
+
+const (
+	// Raw adds the raw values reported by the sensor, in tenths
+	// of μg/m³, as pm2_5_raw and pm10_raw.
+	Raw Column = 1 << iota
+	// DeviceID adds the ID of the sensor, as four hex digits, or
+	// sds011.CombinedDeviceID for combined points.
+	DeviceID
+	// AQI adds the US EPA Air Quality Index of the point and its
+	// category, as aqi and aqi_category (see aqi.FromPoint), or the
+	// index WithAQI says. The JSON writer adds them too.
+	AQI
+	// Spread adds, for points that are averages, the number of
+	// measurements averaged and their standard deviations, as
+	// samples, pm2_5_stddev and pm10_stddev.
+	Spread
+	// Trigger adds what the point was measured on, as trigger:
+	// "manual" for manual points (see sds011.Point.Manual), and
+	// "schedule" for the others.
+	Trigger
+	// Error adds what kind of error made missing points fail, as
+	// error (see sds011.Point.Missing), empty for the others.
+	Error
+	// Extended adds, for every point, the number of measurements
+	// averaged into it, and their lowest, highest and standard
+	// deviation, as sample_count, pm2_5_min, pm2_5_max,
+	// pm2_5_stddev, pm10_min, pm10_max and pm10_stddev. It replaces
+	// the deviations of Spread, which keeps only samples. The JSON
+	// writer adds them too (see AppendExtendedJSON).
+	Extended
+	// Sensors adds how many sensors the combined points combine (see
+	// sds011.Point.Combined), as sensors, empty for the others.
+	Sensors
+)
+
+// Formats are the formats NewWriter knows.
+var Formats = []string{"csv", "tsv", "jsonl", "influx", "collectd"}
+
+// NewWriter returns a writer for the named format, one of Formats.
+// Options that don't apply to the format are ignored.
+func NewWriter(format string, w io.Writer, opts ...Option) (PointWriter, error) {
+	switch format {
+	case "csv":
+		return NewCSVWriter(w, opts...), nil
+	case "tsv":
+		return NewTSVWriter(w, opts...), nil
+	case "jsonl":
+		return NewJSONWriter(w, opts...), nil
+	case "influx":
+		return NewInfluxWriter(w, opts...), nil
+	case "collectd":
+		return NewCollectdWriter(w, opts...), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want one of %v", format, strings.Join(Formats, ", "))
+}
+
+// An Option changes how the writers format points.
+type Option func(*config)
+
+type config struct {
+	header    bool
+	timestamp string // the format of timestamps, "" for RFC 3339
+	columns   Column
+	delimiter rune
+	tags      []Tag
+	aqi       func(sds011.Point) (index int, category string)
+	funcs     []columnFunc
+	missing   string // what missing values are written as
+	// marshal and jsonHeader are those of WithJSONMarshal and
+	// WithJSONHeader, or nil.
+	marshal    func(sds011.Point) ([]byte, error)
+	jsonHeader func() []any
+	// host and interval are those of WithCollectd.
+	host     string
+	interval time.Duration
+}
+
+// columnFunc is a column added by WithColumnFunc.
+type columnFunc struct {
+	name string
+	fn   func(sds011.Point) string
+}
+
+// A Tag is a key and value added to every line of InfluxDB line
+// protocol, like host=kitchen.
+type Tag struct {
+	Key, Value string
+}
+
+// WithTags adds tags to the lines written by the InfluxDB writer,
+// after the sensor one.
+func WithTags(tags ...Tag) Option {
+	return func(c *config) {
+		c.tags = append(c.tags, tags...)
+	}
+}
+
+// WithCollectd sets the host that the collectd writer names in its
+// identifiers, and the interval it says the values come at, which is
+// left out if it's 0, for collectd to take its own.
+func WithCollectd(host string, interval time.Duration) Option {
+	return func(c *config) {
+		c.host, c.interval = host, interval
+	}
+}
+
+// WithHeader makes the writer start with a row naming the columns.
+func WithHeader() Option {
+	return func(c *config) {
+		c.header = true
+	}
+}
+
+// WithJSONMarshal makes the JSON writer encode points with fn instead
+// of sds011.Point.MarshalJSON, like to add fields to what it returns.
+// The object fn returns must start with the timestamp, as
+// MarshalJSON's does, for WithTimestampFormat to apply to it, and
+// the fields of the other options are added after all of its.
+func WithJSONMarshal(fn func(point sds011.Point) ([]byte, error)) Option {
+	return func(c *config) {
+		c.marshal = fn
+	}
+}
+
+// WithJSONHeader makes the JSON writer start with what fn returns,
+// every value encoded as a line of its own, like metadata about the
+// points that follow. It is called when the first point is written.
+// The Reader skips such lines if they have no timestamp field, but a
+// metadata one.
+func WithJSONHeader(fn func() []any) Option {
+	return func(c *config) {
+		c.jsonHeader = fn
+	}
+}
+
+// WithMissing makes the CSV and TSV writers write placeholder, like
+// NaN, for the values that missing points don't have (see
+// sds011.Point.Missing), instead of leaving them empty. The JSON
+// writer always makes them null.
+func WithMissing(placeholder string) Option {
+	return func(c *config) {
+		c.missing = placeholder
+	}
+}
+
+// WithDelimiter makes the writer separate values with r, like ';',
+// instead of its default delimiter. Values containing it are quoted.
+func WithDelimiter(r rune) Option {
+	return func(c *config) {
+		c.delimiter = r
+	}
+}
+
+// WithUnixTimestamps makes the writer write timestamps as seconds
+// since the epoch, instead of in RFC 3339 format. It's the same as
+// WithTimestampFormat("unix").
+func WithUnixTimestamps() Option {
+	return WithTimestampFormat("unix")
+}
+
+// WithTimestampFormat makes the writer write timestamps in format,
+// instead of in RFC 3339 format: "unix" or "unixmilli" for seconds or
+// milliseconds since the epoch, or else a layout for time.Time.Format,
+// like time.RFC3339Nano or "2006-01-02 15:04:05". The JSON writer
+// writes the numbers of seconds or milliseconds as numbers, and the
+// formatted time as a string. The InfluxDB writer ignores it.
+func WithTimestampFormat(format string) Option {
+	return func(c *config) {
+		c.timestamp = format
+	}
+}
+
+// formatTimestamp returns t in the format the config says, and whether
+// it's a number.
+func (cfg config) formatTimestamp(t time.Time) (s string, number bool) {
+	switch cfg.timestamp {
+	case "":
+		return t.Format(time.RFC3339), false
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10), true
+	case "unixmilli":
+		return strconv.FormatInt(t.UnixMilli(), 10), true
+	}
+	return t.Format(cfg.timestamp), false
+}
+
+// WithColumnFunc adds a column named name after all the others,
+// holding what fn returns for a point, like the port of the sensor
+// that took it. The JSON writer adds it as a string, and the InfluxDB
+// writer as a tag.
+func WithColumnFunc(name string, fn func(point sds011.Point) string) Option {
+	return func(c *config) {
+		c.funcs = append(c.funcs, columnFunc{name, fn})
+	}
+}
+
+// WithAQI makes the AQI column hold the index and category fn returns
+// for a point, instead of the US EPA ones, like for the European CAQI.
+// It doesn't add the column.
+func WithAQI(fn func(point sds011.Point) (index int, category string)) Option {
+	return func(c *config) {
+		c.aqi = fn
+	}
+}
+
+// airQuality returns the index and category of point for the AQI
+// column.
+func (cfg config) airQuality(point sds011.Point) (int, string) {
+	if cfg.aqi != nil {
+		return cfg.aqi(point)
+	}
+	result := aqi.FromPoint(point)
+	return result.Index, result.Category.String()
+}
+
+// WithColumns adds the given columns, after the timestamp, PM2.5 and
+// PM10 ones, which are always there.
+func WithColumns(columns ...Column) Option {
+	return func(c *config) {
+		for _, col := range columns {
+			c.columns |= col
+		}
+	}
+}
+
+// csvWriter writes points as delimited rows.
+type csvWriter struct {
+	mu     sync.Mutex
+	w      *csv.Writer
+	cfg    config
+	header bool // set if the header is still to be written
+	fields []string
+}
+
+// NewCSVWriter returns a writer writing points as comma-separated
+// values, quoted as RFC 4180 says. Without options, the rows hold
+// what sds011.Point.MarshalText returns. Every row is written to w
+// as soon as it's complete, so it's fine to pass os.Stdout.
+func NewCSVWriter(w io.Writer, opts ...Option) PointWriter {
+	return newCSVWriter(w, ',', opts)
+}
+
+// NewTSVWriter is like NewCSVWriter, but separates values with tabs.
+func NewTSVWriter(w io.Writer, opts ...Option) PointWriter {
+	return newCSVWriter(w, '\t', opts)
+}
+
+func newCSVWriter(w io.Writer, comma rune, opts []Option) *csvWriter {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.delimiter != 0 {
+		comma = cfg.delimiter
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	return &csvWriter{w: cw, cfg: cfg, header: cfg.header}
+}
+
+func (cw *csvWriter) Write(point sds011.Point) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.header {
+		if err := cw.w.Write(cw.cfg.names()); err != nil {
+			return err
+		}
+		cw.header = false
+	}
+	cw.fields = cw.cfg.row(cw.fields[:0], point)
+	if err := cw.w.Write(cw.fields); err != nil {
+		return err
+	}
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func (cw *csvWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// names returns the names of the columns.
+func (cfg config) names() []string {
+	names := []string{"timestamp", "pm2_5", "pm10"}
+	if cfg.columns&Raw != 0 {
+		names = append(names, "pm2_5_raw", "pm10_raw")
+	}
+	if cfg.columns&DeviceID != 0 {
+		names = append(names, "device_id")
+	}
+	if cfg.columns&AQI != 0 {
+		names = append(names, "aqi", "aqi_category")
+	}
+	switch {
+	case cfg.columns&Spread != 0 && cfg.columns&Extended != 0:
+		names = append(names, "samples")
+	case cfg.columns&Spread != 0:
+		names = append(names, "samples", "pm2_5_stddev", "pm10_stddev")
+	}
+	if cfg.columns&Trigger != 0 {
+		names = append(names, "trigger")
+	}
+	if cfg.columns&Error != 0 {
+		names = append(names, "error")
+	}
+	if cfg.columns&Extended != 0 {
+		names = append(names, "sample_count", "pm2_5_min", "pm2_5_max", "pm2_5_stddev", "pm10_min", "pm10_max", "pm10_stddev")
+	}
+	if cfg.columns&Sensors != 0 {
+		names = append(names, "sensors")
+	}
+	for _, f := range cfg.funcs {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+// row appends the values of the columns for point to fields. Those
+// that missing points don't have are cfg.missing.
+func (cfg config) row(fields []string, point sds011.Point) []string {
+	ts, _ := cfg.formatTimestamp(point.Timestamp)
+	missing := point.Missing != ""
+	value := func(v float64) string {
+		if missing {
+			return cfg.missing
+		}
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	fields = append(fields, ts, value(point.PM25), value(point.PM10))
+	if cfg.columns&Raw != 0 {
+		if missing {
+			fields = append(fields, cfg.missing, cfg.missing)
+		} else {
+			fields = append(fields, strconv.Itoa(int(point.PM25Raw)), strconv.Itoa(int(point.PM10Raw)))
+		}
+	}
+	if cfg.columns&DeviceID != 0 {
+		fields = append(fields, deviceID(point, "%04X"))
+	}
+	if cfg.columns&AQI != 0 {
+		if missing {
+			fields = append(fields, cfg.missing, "")
+		} else {
+			index, category := cfg.airQuality(point)
+			fields = append(fields, strconv.Itoa(index), category)
+		}
+	}
+	switch {
+	case cfg.columns&Spread != 0 && cfg.columns&Extended != 0:
+		fields = append(fields, strconv.Itoa(point.Samples))
+	case cfg.columns&Spread != 0:
+		fields = append(fields, strconv.Itoa(point.Samples), value(point.PM25StdDev), value(point.PM10StdDev))
+	}
+	if cfg.columns&Trigger != 0 {
+		trigger := "schedule"
+		if point.Manual {
+			trigger = "manual"
+		}
+		fields = append(fields, trigger)
+	}
+	if cfg.columns&Error != 0 {
+		fields = append(fields, point.Missing)
+	}
+	if cfg.columns&Extended != 0 {
+		fields = append(fields, strconv.Itoa(max(point.Samples, 1)),
+			value(point.PM25Min), value(point.PM25Max), value(point.PM25StdDev),
+			value(point.PM10Min), value(point.PM10Max), value(point.PM10StdDev))
+	}
+	if cfg.columns&Sensors != 0 {
+		sensors := ""
+		if point.Combined > 0 {
+			sensors = strconv.Itoa(point.Combined)
+		}
+		fields = append(fields, sensors)
+	}
+	for _, f := range cfg.funcs {
+		fields = append(fields, f.fn(point))
+	}
+	return fields
+}
+
+// deviceID returns the device ID of point formatted with format, or
+// sds011.CombinedDeviceID if it's combined.
+func deviceID(point sds011.Point, format string) string {
+	if point.Combined > 0 {
+		return sds011.CombinedDeviceID
+	}
+	return fmt.Sprintf(format, point.DeviceID)
+}
+
+// jsonWriter writes points as JSON lines.
+type jsonWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	cfg    config
+	buf    []byte
+	header bool // set if the header is still to be written
+}
+
+// NewJSONWriter returns a writer writing every point as a JSON object
+// on its own line, encoded as sds011.Point.MarshalJSON does, but with
+// the timestamp formatted as WithTimestampFormat says, the AQI as
+// "aqi" and "aqi_category" and the Extended columns if WithColumns
+// adds them, and the columns of WithColumnFunc, or as WithJSONMarshal
+// says, after the lines of WithJSONHeader. The other options are
+// ignored.
+func NewJSONWriter(w io.Writer, opts ...Option) PointWriter {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &jsonWriter{w: w, cfg: cfg, header: cfg.jsonHeader != nil}
+}
+
+func (jw *jsonWriter) Write(point sds011.Point) error {
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if jw.header {
+		for _, v := range jw.cfg.jsonHeader() {
+			line, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if _, err := jw.w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+		}
+		jw.header = false
+	}
+	marshal := jw.cfg.marshal
+	if marshal == nil {
+		marshal = func(point sds011.Point) ([]byte, error) { return json.Marshal(point) }
+	}
+	b, err := marshal(point)
+	if err != nil {
+		return err
+	}
+	// MarshalJSON starts with the timestamp in RFC 3339 format.
+	prefix := `{"timestamp":"` + point.Timestamp.Format(time.RFC3339) + `"`
+	if rest, ok := bytes.CutPrefix(b, []byte(prefix)); ok && jw.cfg.timestamp != "" {
+		ts, number := jw.cfg.formatTimestamp(point.Timestamp)
+		b = append(jw.buf[:0], `{"timestamp":`...)
+		if !number {
+			quoted, err := json.Marshal(ts)
+			if err != nil {
+				return err
+			}
+			ts = string(quoted)
+		}
+		b = append(append(b, ts...), rest...)
+		jw.buf = b
+	}
+	if jw.cfg.columns&AQI != 0 && point.Missing == "" && len(b) > 0 && b[len(b)-1] == '}' {
+		index, category := jw.cfg.airQuality(point)
+		quoted, err := json.Marshal(category)
+		if err != nil {
+			return err
+		}
+		b = fmt.Appendf(b[:len(b)-1], `,"aqi":%d,"aqi_category":%s}`, index, quoted)
+	}
+	if jw.cfg.columns&Extended != 0 && point.Missing == "" && len(b) > 0 && b[len(b)-1] == '}' {
+		b = append(AppendExtendedJSON(b[:len(b)-1], point), '}')
+	}
+	for _, f := range jw.cfg.funcs {
+		if len(b) == 0 || b[len(b)-1] != '}' {
+			break
+		}
+		name, err := json.Marshal(f.name)
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(f.fn(point))
+		if err != nil {
+			return err
+		}
+		b = fmt.Appendf(b[:len(b)-1], `,%s:%s}`, name, value)
+	}
+	b = append(b, '\n')
+	_, err = jw.w.Write(b)
+	return err
+}
+
+// Flush does nothing, as every point is written right away.
+func (jw *jsonWriter) Flush() error {
+	return nil
+}
+
+// AppendExtendedJSON appends the Extended columns of point to b, the
+// JSON object sds011.Point.MarshalJSON encodes it as without its
+// closing brace, like `,"sample_count":1,"pm2_5_min":12.3`. The
+// deviations are left out if MarshalJSON has them already, for
+// averages of several measurements. Like there, the values have one
+// decimal place, and the deviations two.
+func AppendExtendedJSON(b []byte, point sds011.Point) []byte {
+	b = append(b, `,"sample_count":`...)
+	b = strconv.AppendInt(b, int64(max(point.Samples, 1)), 10)
+	appendValue := func(name string, v float64, prec int) {
+		b = append(b, `,"`...)
+		b = append(b, name...)
+		b = append(b, `":`...)
+		b = strconv.AppendFloat(b, v, 'f', prec, 64)
+	}
+	appendValue("pm2_5_min", point.PM25Min, 1)
+	appendValue("pm2_5_max", point.PM25Max, 1)
+	if point.Samples <= 1 {
+		appendValue("pm2_5_stddev", point.PM25StdDev, 2)
+	}
+	appendValue("pm10_min", point.PM10Min, 1)
+	appendValue("pm10_max", point.PM10Max, 1)
+	if point.Samples <= 1 {
+		appendValue("pm10_stddev", point.PM10StdDev, 2)
+	}
+	return b
+}
+
+// influxWriter writes points in InfluxDB line protocol.
+type influxWriter struct {
+	mu    sync.Mutex
+	w     io.Writer
+	buf   []byte
+	tags  []Tag
+	funcs []columnFunc
+}
+
+// NewInfluxWriter returns a writer writing every point as a line of
+// InfluxDB line protocol, like
+//
+//	particulate,sensor=1a2b pm25=12.30,pm10=20.10 1500000000000000000
+//
+// with the timestamp in nanoseconds, as Telegraf and InfluxDB expect
+// by default. Averages also get a samples field (see
+// sds011.Point.Samples), manual points a trigger=manual tag, and
+// missing points only a missing field with what kind of error made
+// them fail, like missing="timeout". WithTags adds tags, and so does
+// WithColumnFunc; the other options are ignored.
+func NewInfluxWriter(w io.Writer, opts ...Option) PointWriter {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	tags := append([]Tag{{Key: "sensor"}}, cfg.tags...)
+	for _, f := range cfg.funcs {
+		tags = append(tags, Tag{Key: f.name})
+	}
+	return &influxWriter{w: w, tags: tags, funcs: cfg.funcs}
+}
+
+func (iw *influxWriter) Write(point sds011.Point) error {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	iw.tags[0].Value = deviceID(point, "%04x")
+	for i, f := range iw.funcs {
+		iw.tags[len(iw.tags)-len(iw.funcs)+i].Value = f.fn(point)
+	}
+	iw.buf = AppendLine(iw.buf[:0], point, iw.tags)
+	_, err := iw.w.Write(iw.buf)
+	return err
+}
+
+// Flush does nothing, as every point is written right away.
+func (iw *influxWriter) Flush() error {
+	return nil
+}
+
+// AppendLine appends point to b as a line of InfluxDB line protocol,
+// ending with a newline, like NewInfluxWriter writes, but with the
+// given tags, trigger=manual for manual points, and the missing field
+// for missing points. If a key is repeated, the last value wins. Tags
+// with empty values are left out, since InfluxDB doesn't accept them.
+func AppendLine(b []byte, point sds011.Point, tags []Tag) []byte {
+	b = append(b, "particulate"...)
+	for i, tag := range tags {
+		if tag.Value == "" || slices.ContainsFunc(tags[i+1:], func(t Tag) bool { return t.Key == tag.Key }) {
+			continue
+		}
+		if point.Manual && tag.Key == "trigger" {
+			continue
+		}
+		b = append(b, ',')
+		b = appendEscaped(b, tag.Key)
+		b = append(b, '=')
+		b = appendEscaped(b, tag.Value)
+	}
+	if point.Manual {
+		b = append(b, ",trigger=manual"...)
+	}
+	if point.Missing != "" {
+		b = append(b, " missing="...)
+		b = strconv.AppendQuote(b, point.Missing)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, point.Timestamp.UnixNano(), 10)
+		return append(b, '\n')
+	}
+	b = append(b, " pm25="...)
+	b = strconv.AppendFloat(b, point.PM25, 'f', 2, 64)
+	b = append(b, ",pm10="...)
+	b = strconv.AppendFloat(b, point.PM10, 'f', 2, 64)
+	if point.Samples > 0 {
+		b = append(b, ",samples="...)
+		b = strconv.AppendInt(b, int64(point.Samples), 10)
+		b = append(b, 'i')
+	}
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, point.Timestamp.UnixNano(), 10)
+	return append(b, '\n')
+}
+
+// appendEscaped appends s to b, escaping the characters that line
+// protocol gives a meaning to in tag keys and values.
+func appendEscaped(b []byte, s string) []byte {
+	for _, r := range s {
+		switch r {
+		case ',', '=', ' ':
+			b = append(b, '\\')
+		}
+		b = utf8.AppendRune(b, r)
+	}
+	return b
+}
+
+// collectdWriter writes points as PUTVAL commands of collectd's exec
+// plugin.
+type collectdWriter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	buf      []byte
+	host     string
+	interval time.Duration
+}
+
+// NewCollectdWriter returns a writer writing every point as two
+// PUTVAL commands of collectd's exec plugin, one for each of PM2.5 and
+// PM10, like
+//
+//	PUTVAL "kitchen/sds011-1a2b/gauge-pm25" interval=60 1500000000:12.30
+//	PUTVAL "kitchen/sds011-1a2b/gauge-pm10" interval=60 1500000000:20.10
+//
+// with the host and interval WithCollectd sets, the device ID in the
+// plugin instance, so that the values of several sensors don't mix,
+// and the timestamp in seconds. Missing points have U, collectd's
+// unknown value, instead. Every point is written right away, and the
+// other options are ignored.
+func NewCollectdWriter(w io.Writer, opts ...Option) PointWriter {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &collectdWriter{w: w, host: cfg.host, interval: cfg.interval}
+}
+
+func (cw *collectdWriter) Write(point sds011.Point) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.buf = cw.buf[:0]
+	for _, v := range []struct {
+		name  string
+		value float64
+	}{{"pm25", point.PM25}, {"pm10", point.PM10}} {
+		cw.buf = append(cw.buf, `PUTVAL "`...)
+		cw.buf = append(cw.buf, cw.host...)
+		cw.buf = fmt.Appendf(cw.buf, `/sds011-%s/gauge-%s"`, deviceID(point, "%04x"), v.name)
+		if cw.interval > 0 {
+			cw.buf = append(cw.buf, " interval="...)
+			cw.buf = strconv.AppendFloat(cw.buf, cw.interval.Seconds(), 'f', -1, 64)
+		}
+		cw.buf = append(cw.buf, ' ')
+		cw.buf = strconv.AppendInt(cw.buf, point.Timestamp.Unix(), 10)
+		cw.buf = append(cw.buf, ':')
+		if point.Missing != "" {
+			cw.buf = append(cw.buf, 'U')
+		} else {
+			cw.buf = strconv.AppendFloat(cw.buf, v.value, 'f', 2, 64)
+		}
+		cw.buf = append(cw.buf, '\n')
+	}
+	_, err := cw.w.Write(cw.buf)
+	return err
+}
+
+// Flush does nothing, as every point is written right away.
+func (cw *collectdWriter) Flush() error {
+	return nil
+}
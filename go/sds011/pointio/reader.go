@@ -0,0 +1,303 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pointio
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A Reader reads back the points written by the CSV, TSV and JSON
+// writers. It tells which of them wrote its input from the first
+// line, and takes the columns from the header row if there is one, or
+// else expects the timestamp, PM2.5 and PM10 columns first and
+// ignores the rest. Timestamps can be in RFC 3339 format, with or
+// without fractions of a second, or numbers of seconds or
+// milliseconds since the epoch. Header rows after the first, of files
+// put one after another, are skipped, and so are the lines of
+// WithJSONHeader, and JSON lines with a type field, like the daily
+// summaries sds011 writes between the points. Rows whose values are
+// empty or aren't numbers, like the placeholders of WithMissing, are
+// read as missing points, with sds011.Point.Missing set to their
+// error column, or "unknown" if there's none. The columns of
+// WithColumns are read back into the fields of the point they were
+// written from, sample_count into Samples if there's no samples
+// column.
+type Reader struct {
+	r    *bufio.Reader
+	line int // of the last point read
+
+	started bool
+	json    bool
+	csv     *csv.Reader
+	columns map[string]int // by name, for CSV and TSV
+}
+
+// NewReader returns a reader reading points from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next point, or io.EOF when there are no more.
+// Errors about a row say which line it's on.
+func (pr *Reader) Read() (sds011.Point, error) {
+	if !pr.started {
+		if err := pr.start(); err != nil {
+			return sds011.Point{}, err
+		}
+	}
+	if pr.json {
+		return pr.readJSON()
+	}
+	return pr.readCSV()
+}
+
+// start looks at the first line to tell the format, and reads the
+// header row if there is one.
+func (pr *Reader) start() error {
+	pr.started = true
+	first, err := pr.r.Peek(pr.r.Size())
+	if len(first) == 0 {
+		return err
+	}
+	if i := bytes.IndexByte(first, '\n'); i >= 0 {
+		first = first[:i]
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(first), []byte("{")) {
+		pr.json = true
+		return nil
+	}
+	pr.csv = csv.NewReader(pr.r)
+	pr.csv.FieldsPerRecord = -1
+	pr.csv.ReuseRecord = true
+	switch {
+	case bytes.IndexByte(first, '\t') >= 0:
+		pr.csv.Comma = '\t'
+	case bytes.IndexByte(first, ',') < 0 && bytes.IndexByte(first, ';') >= 0:
+		pr.csv.Comma = ';'
+	}
+	pr.columns = map[string]int{"timestamp": 0, "pm2_5": 1, "pm10": 2}
+	if !bytes.HasPrefix(first, []byte("timestamp")) {
+		return nil
+	}
+	header, err := pr.csv.Read()
+	pr.line++
+	if err != nil {
+		return fmt.Errorf("line 1: %w", err)
+	}
+	clear(pr.columns)
+	for i, name := range header {
+		pr.columns[name] = i
+	}
+	for _, name := range []string{"timestamp", "pm2_5", "pm10"} {
+		if _, ok := pr.columns[name]; !ok {
+			return fmt.Errorf("line 1: the header has no %s column", name)
+		}
+	}
+	return nil
+}
+
+// readCSV reads a CSV or TSV row, skipping the header rows of files
+// put one after another.
+func (pr *Reader) readCSV() (sds011.Point, error) {
+	record, err := pr.csv.Read()
+	for err == nil && len(record) > 0 && record[0] == "timestamp" {
+		record, err = pr.csv.Read()
+	}
+	if err != nil {
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			err = perr.Err
+			pr.line = perr.Line
+		}
+		if err == io.EOF {
+			return sds011.Point{}, err
+		}
+		return sds011.Point{}, pr.lineErr(err)
+	}
+	pr.line, _ = pr.csv.FieldPos(0)
+	field := func(name string) string {
+		if i, ok := pr.columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	var point sds011.Point
+	if point.Timestamp, err = parseTimestamp(field("timestamp")); err != nil {
+		return sds011.Point{}, pr.lineErr(err)
+	}
+	pm25, ok25 := parseValue(field("pm2_5"))
+	pm10, ok10 := parseValue(field("pm10"))
+	if kind := field("error"); kind != "" || !ok25 || !ok10 {
+		point.Missing = cmp.Or(kind, "unknown")
+	} else {
+		point.PM25, point.PM10 = pm25, pm10
+		point.PM25Raw, point.PM10Raw = tenths(pm25), tenths(pm10)
+	}
+	if raw, err := strconv.ParseUint(field("pm2_5_raw"), 10, 16); err == nil {
+		point.PM25Raw = uint16(raw)
+	}
+	if raw, err := strconv.ParseUint(field("pm10_raw"), 10, 16); err == nil {
+		point.PM10Raw = uint16(raw)
+	}
+	if id := field("device_id"); id == sds011.CombinedDeviceID {
+		point.Combined, _ = strconv.Atoi(field("sensors"))
+		point.Combined = max(point.Combined, 1)
+	} else if id != "" {
+		v, err := strconv.ParseUint(id, 16, 16)
+		if err != nil {
+			return sds011.Point{}, pr.lineErr(fmt.Errorf("bad device ID %q", id))
+		}
+		point.DeviceID = uint16(v)
+	}
+	point.Samples, _ = strconv.Atoi(cmp.Or(field("samples"), field("sample_count")))
+	point.PM25StdDev, _ = parseValue(field("pm2_5_stddev"))
+	point.PM10StdDev, _ = parseValue(field("pm10_stddev"))
+	point.PM25Min, _ = parseValue(field("pm2_5_min"))
+	point.PM25Max, _ = parseValue(field("pm2_5_max"))
+	point.PM10Min, _ = parseValue(field("pm10_min"))
+	point.PM10Max, _ = parseValue(field("pm10_max"))
+	point.Manual = field("trigger") == "manual"
+	return point, nil
+}
+
+// jsonPoint is what readJSON decodes, more lenient about the timestamp
+// than sds011.Point.UnmarshalJSON.
+type jsonPoint struct {
+	Timestamp json.RawMessage `json:"timestamp"`
+	PM25      *float64        `json:"pm2_5"`
+	PM10      *float64        `json:"pm10"`
+	DeviceID  string          `json:"device_id"`
+	Seq       uint64          `json:"seq"`
+	Samples   int             `json:"samples"`
+	PM25SD    float64         `json:"pm2_5_stddev"`
+	PM10SD    float64         `json:"pm10_stddev"`
+	Trigger   string          `json:"trigger"`
+	Missing   string          `json:"missing"`
+	Sensors   int             `json:"sensors"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Type      string          `json:"type"` // of records that aren't points
+
+	// The Extended columns.
+	SampleCount int     `json:"sample_count"`
+	PM25Min     float64 `json:"pm2_5_min"`
+	PM25Max     float64 `json:"pm2_5_max"`
+	PM10Min     float64 `json:"pm10_min"`
+	PM10Max     float64 `json:"pm10_max"`
+}
+
+// readJSON reads a JSON line, skipping empty ones, those of
+// WithJSONHeader, and those with a type, which aren't points.
+func (pr *Reader) readJSON() (sds011.Point, error) {
+	var j jsonPoint
+	for j.Timestamp == nil {
+		var line []byte
+		for len(bytes.TrimSpace(line)) == 0 {
+			var err error
+			line, err = pr.r.ReadBytes('\n')
+			if len(line) == 0 && err != nil {
+				return sds011.Point{}, err
+			}
+			pr.line++
+		}
+		j = jsonPoint{}
+		if err := json.Unmarshal(line, &j); err != nil {
+			return sds011.Point{}, pr.lineErr(err)
+		}
+		if j.Type != "" {
+			j.Timestamp = nil
+			continue
+		}
+		if j.Metadata == nil {
+			break
+		}
+	}
+	ts := string(j.Timestamp)
+	if unquoted, err := strconv.Unquote(ts); err == nil {
+		ts = unquoted
+	}
+	var point sds011.Point
+	var err error
+	if point.Timestamp, err = parseTimestamp(ts); err != nil {
+		return sds011.Point{}, pr.lineErr(err)
+	}
+	if j.DeviceID == sds011.CombinedDeviceID {
+		point.Combined = max(j.Sensors, 1)
+	} else if j.DeviceID != "" {
+		v, err := strconv.ParseUint(j.DeviceID, 16, 16)
+		if err != nil {
+			return sds011.Point{}, pr.lineErr(fmt.Errorf("bad device ID %q", j.DeviceID))
+		}
+		point.DeviceID = uint16(v)
+	}
+	if j.Missing != "" || j.PM25 == nil || j.PM10 == nil {
+		point.Missing = cmp.Or(j.Missing, "unknown")
+	} else {
+		point.PM25, point.PM10 = *j.PM25, *j.PM10
+		point.PM25Raw, point.PM10Raw = tenths(*j.PM25), tenths(*j.PM10)
+	}
+	point.Seq, point.Samples, point.Manual = j.Seq, cmp.Or(j.Samples, j.SampleCount), j.Trigger == "manual"
+	point.PM25StdDev, point.PM10StdDev = j.PM25SD, j.PM10SD
+	point.PM25Min, point.PM25Max, point.PM10Min, point.PM10Max = j.PM25Min, j.PM25Max, j.PM10Min, j.PM10Max
+	return point, nil
+}
+
+func (pr *Reader) lineErr(err error) error {
+	return fmt.Errorf("line %d: %w", pr.line, err)
+}
+
+// parseTimestamp parses a timestamp in RFC 3339 format, or a number
+// of seconds since the epoch, or of milliseconds if it's too big to be
+// seconds, as those are only 11 digits long until the year 5138.
+func parseTimestamp(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if n >= 1e11 || n <= -1e11 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad timestamp %q: want RFC 3339, or seconds or milliseconds since the epoch", s)
+	}
+	return t, nil
+}
+
+// parseValue parses a concentration, returning false if it's empty or
+// not a number.
+func parseValue(s string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+// tenths returns v in tenths, like the sensor reports it.
+func tenths(v float64) uint16 {
+	return uint16(math.Round(max(v, 0) * 10))
+}
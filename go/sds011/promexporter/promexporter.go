@@ -0,0 +1,428 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package promexporter exports the measurements of an SDS011 sensor
+// as Prometheus metrics.
+package promexporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// descs are the descriptions of the metrics of a collector.
+type descs struct {
+	pm25, pm10, lastRead, samples       *prometheus.Desc
+	reads, readErrors, checksumErrors   *prometheus.Desc
+	uptime, frames, rejected, discarded *prometheus.Desc
+	commands, retries, reconnects       *prometheus.Desc
+	dropped, lastFrame                  *prometheus.Desc
+	awake, workingPeriod, duration      *prometheus.Desc
+	// legacyPM25 and legacyPM10 are the old names of pm25 and pm10,
+	// or nil.
+	legacyPM25, legacyPM10 *prometheus.Desc
+	// aqi and aqiCategory are nil without WithAQI.
+	aqi, aqiCategory *prometheus.Desc
+	// smoothedPM25 and smoothedPM10 are nil without WithSmoothed.
+	smoothedPM25, smoothedPM10 *prometheus.Desc
+	// ratePM25 and ratePM10 are nil without WithRates.
+	ratePM25, ratePM10 *prometheus.Desc
+	// windowPM25 and windowPM10 are the median, the 95th percentile
+	// and the maximum, nil without WithWindowStats.
+	windowPM25, windowPM10 []*prometheus.Desc
+}
+
+// newDescs returns the descriptions of the metrics named with the
+// given namespace, and labeled with device_id, port, the given labels
+// and the variable labels named.
+func newDescs(namespace string, labels prometheus.Labels, legacy, aqi, smoothed, rates, windowed bool) *descs {
+	desc := func(name, help string, variable ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help,
+			append([]string{"device_id", "port"}, variable...), labels)
+	}
+	d := &descs{
+		pm25:           desc("pm25_ugm3", "PM2.5 concentration in μg/m³."),
+		pm10:           desc("pm10_ugm3", "PM10 concentration in μg/m³."),
+		lastRead:       desc("last_read_timestamp_seconds", "When the last measurement was read, in seconds since the epoch."),
+		readErrors:     desc("read_errors_total", "Number of failed reads of measurements, by kind: checksum, timeout, out_of_range, or io for everything else.", "kind"),
+		reads:          desc("reads_total", "Number of reads of measurements, successful or not."),
+		samples:        desc("samples_per_measurement", "Number of samples averaged into the last measurement."),
+		checksumErrors: desc("checksum_errors_total", "Number of measurement frames with bad checksums."),
+		uptime:         desc("laser_on_seconds_total", "Estimated time the sensor's laser has been on, in seconds."),
+		frames:         desc("frames_total", "Number of frames received from the sensor, good or not."),
+		rejected:       desc("frames_rejected_total", "Number of frames rejected, by reason.", "reason"),
+		discarded:      desc("discarded_bytes_total", "Number of bytes skipped when looking for the start of a frame."),
+		commands:       desc("commands_total", "Number of commands sent to the sensor, including retries."),
+		retries:        desc("command_retries_total", "Number of commands sent again after failing."),
+		reconnects:     desc("reconnects_total", "Number of times the port was opened again."),
+		dropped:        desc("dropped_total", "Number of measurements dropped because they weren't read in time, by where they were buffered.", "buffer"),
+		lastFrame:      desc("last_frame_timestamp_seconds", "When the last good frame was received, in seconds since the epoch."),
+		awake:          desc("sensor_awake", "Whether the sensor is awake (1) or asleep (0), as far as the commands sent to it tell."),
+		workingPeriod:  desc("working_period_minutes", "Working period the sensor is set to, in minutes, 0 if it works continuously."),
+		duration:       desc("measurement_duration_seconds", "How long the last measurement took, from waking the sensor up or starting to read it to the last sample."),
+	}
+	if legacy {
+		d.legacyPM25 = desc("pm2_5", "PM2.5 concentration in μg/m³. Deprecated: use "+namespace+"_pm25_ugm3.")
+		d.legacyPM10 = desc("pm10", "PM10 concentration in μg/m³. Deprecated: use "+namespace+"_pm10_ugm3.")
+	}
+	if aqi {
+		d.aqi = desc("aqi", "Air quality index of the latest measurement.")
+		d.aqiCategory = desc("aqi_category", "Category of the air quality index of the latest measurement, which is always 1.", "category")
+	}
+	if smoothed {
+		d.smoothedPM25 = desc("pm25_ugm3_smoothed", "Moving average of the PM2.5 concentration in μg/m³, up to the latest measurement.")
+		d.smoothedPM10 = desc("pm10_ugm3_smoothed", "Moving average of the PM10 concentration in μg/m³, up to the latest measurement.")
+	}
+	if rates {
+		d.ratePM25 = desc("pm25_rate_ugm3_per_min", "Change of the PM2.5 concentration since the measurement before the latest, in μg/m³ per minute.")
+		d.ratePM10 = desc("pm10_rate_ugm3_per_min", "Change of the PM10 concentration since the measurement before the latest, in μg/m³ per minute.")
+	}
+	if windowed {
+		for _, s := range []struct{ suffix, what string }{{"p50", "Median"}, {"p95", "95th percentile"}, {"max", "Maximum"}} {
+			d.windowPM25 = append(d.windowPM25, desc("pm25_ugm3_"+s.suffix, s.what+" of the PM2.5 concentration in μg/m³ over the recent measurements."))
+			d.windowPM10 = append(d.windowPM10, desc("pm10_ugm3_"+s.suffix, s.what+" of the PM10 concentration in μg/m³ over the recent measurements."))
+		}
+	}
+	return d
+}
+
+// A Collector is a prometheus.Collector exporting the latest
+// measurement of a sensor. It doesn't talk to the sensor itself:
+// either pass it the results of reading measurements with Observe and
+// ObserveError, and how long measuring took with ObserveDuration, or
+// let Run read them. Metrics are labeled with the sensor's device ID
+// and the port it's connected to; the measurement gauges are only
+// exported once there is a measurement. The device ID is the one of
+// the latest measurement, and empty before the first one.
+type Collector struct {
+	sensor sds011.Device
+	port   string
+	d      *descs
+	aqi    func(sds011.Point) (index int, category string)
+	smooth func(sds011.Point) (pm25, pm10 float64)
+	rates  func(sds011.Point) (pm25, pm10 float64, ok bool)
+	window func(sds011.Point) (pm25, pm10 sds011.Distribution, ok bool)
+
+	mu             sync.Mutex
+	latest         *sds011.Point
+	reads          uint64
+	readErrors     [len(errorKinds)]uint64
+	checksumErrors uint64
+	duration       time.Duration // of the latest measurement, if known
+}
+
+// errorKinds are the values of the kind label of read_errors_total.
+var errorKinds = [...]string{"checksum", "timeout", "out_of_range", "io"}
+
+// errorKind returns the index in errorKinds of the kind of err.
+func errorKind(err error) int {
+	switch {
+	case errors.Is(err, sds011.ErrChecksum):
+		return 0
+	case errors.Is(err, sds011.ErrTimeout):
+		return 1
+	case errors.Is(err, sds011.ErrOutOfRange):
+		return 2
+	}
+	return 3
+}
+
+// An Option changes the metrics of a collector.
+type Option func(*config)
+
+type config struct {
+	namespace string
+	labels    prometheus.Labels
+	legacy    bool
+	aqi       func(sds011.Point) (index int, category string)
+	smoothed  func(sds011.Point) (pm25, pm10 float64)
+	rates     func(sds011.Point) (pm25, pm10 float64, ok bool)
+	window    func(sds011.Point) (pm25, pm10 sds011.Distribution, ok bool)
+}
+
+// WithNamespace makes the names of the metrics start with namespace
+// and an underscore, instead of "sds011_".
+func WithNamespace(namespace string) Option {
+	return func(c *config) {
+		c.namespace = namespace
+	}
+}
+
+// WithLabels adds labels with constant values to all the metrics, like
+// location="bedroom".
+func WithLabels(labels prometheus.Labels) Option {
+	return func(c *config) {
+		c.labels = labels
+	}
+}
+
+// WithLegacyNames makes the collector also export the PM2.5 and PM10
+// gauges under their old names, sds011_pm2_5 and sds011_pm10, which
+// are going away.
+func WithLegacyNames() Option {
+	return func(c *config) {
+		c.legacy = true
+	}
+}
+
+// WithAQI makes the collector export the air quality index of the
+// latest measurement as aqi, and its category as the label of
+// aqi_category, as fn computes them.
+func WithAQI(fn func(point sds011.Point) (index int, category string)) Option {
+	return func(c *config) {
+		c.aqi = fn
+	}
+}
+
+// WithSmoothed makes the collector export the moving averages of the
+// concentrations up to the latest measurement, as fn computes them, as
+// pm25_ugm3_smoothed and pm10_ugm3_smoothed.
+func WithSmoothed(fn func(point sds011.Point) (pm25, pm10 float64)) Option {
+	return func(c *config) {
+		c.smoothed = fn
+	}
+}
+
+// WithRates makes the collector export the rates of change of the
+// concentrations at the latest measurement, as fn computes them, as
+// pm25_rate_ugm3_per_min and pm10_rate_ugm3_per_min. They are left out
+// while fn returns false.
+func WithRates(fn func(point sds011.Point) (pm25, pm10 float64, ok bool)) Option {
+	return func(c *config) {
+		c.rates = fn
+	}
+}
+
+// WithWindowStats makes the collector export the median, the 95th
+// percentile and the maximum of the concentrations over the recent
+// measurements, up to the latest, as fn computes them, as
+// pm25_ugm3_p50, pm25_ugm3_p95, pm25_ugm3_max and the same for PM10.
+// They are left out while fn returns false.
+func WithWindowStats(fn func(point sds011.Point) (pm25, pm10 sds011.Distribution, ok bool)) Option {
+	return func(c *config) {
+		c.window = fn
+	}
+}
+
+// NewCollector returns a collector for the sensor connected to port.
+// The sensor may be nil for measurements that weren't read from one,
+// like combined ones (see sds011.Point.Combined), which only have the
+// measurement gauges exported.
+func NewCollector(sensor sds011.Device, port string, opts ...Option) *Collector {
+	cfg := config{namespace: "sds011"}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &Collector{
+		sensor: sensor,
+		port:   port,
+		d:      newDescs(cfg.namespace, cfg.labels, cfg.legacy, cfg.aqi != nil, cfg.smoothed != nil, cfg.rates != nil, cfg.window != nil),
+		aqi:    cfg.aqi,
+		smooth: cfg.smoothed,
+		rates:  cfg.rates,
+		window: cfg.window,
+	}
+}
+
+// Observe records a measurement, which counts as one read for every
+// sample it averages.
+func (c *Collector) Observe(point sds011.Point) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latest = &point
+	c.reads += uint64(max(point.Samples, 1))
+}
+
+// ObserveDuration records how long the latest measurement took,
+// including warming the sensor up if it was woken up for it.
+func (c *Collector) ObserveDuration(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.duration = d
+}
+
+// ObserveError records a failure to read a measurement.
+func (c *Collector) ObserveError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reads++
+	c.readErrors[errorKind(err)]++
+	if errors.Is(err, sds011.ErrChecksum) {
+		c.checksumErrors++
+	}
+}
+
+// Run reads measurements from the sensor and observes them, and the
+// errors reading them, until ctx is done or the sensor stops working.
+// Nothing else should read the sensor's measurements meanwhile, as
+// each one goes to only one reader.
+func (c *Collector) Run(ctx context.Context) {
+	for {
+		point, err := c.sensor.GetContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			c.ObserveError(err)
+			if !sds011.Recoverable(err) {
+				return
+			}
+			continue
+		}
+		c.Observe(*point)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.d.pm25
+	ch <- c.d.pm10
+	if c.d.legacyPM25 != nil {
+		ch <- c.d.legacyPM25
+		ch <- c.d.legacyPM10
+	}
+	if c.d.aqi != nil {
+		ch <- c.d.aqi
+		ch <- c.d.aqiCategory
+	}
+	if c.d.smoothedPM25 != nil {
+		ch <- c.d.smoothedPM25
+		ch <- c.d.smoothedPM10
+	}
+	if c.d.ratePM25 != nil {
+		ch <- c.d.ratePM25
+		ch <- c.d.ratePM10
+	}
+	for i := range c.d.windowPM25 {
+		ch <- c.d.windowPM25[i]
+		ch <- c.d.windowPM10[i]
+	}
+	ch <- c.d.lastRead
+	ch <- c.d.readErrors
+	ch <- c.d.reads
+	ch <- c.d.samples
+	ch <- c.d.checksumErrors
+	ch <- c.d.uptime
+	ch <- c.d.frames
+	ch <- c.d.rejected
+	ch <- c.d.discarded
+	ch <- c.d.commands
+	ch <- c.d.retries
+	ch <- c.d.reconnects
+	ch <- c.d.dropped
+	ch <- c.d.lastFrame
+	ch <- c.d.awake
+	ch <- c.d.workingPeriod
+	ch <- c.d.duration
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := ""
+	if c.latest != nil {
+		id = fmt.Sprintf("%04X", c.latest.DeviceID)
+		if c.latest.Combined > 0 {
+			id = sds011.CombinedDeviceID
+		}
+		ch <- prometheus.MustNewConstMetric(c.d.pm25, prometheus.GaugeValue, c.latest.PM25, id, c.port)
+		ch <- prometheus.MustNewConstMetric(c.d.pm10, prometheus.GaugeValue, c.latest.PM10, id, c.port)
+		if c.d.legacyPM25 != nil {
+			ch <- prometheus.MustNewConstMetric(c.d.legacyPM25, prometheus.GaugeValue, c.latest.PM25, id, c.port)
+			ch <- prometheus.MustNewConstMetric(c.d.legacyPM10, prometheus.GaugeValue, c.latest.PM10, id, c.port)
+		}
+		if c.aqi != nil {
+			index, category := c.aqi(*c.latest)
+			ch <- prometheus.MustNewConstMetric(c.d.aqi, prometheus.GaugeValue, float64(index), id, c.port)
+			ch <- prometheus.MustNewConstMetric(c.d.aqiCategory, prometheus.GaugeValue, 1, id, c.port, category)
+		}
+		if c.smooth != nil {
+			pm25, pm10 := c.smooth(*c.latest)
+			ch <- prometheus.MustNewConstMetric(c.d.smoothedPM25, prometheus.GaugeValue, pm25, id, c.port)
+			ch <- prometheus.MustNewConstMetric(c.d.smoothedPM10, prometheus.GaugeValue, pm10, id, c.port)
+		}
+		if c.rates != nil {
+			if pm25, pm10, ok := c.rates(*c.latest); ok {
+				ch <- prometheus.MustNewConstMetric(c.d.ratePM25, prometheus.GaugeValue, pm25, id, c.port)
+				ch <- prometheus.MustNewConstMetric(c.d.ratePM10, prometheus.GaugeValue, pm10, id, c.port)
+			}
+		}
+		if c.window != nil {
+			if pm25, pm10, ok := c.window(*c.latest); ok {
+				for i, v := range []float64{pm25.Median, pm25.P95, pm25.Max} {
+					ch <- prometheus.MustNewConstMetric(c.d.windowPM25[i], prometheus.GaugeValue, v, id, c.port)
+				}
+				for i, v := range []float64{pm10.Median, pm10.P95, pm10.Max} {
+					ch <- prometheus.MustNewConstMetric(c.d.windowPM10[i], prometheus.GaugeValue, v, id, c.port)
+				}
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.d.lastRead, prometheus.GaugeValue, float64(c.latest.Timestamp.UnixNano())/1e9, id, c.port)
+		ch <- prometheus.MustNewConstMetric(c.d.samples, prometheus.GaugeValue, float64(max(c.latest.Samples, 1)), id, c.port)
+	}
+	if c.duration > 0 {
+		ch <- prometheus.MustNewConstMetric(c.d.duration, prometheus.GaugeValue, c.duration.Seconds(), id, c.port)
+	}
+	if c.sensor == nil {
+		return
+	}
+	for i, kind := range errorKinds {
+		ch <- prometheus.MustNewConstMetric(c.d.readErrors, prometheus.CounterValue, float64(c.readErrors[i]), id, c.port, kind)
+	}
+	ch <- prometheus.MustNewConstMetric(c.d.reads, prometheus.CounterValue, float64(c.reads), id, c.port)
+	ch <- prometheus.MustNewConstMetric(c.d.checksumErrors, prometheus.CounterValue, float64(c.checksumErrors), id, c.port)
+	// Only real sensors keep track of their on-time and link.
+	if s, ok := c.sensor.(interface{ Uptime() time.Duration }); ok {
+		ch <- prometheus.MustNewConstMetric(c.d.uptime, prometheus.CounterValue, s.Uptime().Seconds(), id, c.port)
+	}
+	if s, ok := c.sensor.(interface{ Stats() sds011.Stats }); ok {
+		c.collectStats(ch, s.Stats(), id)
+	}
+}
+
+func (c *Collector) collectStats(ch chan<- prometheus.Metric, stats sds011.Stats, id string) {
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), append([]string{id, c.port}, labels...)...)
+	}
+	counter(c.d.frames, stats.Frames)
+	counter(c.d.rejected, stats.BadHeaders, "bad_header")
+	counter(c.d.rejected, stats.BadLengths, "bad_length")
+	counter(c.d.rejected, stats.BadChecksums, "bad_checksum")
+	counter(c.d.discarded, stats.Discarded)
+	counter(c.d.commands, stats.Commands)
+	counter(c.d.retries, stats.Retries)
+	counter(c.d.reconnects, stats.Reconnects)
+	counter(c.d.dropped, stats.DroppedFrames, "sensor")
+	counter(c.d.dropped, stats.DroppedPoints, "stream")
+	if !stats.LastFrame.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.d.lastFrame, prometheus.GaugeValue, float64(stats.LastFrame.UnixNano())/1e9, id, c.port)
+	}
+	if stats.StateKnown {
+		awake := 0.0
+		if stats.Awake {
+			awake = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.d.awake, prometheus.GaugeValue, awake, id, c.port)
+	}
+	if stats.WorkingPeriod >= 0 {
+		ch <- prometheus.MustNewConstMetric(c.d.workingPeriod, prometheus.GaugeValue, float64(stats.WorkingPeriod), id, c.port)
+	}
+}
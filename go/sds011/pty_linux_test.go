@@ -0,0 +1,115 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package sds011_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// newPTYSensor returns a sensor opened with New on a pseudo-terminal
+// with a fake behind it, both closed when the test ends.
+func newPTYSensor(t *testing.T, opts ...sds011.Option) (*sds011.Sensor, *sds011test.PTY) {
+	t.Helper()
+	sensor, pty, err := sds011test.NewPTYSensor(opts...)
+	if err != nil {
+		t.Skipf("no pseudo-terminal: %v", err)
+	}
+	t.Cleanup(func() {
+		sensor.Close()
+		pty.Close()
+	})
+	sensor.SetReadTimeout(2 * time.Second)
+	return sensor, pty
+}
+
+func TestPTYGet(t *testing.T) {
+	sensor, pty := newPTYSensor(t)
+	pty.Fake.SetInterval(time.Hour)
+	for _, v := range []float64{12.3, 0, 999.9} {
+		pty.Fake.Enqueue(v, v/3)
+		pty.Fake.Measure()
+		point, err := sensor.Get()
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if point.PM25Raw != uint16(v*10+0.5) || point.PM10Raw != uint16(v/3*10+0.5) {
+			t.Errorf("Get: got %v, want PM2.5 %v, PM10 %.1f", point, v, v/3)
+		}
+		if point.DeviceID != pty.Fake.DeviceID() {
+			t.Errorf("Get: got device ID %04X, want %04X", point.DeviceID, pty.Fake.DeviceID())
+		}
+	}
+}
+
+func TestPTYQuery(t *testing.T) {
+	sensor, pty := newPTYSensor(t)
+	if err := sensor.MakePassive(); err != nil {
+		t.Fatalf("MakePassive: %v", err)
+	}
+	if pty.Fake.Active() {
+		t.Fatal("the fake is still in active mode")
+	}
+	pty.Fake.Enqueue(42.1, 50.2)
+	point, err := sensor.Query()
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if point.PM25 != 42.1 || point.PM10 != 50.2 {
+		t.Errorf("Query: got %v, want PM2.5 42.1, PM10 50.2", point)
+	}
+}
+
+func TestPTYSleepAwake(t *testing.T) {
+	sensor, pty := newPTYSensor(t, sds011.WithCommandTimeout(200*time.Millisecond))
+	if err := sensor.Sleep(); err != nil {
+		t.Fatalf("Sleep: %v", err)
+	}
+	if pty.Fake.Awake() {
+		t.Error("the fake is awake after Sleep")
+	}
+	// The fake doesn't reply to the query when it's asleep.
+	if awake, err := sensor.State(); awake || err != nil {
+		t.Errorf("State() = %v, %v after Sleep, want false, nil", awake, err)
+	}
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	if !pty.Fake.Awake() {
+		t.Error("the fake is asleep after Awake")
+	}
+	if awake, err := sensor.State(); !awake || err != nil {
+		t.Errorf("State() = %v, %v after Awake, want true, nil", awake, err)
+	}
+	pty.Fake.Measure()
+	if _, err := sensor.Get(); err != nil {
+		t.Errorf("Get after Awake: %v", err)
+	}
+}
+
+func TestPTYUnplugged(t *testing.T) {
+	sensor, pty := newPTYSensor(t)
+	pty.Fake.SetInterval(time.Hour)
+	pty.Close()
+	if _, err := sensor.Get(); err == nil || errors.Is(err, sds011.ErrTimeout) {
+		t.Errorf("Get from a closed terminal: got error %v, want the port failing", err)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// ReconnectPolicy says how a sensor opens its port again after it
+// stops working, for example because the USB adapter was unplugged.
+type ReconnectPolicy struct {
+	// MinBackoff is how long to wait before the first attempt. It
+	// doubles after each failed attempt, up to MaxBackoff. They
+	// default to 1 second and 1 minute. Each wait is given or taken a
+	// random half, though never longer than MaxBackoff, so that
+	// sensors that failed together don't all try again at once.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnReconnect, if not nil, is called every time the port is
+	// opened again, with the error that made the old one fail.
+	OnReconnect func(err error)
+}
+
+// errReopening is why the port is opened again when Reopen asked for
+// it.
+var errReopening = errors.New("reopening asked for")
+
+// settings are the settings that are sent to the sensor again after
+// reconnecting, in case it was power cycled. Nil means that the
+// setting was never changed.
+type settings struct {
+	reportMode    *bool
+	workingPeriod *uint8
+}
+
+// WithAutoReconnect makes the sensor open the port again when reading
+// from it fails, and then restore the reporting mode and working
+// period it was set to. While the port is being reopened, methods
+// wait for as long as their timeouts allow, and then return an error
+// wrapping ErrDisconnected. It only works with sensors created by
+// New.
+func WithAutoReconnect(policy ReconnectPolicy) Option {
+	return func(c *config) error {
+		if policy.MinBackoff < 0 || policy.MaxBackoff < 0 {
+			return errors.New("negative reconnect backoff")
+		}
+		if policy.MinBackoff == 0 {
+			policy.MinBackoff = time.Second
+		}
+		if policy.MaxBackoff == 0 {
+			policy.MaxBackoff = time.Minute
+		}
+		if policy.MaxBackoff < policy.MinBackoff {
+			policy.MaxBackoff = policy.MinBackoff
+		}
+		c.reconnect = &policy
+		return nil
+	}
+}
+
+// WithOnDisconnect makes the sensor call fn as soon as it finds out
+// that its device is gone (see ErrDeviceGone), with an error wrapping
+// it. fn is called from the goroutine reading the port, so it
+// shouldn't take long.
+func WithOnDisconnect(fn func(error)) Option {
+	return func(c *config) error {
+		c.onDisconnect = fn
+		return nil
+	}
+}
+
+// checkGone returns err, or if it means that the device is gone, an
+// error wrapping ErrDeviceGone that the sensor fails with from now
+// on, until it reconnects.
+func (sensor *Sensor) checkGone(err error) error {
+	if !deviceGone(err) {
+		return err
+	}
+	var gone error
+	if sensor.canReconnect() {
+		gone = fmt.Errorf("%w, %w: %w", ErrDeviceGone, ErrDisconnected, err)
+	} else {
+		gone = fmt.Errorf("%w: %w", ErrDeviceGone, err)
+	}
+	if !sensor.gone.CompareAndSwap(nil, &gone) {
+		return *sensor.gone.Load()
+	}
+	sensor.logger.Error("device gone", "error", err)
+	if sensor.onDisconnect != nil {
+		sensor.onDisconnect(gone)
+	}
+	return gone
+}
+
+// goneError returns the error set by checkGone, or nil.
+func (sensor *Sensor) goneError() error {
+	if err := sensor.gone.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Reconnects returns how many times the port was opened again.
+func (sensor *Sensor) Reconnects() uint64 {
+	return sensor.reconnects.Load()
+}
+
+func (sensor *Sensor) canReconnect() bool {
+	return sensor.reconnect != nil && sensor.open != nil && !sensor.isClosed()
+}
+
+// Reopen closes the port and opens it again, as if it had failed, for
+// example to get hold of a device that was plugged in again under the
+// same path. Then the reporting mode and working period are restored.
+// It needs WithAutoReconnect, and waits until the port is open again,
+// or ctx is done.
+func (sensor *Sensor) Reopen(ctx context.Context) error {
+	if !sensor.canReconnect() {
+		return errors.New("reopening the port needs WithAutoReconnect")
+	}
+	sensor.rwcMu.Lock()
+	if sensor.reopened == nil {
+		sensor.reopened = make(chan struct{})
+	}
+	reopened := sensor.reopened
+	sensor.reopening.Store(true)
+	sensor.rwc.Close()
+	sensor.rwcMu.Unlock()
+	select {
+	case <-reopened:
+		return nil
+	case <-sensor.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reopen closes the port, which failed with cause, and keeps trying
+// to open it again. It returns false if the sensor was closed in the
+// meantime.
+func (sensor *Sensor) reopen(cause error) bool {
+	sensor.disconnected.Store(true)
+	defer sensor.disconnected.Store(false)
+	asked := cause == errReopening
+	if asked {
+		sensor.logger.Info("reopening the port")
+	} else {
+		sensor.logger.Warn("port failed, reconnecting", "error", cause)
+	}
+	sensor.port().Close()
+
+	backoff := sensor.reconnect.MinBackoff
+	for {
+		// When asked to, try at once the first time, as the port
+		// didn't fail.
+		wait := min(backoff/2+rand.N(backoff), sensor.reconnect.MaxBackoff)
+		if asked {
+			wait, asked = 0, false
+		}
+		select {
+		case <-time.After(wait):
+		case <-sensor.done:
+			return false
+		}
+		port, err := sensor.open()
+		if err != nil {
+			sensor.logger.Debug("reconnecting failed", "error", err, "backoff", backoff)
+			backoff = min(2*backoff, sensor.reconnect.MaxBackoff)
+			continue
+		}
+
+		sensor.rwcMu.Lock()
+		if sensor.isClosed() {
+			sensor.rwcMu.Unlock()
+			port.Close()
+			return false
+		}
+		sensor.rwc = port
+		sensor.reopening.Store(false)
+		if sensor.reopened != nil {
+			close(sensor.reopened)
+			sensor.reopened = nil
+		}
+		sensor.rwcMu.Unlock()
+
+		sensor.reconnects.Add(1)
+		sensor.gone.Store(nil)
+		sensor.needRestore.Store(true)
+		sensor.logger.Info("reconnected")
+		if sensor.reconnect.OnReconnect != nil {
+			sensor.reconnect.OnReconnect(cause)
+		}
+		return true
+	}
+}
+
+// restoreSettings sends the settings that were changed earlier to the
+// sensor again, if it was reconnected since. It is called with cmdMu
+// held.
+func (sensor *Sensor) restoreSettings() {
+	if !sensor.needRestore.CompareAndSwap(true, false) {
+		return
+	}
+	if active := sensor.restore.reportMode; active != nil {
+		value := reportModeQuery
+		if *active {
+			value = reportModeActive
+		}
+		if _, err := sensor.exchangeLocked(commandReportMode, modeSet, singleValue(value)); err != nil {
+			sensor.logger.Warn("restoring reporting mode failed", "error", err)
+		}
+	}
+	if period := sensor.restore.workingPeriod; period != nil {
+		if _, err := sensor.exchangeLocked(commandWorkingPeriod, modeSet, singleValue(*period)); err != nil {
+			sensor.logger.Warn("restoring working period failed", "error", err)
+		}
+	}
+}
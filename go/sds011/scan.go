@@ -0,0 +1,115 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Discovered is a serial port found by Scan.
+type Discovered struct {
+	Path string
+	// DeviceID and Firmware are those of the sensor connected to
+	// the port. Firmware is zero if the sensor sent measurements,
+	// but didn't answer when asked for it.
+	DeviceID uint16
+	Firmware FirmwareVersion
+	// Err is why the port couldn't be checked for a sensor, for
+	// example because it's busy or the permissions don't allow
+	// opening it. DeviceID and Firmware are zero then.
+	Err error
+}
+
+// scanListen is how long Scan waits for a measurement on each port
+// before asking the sensor for its firmware version.
+const scanListen = 1500 * time.Millisecond
+
+// Scan looks for sensors connected to the serial ports of USB
+// adapters. It opens each port with the given options, waits briefly
+// for a measurement, and then asks the sensor for its firmware
+// version, so it sends a command to any device that sent something
+// that looked like a measurement, and to those that were silent.
+//
+// Scan returns the ports with a sensor, and the ports
+// that couldn't be checked, with Err set. Ports with something else
+// connected are left out. Sensors that are asleep don't answer, so
+// they aren't found.
+func Scan(ctx context.Context, opts ...Option) ([]Discovered, error) {
+	paths, err := serialPorts()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Discovered, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = probe(ctx, path, opts)
+		}()
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var found []Discovered
+	for _, d := range results {
+		if d != nil {
+			found = append(found, *d)
+		}
+	}
+	return found, nil
+}
+
+// probe checks whether there is a sensor connected to the port at
+// path. It returns nil if there isn't.
+func probe(ctx context.Context, path string, opts []Option) *Discovered {
+	opts = append([]Option{WithCommandTimeout(500 * time.Millisecond)}, opts...)
+	sensor, err := New(path, opts...)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &Discovered{Path: path, Err: err}
+	}
+	defer sensor.Close()
+
+	d := &Discovered{Path: path}
+	listenCtx, cancel := context.WithTimeout(ctx, scanListen)
+	point, err := sensor.GetContext(listenCtx)
+	cancel()
+	if err == nil {
+		d.DeviceID = point.DeviceID
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	firmware, ferr := sensor.Firmware()
+	if ferr != nil && err != nil {
+		return nil
+	}
+	if ferr == nil {
+		d.Firmware = firmware
+		if d.DeviceID, err = sensor.DeviceID(); err != nil {
+			return nil
+		}
+	}
+	return d
+}
@@ -18,26 +18,48 @@ package sds011
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	log "github.com/golang/glog"
-	"github.com/jacobsa/go-serial/serial"
 )
 
 type command byte
 type mode byte
 
+// String returns the name of the command.
+func (cmd command) String() string {
+	switch cmd {
+	case commandReportMode:
+		return "report mode"
+	case commandQuery:
+		return "query"
+	case commandDeviceID:
+		return "device ID"
+	case commandWorkState:
+		return "work state"
+	case commandFirmware:
+		return "firmware"
+	case commandWorkingPeriod:
+		return "working period"
+	}
+	return fmt.Sprintf("command %d", byte(cmd))
+}
+
 const (
-	commandReportMode command = 2
-	commandQuery      command = 4
-	commandDeviceID   command = 5
-	commandWorkState  command = 6
-	commandFirmware   command = 7
-	commandCycle      command = 8
+	commandReportMode    command = 2
+	commandQuery         command = 4
+	commandDeviceID      command = 5
+	commandWorkState     command = 6
+	commandFirmware      command = 7
+	commandWorkingPeriod command = 8
 
 	modeGet mode = 0
 	modeSet mode = 1
@@ -65,23 +87,29 @@ func (resp *response) IsReply() bool {
 	return resp.Command == 0xC5
 }
 
-// PM25 returns the sensor's PM2.5 reading. It will panic if this
-// isn't a reply containing the readings.
-func (resp *response) PM25() float64 {
+// PM25 returns the sensor's PM2.5 reading, in tenths of μg/m³. It
+// will panic if this isn't a reply containing the readings.
+func (resp *response) PM25() uint16 {
 	if resp.IsReply() {
 		panic(fmt.Sprintf("access to field that doesn't work with this type of response %#v", resp))
 	}
-	return float64(binary.LittleEndian.Uint16(resp.Data[0:2])) / 10.0
+	return binary.LittleEndian.Uint16(resp.Data[0:2])
 }
 
-// PM10 returns the sensor's PM10 reading. It will panic if this isn't
-// a reply containing the readings.
-func (resp *response) PM10() float64 {
+// PM10 returns the sensor's PM10 reading, in tenths of μg/m³. It will
+// panic if this isn't a reply containing the readings.
+func (resp *response) PM10() uint16 {
 	if resp.IsReply() {
 		panic(fmt.Sprintf("access to field that doesn't work with this type of response %#v", resp))
 	}
 
-	return float64(binary.LittleEndian.Uint16(resp.Data[2:4])) / 10.0
+	return binary.LittleEndian.Uint16(resp.Data[2:4])
+}
+
+// point returns the measurement in the response, taken at ts. It will
+// panic if this is a reply.
+func (resp *response) point(ts time.Time) *Point {
+	return newPoint(resp.PM25(), resp.PM10(), resp.ID(), ts)
 }
 
 func (resp *response) checkMatches(cmd command) {
@@ -90,26 +118,19 @@ func (resp *response) checkMatches(cmd command) {
 	}
 }
 
-// ID returns the response's device ID.
+// ID returns the ID of the device that sent the response. Both
+// measurements and replies carry it. The first byte on the wire is
+// the high byte, so that the ID reads the same as in the datasheet
+// (e.g. 0xA160 for "A1 60").
 func (resp *response) ID() uint16 {
-	if resp.IsReply() {
-		panic(fmt.Sprintf("access to field that doesn't work with this type of response %#v", resp))
-	}
-
-	return binary.LittleEndian.Uint16(resp.Data[4:6])
+	return binary.BigEndian.Uint16(resp.Data[4:6])
 }
 
-// Firmware returns the version of firmware, as a date (yy-mm-dd). It
-// will panic if this is the wrong kind of response.
-func (resp *response) Firmware() string {
+// Firmware returns the version of firmware. It will panic if this is
+// the wrong kind of response.
+func (resp *response) Firmware() FirmwareVersion {
 	resp.checkMatches(commandFirmware)
-	return fmt.Sprintf("%02d-%02d-%02d", resp.Data[1], resp.Data[2], resp.Data[3])
-}
-
-// DeviceID returns the device id. It will panic if this is the
-func (resp *response) DeviceID() string {
-	resp.checkMatches(commandDeviceID)
-	return fmt.Sprintf("%02d%02d", resp.Data[1], resp.Data[2])
+	return FirmwareVersion{Year: resp.Data[1], Month: resp.Data[2], Day: resp.Data[3]}
 }
 
 func (resp *response) ReportMode() byte {
@@ -117,8 +138,8 @@ func (resp *response) ReportMode() byte {
 	return resp.Data[2]
 }
 
-func (resp *response) Cycle() uint8 {
-	resp.checkMatches(commandCycle)
+func (resp *response) WorkingPeriod() uint8 {
+	resp.checkMatches(commandWorkingPeriod)
 	return resp.Data[2]
 }
 
@@ -138,19 +159,19 @@ type request struct {
 	Tail       byte     // 19 always 0xAB
 }
 
-func makeRequest(cmd command, mod mode, value byte) *request {
-	data := [11]byte{}
-	data[0] = value
+// Broadcast is the device ID that addresses every sensor on the line.
+const Broadcast uint16 = 0xFFFF
 
+func makeRequest(cmd command, mod mode, data [11]byte, target uint16) *request {
 	req := &request{
 		Header:     0xAA,
 		SendMarker: 0xB4,
 		Command:    byte(cmd),
 		Mode:       byte(mod),
 		Data:       data,
-		DeviceID:   [2]byte{0xFF, 0xFF},
 		Tail:       0xAB,
 	}
+	binary.BigEndian.PutUint16(req.DeviceID[:], target)
 	checksum := int(req.Command) + int(req.Mode)
 	for _, v := range data {
 		checksum += int(v)
@@ -162,9 +183,12 @@ func makeRequest(cmd command, mod mode, value byte) *request {
 	return req
 }
 
-// IsCorrect returns nil if the responses checksum matches, an error
-// otherwise.
+// IsCorrect returns nil if the response is well formed and its
+// checksum matches, an error otherwise.
 func (resp *response) IsCorrect() error {
+	if resp.Header != 0xAA || resp.Tail != 0xAB || (resp.Command != 0xC0 && resp.Command != 0xC5) {
+		return fmt.Errorf("%w: % x", ErrBadHeader, resp.bytes())
+	}
 
 	var checkSum byte
 	for i := 0; i < 6; i++ {
@@ -172,253 +196,1248 @@ func (resp *response) IsCorrect() error {
 	}
 
 	if checkSum != resp.CheckSum {
-		return fmt.Errorf("bad checksum: %#v", resp)
+		return &ChecksumError{Frame: resp.bytes(), Expected: checkSum, Actual: resp.CheckSum}
 	}
 	return nil
 }
 
-// A Point represents a single reading from the sensor.
-type Point struct {
-	PM25      float64
-	PM10      float64
-	Timestamp time.Time
+// LogValue logs the response as the bytes of the frame.
+func (resp *response) LogValue() slog.Value {
+	return slog.StringValue(fmt.Sprintf("% x", resp.bytes()))
 }
 
-func (point *Point) String() string {
-	return fmt.Sprintf("PM2.5: %v μg/m³ PM10: %v μg/m³", point.PM25, point.PM10)
+// bytes returns the response as it was sent on the wire.
+func (resp *response) bytes() []byte {
+	b := []byte{resp.Header, resp.Command}
+	b = append(b, resp.Data[:]...)
+	return append(b, resp.CheckSum, resp.Tail)
+}
+
+// responseSize is the length of a frame sent by the sensor.
+const responseSize = 10
+
+// automaticTimeout is the data timeout of sensors that weren't given
+// one explicitly (see dataTimeout).
+const automaticTimeout = -1
+
+// readSize is how many bytes are read from the port at once.
+const readSize = 64
+
+// FirmwareVersion is the version of the sensor's firmware, which is
+// the date it was released. Year is counted from 2000.
+type FirmwareVersion struct {
+	Year  uint8
+	Month uint8
+	Day   uint8
+}
+
+// String returns the version as a yy-mm-dd date.
+func (v FirmwareVersion) String() string {
+	return fmt.Sprintf("%02d-%02d-%02d", v.Year, v.Month, v.Day)
 }
 
 // Sensor represents an SDS011 sensor.
+//
+// A Sensor is safe to use from multiple goroutines. Commands are sent
+// one at a time, each waiting for its reply before the next one is
+// sent. Measurements are read independently of that, so a Get waiting
+// for data doesn't hold up a Sleep. If several goroutines call Get,
+// each measurement goes to only one of them.
 type Sensor struct {
-	rwc io.ReadWriteCloser
+	// rwc is the port. It can be replaced when reconnecting, so
+	// access it through port.
+	rwc   io.ReadWriteCloser
+	rwcMu sync.Mutex
+
+	// readLoop sorts the frames it reads into measurements and
+	// replies. Both are closed when reading fails, after readErr is
+	// set.
+	measurements chan frame
+	replies      chan frame
+	readErr      error
+
+	// done is closed by Close.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// cmdMu is held while sending a command and waiting for the
+	// reply. It also guards restore.
+	cmdMu sync.Mutex
+
+	// buf holds bytes that were received, but weren't decoded yet.
+	// It's only used by readLoop.
+	buf []byte
+	// arrivals are the times the bytes in buf were read at, and
+	// consumed and received the positions in the stream of the
+	// start and the end of buf.
+	arrivals           []arrival
+	consumed, received uint64
+	// seq is the sequence number of the last measurement frame.
+	seq uint64
+	// discarded counts bytes dropped from buf when looking for a
+	// frame.
+	discarded atomic.Uint64
+	// frames counts the frames received, checksumErrors,
+	// badHeaders and badLengths those rejected (see Stats).
+	frames         atomic.Uint64
+	checksumErrors atomic.Uint64
+	badHeaders     atomic.Uint64
+	badLengths     atomic.Uint64
+	// commands counts the commands sent, retried those of them
+	// that were sent again.
+	commands atomic.Uint64
+	retried  atomic.Uint64
+	// lastFrame is when the last correct frame was received, in
+	// nanoseconds since the epoch, or 0. lastMeasurement is when
+	// the last measurement was, relative to created, and latency
+	// how long it took to receive the last frame from its first
+	// byte to its last.
+	lastFrame       atomic.Int64
+	lastMeasurement atomic.Int64
+	latency         atomic.Int64
+	created         time.Time
+	// latest holds the raw PM2.5 and PM10 values of the last
+	// measurement received, in bits 16-31 and 0-15, plus 1<<32, or
+	// 0 if there wasn't one.
+	latest atomic.Uint64
+
+	// readTimeout limits how long Get waits for a frame. Zero means
+	// no limit, automaticTimeout one depending on workingPeriod.
+	readTimeout atomic.Int64
+	// commandTimeout is how long we wait for the sensor to answer
+	// a command.
+	commandTimeout time.Duration
+	// workingPeriod is the sensor's working period in minutes plus
+	// one, or 0 if it isn't known.
+	workingPeriod atomic.Int32
+
+	// streamBuffer is the size of the buffers of the channels
+	// returned by Points.
+	streamBuffer int
+	dropPolicy   DropPolicy
+	// droppedFrames counts the measurements dropped because nobody
+	// read them, droppedPoints the points dropped from the
+	// channels returned by Points and Subscribe.
+	droppedFrames atomic.Uint64
+	droppedPoints atomic.Uint64
+
+	// gaps keeps track of the measurements lost between those read
+	// (see Gap).
+	gaps  gapState
+	onGap func(*Gap)
+
+	// onReject is called with the bytes received that were thrown
+	// away (see WithOnReject).
+	onReject func(b []byte, reason error)
+
+	// retries is how many more times a command is sent if there is
+	// no reply, retryBackoff how long to wait before the first of
+	// them.
+	retries      int
+	retryBackoff time.Duration
+
+	logger *slog.Logger
+
+	// open opens the port again. It is nil if the sensor can't
+	// reconnect.
+	open         func() (io.ReadWriteCloser, error)
+	reconnect    *ReconnectPolicy
+	disconnected atomic.Bool
+	reconnects   atomic.Uint64
+	// gone is set when the device went away, to the error the
+	// sensor fails with until it reconnects.
+	gone         atomic.Pointer[error]
+	onDisconnect func(error)
+	// needRestore is set after reconnecting, until the settings in
+	// restore are sent to the sensor again.
+	needRestore atomic.Bool
+	restore     settings
+	// reopening is set by Reopen until the port is opened again, and
+	// reopened, guarded by rwcMu, is then closed.
+	reopening atomic.Bool
+	reopened  chan struct{}
+
+	// deviceID is the ID of the sensor, taken from the first frame
+	// received, plus 1<<16. It is 0 until a frame is received.
+	deviceID atomic.Uint32
+
+	// target is the device ID commands are addressed to. Unless
+	// it's Broadcast, frames from other devices are ignored.
+	target atomic.Uint32
+	// renaming is the ID the sensor is being given by SetDeviceID,
+	// plus 1<<16, or 0. Frames from it are accepted while target
+	// is still the old ID.
+	renaming atomic.Uint32
+
+	trace atomic.Pointer[TraceFunc]
+
+	model Model
+
+	calibration atomic.Pointer[Calibration]
+	// rangeCheck is set if points outside the sensor's range are
+	// errors.
+	rangeCheck bool
+	// stampArrival is set if points are timestamped with when
+	// their frames arrived, rather than when they were read.
+	stampArrival bool
+
+	// autoSleep is how long the sensor may go without Get or Query
+	// being called before it's put to sleep, or 0. wakeWarmup is
+	// how long to warm up after waking it up again.
+	autoSleep  time.Duration
+	wakeWarmup time.Duration
+	// lastUse is when Get or Query was last called, in nanoseconds
+	// since the epoch, and users how many calls are in progress.
+	lastUse atomic.Int64
+	users   atomic.Int32
+	// autoSlept is set while the sensor sleeps because it was idle.
+	// It's only changed with cmdMu held.
+	autoSlept  atomic.Bool
+	autoSleeps atomic.Uint64
+
+	usage usage
+	// stateKnown is set once it's known whether the sensor is awake.
+	stateKnown atomic.Bool
+
+	// sleeping is set when the sensor was put to sleep, and passive
+	// when it was put in query mode.
+	sleeping atomic.Bool
+	passive  atomic.Bool
+	watchdog *watchdog
+
+	broadcast broadcast
+	// cycle is nil unless the sensor is in duty cycle mode.
+	cycle *dutyCycle
+	// usageSaver saves the on-time, or is nil.
+	usageSaver func(time.Duration) error
+}
+
+// frame is a frame received from the sensor, and what was wrong with
+// it, if anything.
+type frame struct {
+	resp response
+	err  error
+	// arrived is when the first byte of the frame was read.
+	arrived time.Time
+	// seq is the sequence number of a measurement frame.
+	seq uint64
+}
+
+// arrival is when the bytes of the stream read from the port, up to
+// end, were read.
+type arrival struct {
+	end uint64
+	t   time.Time
+}
+
+// readLoop reads from the port, and passes the frames it gets to
+// receivers of measurements or replies. Reading in a separate
+// goroutine lets callers give up waiting without losing any bytes.
+//
+// The port is read in chunks of up to readSize bytes, straight into
+// buf, and frames are decoded from there, so that reading doesn't
+// allocate anything.
+func (sensor *Sensor) readLoop() {
+	// What's left in buf after dispatch is always shorter than a
+	// frame, so it can be moved to the start to make room.
+	backing := make([]byte, responseSize+readSize)
+	sensor.buf = backing[:0]
+	for {
+		if cap(sensor.buf)-len(sensor.buf) < readSize {
+			sensor.buf = backing[:copy(backing, sensor.buf)]
+		}
+		end := len(sensor.buf)
+		port := sensor.port()
+		n, err := port.Read(sensor.buf[end : end+readSize])
+		if sensor.isClosed() {
+			// Whatever was read, or went wrong, doesn't matter
+			// anymore.
+			err = ErrClosed
+			n = 0
+		}
+		sensor.buf = sensor.buf[:end+n]
+		if n > 0 {
+			sensor.received += uint64(n)
+			t := time.Now()
+			if tp, ok := port.(timedPort); ok {
+				if at := tp.arrived(); !at.IsZero() {
+					t = at
+				}
+			}
+			sensor.arrivals = append(sensor.arrivals, arrival{end: sensor.received, t: t})
+		}
+		sensor.dispatch()
+		if err != nil {
+			if sensor.reopening.Load() {
+				err = errReopening
+			} else {
+				err = sensor.checkGone(err)
+			}
+			if sensor.canReconnect() && sensor.reopen(err) {
+				continue
+			}
+			sensor.readErr = err
+			close(sensor.measurements)
+			close(sensor.replies)
+			return
+		}
+	}
+}
+
+// dispatch takes the complete frames out of buf, and delivers them.
+// Bytes that can't be the start of a frame, like the tail of a frame
+// that was only partially received, are skipped, so that the sensor
+// recovers from losing alignment on its own.
+func (sensor *Sensor) dispatch() {
+	for {
+		sensor.skipToFrame()
+		if len(sensor.buf) < responseSize {
+			return
+		}
+		if sensor.buf[responseSize-1] != 0xAB {
+			// Not a frame after all, just a byte that looks like
+			// a header, or the start of a frame that was cut
+			// short.
+			sensor.frames.Add(1)
+			if sensor.onReject != nil {
+				sensor.onReject(sensor.buf[:responseSize], sensor.badTail())
+			}
+			if truncated(sensor.buf[:responseSize]) {
+				sensor.badLengths.Add(1)
+				if sensor.buf[1] == 0xC0 {
+					// A measurement lost.
+					sensor.seq++
+					sensor.gaps.lose(sensor.seq, lostResync)
+				}
+			} else {
+				sensor.badHeaders.Add(1)
+			}
+			sensor.discard(1)
+			continue
+		}
+
+		sensor.traceFrame(Received, sensor.buf[:responseSize])
+		f := frame{arrived: sensor.arrivedAt(sensor.consumed)}
+		f.resp, f.err = parseResponse(sensor.buf[:responseSize])
+		completed := sensor.arrivedAt(sensor.consumed + responseSize - 1)
+		sensor.consume(responseSize)
+		sensor.frames.Add(1)
+		if f.err != nil {
+			sensor.logger.Warn("rejected frame", "error", f.err)
+			if sensor.onReject != nil {
+				sensor.onReject(f.resp.bytes(), fmt.Errorf("frame at offset %d: %w", sensor.consumed-responseSize, f.err))
+			}
+			if errors.Is(f.err, ErrChecksum) {
+				sensor.checksumErrors.Add(1)
+			}
+			if !f.resp.IsReply() {
+				sensor.seq++
+				f.seq = sensor.seq
+				if errors.Is(f.err, ErrChecksum) {
+					sensor.gaps.lose(f.seq, lostChecksum)
+				} else {
+					sensor.gaps.lose(f.seq, lostResync)
+				}
+			}
+		} else {
+			if sensor.debugEnabled() {
+				sensor.logger.Debug("received frame", "frame", &f.resp)
+			}
+			if !sensor.accepts(f.resp.ID()) {
+				sensor.logger.Debug("ignoring a frame from another device", "id", fmt.Sprintf("%04X", f.resp.ID()))
+				continue
+			}
+			sensor.deviceID.CompareAndSwap(0, 1<<16|uint32(f.resp.ID()))
+			sensor.lastFrame.Store(time.Now().UnixNano())
+			sensor.latency.Store(int64(completed.Sub(f.arrived)))
+			if !f.resp.IsReply() {
+				sensor.seq++
+				f.seq = sensor.seq
+				sensor.latest.Store(1<<32 | uint64(f.resp.PM25())<<16 | uint64(f.resp.PM10()))
+				sensor.lastMeasurement.Store(int64(time.Since(sensor.created)))
+				sensor.usage.measured()
+			}
+		}
+		if f.resp.IsReply() {
+			sensor.deliver(sensor.replies, f)
+		} else {
+			sensor.deliver(sensor.measurements, f)
+		}
+	}
+}
+
+// truncated returns true if another frame starts inside b, which
+// begins with a frame header but doesn't end with its tail.
+func truncated(b []byte) bool {
+	for i := 1; i < len(b)-1; i++ {
+		if b[i] == 0xAA && (b[i+1] == 0xC0 || b[i+1] == 0xC5) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugEnabled returns true if debug messages are logged. Checking it
+// first saves building the arguments of messages logged for every
+// frame when they would be dropped anyway.
+func (sensor *Sensor) debugEnabled() bool {
+	return sensor.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// accepts returns true if frames from the device with the given ID
+// are meant for this sensor.
+func (sensor *Sensor) accepts(id uint16) bool {
+	target := uint16(sensor.target.Load())
+	return target == Broadcast || id == target || sensor.renaming.Load() == 1<<16|uint32(id)
+}
+
+// deliver sends f to ch without blocking. If ch is full, a frame is
+// dropped: the oldest one waiting in ch if it's a reply, and the one
+// the drop policy says if it's a measurement.
+func (sensor *Sensor) deliver(ch chan frame, f frame) {
+	if ch == sensor.replies {
+		sendNewest(ch, f)
+		return
+	}
+	if offer(ch, f, sensor.dropPolicy) {
+		sensor.droppedFrames.Add(1)
+		sensor.logger.Debug("dropped a frame nobody read")
+	}
+}
+
+// skipToFrame discards bytes from buf up to the first one that could
+// start a frame: 0xAA followed by 0xC0 or 0xC5.
+func (sensor *Sensor) skipToFrame() {
+	for i, b := range sensor.buf {
+		if b != 0xAA {
+			continue
+		}
+		if i+1 == len(sensor.buf) || sensor.buf[i+1] == 0xC0 || sensor.buf[i+1] == 0xC5 {
+			sensor.skip(i)
+			return
+		}
+	}
+	sensor.skip(len(sensor.buf))
+}
+
+// skip discards the first n bytes of buf, which aren't a frame.
+func (sensor *Sensor) skip(n int) {
+	if n > 0 && sensor.onReject != nil {
+		sensor.onReject(sensor.buf[:n], fmt.Errorf("%w at offset %d: %d bytes before a frame header", ErrBadHeader, sensor.consumed, n))
+	}
+	sensor.discard(n)
+}
+
+// badTail returns the reason to reject the frame at the start of buf,
+// which doesn't end with its tail.
+func (sensor *Sensor) badTail() error {
+	b := sensor.buf[:responseSize]
+	for i := 1; i < len(b)-1; i++ {
+		if b[i] == 0xAA && (b[i+1] == 0xC0 || b[i+1] == 0xC5) {
+			return fmt.Errorf("%w at offset %d: cut short by another frame at offset %d", ErrBadHeader, sensor.consumed, sensor.consumed+uint64(i))
+		}
+	}
+	return fmt.Errorf("%w at offset %d: tail %#02x, want 0xab", ErrBadHeader, sensor.consumed+responseSize-1, b[responseSize-1])
+}
+
+// discard drops n bytes from buf.
+func (sensor *Sensor) discard(n int) {
+	if n == 0 {
+		return
+	}
+	if sensor.debugEnabled() {
+		sensor.logger.Debug("discarding bytes", "bytes", fmt.Sprintf("% x", sensor.buf[:n]))
+	}
+	sensor.consume(n)
+	sensor.discarded.Add(uint64(n))
+}
+
+// consume drops n bytes from buf, and the arrival times that were
+// only needed for them.
+func (sensor *Sensor) consume(n int) {
+	sensor.buf = sensor.buf[n:]
+	sensor.consumed += uint64(n)
+	i := 0
+	for i < len(sensor.arrivals) && sensor.arrivals[i].end <= sensor.consumed {
+		i++
+	}
+	sensor.arrivals = append(sensor.arrivals[:0], sensor.arrivals[i:]...)
+}
+
+// arrivedAt returns when the byte at the given position of the stream,
+// which must be in buf, was read.
+func (sensor *Sensor) arrivedAt(pos uint64) time.Time {
+	for _, a := range sensor.arrivals {
+		if a.end > pos {
+			return a.t
+		}
+	}
+	return time.Now()
+}
+
+// Discarded returns the number of bytes that were skipped because
+// they weren't part of a valid frame. A few of them are expected when
+// the port is opened in the middle of a frame; more mean that the
+// link is unreliable.
+func (sensor *Sensor) Discarded() uint64 {
+	return sensor.discarded.Load()
+}
+
+// port returns the port the sensor is currently using.
+func (sensor *Sensor) port() io.ReadWriteCloser {
+	sensor.rwcMu.Lock()
+	defer sensor.rwcMu.Unlock()
+	return sensor.rwc
+}
+
+// isClosed returns true if Close was called.
+func (sensor *Sensor) isClosed() bool {
+	select {
+	case <-sensor.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sensor *Sensor) send(cmd command, mod mode, value byte) error {
+	data := [11]byte{}
+	data[0] = value
+	return sensor.sendData(cmd, mod, data)
 }
 
-func (sensor *Sensor) send(cmd command, mod mode, data byte) error {
+// sendData sends a command with all of its data bytes set.
+func (sensor *Sensor) sendData(cmd command, mod mode, data [11]byte) error {
+	if !sensor.model.supports(cmd) {
+		return fmt.Errorf("%v command: %w by %v", cmd, ErrUnsupported, sensor.model)
+	}
 	b := new(bytes.Buffer)
-	if err := binary.Write(b, binary.LittleEndian, makeRequest(cmd, mod, data)); err != nil {
+	if err := binary.Write(b, binary.LittleEndian, makeRequest(cmd, mod, data, uint16(sensor.target.Load()))); err != nil {
 		return err
 	}
-	log.V(6).Infof("sending bytes: %#v", b.Bytes())
-	_, err := sensor.rwc.Write(b.Bytes())
-	return err
+	sensor.logger.Debug("sending command", "command", cmd, "bytes", fmt.Sprintf("% x", b.Bytes()))
+	if sensor.isClosed() {
+		return ErrClosed
+	}
+	if err := sensor.goneError(); err != nil {
+		return err
+	}
+	if sensor.disconnected.Load() {
+		return ErrDisconnected
+	}
+	if _, err := sensor.port().Write(b.Bytes()); err != nil {
+		return fmt.Errorf("writing: %w", sensor.checkGone(err))
+	}
+	sensor.commands.Add(1)
+	sensor.traceFrame(Sent, b.Bytes())
+	return nil
 }
 
-// receive reads one response from the wire.
-func (sensor *Sensor) receive() (*response, error) {
-	data := new(response)
-	if err := binary.Read(sensor.rwc, binary.LittleEndian, data); err != nil {
-		return nil, err
+// next waits for a frame from ch, which is either measurements or
+// replies. If ctx is done first, it returns ctx.Err().
+func (sensor *Sensor) next(ctx context.Context, ch chan frame) (*frame, error) {
+	select {
+	case f, ok := <-ch:
+		if !ok {
+			return nil, sensor.readError()
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &f, nil
+	case <-sensor.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	if err := data.IsCorrect(); err != nil {
-		return nil, err
+}
+
+// drain drops the frames waiting in ch.
+func (sensor *Sensor) drain(ch chan frame) {
+	for {
+		select {
+		case f, ok := <-ch:
+			if !ok {
+				return
+			}
+			sensor.logger.Debug("dropping stale frame", "frame", &f.resp)
+		default:
+			return
+		}
+	}
+}
+
+// readError returns the error that stopped readLoop, wrapping
+// ErrClosed if the port was closed.
+func (sensor *Sensor) readError() error {
+	if sensor.isClosed() {
+		return ErrClosed
 	}
-	return data, nil
+	err := sensor.readErr
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed) {
+		return fmt.Errorf("%w: %w", ErrClosed, err)
+	}
+	return fmt.Errorf("reading: %w", err)
+}
+
+// receiveMeasurement waits for a measurement frame, for no longer
+// than timeout, if it's positive.
+func (sensor *Sensor) receiveMeasurement(ctx context.Context, timeout time.Duration) (*frame, error) {
+	if timeout <= 0 {
+		return sensor.next(ctx, sensor.measurements)
+	}
+	frameCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	data, err := sensor.next(frameCtx, sensor.measurements)
+	if err != nil && ctx.Err() == nil && frameCtx.Err() != nil {
+		return nil, sensor.timeoutError("data timeout: no measurement", timeout)
+	}
+	return data, err
+}
+
+// timeoutError returns the error for waiting for what for timeout in
+// vain. It wraps ErrDisconnected rather than ErrTimeout if the port
+// is being reopened, and the error set by checkGone if the device is
+// gone.
+func (sensor *Sensor) timeoutError(what string, timeout time.Duration) error {
+	if err := sensor.goneError(); err != nil {
+		return fmt.Errorf("%s in %v: %w", what, timeout, err)
+	}
+	if sensor.disconnected.Load() {
+		return fmt.Errorf("%s in %v: %w", what, timeout, ErrDisconnected)
+	}
+	return fmt.Errorf("%s in %v: %w", what, timeout, ErrTimeout)
 }
 
-func (sensor *Sensor) receiveReply() (*response, error) {
-	// FIXME(ryszard): This should support timeouts.
-	for i := 0; i < 10; i++ {
-		resp, err := sensor.receive()
+// receiveReply waits for the sensor's reply to cmd. Replies to other
+// commands are skipped.
+func (sensor *Sensor) receiveReply(cmd command) (*response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sensor.commandTimeout)
+	defer cancel()
+	for {
+		f, err := sensor.next(ctx, sensor.replies)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, sensor.timeoutError(fmt.Sprintf("command timeout: no reply to %v command", cmd), sensor.commandTimeout)
+		}
 		if err != nil {
 			return nil, err
 		}
-		if resp.IsReply() {
+		resp := &f.resp
+		if resp.Data[0] == byte(cmd) {
 			return resp, nil
 		}
-		log.V(6).Infof("received data, but not a reply: %#v", resp)
+		sensor.logger.Debug("skipping reply to another command", "command", cmd, "frame", resp)
 	}
-	return nil, errors.New("no reply")
+}
 
+// exchange sends a command and waits for the reply, sending it again
+// if there is no reply and there are retries left.
+func (sensor *Sensor) exchange(cmd command, mod mode, data [11]byte) (*response, error) {
+	sensor.cmdMu.Lock()
+	defer sensor.cmdMu.Unlock()
+	sensor.restoreSettings()
+	return sensor.exchangeLocked(cmd, mod, data)
+}
+
+// exchangeLocked is exchange for callers holding cmdMu.
+func (sensor *Sensor) exchangeLocked(cmd command, mod mode, data [11]byte) (*response, error) {
+	sensor.drain(sensor.replies)
+	for attempt := 0; ; attempt++ {
+		if err := sensor.sendData(cmd, mod, data); err != nil {
+			return nil, err
+		}
+		reply, err := sensor.receiveReply(cmd)
+		if err == nil {
+			err = acknowledges(reply, cmd, mod, data)
+		}
+		if retryable(err) && attempt < sensor.retries {
+			sensor.logger.Warn("command failed, retrying", "command", cmd, "attempt", attempt+1, "error", err)
+			if !sensor.backOff(attempt) {
+				return nil, ErrClosed
+			}
+			sensor.retried.Add(1)
+			continue
+		}
+		if err != nil && attempt > 0 {
+			return nil, fmt.Errorf("%v command failed after %d attempts: %w", cmd, attempt+1, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sensor.logger.Debug("received reply", "command", cmd, "frame", reply)
+		return reply, nil
+	}
+}
+
+// backOff waits before retrying a command for the attempt+2nd time.
+// It returns false if the sensor was closed in the meantime.
+func (sensor *Sensor) backOff(attempt int) bool {
+	if sensor.retryBackoff <= 0 {
+		return true
+	}
+	d := sensor.retryBackoff << min(attempt, 16)
+	d = d/2 + rand.N(d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-sensor.done:
+		return false
+	}
+}
+
+// retryable returns true if a command that failed with err may work
+// when sent again.
+func retryable(err error) bool {
+	return errors.Is(err, ErrTimeout) || errors.Is(err, ErrChecksum) || errors.Is(err, ErrNotAcknowledged)
+}
+
+// acknowledges returns nil if reply confirms the command: replies to
+// setting a value echo the mode and the new value. Commands with
+// other replies aren't checked here.
+func acknowledges(reply *response, cmd command, mod mode, data [11]byte) error {
+	switch cmd {
+	case commandReportMode, commandWorkState, commandWorkingPeriod:
+	default:
+		return nil
+	}
+	if reply.Data[1] != byte(mod) || (mod == modeSet && reply.Data[2] != data[0]) {
+		return fmt.Errorf("%w: sent %v command with mode %v and value %v, sensor replied with %v", ErrNotAcknowledged, cmd, mod, data[0], reply.LogValue())
+	}
+	return nil
+}
+
+// command is like exchange, for commands carrying a single value.
+func (sensor *Sensor) command(cmd command, mod mode, value byte) (*response, error) {
+	return sensor.exchange(cmd, mod, singleValue(value))
+}
+
+// singleValue returns the data bytes of a command carrying value.
+func singleValue(value byte) [11]byte {
+	data := [11]byte{}
+	data[0] = value
+	return data
 }
 
 // ReportMode returns true if the device is in active mode, false if
 // in query mode.
 func (sensor *Sensor) ReportMode() (bool, error) {
-	if err := sensor.send(commandReportMode, modeGet, 0); err != nil {
-		return false, err
-	}
-	data, err := sensor.receiveReply()
+	data, err := sensor.command(commandReportMode, modeGet, 0)
 	if err != nil {
 		return false, err
 	}
-	log.V(6).Infof("ReportMode response: %#v", data)
+	sensor.passive.Store(data.ReportMode() != reportModeActive)
 	return data.ReportMode() == reportModeActive, nil
 }
 
+// SetReportingMode switches the sensor between active mode, in which
+// it reports measurements continuously, and query mode, in which it
+// only reports a measurement when asked with Query.
+func (sensor *Sensor) SetReportingMode(active bool) error {
+	var err error
+	if active {
+		err = sensor.MakeActive()
+	} else {
+		err = sensor.MakePassive()
+	}
+	if err == nil {
+		sensor.cmdMu.Lock()
+		sensor.restore.reportMode = &active
+		sensor.cmdMu.Unlock()
+	}
+	return err
+}
+
 // MakeActive makes the sensor actively report its measurements.
 func (sensor *Sensor) MakeActive() error {
-	if err := sensor.send(commandReportMode, modeSet, reportModeActive); err != nil {
-		return err
+	_, err := sensor.command(commandReportMode, modeSet, reportModeActive)
+	if err == nil {
+		sensor.passive.Store(false)
 	}
-	data, err := sensor.receiveReply()
-	if err != nil {
-		return err
-	}
-	log.V(6).Infof("MakeActive: %#v", data)
-	return nil
+	return err
 }
 
 // MakePassive stop the sensor from actively reporting its
 // measurements. You will need to send a Query command.
 func (sensor *Sensor) MakePassive() error {
-	log.V(6).Infof("make passive")
-	if err := sensor.send(commandReportMode, modeSet, reportModeQuery); err != nil {
-		return err
+	_, err := sensor.command(commandReportMode, modeSet, reportModeQuery)
+	if err == nil {
+		sensor.passive.Store(true)
 	}
-	data, err := sensor.receiveReply()
+	return err
+}
+
+// DeviceID returns the sensor's device ID. Every frame sent by the
+// sensor carries its ID, so if any frame has been received already
+// this doesn't talk to the sensor. Otherwise, it asks the sensor for
+// its firmware version and takes the ID from the reply.
+func (sensor *Sensor) DeviceID() (uint16, error) {
+	if id := sensor.deviceID.Load(); id != 0 {
+		return uint16(id), nil
+	}
+	data, err := sensor.command(commandFirmware, modeGet, 0)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	log.V(6).Infof("MakePassive response: %#v", data)
-	return nil
+	return data.ID(), nil
 }
 
-// DeviceID returns the sensor's device ID.
-func (sensor *Sensor) DeviceID() (string, error) {
-	if err := sensor.send(commandDeviceID, modeGet, 0); err != nil {
-		return "", err
+// SetDeviceID changes the sensor's device ID. It returns an error if
+// the sensor doesn't confirm the change. 0xFFFF can't be used, as it
+// addresses all devices. If commands are addressed to the sensor (see
+// SetTarget), they are addressed to its new ID afterwards.
+func (sensor *Sensor) SetDeviceID(id uint16) error {
+	if id == Broadcast {
+		return errors.New("device ID: 0xFFFF is reserved")
 	}
-	data, err := sensor.receiveReply()
+	data := [11]byte{}
+	binary.BigEndian.PutUint16(data[9:11], id)
+	// The sensor replies with its new ID.
+	sensor.renaming.Store(1<<16 | uint32(id))
+	defer sensor.renaming.Store(0)
+	reply, err := sensor.exchange(commandDeviceID, modeGet, data)
 	if err != nil {
-		return "", err
+		return err
+	}
+	if reply.ID() != id {
+		return fmt.Errorf("device ID: asked for %04X, sensor replied with %04X", id, reply.ID())
+	}
+	sensor.deviceID.Store(1<<16 | uint32(id))
+	if uint16(sensor.target.Load()) != Broadcast {
+		sensor.target.Store(uint32(id))
 	}
-	log.V(6).Infof("DeviceID: %#v", data)
-	return data.DeviceID(), nil
+	return nil
+}
 
+// SetTarget addresses the commands sent to the sensor to the device
+// with the given ID, and makes the sensor ignore frames sent by other
+// devices, as when several sensors share one line. Broadcast, the
+// default, addresses commands to every device and accepts frames
+// from any of them.
+func (sensor *Sensor) SetTarget(id uint16) {
+	sensor.target.Store(uint32(id))
 }
 
-// Firmware returns the firmware version (a yy-mm-dd date).
-func (sensor *Sensor) Firmware() (string, error) {
-	if err := sensor.send(commandFirmware, modeGet, 0); err != nil {
-		return "", err
-	}
-	data, err := sensor.receiveReply()
+// Target returns the device ID commands are addressed to.
+func (sensor *Sensor) Target() uint16 {
+	return uint16(sensor.target.Load())
+}
+
+// Firmware returns the firmware version. It returns an error if the
+// sensor doesn't answer, which is what happens when it's asleep.
+func (sensor *Sensor) Firmware() (FirmwareVersion, error) {
+	data, err := sensor.command(commandFirmware, modeGet, 0)
 	if err != nil {
-		return "", err
+		return FirmwareVersion{}, err
 	}
-	log.V(6).Infof("Firmare: %#v", data)
 	return data.Firmware(), nil
-
 }
 
-// Cycle returns the current cycle length in minutes. If it's 0 it
-// means that cycle is not set, and the sensor is streaming data
-// continuously.
-func (sensor *Sensor) Cycle() (uint8, error) {
-	if err := sensor.send(commandCycle, modeGet, 0); err != nil {
-		return 0, err
-	}
-	data, err := sensor.receiveReply()
+// WorkingPeriod returns the current working period in minutes. If
+// it's 0 the sensor works continuously, otherwise it sleeps for the
+// given number of minutes, wakes up for 30 seconds, and reports a
+// measurement.
+func (sensor *Sensor) WorkingPeriod() (uint8, error) {
+	data, err := sensor.command(commandWorkingPeriod, modeGet, 0)
 	if err != nil {
 		return 0, err
 	}
-	log.V(6).Infof("Cycle: %#v", data)
-	return data.Cycle(), nil
+	sensor.setWorkingPeriod(data.WorkingPeriod())
+	return data.WorkingPeriod(), nil
 }
 
-// SetCycle sets the cycle length. The value is the cycle's length in
-// minutes, accepting values from 1 to 30. If you pass it 0 it will
-// disable cycle work, and the sensor will just stream data.
-func (sensor *Sensor) SetCycle(value uint8) error {
-	if value < 0 || value > 30 {
-		return fmt.Errorf("duty cycle: bad value %v. Should be between 0 and 30.", value)
+// SetWorkingPeriod sets the working period to the given number of
+// minutes, accepting values from 0 to 30. If you pass it 0 it will
+// disable periodic work, and the sensor will just stream data. It
+// returns an error if the sensor doesn't confirm the new value.
+func (sensor *Sensor) SetWorkingPeriod(minutes uint8) error {
+	if minutes > 30 {
+		return fmt.Errorf("working period: bad value %v, should be between 0 and 30", minutes)
 	}
-	if err := sensor.send(commandCycle, modeSet, value); err != nil {
+	if _, err := sensor.command(commandWorkingPeriod, modeSet, minutes); err != nil {
 		return err
 	}
-	data, err := sensor.receiveReply()
-	if err != nil {
-		return err
-	}
-	log.V(6).Infof("SetCycle: %#v", data)
+	sensor.setWorkingPeriod(minutes)
+	sensor.cmdMu.Lock()
+	sensor.restore.workingPeriod = &minutes
+	sensor.cmdMu.Unlock()
 	return nil
 }
 
-// Query returns one reading.
+// setWorkingPeriod records the working period, logging it if it
+// changed.
+func (sensor *Sensor) setWorkingPeriod(minutes uint8) {
+	if old := sensor.workingPeriod.Swap(int32(minutes) + 1); old != int32(minutes)+1 {
+		sensor.logger.Info("working period", "minutes", minutes, "previous", old-1)
+	}
+	sensor.usage.setPeriodic(minutes > 0)
+}
+
+// Cycle returns the current working period in minutes.
+//
+// Deprecated: Use WorkingPeriod.
+func (sensor *Sensor) Cycle() (uint8, error) {
+	return sensor.WorkingPeriod()
+}
+
+// SetCycle sets the working period in minutes.
+//
+// Deprecated: Use SetWorkingPeriod.
+func (sensor *Sensor) SetCycle(value uint8) error {
+	return sensor.SetWorkingPeriod(value)
+}
+
+// Query asks the sensor for one reading and returns it. It is meant
+// to be used in query mode (see SetReportingMode). It returns an
+// error wrapping ErrTimeout if the sensor doesn't answer within the
+// command timeout (see WithCommandTimeout).
 func (sensor *Sensor) Query() (*Point, error) {
+	defer sensor.use()()
+	end, err := sensor.beginCycle(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	if err := sensor.wakeIfAutoSlept(context.Background()); err != nil {
+		return nil, err
+	}
+	sensor.cmdMu.Lock()
+	defer sensor.cmdMu.Unlock()
+	sensor.restoreSettings()
+	// Make sure that what we return is the answer, not a measurement
+	// that was waiting to be read.
+	sensor.drain(sensor.measurements)
 	if err := sensor.send(commandQuery, modeGet, 0); err != nil {
 		return nil, err
 	}
-	return sensor.Get()
+	// The answer is waited for like the reply to any other command,
+	// not for the read timeout, which may be unlimited: cmdMu is
+	// held, so every other command waits too.
+	ctx, cancel := context.WithTimeout(context.Background(), sensor.commandTimeout)
+	defer cancel()
+	data, err := sensor.next(ctx, sensor.measurements)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, sensor.timeoutError("command timeout: no reply to query command", sensor.commandTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sensor.debugEnabled() {
+		sensor.logger.Debug("received measurement", "frame", &data.resp)
+	}
+	point, _, err := sensor.point(data)
+	return point, err
 }
 
-// IsAwake returns true if the sensor is awake.
-func (sensor *Sensor) IsAwake() (bool, error) {
-	if err := sensor.send(commandWorkState, modeGet, 0); err != nil {
-		return false, err
+// State asks the sensor whether it is awake, without changing its
+// state. A sensor in deep sleep may not reply at all, so if there is
+// no reply in time State reports it as asleep rather than returning
+// ErrTimeout. Other errors, like ErrClosed or ErrDisconnected, are
+// returned as they are.
+func (sensor *Sensor) State() (awake bool, err error) {
+	data, err := sensor.command(commandWorkState, modeGet, 0)
+	if errors.Is(err, ErrTimeout) {
+		sensor.logger.Debug("no reply to work state query, assuming asleep")
+		sensor.setAwake(false, "state query")
+		return false, nil
 	}
-	data, err := sensor.receiveReply()
 	if err != nil {
 		return false, err
 	}
-	log.V(6).Infof("IsAwake WorkState: %#v", data)
+	sensor.setAwake(data.WorkState() == workStateMeasuring, "state query")
 	return data.WorkState() == workStateMeasuring, nil
 }
 
+// IsAwake returns true if the sensor is awake. It's the same as
+// State.
+func (sensor *Sensor) IsAwake() (bool, error) {
+	return sensor.State()
+}
+
 // Awake awakes the sensor if it is in sleep mode.
+//
+// The measurements received before the sensor replied, which may have
+// been taken before it went to sleep, are discarded (see Flush).
 func (sensor *Sensor) Awake() error {
-	if err := sensor.send(commandWorkState, modeSet, workStateMeasuring); err != nil {
+	sensor.cmdMu.Lock()
+	defer sensor.cmdMu.Unlock()
+	sensor.restoreSettings()
+	if _, err := sensor.exchangeLocked(commandWorkState, modeSet, singleValue(workStateMeasuring)); err != nil {
 		return err
 	}
-	data, err := sensor.receiveReply()
-	if err != nil {
-		return err
-	}
-	log.V(6).Infof("Awake WorkState: %#v", data)
+	sensor.setAwake(true, "wake command")
+	sensor.autoSlept.Store(false)
+	sensor.Flush()
 	return nil
 }
 
 // Sleep puts the sensor to sleep.
 func (sensor *Sensor) Sleep() error {
-	if err := sensor.send(commandWorkState, modeSet, workStateSleeping); err != nil {
+	sensor.cmdMu.Lock()
+	defer sensor.cmdMu.Unlock()
+	sensor.restoreSettings()
+	if _, err := sensor.exchangeLocked(commandWorkState, modeSet, singleValue(workStateSleeping)); err != nil {
 		return err
 	}
-	data, err := sensor.receiveReply()
-	if err != nil {
+	sensor.setAwake(false, "sleep command")
+	sensor.autoSlept.Store(false)
+	return nil
+}
+
+// setAwake records whether the sensor is awake, as found out by what
+// says, logging it with args if it changed.
+func (sensor *Sensor) setAwake(awake bool, by string, args ...any) {
+	sensor.usage.setAwake(awake)
+	wasAwake := !sensor.sleeping.Swap(!awake)
+	if !sensor.stateKnown.Swap(true) || wasAwake != awake {
+		sensor.logger.Info("power state", append([]any{"awake", awake, "by", by}, args...)...)
+	}
+}
+
+// Flush discards the measurements that were received but not read
+// yet, so that the next call to Get returns a fresh one. The port is
+// read continuously, so they include everything the sensor sent
+// before Flush was called, except maybe a frame arriving right then.
+func (sensor *Sensor) Flush() {
+	sensor.drain(sensor.measurements)
+}
+
+// WakeAndWarm wakes the sensor up and waits for warmup, so that its
+// fan has time to flush the chamber; readings taken in the first 30
+// seconds or so after waking up aren't reliable. The measurements
+// the sensor sends while warming up are discarded, so the next call
+// to Get returns one taken afterwards. WakeAndWarm returns ctx.Err()
+// if ctx is done before warmup passes.
+func (sensor *Sensor) WakeAndWarm(ctx context.Context, warmup time.Duration) error {
+	if err := sensor.Awake(); err != nil {
 		return err
 	}
-	log.V(6).Infof("WorkState: %#v", data)
-	return nil
+	return sensor.warm(ctx, warmup)
+}
+
+// warm discards the measurements received until warmup passes.
+func (sensor *Sensor) warm(ctx context.Context, warmup time.Duration) error {
+	timer := time.NewTimer(warmup)
+	defer timer.Stop()
+	for {
+		select {
+		case f, ok := <-sensor.measurements:
+			if !ok {
+				return sensor.readError()
+			}
+			sensor.logger.Debug("discarding frame received while warming up", "frame", &f.resp)
+		case <-timer.C:
+			return nil
+		case <-sensor.done:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
 
-// Close closes the underlying serial port.
+// Close closes the underlying serial port. After that, all methods
+// return ErrClosed. Calls waiting for the sensor, like Get or a
+// command waiting for its reply, return ErrClosed right away, even on
+// platforms where closing the port doesn't interrupt reading it. It
+// is safe to call Close more than once.
 func (sensor *Sensor) Close() {
-	sensor.rwc.Close()
+	sensor.closeOnce.Do(func() {
+		close(sensor.done)
+		sensor.port().Close()
+		if sensor.usageSaver != nil {
+			sensor.saveUsage()
+		}
+	})
 }
 
 // New returns a sensor that will read data from serial port for which
-// the path was provided. It is the responsibility of the caller to
-// close the sensor.
-func New(portPath string) (*Sensor, error) {
-	options := serial.OpenOptions{
-		PortName:        portPath,
-		BaudRate:        9600,
-		DataBits:        8,
-		StopBits:        1,
-		MinimumReadSize: 4,
-	}
-
-	port, err := serial.Open(options)
+// the path was provided, like /dev/ttyUSB0, or COM3 on Windows (see
+// OpenSerial and WithOpener). If it's a URL like tcp://host:port
+// instead, New connects to it with NewFromAddr. It is the
+// responsibility of the caller to close the sensor. New returns an
+// error if any of the options is invalid.
+func New(portPath string, opts ...Option) (*Sensor, error) {
+	if isAddr(portPath) {
+		return NewFromAddr(context.Background(), portPath, opts...)
+	}
+	cfg, err := makeConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	open := func() (io.ReadWriteCloser, error) {
+		port, err := cfg.opener(portPath, cfg.baudRate)
+		if err != nil || !cfg.lock {
+			return port, err
+		}
+		if err := lockPort(port, portPath); err != nil {
+			port.Close()
+			return nil, err
+		}
+		return port, nil
+	}
+	port, err := open()
 	if err != nil {
 		return nil, err
 	}
-	return NewSensor(port), nil
+	return newSensor(port, cfg, open), nil
+}
+
+// NewFromPort returns a sensor that talks to the device over port,
+// which can be anything that carries the sensor's byte stream: a
+// serial port, a network connection to a serial bridge, or a pipe in
+// tests. Closing the sensor closes the port. Options that only make
+// sense for serial ports, like WithBaudRate, are ignored. NewFromPort
+// returns an error, and closes port, if any of the options is
+// invalid.
+func NewFromPort(port io.ReadWriteCloser, opts ...Option) (*Sensor, error) {
+	cfg, err := makeConfig(opts)
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+	return newSensor(port, cfg, nil), nil
+}
+
+// newSensor returns a sensor using port. If open isn't nil, it's used
+// to open the port again when reconnecting.
+func newSensor(port io.ReadWriteCloser, cfg config, open func() (io.ReadWriteCloser, error)) *Sensor {
+	if cfg.capture != nil {
+		c := &capture{w: cfg.capture}
+		port = capturedPort{port, c}
+		if reopen := open; reopen != nil {
+			open = func() (io.ReadWriteCloser, error) {
+				port, err := reopen()
+				if err != nil {
+					return nil, err
+				}
+				return capturedPort{port, c}, nil
+			}
+		}
+	}
+	sensor := &Sensor{
+		rwc:            port,
+		open:           open,
+		measurements:   make(chan frame, cfg.measurementBuffer),
+		replies:        make(chan frame, 4),
+		done:           make(chan struct{}),
+		retries:        cfg.retries,
+		retryBackoff:   cfg.retryBackoff,
+		commandTimeout: cfg.commandTimeout,
+		model:          cfg.model,
+		streamBuffer:   cfg.streamBuffer,
+		dropPolicy:     cfg.dropPolicy,
+		logger:         cfg.logger,
+		reconnect:      cfg.reconnect,
+		onDisconnect:   cfg.onDisconnect,
+		onGap:          cfg.onGap,
+		onReject:       cfg.onReject,
+		autoSleep:      cfg.autoSleep,
+		wakeWarmup:     cfg.wakeWarmup,
+		usageSaver:     cfg.saveUsage,
+		rangeCheck:     cfg.rangeCheck,
+		stampArrival:   cfg.timestamps == FrameArrival,
+		created:        time.Now(),
+	}
+	sensor.lastUse.Store(time.Now().UnixNano())
+	sensor.readTimeout.Store(int64(cfg.readTimeout))
+	sensor.target.Store(uint32(cfg.target))
+	sensor.SetTraceFunc(cfg.trace)
+	sensor.calibration.Store(cfg.calibration)
+	if cfg.loadUsage != nil {
+		sensor.loadUsage(cfg.loadUsage)
+		go sensor.saveUsageLoop()
+	}
+	go sensor.readLoop()
+	if sensor.autoSleep > 0 {
+		go sensor.autoSleepLoop()
+	}
+	if cfg.watchdog != nil {
+		sensor.watchdog = cfg.watchdog
+		go sensor.watchdogLoop()
+	}
+	if cfg.dutyCycle != nil {
+		sensor.cycle = &dutyCycle{warmup: *cfg.dutyCycle}
+		if err := sensor.Sleep(); err != nil {
+			sensor.logger.Warn("putting sensor to sleep failed", "error", err)
+		}
+	}
+	return sensor
 }
 
 // NewSensor returns a sensor that will read its data from the provided
 // read-write-closer.
+//
+// Deprecated: Use NewFromPort.
 func NewSensor(rwc io.ReadWriteCloser) *Sensor {
-	return &Sensor{rwc: rwc}
+	sensor, _ := NewFromPort(rwc)
+	return sensor
+}
+
+// SetReadTimeout limits how long Get and GetContext wait for each
+// measurement frame. When it runs out, they return an error
+// wrapping ErrTimeout. A timeout of 0 means waiting forever.
+//
+// By default, the timeout is 2 seconds more than the time between
+// measurements: a second when the sensor streams data, or its
+// working period, if it's known (see SetWorkingPeriod and
+// WorkingPeriod).
+func (sensor *Sensor) SetReadTimeout(timeout time.Duration) {
+	sensor.readTimeout.Store(int64(timeout))
+}
+
+// dataTimeout returns how long to wait for a measurement frame.
+func (sensor *Sensor) dataTimeout() time.Duration {
+	timeout := time.Duration(sensor.readTimeout.Load())
+	if timeout != automaticTimeout {
+		return timeout
+	}
+	period := time.Second
+	if minutes := sensor.workingPeriod.Load(); minutes > 1 {
+		period = time.Duration(minutes-1) * time.Minute
+	}
+	return period + 2*time.Second
 }
 
 // Get will read one measurement. It will block until data is
-// available. It only makes sense to call read if the sensor is in
-// active mode.
+// available, or the read timeout passes. It only makes sense to call
+// read if the sensor is in active mode.
 func (sensor *Sensor) Get() (point *Point, err error) {
-	data, err := sensor.receive()
+	return sensor.GetContext(context.Background())
+}
+
+// GetContext is like Get, but gives up and returns ctx.Err() when ctx
+// is done. A measurement that was only partially received when that
+// happened will be completed by the next call.
+func (sensor *Sensor) GetContext(ctx context.Context) (*Point, error) {
+	point, _, err := sensor.getContext(ctx)
+	return point, err
+}
+
+// getContext is GetContext, also returning the gap before the point,
+// if there was one.
+func (sensor *Sensor) getContext(ctx context.Context) (*Point, *Gap, error) {
+	defer sensor.use()()
+	end, err := sensor.beginCycle(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer end()
+	if err := sensor.wakeIfAutoSlept(ctx); err != nil {
+		return nil, nil, err
+	}
+	if sensor.needRestore.Load() {
+		sensor.cmdMu.Lock()
+		sensor.restoreSettings()
+		sensor.cmdMu.Unlock()
+	}
+	data, err := sensor.receiveMeasurement(ctx, sensor.dataTimeout())
+	if err != nil {
+		return nil, nil, err
+	}
+	if sensor.debugEnabled() {
+		sensor.logger.Debug("received measurement", "frame", &data.resp)
 	}
-	log.V(6).Infof("Query data: %#v", data)
-	return &Point{PM25: data.PM25(), PM10: data.PM10(), Timestamp: time.Now()}, nil
+	return sensor.point(data)
 }
@@ -0,0 +1,877 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011_test
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"github.com/ryszard/sds011/go/sds011/sds011test"
+)
+
+// newSensor returns a sensor connected to a fake, both closed when
+// the test ends.
+func newSensor(t testing.TB, opts ...sds011.Option) (*sds011.Sensor, *sds011test.Fake) {
+	t.Helper()
+	sensor, fake, err := sds011test.NewSensor(opts...)
+	if err != nil {
+		t.Fatalf("NewSensor: %v", err)
+	}
+	t.Cleanup(func() {
+		sensor.Close()
+		fake.Close()
+	})
+	return sensor, fake
+}
+
+func TestGetTimesOutOnSilentPort(t *testing.T) {
+	sensor, fake := newSensor(t)
+	fake.SetAwake(false)
+	sensor.SetReadTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := sensor.Get()
+	if !errors.Is(err, sds011.ErrTimeout) {
+		t.Fatalf("Get on a silent port: got error %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Get gave up after %v, want about 100ms", elapsed)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	sensor, fake := newSensor(b)
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(time.Hour)
+	b.ReportAllocs()
+	for b.Loop() {
+		fake.Measure()
+		if _, err := sensor.Get(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDataTimeoutOption(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithDataTimeout(50*time.Millisecond))
+	fake.SetAwake(false)
+
+	if _, err := sensor.Get(); !errors.Is(err, sds011.ErrTimeout) {
+		t.Fatalf("Get on a silent port: got error %v, want ErrTimeout", err)
+	}
+}
+
+func TestTimeoutIsPerFrame(t *testing.T) {
+	sensor, fake := newSensor(t)
+	sensor.SetReadTimeout(300 * time.Millisecond)
+	fake.SetInterval(time.Hour)
+
+	// A measurement every 100ms keeps every Get well within the
+	// timeout, even though the whole loop takes longer than it.
+	for i := 0; i < 5; i++ {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			fake.Measure()
+		}()
+		if _, err := sensor.Get(); err != nil {
+			t.Fatalf("Get #%d: %v", i, err)
+		}
+	}
+}
+
+func TestTimeoutRecovers(t *testing.T) {
+	sensor, fake := newSensor(t)
+	fake.SetAwake(false)
+	sensor.SetReadTimeout(50 * time.Millisecond)
+	if _, err := sensor.Get(); !errors.Is(err, sds011.ErrTimeout) {
+		t.Fatalf("Get on a silent port: got error %v, want ErrTimeout", err)
+	}
+
+	fake.Enqueue(12.3, 45.6)
+	fake.SetAwake(true)
+	fake.Measure()
+	point, err := sensor.Get()
+	if err != nil {
+		t.Fatalf("Get after the timeout: %v", err)
+	}
+	if point.PM25 != 12.3 || point.PM10 != 45.6 {
+		t.Errorf("Get after the timeout: got %v, want PM2.5 12.3, PM10 45.6", point)
+	}
+}
+
+// rawPort is a port the test writes the sensor's bytes to. Commands
+// sent to it are dropped.
+type rawPort struct {
+	*io.PipeReader
+	w *io.PipeWriter
+}
+
+func newRawPort() *rawPort {
+	r, w := io.Pipe()
+	return &rawPort{r, w}
+}
+
+func (p *rawPort) Write(b []byte) (int, error) { return len(b), nil }
+
+func (p *rawPort) Close() error {
+	p.w.Close()
+	return p.PipeReader.Close()
+}
+
+// measurementFrame returns the frame of a measurement, with the
+// values in tenths of μg/m³.
+func measurementFrame(pm25, pm10 uint16) []byte {
+	f := []byte{0xAA, 0xC0, byte(pm25), byte(pm25 >> 8), byte(pm10), byte(pm10 >> 8), 0xA1, 0x60, 0, 0xAB}
+	for _, b := range f[2:8] {
+		f[8] += b
+	}
+	return f
+}
+
+func TestResynchronizes(t *testing.T) {
+	good := measurementFrame(123, 456)
+	for _, tc := range []struct {
+		name      string
+		stream    []byte
+		discarded uint64
+	}{
+		{"aligned", good, 0},
+		{"leading junk", append([]byte{0x01, 0x02, 0x03}, good...), 3},
+		{"tail of a frame", append(good[4:], good...), 6},
+		{"header byte in junk", append([]byte{0xAA, 0x00, 0xAA}, good...), 3},
+		{"truncated frame", append(good[:6:6], good...), 6},
+		{"missing tail", append(append(good[:9:9], 0x00), good...), 10},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port := newRawPort()
+			sensor, err := sds011.NewFromPort(port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Close()
+			sensor.SetReadTimeout(time.Second)
+			go port.w.Write(tc.stream)
+
+			point, err := sensor.Get()
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if point.PM25Raw != 123 || point.PM10Raw != 456 {
+				t.Errorf("Get: got %v, want PM2.5 12.3, PM10 45.6", point)
+			}
+			if got := sensor.Discarded(); got != tc.discarded {
+				t.Errorf("Discarded() = %d, want %d", got, tc.discarded)
+			}
+		})
+	}
+}
+
+func TestResynchronizesByteByByte(t *testing.T) {
+	port := newRawPort()
+	sensor, err := sds011.NewFromPort(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sensor.Close()
+	sensor.SetReadTimeout(time.Second)
+	stream := append([]byte{0xAB, 0xAA, 0x17}, measurementFrame(10, 20)...)
+	stream = append(stream, measurementFrame(30, 40)...)
+	go func() {
+		for i := range stream {
+			port.w.Write(stream[i : i+1])
+		}
+	}()
+
+	for _, want := range []uint16{10, 30} {
+		point, err := sensor.Get()
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if point.PM25Raw != want {
+			t.Errorf("Get: got PM2.5 %v, want %v", point.PM25Raw, want)
+		}
+	}
+	if got := sensor.Discarded(); got != 3 {
+		t.Errorf("Discarded() = %d, want 3", got)
+	}
+}
+
+func TestRangeCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		pm25, pm10 uint16
+		opts       []sds011.Option
+		err        error
+	}{
+		{"max", 9999, 9999, nil, nil},
+		{"pm2.5 above max", 10000, 9999, nil, sds011.ErrOutOfRange},
+		{"pm10 above max", 9999, 10000, nil, sds011.ErrOutOfRange},
+		{"unchecked", 64255, 10000, []sds011.Option{sds011.WithRangeCheck(false)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port := newRawPort()
+			sensor, err := sds011.NewFromPort(port, tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Close()
+			sensor.SetReadTimeout(time.Second)
+			go port.w.Write(measurementFrame(tc.pm25, tc.pm10))
+
+			point, err := sensor.Get()
+			if tc.err != nil {
+				var re *sds011.RangeError
+				if !errors.Is(err, tc.err) || !errors.As(err, &re) {
+					t.Fatalf("Get: got error %v, want a *RangeError", err)
+				}
+				if re.Point.PM25Raw != tc.pm25 || re.Point.PM10Raw != tc.pm10 {
+					t.Errorf("RangeError holds %+v, want the decoded point", re.Point)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if point.PM25Raw != tc.pm25 || point.PM10Raw != tc.pm10 {
+				t.Errorf("Get: got %+v, want raw values %d and %d", point, tc.pm25, tc.pm10)
+			}
+		})
+	}
+}
+
+func TestRecoversFromChecksumError(t *testing.T) {
+	sensor, fake := newSensor(t)
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(time.Hour)
+	fake.CorruptNext(1)
+	fake.Measure()
+	fake.Measure()
+
+	if _, err := sensor.Get(); !errors.Is(err, sds011.ErrChecksum) {
+		t.Fatalf("Get of a corrupted frame: got error %v, want ErrChecksum", err)
+	}
+	if _, err := sensor.Get(); err != nil {
+		t.Fatalf("Get after a corrupted frame: %v", err)
+	}
+}
+
+// TestConcurrentUse is meant to be run with -race.
+func TestConcurrentUse(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithCommandTimeout(200*time.Millisecond))
+	sensor.SetReadTimeout(200 * time.Millisecond)
+	fake.SetInterval(10 * time.Millisecond)
+
+	// Measurements and replies to queries may not come while the
+	// sensor sleeps, but commands must never see each other's
+	// replies.
+	allowTimeout := func(what string, err error) {
+		if err != nil && !errors.Is(err, sds011.ErrTimeout) {
+			t.Errorf("%s: %v", what, err)
+		}
+	}
+	var wg sync.WaitGroup
+	run := func(fn func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				fn()
+			}
+		}()
+	}
+	run(func() {
+		_, err := sensor.Get()
+		allowTimeout("Get", err)
+	})
+	run(func() {
+		_, err := sensor.Get()
+		allowTimeout("Get", err)
+	})
+	run(func() {
+		_, err := sensor.Query()
+		allowTimeout("Query", err)
+	})
+	run(func() {
+		_, err := sensor.Firmware()
+		allowTimeout("Firmware", err)
+	})
+	run(func() {
+		if _, err := sensor.State(); err != nil {
+			t.Errorf("State: %v", err)
+		}
+	})
+	run(func() {
+		if err := sensor.Sleep(); err != nil {
+			t.Errorf("Sleep: %v", err)
+		}
+		if err := sensor.Awake(); err != nil {
+			t.Errorf("Awake: %v", err)
+		}
+	})
+	run(func() {
+		sensor.Stats()
+		sensor.Discarded()
+	})
+	wg.Wait()
+}
+
+// waitFrames waits until the sensor received n frames.
+func waitFrames(t *testing.T, sensor *sds011.Sensor, n uint64) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for sensor.Stats().Frames < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d frames, want %d", sensor.Stats().Frames, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithCommandTimeout(time.Second))
+	fake.SetInterval(time.Hour)
+	fake.Enqueue(12.3, 45.6)
+
+	point, err := sensor.Query()
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if point.PM25 != 12.3 || point.PM10 != 45.6 {
+		t.Errorf("Query: got %v, want PM2.5 12.3, PM10 45.6", point)
+	}
+}
+
+func TestQueryTimeoutWithoutReadTimeout(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithDataTimeout(0), sds011.WithCommandTimeout(100*time.Millisecond))
+	fake.SetAwake(false)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sensor.Query()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, sds011.ErrTimeout) {
+			t.Errorf("Query without a reply: got error %v, want ErrTimeout", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Query without a reply still waiting after 2s")
+	}
+	// Other commands aren't held up.
+	if err := sensor.Awake(); err != nil {
+		t.Errorf("Awake after Query: %v", err)
+	}
+}
+
+func TestAwakeDiscardsStaleFrames(t *testing.T) {
+	sensor, fake := newSensor(t)
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(time.Hour)
+	for i := 0; i < 3; i++ {
+		fake.Enqueue(1, 1)
+		fake.Measure()
+	}
+	fake.SetAwake(false)
+
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	fake.Enqueue(50, 60)
+	fake.Measure()
+	point, err := sensor.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if point.PM25 != 50 {
+		t.Errorf("Get after Awake: got %v, want the fresh PM2.5 50", point)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	sensor, fake := newSensor(t)
+	sensor.SetReadTimeout(time.Second)
+	fake.SetInterval(time.Hour)
+	for i := 0; i < 3; i++ {
+		fake.Enqueue(1, 1)
+		fake.Measure()
+	}
+	waitFrames(t, sensor, 3)
+
+	sensor.Flush()
+	fake.Enqueue(50, 60)
+	fake.Measure()
+	point, err := sensor.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if point.PM25 != 50 {
+		t.Errorf("Get after Flush: got %v, want the fresh PM2.5 50", point)
+	}
+}
+
+// replyPort is a rawPort answering each command sent to it with what
+// reply returns, if anything.
+type replyPort struct {
+	*rawPort
+	reply func(cmd []byte) []byte
+}
+
+func newReplyPort(reply func(cmd []byte) []byte) *replyPort {
+	return &replyPort{newRawPort(), reply}
+}
+
+func (p *replyPort) Write(b []byte) (int, error) {
+	if r := p.reply(append([]byte(nil), b...)); r != nil {
+		go p.w.Write(r)
+	}
+	return len(b), nil
+}
+
+// replyFrame returns the frame of a reply with the given data bytes.
+func replyFrame(data ...byte) []byte {
+	return replyFrameFrom(0xA160, data...)
+}
+
+// replyFrameFrom returns the frame of a reply with the given data
+// bytes sent by the device with the given ID.
+func replyFrameFrom(id uint16, data ...byte) []byte {
+	f := []byte{0xAA, 0xC5, 0, 0, 0, 0, byte(id >> 8), byte(id), 0, 0xAB}
+	copy(f[2:6], data)
+	for _, b := range f[2:8] {
+		f[8] += b
+	}
+	return f
+}
+
+func TestState(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		state byte
+		awake bool
+	}{
+		{"measuring", 1, true},
+		{"sleeping", 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var sent []byte
+			port := newReplyPort(func(cmd []byte) []byte {
+				sent = cmd
+				return replyFrame(sds011test.CommandWorkState, 0, tc.state)
+			})
+			sensor, err := sds011.NewFromPort(port, sds011.WithCommandTimeout(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Close()
+
+			awake, err := sensor.State()
+			if err != nil {
+				t.Fatalf("State: %v", err)
+			}
+			if awake != tc.awake {
+				t.Errorf("State() = %v, want %v", awake, tc.awake)
+			}
+			// The query form of the command doesn't change the state.
+			if len(sent) != 19 || sent[2] != sds011test.CommandWorkState || sent[3] != 0 {
+				t.Errorf("State sent % x, want a work state query", sent)
+			}
+			if stats := sensor.Stats(); !stats.StateKnown || stats.Awake != tc.awake {
+				t.Errorf("after State, Stats() has StateKnown %v and Awake %v, want true and %v", stats.StateKnown, stats.Awake, tc.awake)
+			}
+		})
+	}
+}
+
+func TestStateWithoutReply(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithCommandTimeout(100*time.Millisecond))
+	fake.SetAwake(false)
+
+	awake, err := sensor.State()
+	if err != nil {
+		t.Fatalf("State of a sensor in deep sleep: %v", err)
+	}
+	if awake {
+		t.Error("State of a sensor in deep sleep: got awake")
+	}
+	if awake, err := sensor.IsAwake(); err != nil || awake {
+		t.Errorf("IsAwake() = %v, %v, want false, nil", awake, err)
+	}
+}
+
+func TestStateFollowsCommands(t *testing.T) {
+	// A sleeping fake doesn't reply to the query.
+	sensor, _ := newSensor(t, sds011.WithCommandTimeout(200*time.Millisecond))
+	for _, awake := range []bool{true, false, true} {
+		var err error
+		if awake {
+			err = sensor.Awake()
+		} else {
+			err = sensor.Sleep()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := sensor.State()
+		if err != nil {
+			t.Fatalf("State: %v", err)
+		}
+		if got != awake {
+			t.Errorf("State() = %v, want %v", got, awake)
+		}
+	}
+}
+
+func TestStateClosed(t *testing.T) {
+	sensor, _ := newSensor(t)
+	sensor.Close()
+	if _, err := sensor.State(); !errors.Is(err, sds011.ErrClosed) {
+		t.Errorf("State of a closed sensor: got error %v, want ErrClosed", err)
+	}
+}
+
+func TestCloseUnblocksGet(t *testing.T) {
+	sensor, fake := newSensor(t)
+	fake.SetAwake(false)
+	sensor.SetReadTimeout(0)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := sensor.Get()
+		errc <- err
+	}()
+	// Give Get time to start waiting.
+	time.Sleep(50 * time.Millisecond)
+	sensor.Close()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, sds011.ErrClosed) {
+			t.Errorf("Get interrupted by Close: got error %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get still waiting a second after Close")
+	}
+}
+
+// blockingPort is a port whose reads never return, even after it's
+// closed, like serial ports on some platforms.
+type blockingPort struct{ closed chan struct{} }
+
+func (p *blockingPort) Read(b []byte) (int, error)  { select {} }
+func (p *blockingPort) Write(b []byte) (int, error) { return len(b), nil }
+func (p *blockingPort) Close() error {
+	close(p.closed)
+	return nil
+}
+
+func TestCloseUnblocksGetOnStuckPort(t *testing.T) {
+	port := &blockingPort{closed: make(chan struct{})}
+	sensor, err := sds011.NewFromPort(port, sds011.WithCommandTimeout(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor.SetReadTimeout(0)
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := sensor.Get()
+		errc <- err
+	}()
+	go func() {
+		_, err := sensor.Firmware()
+		errc <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	sensor.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if !errors.Is(err, sds011.ErrClosed) {
+				t.Errorf("call interrupted by Close: got error %v, want ErrClosed", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("call still waiting a second after Close")
+		}
+	}
+	select {
+	case <-port.closed:
+	default:
+		t.Error("Close didn't close the port")
+	}
+}
+
+func TestCloseIsIdempotent(t *testing.T) {
+	sensor, _ := newSensor(t)
+	sensor.Close()
+	sensor.Close()
+	if _, err := sensor.Get(); !errors.Is(err, sds011.ErrClosed) {
+		t.Errorf("Get after Close: got error %v, want ErrClosed", err)
+	}
+	if err := sensor.Sleep(); !errors.Is(err, sds011.ErrClosed) {
+		t.Errorf("Sleep after Close: got error %v, want ErrClosed", err)
+	}
+}
+
+// ackPort is a port acknowledging the work state commands sent to
+// it, except for the first drop, and replying with the wrong state to
+// the next nak.
+func ackPort(drop, nak int) (port *replyPort, sent *int) {
+	sent = new(int)
+	port = newReplyPort(func(cmd []byte) []byte {
+		*sent++
+		switch {
+		case *sent <= drop:
+			return nil
+		case *sent <= drop+nak:
+			return replyFrame(cmd[2], cmd[3], cmd[4]+1)
+		}
+		return replyFrame(cmd[2], cmd[3], cmd[4])
+	})
+	return port, sent
+}
+
+func TestCommandRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		drop, nak int
+		opts      []sds011.Option
+		sent      int
+		err       error
+	}{
+		{"no retries", 1, 0, nil, 1, sds011.ErrTimeout},
+		{"not acknowledged", 0, 1, nil, 1, sds011.ErrNotAcknowledged},
+		{"retried", 2, 0, []sds011.Option{sds011.WithCommandRetry(3, 0)}, 3, nil},
+		{"retried after nak", 1, 1, []sds011.Option{sds011.WithCommandRetry(3, 0)}, 3, nil},
+		{"out of attempts", 3, 0, []sds011.Option{sds011.WithCommandRetry(3, 0)}, 3, sds011.ErrTimeout},
+		{"WithRetries", 2, 0, []sds011.Option{sds011.WithRetries(2)}, 3, nil},
+		{"WithRetries out of attempts", 2, 0, []sds011.Option{sds011.WithRetries(1)}, 2, sds011.ErrTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port, sent := ackPort(tc.drop, tc.nak)
+			opts := append([]sds011.Option{sds011.WithCommandTimeout(50 * time.Millisecond)}, tc.opts...)
+			sensor, err := sds011.NewFromPort(port, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Close()
+
+			err = sensor.Sleep()
+			if tc.err == nil && err != nil {
+				t.Fatalf("Sleep: %v", err)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Sleep: got error %v, want %v", err, tc.err)
+			}
+			if *sent != tc.sent {
+				t.Errorf("Sleep sent the command %d times, want %d", *sent, tc.sent)
+			}
+			if got := sensor.Stats().Retries; got != uint64(tc.sent-1) {
+				t.Errorf("Stats().Retries = %d, want %d", got, tc.sent-1)
+			}
+		})
+	}
+}
+
+func TestCommandRetryBackoff(t *testing.T) {
+	port, _ := ackPort(2, 0)
+	sensor, err := sds011.NewFromPort(port, sds011.WithCommandTimeout(10*time.Millisecond), sds011.WithCommandRetry(3, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sensor.Close()
+
+	// The first retry waits for between 25 and 75ms, the second twice
+	// as long.
+	start := time.Now()
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 75*time.Millisecond {
+		t.Errorf("Awake with two retries took %v, want at least 75ms of backoff", elapsed)
+	}
+}
+
+func TestCloseStopsRetries(t *testing.T) {
+	port, _ := ackPort(100, 0)
+	sensor, err := sds011.NewFromPort(port, sds011.WithCommandTimeout(10*time.Millisecond), sds011.WithCommandRetry(100, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() { errc <- sensor.Sleep() }()
+	time.Sleep(50 * time.Millisecond)
+	sensor.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, sds011.ErrClosed) {
+			t.Errorf("Sleep interrupted by Close: got error %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sleep still retrying a second after Close")
+	}
+}
+
+func TestRetryOptions(t *testing.T) {
+	for _, opt := range []sds011.Option{
+		sds011.WithRetries(-1),
+		sds011.WithCommandRetry(0, 0),
+		sds011.WithCommandRetry(1, -time.Second),
+	} {
+		if _, err := sds011.NewFromPort(newRawPort(), opt); err == nil {
+			t.Error("NewFromPort with a bad retry option: got nil error")
+		}
+	}
+}
+
+func TestTargetDevice(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithTargetDevice(0xA160), sds011.WithCommandTimeout(time.Second))
+	fake.SetInterval(time.Hour)
+	if got := sensor.Target(); got != 0xA160 {
+		t.Fatalf("Target() = %04x, want a160", got)
+	}
+
+	if err := sensor.Sleep(); err != nil {
+		t.Fatalf("Sleep: %v", err)
+	}
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	if err := sensor.SetWorkingPeriod(5); err != nil {
+		t.Fatalf("SetWorkingPeriod: %v", err)
+	}
+	fake.Enqueue(12.3, 45.6)
+	if _, err := sensor.Query(); err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+
+	want := map[byte]bool{
+		sds011test.CommandWorkState:     true,
+		sds011test.CommandWorkingPeriod: true,
+		sds011test.CommandQuery:         true,
+	}
+	for _, cmd := range fake.Commands() {
+		if cmd.Target != 0xA160 {
+			t.Errorf("command %d addressed to %04x, want a160", cmd.Code, cmd.Target)
+		}
+		delete(want, cmd.Code)
+	}
+	for code := range want {
+		t.Errorf("command %d wasn't sent", code)
+	}
+}
+
+func TestSetTarget(t *testing.T) {
+	sensor, fake := newSensor(t, sds011.WithCommandTimeout(100*time.Millisecond))
+	if got := sensor.Target(); got != sds011.Broadcast {
+		t.Fatalf("Target() = %04x, want broadcast", got)
+	}
+	if err := sensor.Sleep(); err != nil {
+		t.Fatalf("Sleep: %v", err)
+	}
+
+	// The fake ignores commands addressed to another device.
+	sensor.SetTarget(0xBEEF)
+	if err := sensor.Awake(); !errors.Is(err, sds011.ErrTimeout) {
+		t.Errorf("Awake addressed to another device: got error %v, want ErrTimeout", err)
+	}
+	if fake.Awake() {
+		t.Error("the fake woke up on a command addressed to another device")
+	}
+
+	sensor.SetTarget(0xA160)
+	if err := sensor.Awake(); err != nil {
+		t.Fatalf("Awake: %v", err)
+	}
+	cmds := fake.Commands()
+	for i, want := range []uint16{sds011.Broadcast, 0xBEEF, 0xA160} {
+		if cmds[i].Target != want {
+			t.Errorf("command %d addressed to %04x, want %04x", i, cmds[i].Target, want)
+		}
+	}
+}
+
+func TestTargetIgnoresOtherDevices(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		others int // replies from another device
+		right  bool
+		err    error
+	}{
+		{"right device", 0, true, nil},
+		{"other device first", 1, true, nil},
+		{"other devices first", 3, true, nil},
+		{"only other device", 1, false, sds011.ErrTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The other device answers with a different period, which
+			// would make the command fail if it counted.
+			port := newReplyPort(func(cmd []byte) []byte {
+				var r []byte
+				for i := 0; i < tc.others; i++ {
+					r = append(r, replyFrameFrom(0xBEEF, cmd[2], cmd[3], cmd[4]+1)...)
+				}
+				if tc.right {
+					r = append(r, replyFrame(cmd[2], cmd[3], cmd[4])...)
+				}
+				return r
+			})
+			sensor, err := sds011.NewFromPort(port, sds011.WithTargetDevice(0xA160), sds011.WithCommandTimeout(100*time.Millisecond))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sensor.Close()
+
+			err = sensor.SetWorkingPeriod(5)
+			if tc.err == nil && err != nil {
+				t.Fatalf("SetWorkingPeriod: %v", err)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("SetWorkingPeriod: got error %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestTargetIgnoresOtherMeasurements(t *testing.T) {
+	port := newRawPort()
+	sensor, err := sds011.NewFromPort(port, sds011.WithTargetDevice(0xA160))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sensor.Close()
+	sensor.SetReadTimeout(time.Second)
+
+	other := measurementFrame(10, 10)
+	other[6], other[7] = 0xBE, 0xEF
+	other[8] = 0
+	for _, b := range other[2:8] {
+		other[8] += b
+	}
+	go port.w.Write(append(other, measurementFrame(500, 600)...))
+
+	point, err := sensor.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if point.PM25 != 50 || point.PM10 != 60 {
+		t.Errorf("Get: got %v, want the target's PM2.5 50, PM10 60", point)
+	}
+}
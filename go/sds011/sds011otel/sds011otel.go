@@ -0,0 +1,159 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sds011otel exports the measurements of an SDS011 sensor as
+// OpenTelemetry metrics. It only uses the metric API, so the metrics
+// go wherever the meter provider sends them.
+package sds011otel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ryszard/sds011/go/sds011"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Instruments record the measurements of a sensor with a meter. They
+// don't talk to the sensor themselves: either pass them the results
+// of reading measurements with Observe and ObserveError, or let Run
+// read them. The gauges are observed when the meter
+// collects, from the latest measurement, with the sensor's device ID
+// and port as attributes, and those of WithAttributes.
+type Instruments struct {
+	sensor sds011.Device
+	port   string
+	attrs  []attribute.KeyValue
+	reg    metric.Registration
+
+	mu             sync.Mutex
+	latest         *sds011.Point
+	measurements   int64
+	readErrors     int64
+	checksumErrors int64
+}
+
+// An Option changes the metrics of Instruments.
+type Option func(*Instruments)
+
+// WithAttributes adds attributes with constant values to all the
+// metrics, like location=bedroom.
+func WithAttributes(attrs ...attribute.KeyValue) Option {
+	return func(inst *Instruments) {
+		inst.attrs = append(inst.attrs, attrs...)
+	}
+}
+
+// New registers the instruments for the sensor connected to port with
+// meter. Call Close to unregister them.
+func New(meter metric.Meter, sensor sds011.Device, port string, opts ...Option) (*Instruments, error) {
+	pm25, err := meter.Float64ObservableGauge("sds011.pm2_5",
+		metric.WithDescription("PM2.5 concentration."), metric.WithUnit("ug/m3"))
+	if err != nil {
+		return nil, err
+	}
+	pm10, err := meter.Float64ObservableGauge("sds011.pm10",
+		metric.WithDescription("PM10 concentration."), metric.WithUnit("ug/m3"))
+	if err != nil {
+		return nil, err
+	}
+	measurements, err := meter.Int64ObservableCounter("sds011.measurements",
+		metric.WithDescription("Number of measurements read."))
+	if err != nil {
+		return nil, err
+	}
+	readErrors, err := meter.Int64ObservableCounter("sds011.read_errors",
+		metric.WithDescription("Number of failed reads of measurements, including those with bad checksums."))
+	if err != nil {
+		return nil, err
+	}
+	checksumErrors, err := meter.Int64ObservableCounter("sds011.checksum_errors",
+		metric.WithDescription("Number of measurement frames with bad checksums."))
+	if err != nil {
+		return nil, err
+	}
+
+	inst := &Instruments{sensor: sensor, port: port}
+	for _, opt := range opts {
+		opt(inst)
+	}
+	inst.reg, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		inst.mu.Lock()
+		defer inst.mu.Unlock()
+		id := ""
+		if inst.latest != nil {
+			id = fmt.Sprintf("%04X", inst.latest.DeviceID)
+		}
+		attrs := metric.WithAttributes(append([]attribute.KeyValue{attribute.String("device_id", id), attribute.String("port", inst.port)}, inst.attrs...)...)
+		if inst.latest != nil {
+			o.ObserveFloat64(pm25, inst.latest.PM25, attrs)
+			o.ObserveFloat64(pm10, inst.latest.PM10, attrs)
+		}
+		o.ObserveInt64(measurements, inst.measurements, attrs)
+		o.ObserveInt64(readErrors, inst.readErrors, attrs)
+		o.ObserveInt64(checksumErrors, inst.checksumErrors, attrs)
+		return nil
+	}, pm25, pm10, measurements, readErrors, checksumErrors)
+	if err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// Close unregisters the instruments.
+func (inst *Instruments) Close() error {
+	return inst.reg.Unregister()
+}
+
+// Observe records a measurement.
+func (inst *Instruments) Observe(point sds011.Point) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.latest = &point
+	inst.measurements++
+}
+
+// ObserveError records a failure to read a measurement.
+func (inst *Instruments) ObserveError(err error) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	inst.readErrors++
+	if errors.Is(err, sds011.ErrChecksum) {
+		inst.checksumErrors++
+	}
+}
+
+// Run reads measurements from the sensor and observes them, and the
+// errors reading them, until ctx is done or the sensor stops working.
+// Nothing else should read the sensor's measurements meanwhile, as
+// each one goes to only one reader.
+func (inst *Instruments) Run(ctx context.Context) {
+	for {
+		point, err := inst.sensor.GetContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			inst.ObserveError(err)
+			if !sds011.Recoverable(err) {
+				return
+			}
+			continue
+		}
+		inst.Observe(*point)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A Mock is a sds011.Device that returns scripted measurements and
+// errors. Unlike a Fake, it doesn't speak the protocol, so it's meant
+// for testing code using a Device rather than the sds011 package
+// itself. It's safe for concurrent use.
+type Mock struct {
+	mu      sync.Mutex
+	results []result
+	awake   bool
+	period  uint8
+	closed  bool
+
+	// ready is signalled when a result is pushed, done closed by
+	// Close.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+var _ sds011.Device = (*Mock)(nil)
+
+type result struct {
+	point sds011.Point
+	err   error
+}
+
+// NewMock returns a mock that is awake and has nothing to return yet.
+func NewMock() *Mock {
+	return &Mock{
+		awake: true,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// Push makes the mock return point from a future call to Get,
+// GetContext or Query, after the results pushed before it.
+func (m *Mock) Push(point sds011.Point) {
+	m.push(result{point: point})
+}
+
+// PushError makes the mock return err instead of a point.
+func (m *Mock) PushError(err error) {
+	m.push(result{err: err})
+}
+
+func (m *Mock) push(r result) {
+	m.mu.Lock()
+	m.results = append(m.results, r)
+	m.mu.Unlock()
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the next result, if there is one.
+func (m *Mock) pop() (result, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.results) == 0 {
+		return result{}, false
+	}
+	r := m.results[0]
+	m.results = m.results[1:]
+	if len(m.results) > 0 {
+		// Let other waiting readers know.
+		select {
+		case m.ready <- struct{}{}:
+		default:
+		}
+	}
+	return r, true
+}
+
+func (r result) get() (*sds011.Point, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	point := r.point
+	return &point, nil
+}
+
+// Get returns the next pushed result, waiting for one if there isn't
+// any.
+func (m *Mock) Get() (*sds011.Point, error) {
+	return m.GetContext(context.Background())
+}
+
+// GetContext is like Get, but gives up when ctx is done.
+func (m *Mock) GetContext(ctx context.Context) (*sds011.Point, error) {
+	for {
+		if r, ok := m.pop(); ok {
+			return r.get()
+		}
+		select {
+		case <-m.ready:
+		case <-m.done:
+			return nil, sds011.ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Query returns the next pushed result, or an error wrapping
+// sds011.ErrTimeout if there isn't any.
+func (m *Mock) Query() (*sds011.Point, error) {
+	if m.isClosed() {
+		return nil, sds011.ErrClosed
+	}
+	if r, ok := m.pop(); ok {
+		return r.get()
+	}
+	return nil, fmt.Errorf("no measurement: %w", sds011.ErrTimeout)
+}
+
+// Sleep puts the mock to sleep. That only changes what State returns.
+func (m *Mock) Sleep() error {
+	return m.setAwake(false)
+}
+
+// Awake wakes the mock up.
+func (m *Mock) Awake() error {
+	return m.setAwake(true)
+}
+
+func (m *Mock) setAwake(awake bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return sds011.ErrClosed
+	}
+	m.awake = awake
+	return nil
+}
+
+// State returns true unless the mock was put to sleep.
+func (m *Mock) State() (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false, sds011.ErrClosed
+	}
+	return m.awake, nil
+}
+
+// SetWorkingPeriod records the working period, which WorkingPeriod
+// returns.
+func (m *Mock) SetWorkingPeriod(minutes uint8) error {
+	if minutes > 30 {
+		return fmt.Errorf("working period: bad value %v, should be between 0 and 30", minutes)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return sds011.ErrClosed
+	}
+	m.period = minutes
+	return nil
+}
+
+// WorkingPeriod returns the working period set last.
+func (m *Mock) WorkingPeriod() uint8 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.period
+}
+
+// Close makes all methods return sds011.ErrClosed.
+func (m *Mock) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+}
+
+func (m *Mock) isClosed() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.closed
+}
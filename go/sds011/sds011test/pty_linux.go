@@ -0,0 +1,147 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+
+package sds011test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// A PTY is a fake connected to a pseudo-terminal, so that a sensor
+// can be opened with sds011.New and talk to it through the same serial
+// port code it uses for real hardware. It is only available on Linux.
+type PTY struct {
+	Fake *Fake
+	// Path is the path of the terminal's serial port end, like
+	// /dev/pts/3.
+	Path string
+
+	master, slave *os.File
+}
+
+// NewPTY returns a fake on a new pseudo-terminal. Call Close to stop
+// it.
+func NewPTY() (*PTY, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	path, err := unlockPTY(master)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	// Keep the port end open, so that reading the other one doesn't
+	// fail while no one else has it open, and make it raw, as it
+	// echoes the bytes it receives until then otherwise.
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if err := makeRaw(slave); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, err
+	}
+	pty := &PTY{Fake: New(), Path: path, master: master, slave: slave}
+	go io.Copy(master, pty.Fake)
+	go io.Copy(pty.Fake, master)
+	return pty, nil
+}
+
+// NewPTYSensor returns a fake on a new pseudo-terminal, and a sensor
+// opened with sds011.New on it.
+func NewPTYSensor(opts ...sds011.Option) (*sds011.Sensor, *PTY, error) {
+	pty, err := NewPTY()
+	if err != nil {
+		return nil, nil, err
+	}
+	sensor, err := sds011.New(pty.Path, opts...)
+	if err != nil {
+		pty.Close()
+		return nil, nil, err
+	}
+	return sensor, pty, nil
+}
+
+// Close stops the fake and closes the terminal. A sensor using it
+// gets an error, like when a USB adapter is unplugged.
+func (pty *PTY) Close() error {
+	pty.Fake.Close()
+	pty.slave.Close()
+	return pty.master.Close()
+}
+
+// unlockPTY unlocks the terminal whose master end is master, and
+// returns the path of its slave end.
+func unlockPTY(master *os.File) (string, error) {
+	conn, err := master.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var n uint32
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var unlock int32
+		if _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+			return
+		}
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	})
+	if err != nil {
+		return "", err
+	}
+	if errno != 0 {
+		return "", os.NewSyscallError("ioctl", errno)
+	}
+	return fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// makeRaw turns off all processing of the bytes going through f, a
+// terminal.
+func makeRaw(f *os.File) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if _, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); errno != 0 {
+			return
+		}
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return os.NewSyscallError("ioctl", errno)
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sds011test provides a fake SDS011 sensor, for testing code
+// that uses package sds011 without the hardware.
+//
+// A Fake speaks the sensor's protocol on its side of a port: it
+// answers commands, and streams measurements when it's awake and in
+// active mode. What it measures, and how it misbehaves, can be
+// scripted, and a Simulation makes up plausible readings for it. On
+// Linux, a PTY puts a fake behind a pseudo-terminal, so that code
+// opening real serial ports can be run against it. A Mock is simpler:
+// it's a sds011.Device returning whatever it's given.
+package sds011test
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ryszard/sds011/go/sds011"
+)
+
+// Command codes, as sent in the third byte of a command frame.
+const (
+	CommandReportMode    byte = 2
+	CommandQuery         byte = 4
+	CommandDeviceID      byte = 5
+	CommandWorkState     byte = 6
+	CommandFirmware      byte = 7
+	CommandWorkingPeriod byte = 8
+)
+
+// A Command is a command the fake received.
+type Command struct {
+	Code  byte // one of the Command constants
+	Set   bool // true if the command changes a setting
+	Value byte // the first data byte
+	Data  [11]byte
+	// Target is the device ID the command was addressed to, 0xFFFF
+	// for all devices.
+	Target uint16
+}
+
+// A Fake is a fake SDS011 sensor. It implements io.ReadWriteCloser,
+// which is the sensor's end of the port. Use NewSensor to get a
+// sds011.Sensor connected to it.
+type Fake struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	out    []byte // bytes waiting to be read
+	closed bool
+	done   chan struct{}
+
+	awake    bool
+	active   bool
+	period   uint8
+	id       uint16
+	firmware sds011.FirmwareVersion
+	interval time.Duration
+	ticker   *time.Ticker
+
+	queue   [][2]uint16 // scripted readings, in tenths of μg/m³
+	last    [2]uint16
+	source  func(time.Time) (pm25, pm10 float64)
+	corrupt int
+
+	commands []Command
+	partial  []byte
+}
+
+// New returns a fake sensor that is awake, in active mode, and
+// reports a measurement every second. Call Close to stop it.
+func New() *Fake {
+	fake := &Fake{
+		done:     make(chan struct{}),
+		awake:    true,
+		active:   true,
+		id:       0xA160,
+		firmware: sds011.FirmwareVersion{Year: 15, Month: 7, Day: 10},
+		interval: time.Second,
+	}
+	fake.cond = sync.NewCond(&fake.mu)
+	fake.ticker = time.NewTicker(fake.interval)
+	go fake.stream()
+	return fake
+}
+
+// NewSensor returns a fake and a sensor connected to it.
+func NewSensor(opts ...sds011.Option) (*sds011.Sensor, *Fake, error) {
+	fake := New()
+	sensor, err := sds011.NewFromPort(fake, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sensor, fake, nil
+}
+
+// SetInterval changes how often the fake reports measurements in
+// active mode.
+func (fake *Fake) SetInterval(interval time.Duration) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.interval = interval
+	fake.ticker.Reset(interval)
+}
+
+// SetDeviceID changes the ID the fake reports.
+func (fake *Fake) SetDeviceID(id uint16) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.id = id
+}
+
+// DeviceID returns the ID the fake reports in every frame it sends.
+func (fake *Fake) DeviceID() uint16 {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.id
+}
+
+// SetAwake wakes the fake up or puts it to sleep, without it getting
+// a command. A sleeping fake doesn't report measurements, and ignores
+// all commands but the one waking it up.
+func (fake *Fake) SetAwake(awake bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.awake = awake
+}
+
+// Awake returns true if the fake is awake.
+func (fake *Fake) Awake() bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.awake
+}
+
+// Active returns true if the fake is in active reporting mode.
+func (fake *Fake) Active() bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.active
+}
+
+// WorkingPeriod returns the working period the fake was set to.
+func (fake *Fake) WorkingPeriod() uint8 {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.period
+}
+
+// Enqueue adds a reading to be reported. Readings are reported in
+// the order they were added; when there are none left, the last one
+// is repeated. The values are rounded to tenths of μg/m³, like the
+// sensor does.
+func (fake *Fake) Enqueue(pm25, pm10 float64) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.queue = append(fake.queue, [2]uint16{tenths(pm25), tenths(pm10)})
+}
+
+// SetSource makes the fake take its readings from fn, called with
+// the time of each, when there are no scripted ones (see Enqueue).
+// fn is called with the fake locked, so it mustn't call the fake.
+func (fake *Fake) SetSource(fn func(t time.Time) (pm25, pm10 float64)) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.source = fn
+}
+
+// CorruptNext makes the checksum of the next n frames sent by the
+// fake wrong.
+func (fake *Fake) CorruptNext(n int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.corrupt += n
+}
+
+// Measure makes the fake report a measurement right away, as long as
+// it's awake.
+func (fake *Fake) Measure() {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.awake {
+		fake.sendMeasurement()
+	}
+}
+
+// Commands returns the commands the fake received so far, oldest
+// first.
+func (fake *Fake) Commands() []Command {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]Command(nil), fake.commands...)
+}
+
+// Read reads the bytes sent by the fake, blocking until there are
+// some.
+func (fake *Fake) Read(b []byte) (int, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for len(fake.out) == 0 && !fake.closed {
+		fake.cond.Wait()
+	}
+	if fake.closed {
+		return 0, io.EOF
+	}
+	n := copy(b, fake.out)
+	fake.out = fake.out[n:]
+	return n, nil
+}
+
+// Write passes command frames to the fake. Frames may be split across
+// calls. Bytes that don't form a valid command are ignored, like the
+// sensor does.
+func (fake *Fake) Write(b []byte) (int, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.closed {
+		return 0, io.ErrClosedPipe
+	}
+	fake.partial = append(fake.partial, b...)
+	for len(fake.partial) >= 19 {
+		if fake.partial[0] != 0xAA || fake.partial[1] != 0xB4 {
+			fake.partial = fake.partial[1:]
+			continue
+		}
+		frame := fake.partial[:19]
+		fake.partial = fake.partial[19:]
+		var sum byte
+		for _, v := range frame[2:17] {
+			sum += v
+		}
+		if sum != frame[17] || frame[18] != 0xAB {
+			continue
+		}
+		fake.handle(frame)
+	}
+	return len(b), nil
+}
+
+// Close stops the fake. Pending and future reads return io.EOF.
+func (fake *Fake) Close() error {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !fake.closed {
+		fake.closed = true
+		fake.ticker.Stop()
+		close(fake.done)
+		fake.cond.Broadcast()
+	}
+	return nil
+}
+
+func (fake *Fake) stream() {
+	for {
+		select {
+		case <-fake.ticker.C:
+			fake.mu.Lock()
+			if fake.awake && fake.active {
+				fake.sendMeasurement()
+			}
+			fake.mu.Unlock()
+		case <-fake.done:
+			return
+		}
+	}
+}
+
+// handle reacts to a valid command frame. It is called with mu held.
+func (fake *Fake) handle(frame []byte) {
+	cmd := Command{
+		Code:   frame[2],
+		Set:    frame[3] == 1,
+		Value:  frame[4],
+		Target: binary.BigEndian.Uint16(frame[15:17]),
+	}
+	copy(cmd.Data[:], frame[4:15])
+	fake.commands = append(fake.commands, cmd)
+
+	if cmd.Target != sds011.Broadcast && cmd.Target != fake.id {
+		return
+	}
+	if !fake.awake && !(cmd.Code == CommandWorkState && cmd.Set) {
+		return
+	}
+
+	reply := [4]byte{cmd.Code, frame[3], 0, 0}
+	switch cmd.Code {
+	case CommandReportMode:
+		if cmd.Set {
+			fake.active = cmd.Value == 0
+		}
+		reply[2] = 1
+		if fake.active {
+			reply[2] = 0
+		}
+	case CommandQuery:
+		fake.sendMeasurement()
+		return
+	case CommandDeviceID:
+		fake.id = binary.BigEndian.Uint16(frame[13:15])
+		reply[1] = 0
+	case CommandWorkState:
+		if cmd.Set {
+			fake.awake = cmd.Value == 1
+		}
+		if fake.awake {
+			reply[2] = 1
+		}
+	case CommandFirmware:
+		reply = [4]byte{cmd.Code, fake.firmware.Year, fake.firmware.Month, fake.firmware.Day}
+	case CommandWorkingPeriod:
+		if cmd.Set {
+			fake.period = cmd.Value
+		}
+		reply[2] = fake.period
+	default:
+		return
+	}
+	fake.send(0xC5, [6]byte{reply[0], reply[1], reply[2], reply[3]})
+}
+
+// sendMeasurement sends the next reading. It is called with mu held.
+func (fake *Fake) sendMeasurement() {
+	if len(fake.queue) > 0 {
+		fake.last, fake.queue = fake.queue[0], fake.queue[1:]
+	} else if fake.source != nil {
+		pm25, pm10 := fake.source(time.Now())
+		fake.last = [2]uint16{tenths(pm25), tenths(pm10)}
+	}
+	var data [6]byte
+	binary.LittleEndian.PutUint16(data[0:2], fake.last[0])
+	binary.LittleEndian.PutUint16(data[2:4], fake.last[1])
+	fake.send(0xC0, data)
+}
+
+// send queues a frame to be read. It fills in the device ID, and is
+// called with mu held.
+func (fake *Fake) send(kind byte, data [6]byte) {
+	binary.BigEndian.PutUint16(data[4:6], fake.id)
+	var sum byte
+	for _, v := range data {
+		sum += v
+	}
+	if fake.corrupt > 0 {
+		fake.corrupt--
+		sum++
+	}
+	fake.out = append(fake.out, 0xAA, kind)
+	fake.out = append(fake.out, data[:]...)
+	fake.out = append(fake.out, sum, 0xAB)
+	fake.cond.Broadcast()
+}
+
+func tenths(v float64) uint16 {
+	return uint16(v*10 + 0.5)
+}
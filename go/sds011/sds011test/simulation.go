@@ -0,0 +1,91 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011test
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// A Simulation makes up plausible readings, for a Fake to report
+// (see Fake.SetSource): levels that rise and fall over the day,
+// wander off randomly and come back, and now and then spike, like
+// when someone lights a candle. The zero value reads 0; set the
+// fields before the first reading.
+type Simulation struct {
+	// PM25 and PM10 are the levels the readings keep around, in
+	// μg/m³.
+	PM25, PM10 float64
+	// Diurnal is how much the levels rise above them in the evening,
+	// and fall below them in the morning, as a fraction of them.
+	Diurnal float64
+	// Walk is how far the levels wander off in an hour, as a
+	// fraction of them, give or take.
+	Walk float64
+	// Spikes is how many spikes there are in an hour, on average.
+	Spikes float64
+	// Seed seeds the random numbers, so that a simulation started
+	// at the same time with the same seed reads the same.
+	Seed uint64
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	last  time.Time
+	walk  float64 // log of the factor the levels wandered off by
+	spike float64 // how many times the levels the spike adds
+}
+
+// spikeDecay is how long it takes for a spike to fall by a factor of
+// e.
+const spikeDecay = 10 * time.Minute
+
+// Reading returns the levels at t, which must not be before the time
+// of the last reading. It's safe to call from multiple goroutines.
+func (s *Simulation) Reading(t time.Time) (pm25, pm10 float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rng == nil {
+		s.rng = rand.New(rand.NewPCG(s.Seed, s.Seed>>32|1))
+		s.last = t
+	}
+	dt := max(t.Sub(s.last), 0)
+	s.last = t
+	hours := dt.Hours()
+
+	// The walk is pulled back towards the levels, so that it doesn't
+	// wander off for good.
+	s.walk += -s.walk*hours + s.Walk*math.Sqrt(hours)*s.rng.NormFloat64()
+	s.spike *= math.Exp(-float64(dt) / float64(spikeDecay))
+	if s.rng.Float64() < 1-math.Exp(-s.Spikes*hours) {
+		s.spike += 2 + 6*s.rng.Float64()
+	}
+	// Peaking at 8 in the evening.
+	day := float64(t.Hour()) + float64(t.Minute())/60
+	diurnal := 1 + s.Diurnal*math.Sin(2*math.Pi*(day-14)/24)
+
+	factor := max(diurnal, 0) * math.Exp(s.walk) * (1 + s.spike)
+	// A bit of noise of their own, so that PM2.5 and PM10 don't
+	// just move in step.
+	pm25 = s.PM25 * factor * (1 + 0.03*s.rng.NormFloat64())
+	pm10 = s.PM10 * factor * (1 + 0.03*s.rng.NormFloat64())
+	return clampLevel(pm25), clampLevel(max(pm10, pm25))
+}
+
+// clampLevel keeps v within what the sensor can report.
+func clampLevel(v float64) float64 {
+	return min(max(v, 0), 999.9)
+}
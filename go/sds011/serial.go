@@ -0,0 +1,32 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import "io"
+
+// An Opener opens the serial port at path, set up for 8 data bits, no
+// parity and 1 stop bit at the given baud rate. The port's Read should
+// block until some bytes arrive, but may return no bytes and no error
+// now and then.
+//
+// New opens ports with OpenSerial, unless it's given another Opener
+// with WithOpener, for example one using a different serial library.
+type Opener func(path string, baudRate int) (io.ReadWriteCloser, error)
+
+// OpenSerial is the Opener New uses by default. It takes POSIX tty
+// paths, like /dev/ttyUSB0, or on Windows port names, like COM3.
+func OpenSerial(path string, baudRate int) (io.ReadWriteCloser, error) {
+	return openSerial(path, baudRate)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package sds011
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+func openSerial(path string, baudRate int) (io.ReadWriteCloser, error) {
+	port, err := serial.Open(serial.OpenOptions{
+		PortName:        path,
+		BaudRate:        uint(baudRate),
+		DataBits:        8,
+		StopBits:        1,
+		MinimumReadSize: 4,
+	})
+	if err != nil {
+		return nil, err
+	}
+	f, ok := port.(*os.File)
+	if !ok {
+		return port, nil
+	}
+	return pollable(f)
+}
+
+// pollable returns a file for the same port as f, which it closes,
+// that is read through the runtime's poller. go-serial leaves the
+// port in blocking mode, where closing it waits for a read in
+// progress, which never ends if the sensor is asleep.
+func pollable(f *os.File) (*os.File, error) {
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+// lockPort takes an exclusive advisory lock on port, which was opened
+// from path, if it's a file. The lock goes away when the port is
+// closed, or the process exits.
+func lockPort(port io.ReadWriteCloser, path string) error {
+	conn, ok := port.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("locking %v: %w", path, err)
+	}
+	// Not Fd, which would put the port in blocking mode again.
+	if cerr := raw.Control(func(fd uintptr) {
+		err = syscall.Flock(int(fd), syscall.LOCK_EX|syscall.LOCK_NB)
+	}); cerr != nil {
+		return fmt.Errorf("locking %v: %w", path, cerr)
+	}
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return &PortBusyError{Path: path, PID: lockHolder(path)}
+	}
+	if err != nil {
+		return fmt.Errorf("locking %v: %w", path, err)
+	}
+	return nil
+}
+
+// deviceGone returns true if err means that the device behind the
+// port went away.
+func deviceGone(err error) bool {
+	return errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.EIO)
+}
+
+// serialPorts returns the paths of the serial ports a sensor may be
+// connected to: those of USB serial adapters.
+func serialPorts() ([]string, error) {
+	patterns := []string{"/dev/ttyUSB*", "/dev/ttyACM*"}
+	if runtime.GOOS == "darwin" {
+		patterns = []string{"/dev/cu.usbserial*", "/dev/cu.wchusbserial*", "/dev/cu.SLAB_USBtoUART*"}
+	}
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+
+package sds011
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+func openSerial(path string, baudRate int) (io.ReadWriteCloser, error) {
+	// Asking for a minimum read size on Windows makes reads return
+	// after about a millisecond whether anything arrived or not,
+	// which would keep readLoop spinning. With a timeout instead,
+	// they wait for the first byte, for up to that long.
+	port, err := serial.Open(serial.OpenOptions{
+		PortName:              path,
+		BaudRate:              uint(baudRate),
+		DataBits:              8,
+		StopBits:              1,
+		InterCharacterTimeout: 100, // milliseconds
+	})
+	// Windows only lets one process open a port at a time.
+	if errors.Is(err, syscall.ERROR_ACCESS_DENIED) {
+		return nil, &PortBusyError{Path: path}
+	}
+	return port, err
+}
+
+// lockPort does nothing, as ports are locked when they are opened.
+func lockPort(port io.ReadWriteCloser, path string) error {
+	return nil
+}
+
+// errorDeviceNotConnected is ERROR_DEVICE_NOT_CONNECTED, which
+// syscall doesn't define.
+const errorDeviceNotConnected syscall.Errno = 1167
+
+// deviceGone returns true if err means that the device behind the
+// port went away.
+func deviceGone(err error) bool {
+	return errors.Is(err, errorDeviceNotConnected) || errors.Is(err, syscall.ERROR_OPERATION_ABORTED)
+}
+
+// serialPorts returns the names of the serial ports a sensor may be
+// connected to. Without enumerating the devices, that's all of them;
+// the ones that don't exist fail to open.
+func serialPorts() ([]string, error) {
+	var names []string
+	for i := 1; i <= 32; i++ {
+		names = append(names, fmt.Sprintf("COM%d", i))
+	}
+	return names, nil
+}
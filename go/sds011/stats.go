@@ -0,0 +1,98 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import "time"
+
+// Stats are counters describing how well the link to the sensor
+// works. They only grow, except for LastFrame and Subscribers, so
+// rates of errors can be computed from their differences.
+type Stats struct {
+	// Frames is the number of frames received, good or not.
+	Frames uint64
+	// BadHeaders counts frames that didn't end with the expected
+	// byte, BadLengths those cut short by the start of another
+	// frame, and BadChecksums those with checksums that didn't
+	// match their contents.
+	BadHeaders   uint64
+	BadLengths   uint64
+	BadChecksums uint64
+	// Discarded is the number of bytes skipped when looking for the
+	// start of a frame (see Sensor.Discarded).
+	Discarded uint64
+	// Commands is the number of commands sent, including Retries,
+	// those sent again after failing.
+	Commands uint64
+	Retries  uint64
+	// Reconnects is the number of times the port was opened again
+	// (see WithAutoReconnect), AutoSleeps the number of times the
+	// sensor was put to sleep (see WithAutoSleep).
+	Reconnects uint64
+	AutoSleeps uint64
+	// DroppedFrames counts the measurements dropped because nobody
+	// read them in time, and DroppedPoints those dropped from the
+	// channels returned by Points and Subscribe (see
+	// WithDropPolicy).
+	DroppedFrames uint64
+	DroppedPoints uint64
+	// WatchdogWakes and WatchdogReopens count the recovery steps
+	// taken by the watchdog (see WithWatchdog).
+	WatchdogWakes   uint64
+	WatchdogReopens uint64
+	// LastFrame is when the last good frame was received, or zero,
+	// and Latency how long it took from its first byte to its last.
+	// A long latency means that the port delivers bytes late.
+	LastFrame time.Time
+	Latency   time.Duration
+	// Awake is whether the sensor is awake, as far as the commands
+	// sent to it and their replies tell, and StateKnown whether they
+	// told yet. WorkingPeriod is its working period in minutes, as
+	// last read or set, or -1 if it isn't known.
+	Awake, StateKnown bool
+	WorkingPeriod     int
+	// Subscribers has the counters of the current subscribers (see
+	// Subscribe), in the order they subscribed.
+	Subscribers []SubscriberStats
+}
+
+// Stats returns the sensor's counters.
+func (sensor *Sensor) Stats() Stats {
+	s := Stats{
+		Frames:       sensor.frames.Load(),
+		BadHeaders:   sensor.badHeaders.Load(),
+		BadLengths:   sensor.badLengths.Load(),
+		BadChecksums: sensor.checksumErrors.Load(),
+		Discarded:    sensor.discarded.Load(),
+		Commands:     sensor.commands.Load(),
+		Retries:      sensor.retried.Load(),
+		Reconnects:   sensor.reconnects.Load(),
+		AutoSleeps:   sensor.autoSleeps.Load(),
+
+		DroppedFrames: sensor.droppedFrames.Load(),
+		DroppedPoints: sensor.droppedPoints.Load(),
+	}
+	if w := sensor.watchdog; w != nil {
+		s.WatchdogWakes = w.counts[WatchdogWake].Load()
+		s.WatchdogReopens = w.counts[WatchdogReopen].Load()
+	}
+	s.Awake, s.StateKnown = !sensor.sleeping.Load(), sensor.stateKnown.Load()
+	s.WorkingPeriod = int(sensor.workingPeriod.Load()) - 1
+	s.Subscribers = sensor.subscriberStats()
+	s.Latency = time.Duration(sensor.latency.Load())
+	if t := sensor.lastFrame.Load(); t != 0 {
+		s.LastFrame = time.Unix(0, t)
+	}
+	return s
+}
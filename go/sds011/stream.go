@@ -0,0 +1,156 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"context"
+	"errors"
+)
+
+// Points reads measurements in a new goroutine until ctx is done or
+// the sensor stops working, and sends them to the first channel. It
+// is meant for sensors in active mode.
+//
+// Errors that the sensor can recover from, like bad checksums and
+// timeouts, are sent to the second channel, and reading continues,
+// as are the gaps between the points (see Gap).
+// Any other error is sent to it last, and reading stops. Both
+// channels are closed when reading stops.
+//
+// Reading never waits for the consumer. The channels are buffered
+// (see WithStreamBuffer), and when a buffer is full the oldest
+// element in it is dropped to make room for the new one, so a slow
+// consumer misses old measurements rather than falls behind. For
+// points, WithDropPolicy can make it drop the new one instead. The
+// points keep the timestamps of when their frames arrived (see
+// WithTimestamps), so how stale they are can be told.
+func (sensor *Sensor) Points(ctx context.Context) (<-chan Point, <-chan error) {
+	points := make(chan Point, sensor.streamBuffer)
+	errs := make(chan error, sensor.streamBuffer)
+	go func() {
+		defer close(points)
+		defer close(errs)
+		for {
+			point, gap, err := sensor.getContext(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if gap != nil {
+				sendNewest(errs, error(gap))
+			}
+			if err != nil {
+				sendNewest(errs, err)
+				if Recoverable(err) {
+					continue
+				}
+				return
+			}
+			if offer(points, *point, sensor.dropPolicy) {
+				sensor.droppedPoints.Add(1)
+			}
+		}
+	}()
+	return points, errs
+}
+
+// A ListenOption changes how Listen reads measurements.
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	onError func(error)
+}
+
+// OnError makes Listen pass the errors it recovers from to fn, and
+// the gaps between the points (see Gap).
+func OnError(fn func(error)) ListenOption {
+	return func(c *listenConfig) {
+		c.onError = fn
+	}
+}
+
+// Listen reads measurements and calls fn with each of them, until ctx
+// is done, fn returns an error, or the sensor stops working. It
+// returns ctx.Err(), fn's error, or the error that stopped the sensor.
+// fn is called from the goroutine calling Listen, so reading waits
+// for it to return. Errors that the sensor can recover from, like bad
+// checksums and timeouts, are skipped (see OnError). Listen is meant
+// for sensors in active mode.
+func (sensor *Sensor) Listen(ctx context.Context, fn func(Point) error, opts ...ListenOption) error {
+	var cfg listenConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	for {
+		point, gap, err := sensor.getContext(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if gap != nil && cfg.onError != nil {
+			cfg.onError(gap)
+		}
+		if err != nil {
+			if !Recoverable(err) {
+				return err
+			}
+			if cfg.onError != nil {
+				cfg.onError(err)
+			}
+			continue
+		}
+		if err := fn(*point); err != nil {
+			return err
+		}
+	}
+}
+
+// Recoverable returns true if reading measurements can go on after
+// err: the sensor sent a corrupted frame or a measurement out of
+// range, didn't send one in time, is reconnecting, or err is a Gap.
+func Recoverable(err error) bool {
+	return errors.Is(err, ErrGap) || errors.Is(err, ErrChecksum) || errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrTimeout) || errors.Is(err, ErrDisconnected)
+}
+
+// offer sends v to ch without blocking, dropping an element as policy
+// says if ch is full. It returns true if something was dropped. It
+// must be the only sender on ch.
+func offer[T any](ch chan T, v T, policy DropPolicy) (dropped bool) {
+	if policy == DropOldest {
+		return sendNewest(ch, v)
+	}
+	select {
+	case ch <- v:
+		return false
+	default:
+		return true
+	}
+}
+
+// sendNewest sends v to ch without blocking, dropping the oldest
+// element waiting in ch if it's full. It returns true if something
+// was dropped. It must be the only sender on ch.
+func sendNewest[T any](ch chan T, v T) (dropped bool) {
+	for {
+		select {
+		case ch <- v:
+			return dropped
+		default:
+		}
+		select {
+		case <-ch:
+			dropped = true
+		default:
+		}
+	}
+}
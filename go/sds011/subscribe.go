@@ -0,0 +1,154 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+)
+
+// SubscriberStats are the counters of a channel returned by
+// Subscribe.
+type SubscriberStats struct {
+	// ID numbers the subscriptions in the order they were made,
+	// starting from 1.
+	ID        uint64
+	Delivered uint64
+	// Dropped is the number of points dropped because the
+	// subscriber didn't keep up.
+	Dropped uint64
+}
+
+type subscriber struct {
+	ch    chan Point
+	stats SubscriberStats
+}
+
+// broadcast is the state of Subscribe.
+type broadcast struct {
+	mu     sync.Mutex
+	subs   map[*subscriber]struct{}
+	lastID uint64
+	// stop stops reading, which runs while there are subscribers.
+	stop context.CancelFunc
+}
+
+// Subscribe returns a channel receiving all measurements from now on,
+// until ctx is done or the sensor stops working, when it's closed.
+// It can be called any number of times, and all the channels get the
+// same measurements, read once by a goroutine running while there are
+// subscribers. It is meant for sensors in active mode, and nothing
+// else should read measurements meanwhile, as it would take them from
+// the subscribers.
+//
+// Errors that the sensor can recover from are skipped. Each channel
+// is buffered (see WithStreamBuffer), and when its buffer is full its
+// oldest point is dropped to make room for the new one, or the new
+// one is (see WithDropPolicy), so a slow subscriber misses points
+// rather than holds up the others.
+// Stats counts the points delivered and dropped for each subscriber.
+func (sensor *Sensor) Subscribe(ctx context.Context) <-chan Point {
+	b := &sensor.broadcast
+	sub := &subscriber{ch: make(chan Point, sensor.streamBuffer)}
+	b.mu.Lock()
+	b.lastID++
+	sub.stats.ID = b.lastID
+	if b.subs == nil {
+		b.subs = make(map[*subscriber]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	if b.stop == nil {
+		var readCtx context.Context
+		readCtx, b.stop = context.WithCancel(context.Background())
+		go sensor.broadcastLoop(readCtx)
+	}
+	b.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sensor.done:
+		}
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		sensor.unsubscribe(sub)
+	}()
+	return sub.ch
+}
+
+// unsubscribe closes sub's channel, and stops reading if it was the
+// last one. It is called with broadcast.mu held.
+func (sensor *Sensor) unsubscribe(sub *subscriber) {
+	b := &sensor.broadcast
+	if _, ok := b.subs[sub]; !ok {
+		return
+	}
+	delete(b.subs, sub)
+	close(sub.ch)
+	if len(b.subs) == 0 && b.stop != nil {
+		b.stop()
+		b.stop = nil
+	}
+}
+
+// broadcastLoop reads measurements and sends them to the subscribers
+// until ctx is done or the sensor stops working.
+func (sensor *Sensor) broadcastLoop(ctx context.Context) {
+	b := &sensor.broadcast
+	for {
+		point, err := sensor.GetContext(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if Recoverable(err) {
+				continue
+			}
+			sensor.logger.Warn("reading for subscribers failed", "error", err)
+			b.mu.Lock()
+			for sub := range b.subs {
+				sensor.unsubscribe(sub)
+			}
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Lock()
+		for sub := range b.subs {
+			sub.stats.Delivered++
+			if offer(sub.ch, *point, sensor.dropPolicy) {
+				sub.stats.Dropped++
+				sensor.droppedPoints.Add(1)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// subscriberStats returns the counters of the current subscribers.
+func (sensor *Sensor) subscriberStats() []SubscriberStats {
+	b := &sensor.broadcast
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var stats []SubscriberStats
+	for sub := range b.subs {
+		stats = append(stats, sub.stats)
+	}
+	slices.SortFunc(stats, func(a, b SubscriberStats) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return stats
+}
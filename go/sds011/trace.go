@@ -0,0 +1,76 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+// Direction says which way a traced frame went.
+type Direction int
+
+const (
+	// Sent is a frame sent to the sensor.
+	Sent Direction = iota
+	// Received is a frame received from the sensor.
+	Received
+)
+
+// String returns "sent" or "received".
+func (dir Direction) String() string {
+	switch dir {
+	case Sent:
+		return "sent"
+	case Received:
+		return "received"
+	}
+	return "unknown"
+}
+
+// A TraceFunc is called with every frame sent to or received from the
+// sensor, including the received frames that are later rejected, for
+// example because of their checksum. Frames are traced as they are
+// written and read, from the goroutine doing it, so a TraceFunc must
+// be fast: received frames wait for it before being delivered. It
+// must not call the sensor's methods, and it must not keep frame,
+// which is only valid until it returns.
+type TraceFunc func(dir Direction, frame []byte)
+
+// SetTraceFunc sets the function that traces the sensor's frames. A
+// nil fn stops tracing.
+func (sensor *Sensor) SetTraceFunc(fn TraceFunc) {
+	if fn == nil {
+		sensor.trace.Store(nil)
+		return
+	}
+	sensor.trace.Store(&fn)
+}
+
+// traceFrame passes frame to the trace function, if there is one.
+func (sensor *Sensor) traceFrame(dir Direction, frame []byte) {
+	if fn := sensor.trace.Load(); fn != nil {
+		(*fn)(dir, frame)
+	}
+}
+
+// WithOnReject makes the sensor call fn with the bytes it receives
+// and throws away, and why: frames failing their checksum, wrapping
+// a *ChecksumError, and bytes that aren't a frame at all, or a frame
+// cut short, wrapping ErrBadHeader. The reasons say where in the
+// stream of bytes received the bytes were, counting from 0. Like a
+// TraceFunc, fn is called from the goroutine reading the port, and
+// must not keep b.
+func WithOnReject(fn func(b []byte, reason error)) Option {
+	return func(c *config) error {
+		c.onReject = fn
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// workWindow is how long the sensor measures for in each working
+	// period.
+	workWindow = 30 * time.Second
+	// usageSaveInterval is how often the on-time is saved, besides
+	// when the sensor is closed.
+	usageSaveInterval = 5 * time.Minute
+)
+
+// WithUsageStore makes the sensor's on-time (see Sensor.Uptime)
+// persist. load is called once, when the sensor is created, to get
+// the on-time accumulated so far, and save is called with the new
+// total every few minutes and when the sensor is closed. Errors from
+// them are logged.
+func WithUsageStore(load func() (time.Duration, error), save func(time.Duration) error) Option {
+	return func(c *config) error {
+		if load == nil || save == nil {
+			return errors.New("nil usage store function")
+		}
+		c.loadUsage, c.saveUsage = load, save
+		return nil
+	}
+}
+
+// usage accumulates the time the sensor's laser is on. While the
+// sensor works continuously, that's the time it's awake, which is
+// known from the commands sent to it and the measurements it sends.
+// With a working period set, the laser is only on for 30 seconds
+// before each measurement, so each of those counts instead.
+type usage struct {
+	mu       sync.Mutex
+	total    time.Duration
+	awake    bool
+	periodic bool
+	// since is when the time up to total was accounted for.
+	since time.Time
+}
+
+// settle adds the time the laser was on since the last call to total.
+func (u *usage) settle(now time.Time) {
+	if u.awake && !u.periodic {
+		u.total += now.Sub(u.since)
+	}
+	u.since = now
+}
+
+func (u *usage) setAwake(awake bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.settle(time.Now())
+	u.awake = awake
+}
+
+func (u *usage) setPeriodic(periodic bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.settle(time.Now())
+	u.periodic = periodic
+}
+
+// measured records that a measurement was received.
+func (u *usage) measured() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.settle(time.Now())
+	u.awake = true
+	if u.periodic {
+		u.total += workWindow
+	}
+}
+
+func (u *usage) get() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.settle(time.Now())
+	return u.total
+}
+
+// Uptime returns an estimate of how long the sensor's laser has been
+// on, which is what wears it out: it's rated for about 8000 hours.
+// It includes the time loaded from the store set with WithUsageStore,
+// if any. Without one, it only covers the time since the sensor was
+// created.
+func (sensor *Sensor) Uptime() time.Duration {
+	return sensor.usage.get()
+}
+
+// loadUsage initializes the on-time from the usage store.
+func (sensor *Sensor) loadUsage(load func() (time.Duration, error)) {
+	total, err := load()
+	if err != nil {
+		sensor.logger.Warn("loading on-time failed", "error", err)
+		return
+	}
+	sensor.usage.mu.Lock()
+	sensor.usage.total += total
+	sensor.usage.mu.Unlock()
+}
+
+// saveUsageLoop saves the on-time every usageSaveInterval until the
+// sensor is closed.
+func (sensor *Sensor) saveUsageLoop() {
+	ticker := time.NewTicker(usageSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sensor.saveUsage()
+		case <-sensor.done:
+			return
+		}
+	}
+}
+
+func (sensor *Sensor) saveUsage() {
+	if err := sensor.usageSaver(sensor.Uptime()); err != nil {
+		sensor.logger.Warn("saving on-time failed", "error", err)
+	}
+}
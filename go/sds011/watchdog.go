@@ -0,0 +1,122 @@
+// Copyright 2017 Ryszard Szopa <ryszard.szopa@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sds011
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// A WatchdogStage is a step the watchdog takes to get a silent sensor
+// to send measurements again.
+type WatchdogStage int
+
+const (
+	// WatchdogWake sends the sensor the command to wake up.
+	WatchdogWake WatchdogStage = iota
+	// WatchdogReopen closes the port, so that it's opened again
+	// (see WithAutoReconnect).
+	WatchdogReopen
+)
+
+func (s WatchdogStage) String() string {
+	switch s {
+	case WatchdogWake:
+		return "wake"
+	case WatchdogReopen:
+		return "reopen"
+	}
+	return "unknown"
+}
+
+type watchdog struct {
+	silence time.Duration
+	onStage func(WatchdogStage)
+	counts  [2]atomic.Uint64
+}
+
+// WithWatchdog makes the sensor check that measurements keep coming:
+// sometimes a sensor stops sending them until it's power cycled or
+// its port is opened again. When there was no measurement for
+// silence, the sensor is sent the command to wake up. If that doesn't
+// help within another silence, and the sensor can reconnect (see
+// WithAutoReconnect), its port is closed and opened again, after
+// which it starts over. The watchdog doesn't bark while the sensor
+// was put to sleep or in query mode, and waits for its working
+// period on top of silence, if it's known (see WorkingPeriod). If
+// onStage isn't nil, it's called before each step. Stats counts them.
+func WithWatchdog(silence time.Duration, onStage func(WatchdogStage)) Option {
+	return func(c *config) error {
+		if silence <= 0 {
+			return errors.New("watchdog silence must be positive")
+		}
+		c.watchdog = &watchdog{silence: silence, onStage: onStage}
+		return nil
+	}
+}
+
+// watchdogLoop watches the sensor until it's closed.
+func (sensor *Sensor) watchdogLoop() {
+	w := sensor.watchdog
+	ticker := time.NewTicker(max(w.silence/4, 100*time.Millisecond))
+	defer ticker.Stop()
+	// since is when the silence being timed started: when the
+	// watchdog started, the last measurement arrived, or the last
+	// step was taken.
+	since := time.Now()
+	stage := WatchdogWake
+	for {
+		select {
+		case <-ticker.C:
+		case <-sensor.done:
+			return
+		}
+		now := time.Now()
+		if last := sensor.created.Add(time.Duration(sensor.lastMeasurement.Load())); last.After(since) {
+			since, stage = last, WatchdogWake
+		}
+		if sensor.sleeping.Load() || sensor.passive.Load() || sensor.disconnected.Load() {
+			since, stage = now, WatchdogWake
+			continue
+		}
+		silence := w.silence
+		if minutes := sensor.workingPeriod.Load(); minutes > 1 {
+			silence += time.Duration(minutes-1) * time.Minute
+		}
+		if now.Sub(since) < silence {
+			continue
+		}
+		if stage == WatchdogReopen && !sensor.canReconnect() {
+			stage = WatchdogWake
+		}
+		sensor.logger.Warn("no measurements, taking watchdog step", "silence", now.Sub(since), "step", stage)
+		w.counts[stage].Add(1)
+		if w.onStage != nil {
+			w.onStage(stage)
+		}
+		switch stage {
+		case WatchdogWake:
+			if _, err := sensor.command(commandWorkState, modeSet, workStateMeasuring); err != nil {
+				sensor.logger.Warn("watchdog failed to wake the sensor up", "error", err)
+			}
+			stage = WatchdogReopen
+		case WatchdogReopen:
+			sensor.port().Close()
+			stage = WatchdogWake
+		}
+		since = time.Now()
+	}
+}